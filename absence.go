@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// absenceReportVersion is the format version of absence reports.
+const absenceReportVersion = 1
+
+// maxReportedPresentKeys limits how many present keys an absence report
+// lists, so that a failed check doesn't produce a huge report.
+const maxReportedPresentKeys = 100
+
+// A presentKey is a key that an absence check found on a server.
+type presentKey struct {
+	Server string `json:"server"`
+	Key    string `json:"key"`
+}
+
+// An absenceReport records a check that no keys match a condition, or that
+// none of a list of keys exist, on a server and its replicas, as proof that
+// purged data hasn't reappeared.
+type absenceReport struct {
+	Version   int      `json:"version"`
+	Servers   []string `json:"servers"`
+	Condition string   `json:"condition,omitempty"`
+	KeysFile  string   `json:"keys_file,omitempty"`
+
+	CheckedBy   string    `json:"checked_by"`
+	CheckedAt   time.Time `json:"checked_at"`
+	CheckedKeys int64     `json:"checked_keys"`
+
+	Absent       bool         `json:"absent"`
+	PresentCount int64        `json:"present_count"`
+	Present      []presentKey `json:"present,omitempty"`
+
+	Tags operationTags `json:"tags,omitempty"`
+
+	// Signature is "hmac-sha256:" and the hex HMAC-SHA256 of the report
+	// without its signature, keyed with VERIFY_REPORT_SECRET, or
+	// "sha256:" and the plain SHA-256 digest if there's no secret.
+	Signature string `json:"signature"`
+}
+
+func (a *absenceReport) present(server, key string, display keyDisplay) {
+	a.PresentCount++
+	if len(a.Present) < maxReportedPresentKeys {
+		a.Present = append(a.Present, presentKey{Server: server, Key: display.Format(key)})
+	}
+	fmt.Fprintf(os.Stderr, "> %s: key %#v is present\n", server, key)
+}
+
+// sign sets the report's signature, keyed with secret if it's not empty.
+func (a *absenceReport) sign(secret string) error {
+	a.Signature = ""
+	unsigned, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		digest := sha256.Sum256(unsigned)
+		a.Signature = "sha256:" + hex.EncodeToString(digest[:])
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(unsigned)
+	a.Signature = "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+	return nil
+}
+
+// verifyAbsence checks that nothing matches the search for values args (or
+// that none of the keys in VERIFY_KEYS_FILE exist) on r and on the replicas
+// in VERIFY_REPLICA_ADDRS, and prints a signed absence report to stdout. It
+// reports whether everything was absent.
+func (r redisSearch) verifyAbsence(args []string) (absent bool, err error) {
+	report := &absenceReport{
+		Version:   absenceReportVersion,
+		CheckedBy: operatorName(),
+		CheckedAt: time.Now().UTC(),
+		Tags:      r.Tags,
+	}
+	servers := append([]*redis.Client{r.Client}, envReplicaClients()...)
+	for _, server := range servers {
+		report.Servers = append(report.Servers, server.Options().Addr)
+	}
+
+	if keysFile := os.Getenv("VERIFY_KEYS_FILE"); keysFile != "" {
+		report.KeysFile = keysFile
+		err = verifyKeysAbsent(report, servers, keysFile, r.KeyDisplay)
+	} else {
+		var search *searchCondition
+		if search, err = envSearchCondition(args); err != nil {
+			return false, fmt.Errorf("invalid search condition: %w", err)
+		}
+		report.Condition = search.String()
+		err = r.verifyNoMatches(report, servers, search)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	report.Absent = report.PresentCount == 0
+	secret := os.Getenv("VERIFY_REPORT_SECRET")
+	if secret == "" {
+		fmt.Fprintf(os.Stderr, "> VERIFY_REPORT_SECRET is not set: the report is only checksummed, not signed\n")
+	}
+	if err = report.sign(secret); err != nil {
+		return false, err
+	}
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	fmt.Println(string(reportJSON))
+	fmt.Fprintf(os.Stderr, "> checked %d keys on %d servers: %d present\n",
+		report.CheckedKeys, len(servers), report.PresentCount)
+	return report.Absent, nil
+}
+
+// verifyKeysAbsent checks that none of the keys listed in keysFile, one per
+// line formatted with display, exist on servers.
+func verifyKeysAbsent(report *absenceReport, servers []*redis.Client, keysFile string, display keyDisplay) error {
+	file, err := os.Open(keysFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Keys may start or end with spaces, so only line endings are trimmed.
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		key, err := display.Parse(line)
+		if err != nil {
+			return fmt.Errorf("invalid key in %s: %w", keysFile, err)
+		}
+		report.CheckedKeys++
+		for _, server := range servers {
+			exists, err := server.Exists(ctx, key).Result()
+			if err != nil {
+				return fmt.Errorf("couldn't check key %#v on %s: %w", key, server.Options().Addr, err)
+			}
+			if exists > 0 {
+				report.present(server.Options().Addr, key, display)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// verifyNoMatches checks that no keys match search on servers.
+func (r redisSearch) verifyNoMatches(report *absenceReport, servers []*redis.Client, search *searchCondition) error {
+	for _, server := range servers {
+		// Check with a plain search of each server: protected keys count as
+		// present, and nothing is reported as a match of a run.
+		checker := redisSearch{
+			Client:           server,
+			Options:          server.Options(),
+			Debug:            r.Debug,
+			Progress:         r.Progress,
+			ExcludeKeys:      r.ExcludeKeys,
+			InternalKeys:     r.InternalKeys,
+			Watchdog:         r.Watchdog,
+			ScanType:         r.ScanType,
+			HashScan:         r.HashScan,
+			StringChunkSize:  r.StringChunkSize,
+			QuarantinePrefix: r.QuarantinePrefix,
+		}
+		fmt.Fprintf(os.Stderr, "> checking that no keys on %s match %s\n", checker.String(), search)
+		totalKeys, err := checker.countKeys()
+		if err != nil {
+			return fmt.Errorf("couldn't count keys on %s: %w", server.Options().Addr, err)
+		}
+		report.CheckedKeys += totalKeys
+		err = checker.matchingKeysDo(search, func(key string, size int) error {
+			report.present(server.Options().Addr, key, r.KeyDisplay)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't search %s: %w", server.Options().Addr, err)
+		}
+	}
+	return nil
+}
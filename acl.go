@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// aclRule collects the commands and key patterns a run needs, to print the
+// Redis ACL rules of a least-privilege user for it.
+type aclRule struct {
+	commands    map[string]bool
+	keyPatterns map[string]bool
+}
+
+func newACLRule() *aclRule {
+	return &aclRule{commands: map[string]bool{}, keyPatterns: map[string]bool{}}
+}
+
+// Allow allows commands, which may be command|subcommand.
+func (a *aclRule) Allow(commands ...string) {
+	for _, command := range commands {
+		a.commands[command] = true
+	}
+}
+
+// Keys allows access to keys matching the glob pattern ("" for all keys).
+func (a *aclRule) Keys(pattern string) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	a.keyPatterns[pattern] = true
+}
+
+// String formats a as ACL rules, as accepted by ACL SETUSER.
+func (a *aclRule) String() string {
+	var rules []string
+	if a.keyPatterns["*"] {
+		rules = append(rules, "~*")
+	} else {
+		rules = append(rules, sortedKeys(a.keyPatterns, "~")...)
+	}
+	return strings.Join(append(rules, sortedKeys(a.commands, "+")...), " ")
+}
+
+func sortedKeys(set map[string]bool, prefix string) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, prefix+key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeKeyPattern escapes the glob metacharacters in key, so that an ACL key
+// pattern allows exactly key.
+func escapeKeyPattern(key string) string {
+	var escaped strings.Builder
+	for _, c := range key {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// aclForRun returns the ACL rules needed by a run of searches, whose keys
+// are deleted if deletes is set, with the optional parts of the run
+// configured by r and the environment.
+func (r redisSearch) aclForRun(searches []*searchCondition, deletes bool) *aclRule {
+	acl := newACLRule()
+	acl.Allow("scan", "dbsize")
+	if r.Options.DB != 0 {
+		acl.Allow("select")
+	}
+	if r.Options.OnConnect != nil {
+		acl.Allow("client|no-touch")
+	}
+	// INFO and COMMAND INFO detect the server's capabilities.
+	acl.Allow("info", "command|info")
+	if r.Watchdog != nil {
+		acl.Allow("ping", "latency|latest")
+	}
+	if outputDescribesKeys() {
+		acl.Allow("type", "ttl")
+	}
+
+	for _, search := range searches {
+		acl.Keys(search.KeyPattern)
+		r.searchACL(acl, search)
+	}
+
+	if deletes && !r.DryRun {
+		switch {
+		case len(r.DeleteFields) > 0:
+			acl.Allow("hdel")
+		case r.DeleteElements != nil:
+			acl.Allow(elementRemoveCommands[r.DeleteElements.AccessMode])
+		case r.QuarantinePrefix != "":
+			acl.Keys(escapeKeyPattern(r.QuarantinePrefix) + "*")
+			acl.Allow("renamenx")
+			if r.QuarantineTTL > 0 {
+				acl.Allow("expire")
+			}
+		case r.ExpireSeconds > 0:
+			acl.Allow("expire")
+		case r.Unlink:
+			acl.Allow("unlink")
+		default:
+			acl.Allow("del")
+		}
+		if r.Backup != nil {
+			acl.Allow("dump", "pttl")
+		}
+		if envBool("WAIT_AND_REDELETE", "false") && !r.keepsDeletedKeys() {
+			acl.Allow("exists")
+		}
+		if r.Verifier != nil {
+			acl.Allow("exists", "pttl", "hexists")
+			for _, search := range searches {
+				valueSourceACL(acl, search.ValueSource())
+			}
+		}
+		if envInt("RERUN_WINDOW", 0) > 0 {
+			acl.Keys(escapeKeyPattern(rerunKeyPrefix) + "*")
+			acl.Allow("get", "set")
+		}
+		if envInt("MAX_MATCH_PERCENT", 0) > 0 {
+			acl.Allow("randomkey")
+		}
+		if confirmation, err := envDeleteConfirmation(); err == nil && confirmation != nil && confirmation.Sample > 0 {
+			acl.Allow("randomkey")
+		}
+	}
+
+	if key := os.Getenv("CHECKPOINT_KEY"); key != "" {
+		acl.Keys(escapeKeyPattern(key))
+		acl.Allow("get", "set", "del")
+	}
+
+	if lock := envInstanceLock(r.Client); lock != nil {
+		// The lock is queued for, renewed and released by Lua scripts,
+		// which call its commands themselves.
+		acl.Keys(escapeKeyPattern(lock.Key))
+		acl.Keys(escapeKeyPattern(lock.QueueKey()))
+		acl.Keys(escapeKeyPattern(lock.WaitersKey()))
+		acl.Allow("set", "get", "del", "pexpire", "evalsha", "eval")
+		acl.Allow("zadd", "zrem", "zrank", "zrange", "zrangebyscore")
+	}
+	return acl
+}
+
+// searchACL allows the commands that matching search reads values with.
+func (r redisSearch) searchACL(acl *aclRule, search *searchCondition) {
+	if len(search.HashMatch) > 0 {
+		acl.Allow("hmget")
+		if !search.ReadsWholeValue() {
+			return
+		}
+	}
+	if search.MatchElements {
+		valueSourceACL(acl, valueSource{AccessMode: search.AccessMode})
+		return
+	}
+	reader := r.valueReader(search)
+	if reader.ReadsSizesOnly() {
+		switch {
+		case r.MemorySizes:
+			acl.Allow("memory|usage")
+		case search.AccessMode == valueAccessHash:
+			acl.Allow("hstrlen", "hexists")
+		default:
+			acl.Allow("strlen", "exists")
+		}
+		return
+	}
+	if reader.PrechecksSizes() {
+		if search.AccessMode == valueAccessHash {
+			acl.Allow("hstrlen")
+		} else {
+			acl.Allow("strlen")
+		}
+	}
+	switch source := search.ValueSource(); {
+	case !reader.StreamsValues():
+		valueSourceACL(acl, source)
+	case source.AccessMode == valueAccessHash:
+		acl.Allow("hscan")
+	default:
+		acl.Allow("getrange", "exists")
+	}
+}
+
+// valueSourceACL allows the commands that source.Get reads values with.
+func valueSourceACL(acl *aclRule, source valueSource) {
+	switch source.AccessMode {
+	case valueAccessString:
+		acl.Allow("get", "mget")
+	case valueAccessHash:
+		if source.HashField != "" {
+			acl.Allow("hget")
+		} else {
+			acl.Allow("hgetall")
+		}
+	case valueAccessList:
+		acl.Allow("lrange")
+	case valueAccessSet:
+		acl.Allow("sscan")
+	case valueAccessZSet:
+		acl.Allow("zscan")
+	case valueAccessStream:
+		acl.Allow("xrange")
+	case valueAccessJSON:
+		acl.Allow("json.get")
+	}
+}
+
+// evictionACL allows the commands that scoring eviction candidates needs.
+func evictionACL(acl *aclRule) {
+	acl.Allow("memory|usage", "pttl", "object|idletime", "object|freq")
+}
+
+// printACL prints an ACL SETUSER command creating the ACL_USER (default
+// "redis-purge") user with just enough access for acl.
+func printACL(acl *aclRule) {
+	user := envDefault("ACL_USER", "redis-purge")
+	fmt.Fprintf(os.Stderr, "> replace <password> with the user's password; SCAN, DBSIZE and RANDOMKEY aren't limited by key patterns\n")
+	fmt.Printf("ACL SETUSER %s reset on ><password> %s\n", user, acl)
+}
+
+// printRunACL prints the ACL rules needed by the run configured by the
+// environment, searching for values args.
+func (r redisSearch) printRunACL(args []string, rulesFile string, freeTargetBytes int64) error {
+	var acl *aclRule
+	switch {
+	case rulesFile != "":
+		rules, err := loadPurgeRules(rulesFile)
+		if err != nil {
+			return fmt.Errorf("error loading rules from %s: %w", rulesFile, err)
+		}
+		searches := make([]*searchCondition, 0, len(rules))
+		for _, rule := range rules {
+			searches = append(searches, rule.condition)
+		}
+		acl = r.aclForRun(searches, len(deleteConditions(rules)) > 0)
+	case freeTargetBytes > 0:
+		acl = r.aclForRun(nil, false)
+		acl.Keys(os.Getenv("KEY_PATTERN"))
+		evictionACL(acl)
+	default:
+		needle, err := envSearchCondition(args)
+		if err != nil {
+			return fmt.Errorf("invalid search condition: %w", err)
+		}
+		if err = r.envDeleteFields(needle); err != nil {
+			return fmt.Errorf("invalid DELETE_FIELDS: %w", err)
+		}
+		if err = r.envDeleteElements(needle); err != nil {
+			return fmt.Errorf("invalid DELETE_ELEMENTS: %w", err)
+		}
+		acl = r.aclForRun([]*searchCondition{needle}, envBool("DELETE_MATCHING_KEYS", "false"))
+	}
+	printACL(acl)
+	return nil
+}
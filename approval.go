@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A purgePlan describes a destructive run, for a second person to approve
+// before any keys are deleted.
+type purgePlan struct {
+	ID            string    `json:"id"`
+	Target        string    `json:"target"`
+	Action        string    `json:"action"`
+	Conditions    []string  `json:"conditions"`
+	EstimatedKeys int64     `json:"estimated_keys"`
+	RequestedBy   string    `json:"requested_by"`
+	RequestedAt   time.Time `json:"requested_at"`
+
+	Tags operationTags `json:"tags,omitempty"`
+}
+
+// approvalResponse is the body returned by the approval webhook and poll
+// URL. The webhook may set PollURL to tell us where to wait for a decision.
+type approvalResponse struct {
+	PollURL string `json:"poll_url"`
+	Status  string `json:"status"`
+	Token   string `json:"token"`
+	Reason  string `json:"reason"`
+}
+
+// approvalGate blocks destructive runs until they're approved, if
+// APPROVAL_URL is set.
+type approvalGate struct {
+	URL          string
+	PollURL      string
+	PollInterval time.Duration
+	Timeout      time.Duration
+	TokenSecret  string
+
+	client *http.Client
+}
+
+func envApprovalGate() *approvalGate {
+	url := os.Getenv("APPROVAL_URL")
+	if url == "" {
+		return nil
+	}
+	return &approvalGate{
+		URL:          url,
+		PollURL:      os.Getenv("APPROVAL_POLL_URL"),
+		PollInterval: time.Duration(envInt("APPROVAL_POLL_INTERVAL", 10)) * time.Second,
+		Timeout:      time.Duration(envInt("APPROVAL_TIMEOUT", 3600)) * time.Second,
+		TokenSecret:  os.Getenv("APPROVAL_TOKEN_SECRET"),
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// requireApproval returns nil if a delete of keys matching conditions may go
+// ahead: either no APPROVAL_URL is configured, or the plan was approved.
+func (r redisSearch) requireApproval(conditions []string) error {
+	gate := envApprovalGate()
+	if gate == nil {
+		return nil
+	}
+	if r.DryRun {
+		fmt.Fprintf(os.Stderr, "> dry run: not requesting approval, since nothing will be deleted\n")
+		return nil
+	}
+	plan, err := r.newPurgePlan(conditions)
+	if err != nil {
+		return err
+	}
+	return gate.Approve(plan, os.Stdin)
+}
+
+// newPurgePlan describes a delete of keys matching conditions on r.
+func (r redisSearch) newPurgePlan(conditions []string) (*purgePlan, error) {
+	totalKeys, err := r.countKeys()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count keys: %w", err)
+	}
+	plan := &purgePlan{
+		Target:        r.String(),
+		Action:        r.deleteAction(),
+		Conditions:    conditions,
+		EstimatedKeys: totalKeys,
+		RequestedBy:   operatorName(),
+		RequestedAt:   time.Now().UTC(),
+		Tags:          r.Tags,
+	}
+	planJSON, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	planHash := sha256.Sum256(planJSON)
+	plan.ID = hex.EncodeToString(planHash[:8])
+	return plan, nil
+}
+
+func operatorName() string {
+	// Windows sets USERNAME rather than USER.
+	user := envDefault("USER", envDefault("USERNAME", "unknown"))
+	host, err := os.Hostname()
+	if err != nil {
+		return user
+	}
+	return user + "@" + host
+}
+
+// Approve posts plan to the approval webhook and waits until it's approved,
+// either by polling for a decision or by the operator pasting an approval
+// token on in. Returns an error if the plan is rejected or not approved in
+// time.
+func (a *approvalGate) Approve(plan *purgePlan, in io.Reader) error {
+	fmt.Fprintf(os.Stderr, "> requesting approval for plan %s: %s on %s, %s (keyspace size %d)\n",
+		plan.ID, plan.Action, plan.Target, strings.Join(plan.Conditions, "; "), plan.EstimatedKeys)
+	if len(plan.Tags) > 0 {
+		fmt.Fprintf(os.Stderr, "> plan %s tags: %s\n", plan.ID, plan.Tags)
+	}
+
+	planJSON, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	var posted approvalResponse
+	if err = a.request(http.MethodPost, a.URL, bytes.NewReader(planJSON), &posted); err != nil {
+		return fmt.Errorf("couldn't post plan to approval webhook: %w", err)
+	}
+	if done, err := a.decision(plan, &posted); done {
+		return err
+	}
+
+	pollURL := a.PollURL
+	if posted.PollURL != "" {
+		pollURL = posted.PollURL
+	}
+	if pollURL != "" {
+		return a.poll(plan, pollURL)
+	}
+	return a.readToken(plan, in)
+}
+
+func (a *approvalGate) poll(plan *purgePlan, pollURL string) error {
+	pollURL = strings.Replace(pollURL, "{id}", plan.ID, -1)
+	deadline := time.Now().Add(a.Timeout)
+	fmt.Fprintf(os.Stderr, "> waiting up to %s for approval of plan %s at %s\n", a.Timeout, plan.ID, pollURL)
+	for time.Now().Before(deadline) {
+		var status approvalResponse
+		if err := a.request(http.MethodGet, pollURL, nil, &status); err != nil {
+			fmt.Fprintf(os.Stderr, "> approval poll failed (%s), retrying\n", err)
+		} else if done, err := a.decision(plan, &status); done {
+			return err
+		}
+		time.Sleep(a.PollInterval)
+	}
+	return fmt.Errorf("plan %s was not approved within %s", plan.ID, a.Timeout)
+}
+
+// decision reports whether response settles the approval of plan, and if so
+// whether it was approved (nil error) or not.
+func (a *approvalGate) decision(plan *purgePlan, response *approvalResponse) (done bool, err error) {
+	switch strings.ToLower(response.Status) {
+	case "approved":
+		if err = a.checkToken(plan, response.Token); err != nil {
+			return true, err
+		}
+		fmt.Fprintf(os.Stderr, "> plan %s approved (token %s)\n", plan.ID, response.Token)
+		return true, nil
+	case "rejected", "denied":
+		return true, fmt.Errorf("plan %s was rejected: %s", plan.ID, response.Reason)
+	}
+	return false, nil
+}
+
+func (a *approvalGate) readToken(plan *purgePlan, in io.Reader) error {
+	fmt.Fprintf(os.Stderr, "> paste the approval token for plan %s: ", plan.ID)
+	token, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || token == "") {
+		return fmt.Errorf("couldn't read approval token: %w", err)
+	}
+	token = strings.TrimSpace(token)
+	if err = a.checkToken(plan, token); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "> plan %s approved (token %s)\n", plan.ID, token)
+	return nil
+}
+
+// checkToken verifies an approval token for plan. If APPROVAL_TOKEN_SECRET
+// is set, the token must be the hex HMAC-SHA256 of the plan ID with that
+// secret; otherwise any non-empty token is accepted and logged.
+func (a *approvalGate) checkToken(plan *purgePlan, token string) error {
+	if token == "" {
+		return fmt.Errorf("plan %s: empty approval token", plan.ID)
+	}
+	if a.TokenSecret == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(a.TokenSecret))
+	mac.Write([]byte(plan.ID))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(strings.ToLower(token)), []byte(expected)) {
+		return fmt.Errorf("plan %s: invalid approval token", plan.ID)
+	}
+	return nil
+}
+
+func (a *approvalGate) request(method, url string, body io.Reader, response *approvalResponse) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	responseBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(responseBody)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(responseBody, response)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// backupVersion is the format version of backup files. Version 2 added
+// KeysKept.
+const backupVersion = 2
+
+// A backupHeader is the first line of a backup file, describing the run
+// that wrote it.
+type backupHeader struct {
+	Version   int           `json:"version"`
+	Target    string        `json:"target"`
+	Condition string        `json:"condition"`
+	StartedBy string        `json:"started_by"`
+	StartedAt time.Time     `json:"started_at"`
+	Tags      operationTags `json:"tags,omitempty"`
+	// KeysKept is set if the run left its keys in place, expiring them or
+	// deleting fields or elements of them, so that undo must replace them.
+	KeysKept bool `json:"keys_kept,omitempty"`
+}
+
+// A backupRecord is a line of a backup file: a key as it was just before
+// the run deleted it.
+type backupRecord struct {
+	// Key is escaped as with KEY_DISPLAY=escape, so that any key survives
+	// the round trip through JSON.
+	Key string `json:"key"`
+	// Dump is the key's DUMP serialization; encoding/json base64-encodes it.
+	Dump []byte `json:"dump"`
+	// PTTL is the key's TTL in milliseconds, or 0 if it doesn't expire.
+	PTTL int64 `json:"pttl"`
+}
+
+// keyBackup DUMPs every key just before it's deleted to a backup file of
+// JSON lines, so that an accidental purge can be reversed with undo.
+type keyBackup struct {
+	Path string
+
+	file *os.File
+}
+
+// envKeyBackup returns the backup configured by BACKUP and BACKUP_FILE, or
+// nil if BACKUP is not set.
+func envKeyBackup() *keyBackup {
+	if !envBool("BACKUP", "false") {
+		return nil
+	}
+	return &keyBackup{
+		Path: envDefault("BACKUP_FILE", "redis-purge-backup-"+time.Now().UTC().Format("20060102T150405")+".ndjson"),
+	}
+}
+
+// Open creates the backup file, which mustn't exist yet, and writes its
+// header.
+func (b *keyBackup) Open(header backupHeader) error {
+	file, err := os.OpenFile(b.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't create backup file: %w", err)
+	}
+	b.file = file
+	header.Version = backupVersion
+	fmt.Fprintf(os.Stderr, "> backing up deleted keys to %s\n", b.Path)
+	return b.write(header)
+}
+
+func (b *keyBackup) write(line interface{}) error {
+	lineJSON, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	// Each line is written at once, so that a crashed run leaves at most
+	// its last line incomplete.
+	if _, err = b.file.Write(append(lineJSON, '\n')); err != nil {
+		return fmt.Errorf("couldn't write to backup file %s: %w", b.Path, err)
+	}
+	return nil
+}
+
+// Save backs up key from client. A key that no longer exists is skipped.
+// Save on a nil keyBackup does nothing.
+func (b *keyBackup) Save(client *redis.Client, key string) error {
+	if b == nil {
+		return nil
+	}
+	ctx := context.Background()
+	dump, err := client.Dump(ctx, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't DUMP key for backup: %w", err)
+	}
+	pttl, err := client.PTTL(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't read TTL for backup: %w", err)
+	}
+	record := backupRecord{Key: escapeKey(key), Dump: []byte(dump)}
+	if pttl > 0 {
+		record.PTTL = int64(pttl / time.Millisecond)
+	}
+	return b.write(record)
+}
+
+// Close syncs and closes the backup file. Close on a nil keyBackup does
+// nothing.
+func (b *keyBackup) Close() {
+	if b == nil || b.file == nil {
+		return
+	}
+	if err := b.file.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't sync backup file %s: %s\n", b.Path, err)
+	}
+	b.file.Close()
+	b.file = nil
+}
+
+// openBackup opens r.Backup, if set, for a destructive run of condition.
+// Dry runs make no backup.
+func (r *redisSearch) openBackup(condition string) error {
+	if r.Backup == nil {
+		return nil
+	}
+	if r.DryRun {
+		fmt.Fprintf(os.Stderr, "> dry run: not backing up keys, since nothing will be deleted\n")
+		r.Backup = nil
+		return nil
+	}
+	err := r.Backup.Open(backupHeader{
+		Target:    r.String(),
+		Condition: condition,
+		StartedBy: operatorName(),
+		StartedAt: time.Now().UTC(),
+		Tags:      r.Tags,
+		KeysKept:  r.ExpireSeconds > 0 || len(r.DeleteFields) > 0 || r.DeleteElements != nil,
+	})
+	if err != nil {
+		return err
+	}
+	atExit(r.Backup.Close)
+	return nil
+}
+
+// undoBackup RESTOREs the keys backed up in the backup file at path, with
+// their TTLs as they were backed up. Keys that exist again are left alone,
+// unless replace is set or the run that backed them up kept its keys.
+func (r redisSearch) undoBackup(path string, replace bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("couldn't open backup file: %w", err)
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+
+	line, err := in.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return fmt.Errorf("couldn't read backup file %s: %w", path, err)
+	}
+	var header backupHeader
+	if err = json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("couldn't read backup file %s header: %w", path, err)
+	}
+	if err = checkFormatVersion("backup file "+path, header.Version, backupVersion); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "> restoring keys backed up from %s by %s at %s, matching %s, into %s\n",
+		header.Target, header.StartedBy, header.StartedAt.Format(time.RFC3339), header.Condition, r.String())
+	if header.KeysKept && !replace {
+		// The keys weren't deleted, so every RESTORE would find its key
+		// still there.
+		fmt.Fprintf(os.Stderr, "> replacing the keys, since the run that backed them up expired them or deleted fields or elements of them\n")
+		replace = true
+	}
+
+	ctx := context.Background()
+	var restored, existing, failed int64
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("couldn't read backup file %s: %w", path, err)
+		}
+		var record backupRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			// A run that crashed may have left its last line incomplete.
+			fmt.Fprintf(os.Stderr, "> skipping malformed line %d of backup file: %s\n", lineNumber, err)
+			failed++
+			continue
+		}
+		key, err := keyDisplayEscape.Parse(record.Key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "> skipping line %d of backup file: %s\n", lineNumber, err)
+			failed++
+			continue
+		}
+		ttl := time.Duration(record.PTTL) * time.Millisecond
+		if r.DryRun {
+			if !r.Quiet {
+				fmt.Printf("RESTORE %s (ttl = %s)\n", r.KeyDisplay.Format(key), ttl)
+			}
+			restored++
+			continue
+		}
+		if replace {
+			err = r.Client.RestoreReplace(ctx, key, ttl, string(record.Dump)).Err()
+		} else {
+			err = r.Client.Restore(ctx, key, ttl, string(record.Dump)).Err()
+		}
+		switch {
+		case err != nil && strings.Contains(err.Error(), "BUSYKEY"):
+			fmt.Fprintf(os.Stderr, "> not restoring %s, which exists again\n", r.KeyDisplay.Format(key))
+			existing++
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "> couldn't restore %s: %s\n", r.KeyDisplay.Format(key), err)
+			failed++
+		default:
+			if !r.Quiet {
+				fmt.Printf("RESTORE %s (ttl = %s)\n", r.KeyDisplay.Format(key), ttl)
+			}
+			restored++
+		}
+	}
+
+	verb := "restored"
+	if r.DryRun {
+		verb = "would have restored"
+	}
+	fmt.Fprintf(os.Stderr, "> %s %d keys from %s, %d keys left alone because they exist, %d keys failed\n", verb, restored, path, existing, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d keys couldn't be restored", failed)
+	}
+	return nil
+}
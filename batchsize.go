@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// batchSizer adapts the SCAN count, and so how many values are read in each
+// MGET or pipeline, to how long batches take: growing it while the server
+// answers quickly and shrinking it when batches are slow.
+type batchSizer struct {
+	Count    int
+	Min, Max int
+	// Target is the time a batch's SCAN and value reads should take.
+	Target time.Duration
+	Debug  bool
+}
+
+// envBatchSizer returns the sizer configured by SCAN_COUNT=auto and
+// BATCH_TARGET_MS, or nil if the SCAN count is fixed.
+func envBatchSizer() *batchSizer {
+	if !strings.EqualFold(os.Getenv("SCAN_COUNT"), "auto") {
+		return nil
+	}
+	return &batchSizer{
+		Count:  defaultScanCount,
+		Min:    envInt("SCAN_COUNT_MIN", 10),
+		Max:    envInt("SCAN_COUNT_MAX", 5000),
+		Target: time.Duration(envInt("BATCH_TARGET_MS", 50)) * time.Millisecond,
+		Debug:  os.Getenv("DEBUG") != "",
+	}
+}
+
+// Observe records that a batch took elapsed to scan and read, doubling Count
+// if it took under half of Target, and halving it if it took over Target.
+// Observe on a nil batchSizer does nothing.
+func (s *batchSizer) Observe(elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	count := s.Count
+	switch {
+	case elapsed > s.Target:
+		count /= 2
+		if count < s.Min {
+			count = s.Min
+		}
+	case elapsed < s.Target/2:
+		count *= 2
+		if count > s.Max {
+			count = s.Max
+		}
+	}
+	if count != s.Count && s.Debug {
+		fmt.Fprintf(os.Stderr, "> batch took %s, SCAN count now %d\n", elapsed, count)
+	}
+	s.Count = count
+}
+
+// scanCount returns the COUNT to pass to SCAN.
+func (r redisSearch) scanCount() int {
+	if r.Batches != nil {
+		return r.Batches.Count
+	}
+	if r.ScanCount <= 0 {
+		return defaultScanCount
+	}
+	return r.ScanCount
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// serverCaps are the capabilities of the server detected at startup, or nil
+// before then. The CLIENT NO-TOUCH connection hook reads them, since it's
+// configured before there's a client to detect them with.
+var serverCaps *serverCapabilities
+
+// serverCapabilities are the optional commands a Redis server supports, as
+// detected from its version in INFO server and, where COMMAND INFO is
+// allowed, the commands it hasn't had renamed or disabled, as managed
+// services often do.
+type serverCapabilities struct {
+	// Version is the server's redis_version, or "" if it couldn't be
+	// detected, in which case no optional command is used.
+	Version string
+
+	Unlink      bool
+	MemoryUsage bool
+	ScanType    bool
+	NoTouch     bool
+}
+
+// detectCapabilities detects the capabilities of the server client connects
+// to. A server that can't be asked is reported, and is taken to support none.
+func detectCapabilities(client *redis.Client) *serverCapabilities {
+	ctx := context.Background()
+	caps := &serverCapabilities{}
+	info, err := client.Info(ctx, "server").Result()
+	if err == nil {
+		caps.Version, err = infoVersion(info)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't detect server capabilities (%s): deleting with DEL, scanning all types and not using CLIENT NO-TOUCH\n", err)
+		return caps
+	}
+	caps.Unlink = caps.AtLeast(4, 0)
+	caps.MemoryUsage = caps.AtLeast(4, 0)
+	caps.ScanType = caps.AtLeast(6, 0)
+	caps.NoTouch = caps.AtLeast(7, 2)
+
+	// COMMAND INFO replies with nil for commands the server doesn't have.
+	// Servers that don't allow it are trusted to have every command of
+	// their version.
+	reply, err := client.Do(ctx, "command", "info", "unlink", "memory", "client").Result()
+	if commands, ok := reply.([]interface{}); err == nil && ok && len(commands) == 3 {
+		caps.Unlink = caps.Unlink && commands[0] != nil
+		caps.MemoryUsage = caps.MemoryUsage && commands[1] != nil
+		caps.NoTouch = caps.NoTouch && commands[2] != nil
+	}
+	return caps
+}
+
+// infoVersion returns the redis_version of INFO server.
+func infoVersion(info string) (string, error) {
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "redis_version:")), nil
+		}
+	}
+	return "", fmt.Errorf("no redis_version in INFO server")
+}
+
+// AtLeast reports whether the server's version is at least major.minor.
+func (c *serverCapabilities) AtLeast(major, minor int) bool {
+	parts := strings.SplitN(c.Version, ".", 3)
+	serverMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	serverMinor := 0
+	if len(parts) > 1 {
+		serverMinor, _ = strconv.Atoi(parts[1])
+	}
+	return serverMajor > major || serverMajor == major && serverMinor >= minor
+}
+
+// String describes the server and the optional commands it supports.
+func (c *serverCapabilities) String() string {
+	if c.Version == "" {
+		return "unknown server version"
+	}
+	var supported []string
+	for _, capability := range []struct {
+		name string
+		ok   bool
+	}{{"UNLINK", c.Unlink}, {"MEMORY USAGE", c.MemoryUsage}, {"SCAN TYPE", c.ScanType}, {"CLIENT NO-TOUCH", c.NoTouch}} {
+		if capability.ok {
+			supported = append(supported, capability.name)
+		}
+	}
+	if len(supported) == 0 {
+		supported = append(supported, "none of UNLINK, MEMORY USAGE, SCAN TYPE or CLIENT NO-TOUCH")
+	}
+	return fmt.Sprintf("Redis %s, supporting %s", c.Version, strings.Join(supported, ", "))
+}
+
+// warn reports that a setting needs a capability the server doesn't have.
+// A server whose capabilities are unknown has already been reported.
+func (c *serverCapabilities) warn(setting, capability, version, consequence string) {
+	if c.Version == "" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "> warning: %s needs %s (Redis %s or newer), which Redis %s doesn't support: %s\n", setting, capability, version, c.Version, consequence)
+}
+
+// envUnlink reports whether keys are deleted with UNLINK, which frees their
+// memory in the background, rather than DEL, which blocks the server while
+// a large key is freed: DELETE_COMMAND=auto (the default) uses UNLINK where
+// the server supports it, and DELETE_COMMAND=unlink or del forces either.
+func envUnlink(caps *serverCapabilities) (bool, error) {
+	switch strings.ToLower(envDefault("DELETE_COMMAND", "auto")) {
+	case "auto":
+		return caps.Unlink, nil
+	case "unlink":
+		if !caps.Unlink {
+			caps.warn("DELETE_COMMAND=unlink", "UNLINK", "4.0", "deletes are likely to fail")
+		}
+		return true, nil
+	case "del":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown DELETE_COMMAND %#v (expected auto, unlink or del)", os.Getenv("DELETE_COMMAND"))
+}
+
+// checkCapabilities warns about settings the server can't support, and sizes
+// values by their length where MEMORY USAGE is missing.
+func (r *redisSearch) checkCapabilities() {
+	caps := r.Caps
+	if r.Debug {
+		fmt.Fprintf(os.Stderr, "> server: %s\n", caps)
+	}
+	if r.MemorySizes && caps.Version != "" && !caps.MemoryUsage {
+		caps.warn("SIZE_MODE=memory", "MEMORY USAGE", "4.0", "sizing values by their length instead")
+		r.MemorySizes = false
+	}
+	if r.ScanType && !caps.ScanType {
+		caps.warn("SCAN_TYPE=y", "SCAN TYPE", "6.0", "scans are likely to fail")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// checkpointVersion is the format version of checkpoints.
+const checkpointVersion = 1
+
+// A scanCheckpoint saves the progress of a scan every so often, so that a
+// run that crashed or was interrupted can be resumed with --resume from
+// about where it stopped, rather than scanning the keyspace from the start.
+// It's kept in a file, or in a key in the target Redis, where other
+// operators, or a rescheduled job on another machine, can see and resume it.
+type scanCheckpoint struct {
+	Version int `json:"version"`
+	// Target, Condition and Action identify the run, which a resumed run
+	// must repeat.
+	Target    string `json:"target"`
+	Condition string `json:"condition"`
+	Action    string `json:"action"`
+
+	// Cursor is the SCAN cursor to resume from.
+	Cursor      uint64 `json:"cursor"`
+	ScannedKeys int64  `json:"scanned_keys"`
+	MatchedKeys int64  `json:"matched_keys"`
+	Resumes     int    `json:"resumes"`
+
+	// Status is "running" while the run is scanning, or "interrupted" or
+	// "failed", with Error, once it has stopped before the end of the
+	// keyspace.
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	UpdatedBy string        `json:"updated_by"`
+	StartedAt time.Time     `json:"started_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Tags      operationTags `json:"tags,omitempty"`
+
+	// path is the checkpoint file, or, if key is set, empty.
+	path     string
+	key      string
+	client   *redis.Client
+	interval time.Duration
+	saved    time.Time
+}
+
+// envCheckpointStore returns an empty checkpoint kept where CHECKPOINT_FILE
+// or CHECKPOINT_KEY (in client) says, or nil if neither is set.
+func envCheckpointStore(client *redis.Client) (*scanCheckpoint, error) {
+	path, key := os.Getenv("CHECKPOINT_FILE"), os.Getenv("CHECKPOINT_KEY")
+	switch {
+	case path != "" && key != "":
+		return nil, fmt.Errorf("only one of CHECKPOINT_FILE and CHECKPOINT_KEY may be set")
+	case path == "" && key == "":
+		return nil, nil
+	}
+	return &scanCheckpoint{
+		path:     path,
+		key:      key,
+		client:   client,
+		interval: time.Duration(envInt("CHECKPOINT_INTERVAL", 10)) * time.Second,
+	}, nil
+}
+
+// envScanCheckpoint returns the checkpoint in CHECKPOINT_FILE or
+// CHECKPOINT_KEY for a run of action on condition on target, saved every
+// CHECKPOINT_INTERVAL seconds, or nil if neither is set. An existing
+// checkpoint is only resumed if resume is set, and a new one is only started
+// if it isn't, so that a run neither silently skips part of the keyspace nor
+// restarts a purge that should have been resumed. A checkpoint that another
+// run updated recently, which may still be running, is only resumed if force
+// is set.
+func envScanCheckpoint(client *redis.Client, target, condition, action string, resume, force bool) (*scanCheckpoint, error) {
+	checkpoint, err := envCheckpointStore(client)
+	if err != nil || checkpoint == nil {
+		if err == nil && resume {
+			err = fmt.Errorf("--resume needs CHECKPOINT_FILE or CHECKPOINT_KEY")
+		}
+		return nil, err
+	}
+
+	found, err := checkpoint.load()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if resume {
+			return nil, fmt.Errorf("there is no checkpoint %s to resume", checkpoint)
+		}
+		now := time.Now().UTC()
+		checkpoint.Version = checkpointVersion
+		checkpoint.Target, checkpoint.Condition, checkpoint.Action = target, condition, action
+		checkpoint.StartedAt, checkpoint.UpdatedAt = now, now
+		return checkpoint, nil
+	}
+	if !resume {
+		return nil, fmt.Errorf("checkpoint %s is from an unfinished run; pass --resume to carry on with it, or remove it to start again", checkpoint)
+	}
+	if err = checkFormatVersion("checkpoint "+checkpoint.String(), checkpoint.Version, checkpointVersion); err != nil {
+		return nil, err
+	}
+	// The checkpoint is saved in the current format from now on.
+	checkpoint.Version = checkpointVersion
+	if checkpoint.Target != target || checkpoint.Condition != condition || checkpoint.Action != action {
+		return nil, fmt.Errorf("checkpoint %s is for a run to %s %s on %s, not to %s %s on %s",
+			checkpoint, checkpoint.Action, checkpoint.Condition, checkpoint.Target, action, condition, target)
+	}
+	if checkpoint.Status == "running" && time.Since(checkpoint.UpdatedAt) < 3*checkpoint.interval && !force {
+		return nil, fmt.Errorf("checkpoint %s was updated by %s at %s, and its run may still be going; set FORCE=y to resume it anyway",
+			checkpoint, checkpoint.UpdatedBy, checkpoint.UpdatedAt.Format(time.RFC3339))
+	}
+	checkpoint.Resumes++
+	checkpoint.Error = ""
+	return checkpoint, nil
+}
+
+// String describes where the checkpoint is kept.
+func (c *scanCheckpoint) String() string {
+	if c.key != "" {
+		return fmt.Sprintf("key %#v", c.key)
+	}
+	return c.path
+}
+
+// Setting names the setting that says where the checkpoint is kept.
+func (c *scanCheckpoint) Setting() string {
+	if c.key != "" {
+		return "CHECKPOINT_KEY"
+	}
+	return "CHECKPOINT_FILE"
+}
+
+// load reads the saved checkpoint into c, reporting whether there is one.
+func (c *scanCheckpoint) load() (found bool, err error) {
+	var data []byte
+	if c.key != "" {
+		data, err = c.client.Get(context.Background(), c.key).Bytes()
+		if err == redis.Nil {
+			return false, nil
+		}
+	} else {
+		data, err = ioutil.ReadFile(c.path)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("couldn't read checkpoint %s: %w", c, err)
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return false, fmt.Errorf("couldn't parse checkpoint %s: %w", c, err)
+	}
+	return true, nil
+}
+
+// store replaces the saved checkpoint with data.
+func (c *scanCheckpoint) store(data []byte) error {
+	if c.key != "" {
+		return c.client.Set(context.Background(), c.key, data, 0).Err()
+	}
+	// Write a temporary file and rename it over the checkpoint, so that a
+	// crash while saving doesn't lose it.
+	temp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(append(data, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), c.path)
+	}
+	return err
+}
+
+// remove removes the saved checkpoint, if any.
+func (c *scanCheckpoint) remove() error {
+	if c.key != "" {
+		return c.client.Del(context.Background(), c.key).Err()
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Start saves the checkpoint as running, so that others can see the run
+// has started, and returns the cursor to scan from. Start on a nil
+// scanCheckpoint returns 0.
+func (c *scanCheckpoint) Start() (uint64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	if c.Resumes > 0 {
+		fmt.Fprintf(os.Stderr, "> checkpoint %s: resuming at cursor %d after %d scanned keys, %d matched\n",
+			c, c.Cursor, c.ScannedKeys, c.MatchedKeys)
+	}
+	return c.Cursor, c.Save(c.Cursor, nil)
+}
+
+// Advance records a scanned batch, and the cursor after it, saving the
+// checkpoint if it hasn't been saved for its interval. Once the scan is
+// complete, at cursor 0, the checkpoint is removed. Advance on a nil
+// scanCheckpoint does nothing.
+func (c *scanCheckpoint) Advance(cursor uint64, scanned, matched int64) error {
+	if c == nil {
+		return nil
+	}
+	c.ScannedKeys += scanned
+	c.MatchedKeys += matched
+	if cursor == 0 {
+		if err := c.remove(); err != nil {
+			return fmt.Errorf("couldn't remove finished checkpoint %s: %w", c, err)
+		}
+		return nil
+	}
+	if time.Since(c.saved) < c.interval {
+		c.Cursor = cursor
+		return nil
+	}
+	return c.Save(cursor, nil)
+}
+
+// Save saves the checkpoint, to resume at cursor, with the status of a run
+// that is still scanning or, if stopped is set, that stopped with it. Save on
+// a nil scanCheckpoint does nothing.
+func (c *scanCheckpoint) Save(cursor uint64, stopped error) error {
+	if c == nil {
+		return nil
+	}
+	c.Cursor = cursor
+	switch {
+	case stopped == nil:
+		c.Status = "running"
+	case errors.Is(stopped, errInterrupted):
+		c.Status = "interrupted"
+	default:
+		c.Status, c.Error = "failed", stopped.Error()
+	}
+	c.UpdatedBy = operatorName()
+	c.UpdatedAt = time.Now().UTC()
+	c.saved = time.Now()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = c.store(data); err != nil {
+		return fmt.Errorf("couldn't save checkpoint %s: %w", c, err)
+	}
+	return nil
+}
+
+// openCheckpoint sets up r.Checkpoint for a run of action on condition, if
+// CHECKPOINT_FILE or CHECKPOINT_KEY is set. A LEDGER_FILE already keeps the
+// run's progress.
+func (r *redisSearch) openCheckpoint(condition, action string, resume bool) (err error) {
+	r.Checkpoint, err = envScanCheckpoint(r.Client, r.String(), condition, action, resume, envBool("FORCE", "false"))
+	if err != nil || r.Checkpoint == nil {
+		return err
+	}
+	if r.Ledger != nil {
+		return fmt.Errorf("%s can't be used with LEDGER_FILE, which already records where to resume", r.Checkpoint.Setting())
+	}
+	if len(r.Tags) > 0 {
+		r.Checkpoint.Tags = r.Tags
+	}
+	if r.Checkpoint.key != "" {
+		r.InternalKeys = append(r.InternalKeys, r.Checkpoint.key)
+	}
+	return nil
+}
+
+// printCheckpointStatus prints the progress and status of the run recorded in
+// the checkpoint in CHECKPOINT_FILE or CHECKPOINT_KEY.
+func (r redisSearch) printCheckpointStatus() error {
+	checkpoint, err := envCheckpointStore(r.Client)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		return fmt.Errorf("none of LEDGER_FILE, CHECKPOINT_FILE or CHECKPOINT_KEY is set")
+	}
+	found, err := checkpoint.load()
+	if err != nil {
+		return err
+	}
+	if !found {
+		fmt.Printf("no checkpoint %s: no run is in progress, or the last one completed\n", checkpoint)
+		return nil
+	}
+	fmt.Printf("%s of %s on %s: %s\n", checkpoint.Action, checkpoint.Condition, checkpoint.Target, checkpoint.Status)
+	if checkpoint.Error != "" {
+		fmt.Printf("error: %s\n", checkpoint.Error)
+	}
+	fmt.Printf("resumes: %d, started %s, last updated %s by %s\n", checkpoint.Resumes,
+		checkpoint.StartedAt.Format(time.RFC3339), checkpoint.UpdatedAt.Format(time.RFC3339), checkpoint.UpdatedBy)
+	if len(checkpoint.Tags) > 0 {
+		fmt.Printf("tags: %s\n", checkpoint.Tags)
+	}
+	fmt.Printf("scanned %d keys, matched %d, next cursor %d\n", checkpoint.ScannedKeys, checkpoint.MatchedKeys, checkpoint.Cursor)
+	return nil
+}
+
+// checkpointAction names what a run does to the keys it matches, for its
+// checkpoint.
+func (r redisSearch) checkpointAction(deletes bool) string {
+	switch {
+	case !deletes:
+		return "list"
+	case r.DryRun:
+		return "dry-run delete"
+	default:
+		return "delete"
+	}
+}
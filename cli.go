@@ -0,0 +1,343 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A cliSetting is a setting that can be given as a flag as well as in the
+// environment. The flag's name is the variable's, in lower case with dashes,
+// such as --key-pattern for KEY_PATTERN.
+type cliSetting struct {
+	Env     string
+	Section string
+	Help    string
+	// Bool settings are set to y by a bare flag, such as --dry-run.
+	Bool bool
+}
+
+// cliSettings are the settings of the list, delete and count commands, in the
+// order --help lists them. Settings not listed, such as secrets and the
+// OpenTelemetry variables, are only read from the environment.
+var cliSettings = []cliSetting{
+	{Env: "REDIS_ADDR", Section: "Connection", Help: "address of the Redis server (default :6379)"},
+	{Env: "TLS", Section: "Connection", Help: "connect with TLS (default y)", Bool: true},
+	{Env: "READ_TIMEOUT", Section: "Connection", Help: "read timeout in seconds (default 180)"},
+	{Env: "READ_REPLICA_ADDR", Section: "Connection", Help: "replica to scan and read values from"},
+	{Env: "NO_TOUCH", Section: "Connection", Help: "CLIENT NO-TOUCH: auto, y or n (default auto)"},
+
+	{Env: "ACCESS_MODE", Section: "Search", Help: "read values as hash, string, list, set, zset, stream or json (default hash)"},
+	{Env: "HASH_FIELD", Section: "Search", Help: "only match this hash field"},
+	{Env: "HASH_SCAN", Section: "Search", Help: "read whole hashes with HSCAN, matching them as they're read", Bool: true},
+	{Env: "HASH_MATCH", Section: "Search", Help: "match hash fields, such as 'f=v;g!=w'"},
+	{Env: "JSON_PATH", Section: "Search", Help: "only match the parts of JSON documents selected by this JSONPath"},
+	{Env: "MATCH_ELEMENTS", Section: "Search", Help: "match each element of a collection separately", Bool: true},
+	{Env: "STRING_CHUNK_SIZE", Section: "Search", Help: "read strings with GETRANGE, this many bytes at a time"},
+	{Env: "KEY_PATTERN", Section: "Search", Help: "only search keys matching this glob pattern"},
+	{Env: "EXCLUDE_KEY_PATTERNS", Section: "Search", Help: "never match keys matching these glob patterns"},
+	{Env: "SCAN_TYPE", Section: "Search", Help: "pass SCAN the TYPE of keys to read: auto, y or n (default auto)"},
+	{Env: "SEARCH_DELIMITER", Section: "Search", Help: "also split each value on this delimiter"},
+	{Env: "SEARCH_MODE", Section: "Search", Help: "match any or all of the values (default any)"},
+	{Env: "REQUIRED_MATCH_COUNT", Section: "Search", Help: "match values containing a value this many times, rather than exactly"},
+	{Env: "INVERT_MATCH", Section: "Search", Help: "match the keys whose values don't match", Bool: true},
+	{Env: "SIZE_THRESHOLD", Section: "Search", Help: "only match values of at least this many bytes"},
+	{Env: "SIZE_MAX", Section: "Search", Help: "only match values of at most this many bytes"},
+	{Env: "SIZE_MODE", Section: "Search", Help: "size keys by MEMORY USAGE, if memory"},
+	{Env: "RULES_FILE", Section: "Search", Help: "run the rules in this JSON file, instead of searching for values"},
+	{Env: "FREE_TARGET_BYTES", Section: "Search", Help: "list the best candidates to delete to free this many bytes"},
+	{Env: "FREE_TARGET_OVERSAMPLE", Section: "Search", Help: "score this many times FREE_TARGET_BYTES of candidates (default 3)"},
+
+	{Env: "SCAN_COUNT", Section: "Scanning", Help: "SCAN COUNT hint, or auto (default 50)"},
+	{Env: "SCAN_COUNT_MIN", Section: "Scanning", Help: "smallest SCAN COUNT with SCAN_COUNT=auto (default 10)"},
+	{Env: "SCAN_COUNT_MAX", Section: "Scanning", Help: "largest SCAN COUNT with SCAN_COUNT=auto (default 5000)"},
+	{Env: "BATCH_TARGET_MS", Section: "Scanning", Help: "target time per batch with SCAN_COUNT=auto (default 50)"},
+	{Env: "CONCURRENCY", Section: "Scanning", Help: "read the values of each batch with this many workers (default 1)"},
+	{Env: "START_CURSOR", Section: "Scanning", Help: "start scanning at this cursor"},
+	{Env: "LEDGER_FILE", Section: "Scanning", Help: "run the purge in sessions, recording progress in this file"},
+	{Env: "SESSION_DURATION", Section: "Scanning", Help: "stop each session after this many seconds"},
+	{Env: "CHECKPOINT_FILE", Section: "Scanning", Help: "save progress in this file, to carry on from with --resume"},
+	{Env: "CHECKPOINT_KEY", Section: "Scanning", Help: "save progress in this Redis key, to carry on from with --resume"},
+	{Env: "CHECKPOINT_INTERVAL", Section: "Scanning", Help: "save progress every this many seconds (default 10)"},
+	{Env: "WATCH_INTERVAL", Section: "Scanning", Help: "repeat the run every this many seconds"},
+
+	{Env: "DRY_RUN", Section: "Deleting", Help: "go through the motions of deleting, without deleting anything", Bool: true},
+	{Env: "ALLOW_MATCH_ALL", Section: "Deleting", Help: "allow deleting with no search values", Bool: true},
+	{Env: "EXPIRE_SECONDS", Section: "Deleting", Help: "expire matching keys after this many seconds, instead of deleting them"},
+	{Env: "QUARANTINE_PREFIX", Section: "Deleting", Help: "rename matching keys with this prefix, instead of deleting them"},
+	{Env: "QUARANTINE_TTL", Section: "Deleting", Help: "expire quarantined keys after this many seconds"},
+	{Env: "DELETE_FIELDS", Section: "Deleting", Help: "delete the matching hash fields, rather than the keys", Bool: true},
+	{Env: "DELETE_ELEMENTS", Section: "Deleting", Help: "delete the matching elements, rather than the keys", Bool: true},
+	{Env: "DELETE_COMMAND", Section: "Deleting", Help: "delete keys with auto, unlink or del (default auto: UNLINK where supported)"},
+	{Env: "DELETE_ORDER", Section: "Deleting", Help: "delete in scan or largest-first order (default scan)"},
+	{Env: "DELETE_ORDER_BUFFER", Section: "Deleting", Help: "hold this many keys for DELETE_ORDER (default 100000)"},
+	{Env: "MARK_FILE", Section: "Deleting", Help: "mark the keys listed in this plan file, for a later sweep"},
+	{Env: "SWEEP_FILE", Section: "Deleting", Help: "delete the keys marked in this plan file"},
+	{Env: "SWEEP_CHECKSUM", Section: "Deleting", Help: "only sweep a plan file with this SHA-256"},
+	{Env: "WAIT_AND_REDELETE", Section: "Deleting", Help: "wait and delete keys that are inserted again", Bool: true},
+	{Env: "CLEAN_DELETE_MIN", Section: "Deleting", Help: "with WAIT_AND_REDELETE, stop after this many clean iterations (default 500)"},
+	{Env: "CLEAN_DELETE_WAIT_MS", Section: "Deleting", Help: "with WAIT_AND_REDELETE, wait this many ms between iterations (default 150)"},
+	{Env: "AUTO_RETRY", Section: "Deleting", Help: "retry failed deletes this many times"},
+	{Env: "AUTO_RETRY_BACKOFF_MS", Section: "Deleting", Help: "wait this many ms before retrying"},
+	{Env: "BACKUP", Section: "Deleting", Help: "DUMP every key before deleting it", Bool: true},
+	{Env: "BACKUP_FILE", Section: "Deleting", Help: "file to back up deleted keys to"},
+	{Env: "VERIFY_SAMPLE", Section: "Deleting", Help: "check that this many deleted keys are gone"},
+	{Env: "VERIFY_REPLICA_ADDRS", Section: "Deleting", Help: "also check these replicas"},
+
+	{Env: "PROTECTED_KEY_PATTERNS", Section: "Safety", Help: "never delete keys matching these glob patterns"},
+	{Env: "MAX_DELETES", Section: "Safety", Help: "delete at most this many keys"},
+	{Env: "MAX_DELETES_ACTION", Section: "Safety", Help: "abort or stop at MAX_DELETES (default abort)"},
+	{Env: "DELETES_PER_SECOND", Section: "Safety", Help: "delete at most this many keys a second"},
+	{Env: "ALLOWED_WINDOW", Section: "Safety", Help: "only delete in this window, such as '01:00-05:00 UTC'"},
+	{Env: "OUTSIDE_WINDOW_ACTION", Section: "Safety", Help: "refuse or pause outside ALLOWED_WINDOW (default refuse)"},
+	{Env: "MAX_MATCH_PERCENT", Section: "Safety", Help: "refuse to delete if more than this percentage of keys match"},
+	{Env: "MATCH_RATIO_SAMPLE", Section: "Safety", Help: "estimate the match percentage from this many keys (default 1000)"},
+	{Env: "OVERRIDE_MATCH_RATIO", Section: "Safety", Help: "delete even if more than MAX_MATCH_PERCENT of keys match", Bool: true},
+	{Env: "MAX_CONSECUTIVE_ERRORS", Section: "Safety", Help: "abort after this many errors in a row"},
+	{Env: "CONFIRM_DELETE", Section: "Safety", Help: "ask to confirm deletes, by typing the count of matches"},
+	{Env: "CONFIRM_SAMPLE", Section: "Safety", Help: "estimate the count of matches from this many keys (default 1000)"},
+	{Env: "APPROVAL_URL", Section: "Safety", Help: "webhook that must approve destructive runs"},
+	{Env: "APPROVAL_POLL_URL", Section: "Safety", Help: "URL to poll for approval"},
+	{Env: "APPROVAL_POLL_INTERVAL", Section: "Safety", Help: "poll for approval every this many seconds (default 10)"},
+	{Env: "APPROVAL_TIMEOUT", Section: "Safety", Help: "wait this many seconds for approval (default 3600)"},
+	{Env: "INSTANCE_LOCK", Section: "Safety", Help: "lock the target against other runs", Bool: true},
+	{Env: "INSTANCE_LOCK_KEY", Section: "Safety", Help: "key to lock the target with (default redis-purge:lock)"},
+	{Env: "INSTANCE_LOCK_WAIT", Section: "Safety", Help: "wait this many seconds for the lock"},
+	{Env: "RERUN_WINDOW", Section: "Safety", Help: "catch identical runs within this many seconds"},
+	{Env: "RERUN_ACTION", Section: "Safety", Help: "skip or warn about repeated runs (default skip)"},
+	{Env: "FORCE", Section: "Safety", Help: "run a repeated run, or resume a recently updated checkpoint, anyway", Bool: true},
+	{Env: "STALL_TIMEOUT", Section: "Safety", Help: "report a scan that makes no progress for this many seconds"},
+	{Env: "STALL_ACTION", Section: "Safety", Help: "abort or warn on a stalled scan (default abort)"},
+
+	{Env: "OUTPUT_SINKS", Section: "Output", Help: "where to write matches, such as stdout,ndjson:matches.ndjson (default stdout)"},
+	{Env: "OUTPUT_FORMAT", Section: "Output", Help: "format of the stdout sink: text, json, csv or keys (default text)"},
+	{Env: "OUTPUT_COLUMNS", Section: "Output", Help: "columns of csv output (default key,size,action,rule,owner)"},
+	{Env: "OUTPUT_TEMPLATE", Section: "Output", Help: "Go text/template for each match written as text"},
+	{Env: "QUIET", Section: "Output", Help: "print no per-key lines or progress, just the summary", Bool: true},
+	{Env: "TUI", Section: "Output", Help: "show scans on a full-screen dashboard, with keys to pause and abort", Bool: true},
+	{Env: "COLOR", Section: "Output", Help: "color deletes, errors and summaries: auto, y or n (default auto)"},
+	{Env: "OUTPUT_FILE", Section: "Output", Help: "write the report to this file"},
+	{Env: "OUTPUT_HTTP_BATCH", Section: "Output", Help: "POST this many matches at a time (default 100)"},
+	{Env: "SUMMARY_FILE", Section: "Output", Help: "write a JSON summary of the run to this file, or - for stdout"},
+	{Env: "OPERATION_TAGS", Section: "Output", Help: "key=value tags for the run, such as ticket=OPS-1234"},
+	{Env: "KEY_DISPLAY", Section: "Output", Help: "format keys raw, escape, hex or base64 (default raw)"},
+	{Env: "RESULTS_ADDR", Section: "Output", Help: "serve matches over HTTP on this address"},
+	{Env: "RESULTS_BUFFER", Section: "Output", Help: "serve at least the last this many matches (default 100000)"},
+	{Env: "RESULTS_LINGER", Section: "Output", Help: "keep serving results this many seconds after the run"},
+	{Env: "KEY_OWNERS_FILE", Section: "Output", Help: "annotate matches with the owners of key prefixes in this file"},
+	{Env: "KEY_OWNERS_URL", Section: "Output", Help: "look up the owners of key prefixes with this URL"},
+	{Env: "KEY_OWNERS_DELIMITER", Section: "Output", Help: "key prefix delimiter for owners (default :)"},
+
+	{Env: "FINGERPRINT", Section: "Reports", Help: "print a fingerprint of the matching keys", Bool: true},
+	{Env: "FINGERPRINT_PREVIOUS", Section: "Reports", Help: "report whether the fingerprint has changed from this one"},
+	{Env: "SCHEMA_REPORT", Section: "Reports", Help: "report the schemas of matched JSON values", Bool: true},
+	{Env: "SIZE_HISTOGRAM", Section: "Reports", Help: "report a histogram of matched (y) or all (all) value sizes"},
+	{Env: "PREFIX_REPORT", Section: "Reports", Help: "report matches by key prefix", Bool: true},
+	{Env: "PREFIX_DELIMITER", Section: "Reports", Help: "key prefix delimiter (default :)"},
+	{Env: "PREFIX_REPORT_TOP", Section: "Reports", Help: "report the largest this many prefixes (default 20)"},
+	{Env: "REPORT_TTL", Section: "Reports", Help: "report matches by remaining TTL", Bool: true},
+	{Env: "KEYSPACE_SNAPSHOT", Section: "Reports", Help: "report the keyspace's types and prefixes before the run", Bool: true},
+	{Env: "KEYSPACE_SNAPSHOT_SAMPLE", Section: "Reports", Help: "snapshot this many keys (default 10000)"},
+	{Env: "ALERT_ON_MATCH", Section: "Reports", Help: "exit with ALERT_EXIT_CODE if any key matches", Bool: true},
+	{Env: "ALERT_EXIT_CODE", Section: "Reports", Help: "exit status for ALERT_ON_MATCH (default 2)"},
+	{Env: "EXIT_CODES", Section: "Reports", Help: "exit with 3 if no key matched, or 4 if some deletes failed", Bool: true},
+	{Env: "RATE_ALERT_THRESHOLD", Section: "Reports", Help: "alert when new matches a minute rise above this, when watching"},
+	{Env: "RATE_ALERT_URL", Section: "Reports", Help: "POST rate alerts to this URL"},
+
+	{Env: "PRE_MATCH_HOOK", Section: "Hooks", Help: "run this command for each scanned key; non-zero exit skips it"},
+	{Env: "POST_MATCH_HOOK", Section: "Hooks", Help: "run this command for each matching key; non-zero exit skips it"},
+	{Env: "PRE_DELETE_HOOK", Section: "Hooks", Help: "run this command before each delete; non-zero exit vetoes it"},
+	{Env: "POST_DELETE_HOOK", Section: "Hooks", Help: "run this command after each delete"},
+	{Env: "HOOK_TIMEOUT", Section: "Hooks", Help: "veto keys whose hooks take longer than this many seconds (default 30)"},
+
+	{Env: "PROGRESS", Section: "Diagnostics", Help: "report progress on stderr (default y)", Bool: true},
+	{Env: "PROGRESS_INTERVAL", Section: "Diagnostics", Help: "log progress every this many seconds off a terminal (default 30)"},
+	{Env: "PROGRESS_KEYS", Section: "Diagnostics", Help: "also log progress every this many keys off a terminal"},
+	{Env: "PPROF_ADDR", Section: "Diagnostics", Help: "serve pprof profiles on this address"},
+	{Env: "DEBUG", Section: "Diagnostics", Help: "print debugging output, if set to anything"},
+}
+
+// cliCommands are the commands that take cliSettings as flags, and what
+// each sets DELETE_MATCHING_KEYS and COUNT_ONLY to.
+var cliCommands = map[string]struct {
+	Help     string
+	Deleting string
+	Count    string
+}{
+	"list":   {Help: "list the matching keys", Deleting: "n", Count: "n"},
+	"delete": {Help: "delete the matching keys", Deleting: "y", Count: "n"},
+	"count":  {Help: "count the matching keys and their total size", Deleting: "n", Count: "y"},
+}
+
+// flagName returns the flag for an environment variable.
+func flagName(env string) string {
+	return strings.ToLower(strings.Replace(env, "_", "-", -1))
+}
+
+// envFlag is a flag that sets its environment variable, so that the rest of
+// the run reads flags and the environment alike.
+type envFlag struct {
+	setting cliSetting
+}
+
+func (f *envFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return os.Getenv(f.setting.Env)
+}
+
+func (f *envFlag) Set(value string) error {
+	if f.setting.Bool {
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		value = "n"
+		if on {
+			value = "y"
+		}
+	}
+	return os.Setenv(f.setting.Env, value)
+}
+
+func (f *envFlag) IsBoolFlag() bool {
+	return f.setting.Bool
+}
+
+// parseCommandLine turns a list, delete or count command line, such as
+// delete --key-pattern 'session:*' --dry-run bad-value, into the environment
+// and search values the rest of the run reads: flags take precedence over
+// environment variables, which are used for any setting not given as a flag.
+// The config file given with --config, or in CONFIG_FILE, supplies any
+// setting set by neither, and the values if none are given. run NAME runs
+// the profile called NAME of the config file (redis-purge.toml by default) as
+// its command, with the same flags. Other command lines are returned as they
+// are, with CONFIG_FILE applied likewise. resume reports whether --resume was
+// given.
+func parseCommandLine(args []string) (values []string, resume bool) {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	switch name {
+	case "help", "-h", "-help", "--help":
+		commandHelp()
+		exit(0)
+	}
+	command, ok := cliCommands[name]
+	if !ok && name != "run" {
+		config := envPurgeConfig("", "")
+		config.Apply()
+		if len(args) == 0 && config != nil && config.HasValues {
+			args = append([]string{"--"}, config.Values...)
+		}
+		return args, false
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	for _, setting := range cliSettings {
+		flags.Var(&envFlag{setting: setting}, flagName(setting.Env), setting.Help)
+	}
+	flags.BoolVar(&resume, "resume", false, "carry on from the checkpoint")
+	configPath := flags.String("config", "", "read settings from this file")
+	usageName := name
+	if name == "run" {
+		usageName, command.Help = "run PROFILE", "run a profile of the config file as its command"
+	}
+	parse := func(args []string) {
+		if err := flags.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				settingsHelp(usageName, command.Help)
+				exit(0)
+			}
+			fmt.Fprintf(os.Stderr, "> %s; see %s %s --help\n", err, os.Args[0], name)
+			exit(1)
+		}
+	}
+	parse(args[1:])
+
+	var config *purgeConfig
+	if name == "run" {
+		// The profile's name may come before or after the flags, which
+		// continue after it.
+		if flags.NArg() == 0 {
+			runHelp(envPurgeConfig(*configPath, defaultConfigFile))
+			exit(1)
+		}
+		profileName := flags.Arg(0)
+		parse(flags.Args()[1:])
+		var profile *configProfile
+		var err error
+		config, profile, err = envPurgeConfig(*configPath, defaultConfigFile).Profile(profileName)
+		reportError("couldn't run profile", err)
+		command = cliCommands[profile.Command]
+	} else {
+		config = envPurgeConfig(*configPath, "")
+	}
+	config.Apply()
+	os.Setenv("DELETE_MATCHING_KEYS", command.Deleting)
+	os.Setenv("COUNT_ONLY", command.Count)
+	values = flags.Args()
+	if len(values) == 0 && config != nil && config.HasValues {
+		values = config.Values
+	}
+	// The values follow --, so that none is taken for a subcommand.
+	return append([]string{"--"}, values...), resume
+}
+
+// commandHelp prints the commands, for --help.
+func commandHelp() {
+	fmt.Fprintf(os.Stderr, `Usage: %[1]s list|delete|count [flags] [--] [value...]
+       %[1]s run PROFILE [flags] [--] [value...]
+
+Commands:
+  list     %s
+  delete   %s
+  count    %s
+  run      run a profile of the config file (%s by default) as its command
+
+%[1]s COMMAND --help lists the flags of each command, and the environment
+variables each flag may be set with instead. The other subcommands (wizard,
+status, print-acl, verify-absence and undo), and the environment-only form,
+%[1]s [value...], are described when %[1]s is run with no arguments.
+`, os.Args[0], cliCommands["list"].Help, cliCommands["delete"].Help, cliCommands["count"].Help, defaultConfigFile)
+}
+
+// runHelp prints the profiles of config, for run without a profile.
+func runHelp(config *purgeConfig) {
+	fmt.Fprintf(os.Stderr, "Usage: %s run PROFILE [flags] [--] [value...]\n\n", os.Args[0])
+	if len(config.Profiles) == 0 {
+		fmt.Fprintf(os.Stderr, "%s has no profiles.\n", config.Path)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Profiles in %s:\n", config.Path)
+	for _, name := range config.ProfileNames() {
+		profile := config.Profiles[name]
+		fmt.Fprintf(os.Stderr, "  %-24s %-8s %s\n", name, profile.Command, profile.Description)
+	}
+}
+
+// settingsHelp prints the flags of command, for command --help.
+func settingsHelp(command, help string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] [--] [value...]\n\n%s%s. Flags must come before the values.\n",
+		os.Args[0], command, strings.ToUpper(help[:1]), help[1:])
+	section := ""
+	for _, setting := range cliSettings {
+		if setting.Section != section {
+			section = setting.Section
+			fmt.Fprintf(os.Stderr, "\n%s:\n", section)
+		}
+		name := "--" + flagName(setting.Env)
+		if !setting.Bool {
+			name += " value"
+		}
+		fmt.Fprintf(os.Stderr, "  %-32s %s [%s]\n", name, setting.Help, setting.Env)
+	}
+	fmt.Fprintf(os.Stderr, "\nConfig:\n  %-32s %s\n", "--config file", "read settings, and values, from this TOML file [CONFIG_FILE]")
+	fmt.Fprintf(os.Stderr, "\nResuming:\n  %-32s %s\n", "--resume", "carry on from the checkpoint in CHECKPOINT_FILE or CHECKPOINT_KEY")
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/greensnark/redis-purge/purge"
+
+// collectionPageSize is the number of elements read per command from
+// collection values and hashes, so that huge values aren't read in one reply.
+const collectionPageSize = purge.CollectionPageSize
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// ANSI SGR codes of the colors output is painted in.
+const (
+	colorBold   = "1"
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// useColor reports whether output to f is colored: with COLOR=auto (the
+// default), if f is a terminal, NO_COLOR isn't set and TERM isn't dumb;
+// otherwise if COLOR is y.
+func useColor(f *os.File) bool {
+	if mode := envDefault("COLOR", "auto"); mode != "auto" {
+		return envBool("COLOR", "n")
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// paint returns text in color, if output to f is colored.
+func paint(f *os.File, color, text string) string {
+	if text == "" || !useColor(f) {
+		return text
+	}
+	return "\033[" + color + "m" + text + "\033[0m"
+}
+
+// actionColor returns the color of a match's action: red for destructive
+// actions, yellow for those a dry run would have taken, and none for keys
+// that are only listed.
+func actionColor(record purge.Record) string {
+	switch {
+	case record.Action == "list":
+		return ""
+	case record.DryRun:
+		return colorYellow
+	default:
+		return colorRed
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// purgeConfig is a config file of settings, so that a recurring purge job can
+// be kept under version control rather than in a long list of environment
+// variables. Config files are TOML, such as:
+//
+//	redis_addr = "redis.internal:6379"
+//	values = ["bad-value"]
+//
+//	[safety]
+//	max_deletes = 10000
+//	protected_key_patterns = ["config:*", "billing:*"]
+//
+// Settings are named after the environment variables, in lower case with
+// underscores or dashes, and may be grouped in tables named after the
+// sections of --help. Arrays are joined with commas, as the comma-separated
+// settings expect, and booleans become y or n.
+type purgeConfig struct {
+	Path     string
+	Settings map[string]string
+	// Values are the search values, used when none are given on the command
+	// line; HasValues reports whether the file sets them.
+	Values    []string
+	HasValues bool
+	// Profiles are the [profiles.NAME] tables of the file, run by name with
+	// the run command.
+	Profiles map[string]*configProfile
+}
+
+// A configProfile is a named search or delete in a config file, such as
+//
+//	[profiles.stale-sessions]
+//	command = "delete"
+//	key_pattern = "session:*"
+//
+//	[profiles.stale-sessions.safety]
+//	max_deletes = 50000
+//
+// Its settings, including its own safety caps, take precedence over those of
+// the rest of the file.
+type configProfile struct {
+	// Command is list, delete or count (the default is list).
+	Command     string
+	Description string
+	Config      purgeConfig
+}
+
+// defaultConfigFile is the config file the run command reads profiles from,
+// if neither --config nor CONFIG_FILE is set.
+const defaultConfigFile = "redis-purge.toml"
+
+// A configEntry is a key, and its value, in a table of a config file.
+type configEntry struct {
+	Table []string
+	Key   string
+	Value configValue
+	Line  int
+}
+
+// A configValue is a string, or an array of strings; numbers and booleans
+// are kept as the text the environment would have.
+type configValue struct {
+	Text  string
+	List  []string
+	Array bool
+}
+
+func (v configValue) String() string {
+	if v.Array {
+		return strings.Join(v.List, ",")
+	}
+	return v.Text
+}
+
+// loadPurgeConfig reads the config file at path.
+func loadPurgeConfig(path string) (*purgeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	c := &purgeConfig{Path: path, Settings: map[string]string{}, Profiles: map[string]*configProfile{}}
+	for _, entry := range entries {
+		if err = c.add(entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, entry.Line, err)
+		}
+	}
+	for name, profile := range c.Profiles {
+		if _, ok := cliCommands[profile.Command]; !ok {
+			return nil, fmt.Errorf("%s: profile %s has command %#v, not list, delete or count", path, name, profile.Command)
+		}
+	}
+	return c, nil
+}
+
+// add adds entry to the config, or to the profile whose table it's in.
+func (c *purgeConfig) add(entry configEntry) error {
+	table := entry.Table
+	if len(table) == 0 || len(table) == 1 && isConfigSection(table[0]) {
+		return c.set(entry)
+	}
+	if table[0] != "profiles" || len(table) == 1 || len(table) > 3 || len(table) == 3 && !isConfigSection(table[2]) {
+		return fmt.Errorf("unknown table [%s]", strings.Join(table, "."))
+	}
+	profile := c.Profiles[table[1]]
+	if profile == nil {
+		profile = &configProfile{Command: "list", Config: purgeConfig{Settings: map[string]string{}}}
+		c.Profiles[table[1]] = profile
+	}
+	if len(table) == 2 {
+		switch entry.Key {
+		case "command":
+			profile.Command = entry.Value.String()
+			return nil
+		case "description":
+			profile.Description = entry.Value.String()
+			return nil
+		}
+	}
+	return profile.Config.set(entry)
+}
+
+// set sets the setting of entry, which mustn't already be set.
+func (c *purgeConfig) set(entry configEntry) error {
+	if entry.Key == "values" {
+		if !entry.Value.Array {
+			return fmt.Errorf("values must be an array of strings")
+		}
+		if c.HasValues {
+			return fmt.Errorf("values is set twice")
+		}
+		c.Values, c.HasValues = entry.Value.List, true
+		return nil
+	}
+	env, ok := configSetting(entry.Key)
+	if !ok {
+		return fmt.Errorf("unknown setting %#v", entry.Key)
+	}
+	if _, ok := c.Settings[env]; ok {
+		return fmt.Errorf("%s is set twice", entry.Key)
+	}
+	c.Settings[env] = entry.Value.String()
+	return nil
+}
+
+// configSetting returns the environment variable a config file key names.
+func configSetting(key string) (env string, ok bool) {
+	env = strings.ToUpper(strings.Replace(key, "-", "_", -1))
+	for _, setting := range cliSettings {
+		if setting.Env == env {
+			return env, true
+		}
+	}
+	return "", false
+}
+
+// isConfigSection reports whether table is a section of --help, in which a
+// config file may group settings.
+func isConfigSection(table string) bool {
+	for _, setting := range cliSettings {
+		if strings.ToLower(setting.Section) == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Profile returns the settings of the profile called name: the file's,
+// overridden by the profile's own.
+func (c *purgeConfig) Profile(name string) (*purgeConfig, *configProfile, error) {
+	profile := c.Profiles[name]
+	if profile == nil {
+		if len(c.Profiles) == 0 {
+			return nil, nil, fmt.Errorf("%s has no profiles", c.Path)
+		}
+		return nil, nil, fmt.Errorf("%s has no profile %#v: its profiles are %s", c.Path, name, strings.Join(c.ProfileNames(), ", "))
+	}
+	merged := &purgeConfig{
+		Path:      fmt.Sprintf("profile %s of %s", name, c.Path),
+		Settings:  map[string]string{},
+		Values:    c.Values,
+		HasValues: c.HasValues,
+	}
+	for env, value := range c.Settings {
+		merged.Settings[env] = value
+	}
+	for env, value := range profile.Config.Settings {
+		merged.Settings[env] = value
+	}
+	if profile.Config.HasValues {
+		merged.Values, merged.HasValues = profile.Config.Values, true
+	}
+	return merged, profile, nil
+}
+
+// ProfileNames returns the names of the config's profiles, in sorted order.
+func (c *purgeConfig) ProfileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply sets the environment variables of the config's settings, other than
+// those already set, so that flags and the environment take precedence over
+// the file. Apply on a nil purgeConfig does nothing.
+func (c *purgeConfig) Apply() {
+	if c == nil {
+		return
+	}
+	var overridden []string
+	for env, value := range c.Settings {
+		if _, set := os.LookupEnv(env); set {
+			overridden = append(overridden, env)
+		} else {
+			os.Setenv(env, value)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "> read %d settings from %s", len(c.Settings)-len(overridden), c.Path)
+	if len(overridden) > 0 {
+		// Name them, since an overridden safety cap is worth noticing.
+		sort.Strings(overridden)
+		fmt.Fprintf(os.Stderr, "; %s overridden by flags or the environment", strings.Join(overridden, ", "))
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// envPurgeConfig reads the config file at path, or CONFIG_FILE if path is
+// empty, or else defaultPath. It returns nil if there's no config file.
+func envPurgeConfig(path, defaultPath string) *purgeConfig {
+	if path == "" {
+		if path = envDefault("CONFIG_FILE", defaultPath); path == "" {
+			return nil
+		}
+	}
+	config, err := loadPurgeConfig(path)
+	reportError("couldn't read config file", err)
+	return config
+}
+
+// parseConfig parses the subset of TOML config files are written in: tables,
+// bare keys, and strings, decimal integers, booleans and arrays of them.
+func parseConfig(data string) ([]configEntry, error) {
+	p := &configParser{data: data, line: 1}
+	var entries []configEntry
+	var table []string
+	for {
+		p.skipBlank(true)
+		if p.done() {
+			return entries, nil
+		}
+		line := p.line
+		if p.peek() == '[' {
+			var err error
+			if table, err = p.table(); err != nil {
+				return nil, fmt.Errorf("%d: %w", line, err)
+			}
+		} else {
+			key := p.bareKey()
+			if key == "" {
+				return nil, fmt.Errorf("%d: expected a key or [table]", line)
+			}
+			p.skipBlank(false)
+			if p.done() || p.peek() != '=' {
+				return nil, fmt.Errorf("%d: expected = after %s", line, key)
+			}
+			p.pos++
+			p.skipBlank(false)
+			value, err := p.value(true)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s: %w", line, key, err)
+			}
+			entries = append(entries, configEntry{Table: table, Key: key, Value: value, Line: line})
+		}
+		p.skipBlank(false)
+		if !p.done() && p.peek() != '\n' {
+			return nil, fmt.Errorf("%d: unexpected %q", p.line, p.peek())
+		}
+	}
+}
+
+type configParser struct {
+	data string
+	pos  int
+	line int
+}
+
+func (p *configParser) done() bool { return p.pos >= len(p.data) }
+
+func (p *configParser) peek() byte { return p.data[p.pos] }
+
+// skipBlank skips spaces, tabs and comments, and newlines if newlines is set.
+func (p *configParser) skipBlank(newlines bool) {
+	for !p.done() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.done() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *configParser) bareKey() string {
+	start := p.pos
+	for !p.done() && isBareKeyChar(p.peek()) {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// table parses a [table] header into its dotted names.
+func (p *configParser) table() ([]string, error) {
+	p.pos++
+	if !p.done() && p.peek() == '[' {
+		return nil, fmt.Errorf("arrays of tables aren't supported")
+	}
+	var names []string
+	for {
+		p.skipBlank(false)
+		name := p.bareKey()
+		if name == "" {
+			return nil, fmt.Errorf("expected a table name")
+		}
+		names = append(names, name)
+		p.skipBlank(false)
+		if p.done() {
+			return nil, fmt.Errorf("expected ] after table name")
+		}
+		switch p.peek() {
+		case '.':
+			p.pos++
+		case ']':
+			p.pos++
+			return names, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q in table name", p.peek())
+		}
+	}
+}
+
+// value parses a value; arrays, of values other than arrays, are only
+// allowed if array is set.
+func (p *configParser) value(array bool) (configValue, error) {
+	if p.done() || p.peek() == '\n' {
+		return configValue{}, fmt.Errorf("expected a value")
+	}
+	switch c := p.peek(); {
+	case c == '[':
+		if !array {
+			return configValue{}, fmt.Errorf("nested arrays aren't supported")
+		}
+		return p.array()
+	case c == '"' || c == '\'':
+		text, err := p.quoted()
+		return configValue{Text: text}, err
+	}
+	start := p.pos
+	for !p.done() && !strings.ContainsRune(" \t\r\n#,]", rune(p.peek())) {
+		p.pos++
+	}
+	text := p.data[start:p.pos]
+	switch text {
+	case "true":
+		return configValue{Text: "y"}, nil
+	case "false":
+		return configValue{Text: "n"}, nil
+	}
+	// Settings are read as decimal integers, so hex, octal, binary, floats,
+	// inf and nan, which they'd read as something else or not at all, are
+	// refused here.
+	number := strings.Replace(text, "_", "", -1)
+	if _, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return configValue{Text: number}, nil
+	}
+	return configValue{}, fmt.Errorf("bad value %#v: numbers must be decimal integers, and strings quoted", text)
+}
+
+func (p *configParser) array() (configValue, error) {
+	p.pos++
+	value := configValue{Array: true, List: []string{}}
+	for {
+		p.skipBlank(true)
+		if p.done() {
+			return configValue{}, fmt.Errorf("expected ] at end of array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return value, nil
+		}
+		element, err := p.value(false)
+		if err != nil {
+			return configValue{}, err
+		}
+		value.List = append(value.List, element.Text)
+		p.skipBlank(true)
+		if p.done() {
+			return configValue{}, fmt.Errorf("expected ] at end of array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return configValue{}, fmt.Errorf("expected , or ] in array, not %q", p.peek())
+		}
+	}
+}
+
+// quoted parses a basic "string", with escapes, or a literal 'string'.
+func (p *configParser) quoted() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.data[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", fmt.Errorf("multi-line strings aren't supported")
+	}
+	start := p.pos
+	for p.pos++; !p.done() && p.peek() != quote && p.peek() != '\n'; p.pos++ {
+		if quote == '"' && p.peek() == '\\' {
+			p.pos++
+		}
+	}
+	if p.done() || p.peek() != quote {
+		return "", fmt.Errorf("unterminated string")
+	}
+	p.pos++
+	if quote == '\'' {
+		return p.data[start+1 : p.pos-1], nil
+	}
+	text, err := strconv.Unquote(p.data[start:p.pos])
+	if err != nil {
+		return "", fmt.Errorf("bad string %s", p.data[start:p.pos])
+	}
+	return text, nil
+}
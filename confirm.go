@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// deleteConfirmation asks the operator to confirm a delete, once they've
+// seen how many keys it would delete.
+type deleteConfirmation struct {
+	// Sample, if > 0, estimates the keys to delete from Sample random keys
+	// instead of counting them with a full scan.
+	Sample int
+}
+
+// envDeleteConfirmation returns the confirmation configured by
+// CONFIRM_DELETE and CONFIRM_SAMPLE, or nil if deletes aren't confirmed.
+func envDeleteConfirmation() (*deleteConfirmation, error) {
+	switch mode := envDefault("CONFIRM_DELETE", "n"); mode {
+	case "n", "no", "false":
+		return nil, nil
+	case "count":
+		return &deleteConfirmation{}, nil
+	case "sample":
+		return &deleteConfirmation{Sample: envInt("CONFIRM_SAMPLE", 1000)}, nil
+	default:
+		return nil, fmt.Errorf("unknown CONFIRM_DELETE %#v (expected count or sample)", mode)
+	}
+}
+
+// confirmDelete returns nil if a delete of keys matching search may go
+// ahead: either CONFIRM_DELETE is not set, or the operator confirmed the
+// delete after seeing how many keys it would delete.
+func (r redisSearch) confirmDelete(search *searchCondition) error {
+	confirmation, err := envDeleteConfirmation()
+	if err != nil || confirmation == nil {
+		return err
+	}
+	if r.DryRun {
+		fmt.Fprintf(os.Stderr, "> dry run: not asking for confirmation, since nothing will be deleted\n")
+		return nil
+	}
+
+	estimator := r.estimator()
+	var keys, size int64
+	var estimate string
+	if confirmation.Sample > 0 {
+		fmt.Fprintf(os.Stderr, "> estimating keys matching %s from %d random keys\n", search, confirmation.Sample)
+		keys, size, err = estimator.sampleMatchingKeys(search, confirmation.Sample)
+		estimate = "about "
+	} else {
+		fmt.Fprintf(os.Stderr, "> counting keys matching %s\n", search)
+		err = estimator.matchingKeysDo(search, func(key string, keySize int) error {
+			keys++
+			size += int64(keySize)
+			return nil
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't count keys to delete: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "> %s%d keys / %s%d bytes will be deleted from %s\n", estimate, keys, estimate, size, r.String())
+	return confirmation.Confirm(os.Stdin)
+}
+
+// estimator returns a copy of r for passes that only estimate matches, which
+// mustn't count towards the run's own reports, or advance its ledger.
+func (r redisSearch) estimator() redisSearch {
+	estimator := r
+	estimator.Schemas = nil
+	estimator.Sizes = nil
+	estimator.Verifier = nil
+	estimator.Ledger = nil
+	estimator.Checkpoint = nil
+	estimator.Events = nil
+	estimator.Backup = nil
+	// The dashboard would read the keys, such as the answer to the
+	// confirmation prompt, typed after the estimate.
+	estimator.Dashboard = nil
+	// Estimates only sample keys, so they don't run hooks for them.
+	estimator.Hooks = nil
+	estimator.Protected = r.Protected.quiet()
+	return estimator
+}
+
+// sampleMatchingKeys estimates the number and total size of keys matching
+// search from samples random keys.
+func (r redisSearch) sampleMatchingKeys(search *searchCondition, samples int) (keys, size int64, err error) {
+	totalKeys, err := r.countKeys()
+	if err != nil || totalKeys == 0 {
+		return 0, 0, err
+	}
+	reader := r.valueReader(search)
+	var matched, matchedSize int64
+	for i := 0; i < samples; i++ {
+		key, err := r.reader().RandomKey(context.Background()).Result()
+		if err != nil {
+			return 0, 0, err
+		}
+		if r.isInternalKey(key) || r.ExcludeKeys.Matches(key) ||
+			(search.KeyPattern != "" && !keyPatternMatches(search.KeyPattern, key)) {
+			continue
+		}
+		read := reader.Read(context.Background(), key)
+		if read.Err != nil || !read.Matched || r.Protected.Protects(key, read.Size, "") {
+			continue
+		}
+		matched++
+		matchedSize += int64(read.Size)
+	}
+	scale := float64(totalKeys) / float64(samples)
+	return int64(float64(matched) * scale), int64(float64(matchedSize) * scale), nil
+}
+
+// Confirm asks the operator to type yes on in to go ahead with the delete.
+func (c *deleteConfirmation) Confirm(in io.Reader) error {
+	fmt.Fprintf(os.Stderr, "> type yes to delete them: ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return fmt.Errorf("couldn't read confirmation: %w", err)
+	}
+	if answer = strings.TrimSpace(answer); answer != "yes" {
+		return fmt.Errorf("expected yes, got %#v", answer)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// dashboardSamples is how many of the latest matches and errors a
+// runDashboard shows.
+const dashboardSamples = 5
+
+// dashboardInterval is how often a runDashboard is redrawn.
+const dashboardInterval = 250 * time.Millisecond
+
+// runDashboard is a full-screen terminal view of a run in progress, for
+// operators babysitting a large purge: how far the scan has got and how fast,
+// the latest matches and errors, and keys to pause, resume or abort it.
+type runDashboard struct {
+	// Target describes the server the run is on.
+	Target string
+
+	mu       sync.Mutex
+	matches  []string
+	errors   []string
+	paused   bool
+	running  bool
+	reading  bool
+	done     chan struct{}
+	finished chan struct{}
+	restore  func()
+}
+
+// envRunDashboard returns the dashboard configured by TUI=y, or nil if it's
+// not. The dashboard needs stderr, which it's drawn on, and stdin, which its
+// keys are read from, to be a terminal.
+func envRunDashboard(target string) (*runDashboard, error) {
+	if !envBool("TUI", "false") {
+		return nil, nil
+	}
+	if !isTerminal(os.Stderr) || !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("TUI=y needs stdin and stderr to be a terminal")
+	}
+	return &runDashboard{Target: target}, nil
+}
+
+// Subscribe records the latest matches and errors of the run. Subscribe on a
+// nil runDashboard does nothing.
+func (d *runDashboard) Subscribe(events *purgeEvents) {
+	if d == nil {
+		return
+	}
+	events.OnMatch(func(record purge.Record) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.matches = appendSample(d.matches, formatRecord(record, false))
+	})
+	events.OnError(func(key string, err error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.errors = appendSample(d.errors, fmt.Sprintf("%s: %s", key, err))
+	})
+}
+
+// appendSample appends sample to samples, keeping only the latest.
+func appendSample(samples []string, sample string) []string {
+	samples = append(samples, sample)
+	if len(samples) > dashboardSamples {
+		samples = samples[len(samples)-dashboardSamples:]
+	}
+	return samples
+}
+
+// Start takes over the terminal to draw the dashboard, until Stop. Start on a
+// nil runDashboard does nothing.
+func (d *runDashboard) Start() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return
+	}
+	restore, err := setCbreak(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't read dashboard keys as they're pressed (%s): press Enter after each\n", err)
+		restore = func() {}
+	}
+	d.restore = restore
+	if !d.reading {
+		// In case the run exits before Stop, leave the terminal as it was.
+		atExit(d.Stop)
+		d.reading = true
+		go d.readKeys()
+	}
+	d.running, d.paused = true, false
+	d.done = make(chan struct{})
+	d.finished = make(chan struct{})
+	// \033[?1049h switches to the alternate screen, and \033[?25l hides the
+	// cursor, so that the terminal's contents are back when the run ends.
+	fmt.Fprint(os.Stderr, "\033[?1049h\033[?25l")
+	go d.draw(d.done, d.finished)
+}
+
+// Stop gives the terminal back. Stop on a nil runDashboard, or one that isn't
+// running, does nothing.
+func (d *runDashboard) Stop() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.running {
+		d.mu.Unlock()
+		return
+	}
+	d.running, d.paused = false, false
+	close(d.done)
+	d.mu.Unlock()
+	<-d.finished
+	d.restore()
+	fmt.Fprint(os.Stderr, "\033[?25h\033[?1049l")
+}
+
+// Paused reports whether the operator has paused the run.
+func (d *runDashboard) Paused() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// WaitWhilePaused waits until the run is resumed or interrupted, recording
+// progress with watchdog meanwhile, since a paused run isn't stalled.
+// WaitWhilePaused on a nil runDashboard returns at once.
+func (d *runDashboard) WaitWhilePaused(watchdog *scanWatchdog) {
+	for d.Paused() && !isInterrupted() {
+		watchdog.Progress()
+		sleep(dashboardInterval)
+	}
+}
+
+// readKeys acts on the keys pressed while the dashboard is running: p pauses
+// or resumes the run, and a or q aborts it, as an interrupt does. Keys pressed
+// between scans are ignored.
+func (d *runDashboard) readKeys() {
+	key := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(key); err != nil || n == 0 {
+			return
+		}
+		d.mu.Lock()
+		switch {
+		case !d.running:
+		case key[0] == 'p' || key[0] == 'P' || key[0] == ' ':
+			d.paused = !d.paused
+		case key[0] == 'a' || key[0] == 'A' || key[0] == 'q' || key[0] == 'Q':
+			d.paused = false
+			interrupt()
+		}
+		d.mu.Unlock()
+	}
+}
+
+// draw redraws the dashboard every dashboardInterval until done is closed,
+// then closes finished.
+func (d *runDashboard) draw(done, finished chan struct{}) {
+	defer close(finished)
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for {
+		d.render()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// render draws the dashboard from the top of the screen.
+func (d *runDashboard) render() {
+	stats := liveStats.Snapshot()
+	width := terminalWidth()
+	d.mu.Lock()
+	status := "running"
+	switch {
+	case isInterrupted():
+		status = "stopping"
+	case d.paused:
+		status = "PAUSED"
+	}
+	matches := append([]string(nil), d.matches...)
+	errs := append([]string(nil), d.errors...)
+	d.mu.Unlock()
+
+	var keyRate float64
+	if stats.Elapsed > 0 {
+		keyRate = float64(stats.Scanned) / stats.Elapsed.Seconds()
+	}
+	lines := []string{
+		paint(os.Stderr, colorBold, fitLine([]string{"redis-purge", d.Target, status}, width)),
+		"",
+		fitLine([]string{
+			fmt.Sprintf("Scanned %d of %d keys (%.2f%%)", stats.Scanned, stats.Total, percentage(stats.Scanned, stats.Total)),
+			"eta " + estimateRemaining(stats.Scanned, stats.Total, keyRate),
+			fmt.Sprintf("%.1f keys/s", keyRate),
+			"elapsed " + stats.Elapsed.Round(time.Second).String(),
+		}, width),
+		progressBar(stats.Scanned, stats.Total, width-1),
+		fitLine([]string{
+			fmt.Sprintf("Matched %d keys (%d bytes)", stats.Matched, stats.MatchedBytes),
+			fmt.Sprintf("deleted %d", stats.Deleted),
+			fmt.Sprintf("errors %d", stats.Errors),
+		}, width),
+		"",
+		paint(os.Stderr, colorBold, "Latest matches"),
+	}
+	lines = append(lines, samples(matches, width)...)
+	lines = append(lines, "", paint(os.Stderr, colorBold, "Latest errors"))
+	lines = append(lines, samples(errs, width)...)
+	lines = append(lines, "", fitLine([]string{"p: pause/resume", "a or q: abort"}, width))
+
+	// \033[H moves to the top left, \033[K clears the rest of each line and
+	// \033[J the rest of the screen.
+	var screen strings.Builder
+	screen.WriteString("\033[H")
+	for _, line := range lines {
+		screen.WriteString(line + "\033[K\r\n")
+	}
+	screen.WriteString("\033[J")
+	fmt.Fprint(os.Stderr, screen.String())
+}
+
+// samples returns the lines of a list of samples, fitted to width.
+func samples(list []string, width int) []string {
+	if len(list) == 0 {
+		return []string{"  (none yet)"}
+	}
+	lines := make([]string, len(list))
+	for i, sample := range list {
+		lines[i] = fitLine([]string{"  " + strings.Replace(sample, "\n", " ", -1)}, width)
+	}
+	return lines
+}
+
+// progressBar returns a bar of width columns, filled in proportion to num of
+// den.
+func progressBar(num, den int64, width int) string {
+	if width < 3 {
+		return ""
+	}
+	inner := width - 2
+	filled := 0
+	if den > 0 {
+		filled = int(int64(inner) * num / den)
+	}
+	if filled > inner {
+		filled = inner
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", inner-filled) + "]"
+}
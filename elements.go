@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// elementRemoveCommands are the commands that remove elements from each
+// collection access mode that supports DELETE_ELEMENTS.
+var elementRemoveCommands = map[valueAccessMode]string{
+	valueAccessList: "lrem",
+	valueAccessSet:  "srem",
+	valueAccessZSet: "zrem",
+}
+
+// matchingElements returns the distinct elements of the collection at key
+// that match s.
+func (r redisSearch) matchingElements(key string, s *searchCondition) ([]string, error) {
+	elements, err := s.AccessMode.Elements(context.Background(), r.Client, key)
+	if err != nil {
+		return nil, err
+	}
+	valueMatches := s.Matcher()
+	var matching []string
+	seen := map[string]bool{}
+	for _, element := range elements {
+		if valueMatches(element) && !seen[string(element)] {
+			seen[string(element)] = true
+			matching = append(matching, string(element))
+		}
+	}
+	return matching, nil
+}
+
+// deleteElements removes the elements of key that match DeleteElements,
+// leaving the rest of the collection. Redis deletes the key if no elements
+// are left.
+func (r redisSearch) deleteElements(key string) error {
+	elements, err := r.matchingElements(key, r.DeleteElements)
+	if err != nil || len(elements) == 0 {
+		return err
+	}
+	ctx := context.Background()
+	for start := 0; start < len(elements); start += collectionPageSize {
+		end := start + collectionPageSize
+		if end > len(elements) {
+			end = len(elements)
+		}
+		page := make([]interface{}, 0, end-start)
+		for _, element := range elements[start:end] {
+			page = append(page, element)
+		}
+
+		switch r.DeleteElements.AccessMode {
+		case valueAccessList:
+			// LREM removes one value at a time; count 0 removes every copy.
+			pipe := r.Client.Pipeline()
+			for _, element := range elements[start:end] {
+				pipe.LRem(ctx, key, 0, element)
+			}
+			_, err = pipe.Exec(ctx)
+		case valueAccessSet:
+			err = r.Client.SRem(ctx, key, page...).Err()
+		case valueAccessZSet:
+			err = r.Client.ZRem(ctx, key, page...).Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envDeleteElements sets r.DeleteElements to search if DELETE_ELEMENTS is
+// set, so that only the matching elements of collections are removed.
+func (r *redisSearch) envDeleteElements(search *searchCondition) error {
+	if !envBool("DELETE_ELEMENTS", "false") {
+		return nil
+	}
+	if r.ExpireSeconds > 0 || r.QuarantinePrefix != "" || len(r.DeleteFields) > 0 {
+		return fmt.Errorf("DELETE_ELEMENTS can't be used with EXPIRE_SECONDS, QUARANTINE_PREFIX or DELETE_FIELDS")
+	}
+	command, ok := elementRemoveCommands[search.AccessMode]
+	if !search.MatchElements || !ok {
+		return fmt.Errorf("DELETE_ELEMENTS requires MATCH_ELEMENTS=y and ACCESS_MODE=list, set or zset")
+	}
+	r.DeleteElements = search
+	if r.Output != nil {
+		r.Output.DeleteAction = command
+	}
+	if r.Verifier != nil {
+		r.Verifier.Elements = search
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// readOptions returns how the purge engine reads values for r.
+func (r redisSearch) readOptions() purge.ReadOptions {
+	return purge.ReadOptions{
+		Concurrency:     r.Concurrency,
+		HashScan:        r.HashScan,
+		StringChunkSize: r.StringChunkSize,
+		MemorySizes:     r.MemorySizes,
+		// SCHEMA_REPORT needs the values of matching keys, and VERIFY_SAMPLE
+		// those of kept keys too.
+		KeepValues:          r.Schemas != nil,
+		KeepUnmatchedValues: r.Verifier != nil,
+	}
+}
+
+// valueReader returns a reader of the values of keys matching search, from
+// the replica if there is one.
+func (r redisSearch) valueReader(search *searchCondition) *purge.Reader {
+	return purge.NewReader(r.reader(), search, r.readOptions())
+}
+
+// purger returns the purge engine for a scan of r, with the hooks of run and
+// then of hooks.
+func (r redisSearch) purger(run *scanRun, hooks ...purge.Hooks) *purge.Purger {
+	return &purge.Purger{
+		Client:      r.Client,
+		ReadClient:  r.Replica,
+		StartCursor: run.cursor,
+		ScanType:    r.ScanType,
+		Unlink:      r.Unlink,
+		DryRun:      r.DryRun,
+		ReadOptions: r.readOptions(),
+		Hooks:       purge.ChainHooks(append([]purge.Hooks{run.hooks()}, hooks...)...),
+	}
+}
+
+// A scanRun is the command's side of one scan of the keyspace by the purge
+// engine: the progress, tracing, exclusions, watchdog, dashboard, ledger and
+// checkpoint of the run, wired into the scan with its hooks.
+type scanRun struct {
+	r         redisSearch
+	totalKeys int64
+	progress  *scanProgress
+
+	// cursor is where the SCAN step being visited was scanned from, and so
+	// where an interrupted scan resumes.
+	cursor uint64
+	// scanned counts the keys SCAN returned, and visited those visited so
+	// far, of which matched matched.
+	scanned, visited, matched, excluded int64
+
+	stepStarted     time.Time
+	stepKeys        int64
+	stepMatchedFrom int64
+	// batchSpan is the span of the SCAN step, and span that of the SCAN,
+	// fetch or visit within it in progress.
+	batchSpan, span *traceSpan
+}
+
+// startScan starts a scan of the keyspace, at the cursor the ledger,
+// checkpoint or START_CURSOR says to resume at. The scan must be ended with
+// end.
+func (r redisSearch) startScan() (*scanRun, error) {
+	totalKeys, err := r.countKeys()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count keys: %w", err)
+	}
+	s := &scanRun{r: r, totalKeys: totalKeys, progress: newScanProgress(totalKeys)}
+
+	r.Watchdog.Start()
+	s.cursor = r.Ledger.Start(totalKeys)
+	switch {
+	case r.Checkpoint != nil:
+		if s.cursor, err = r.Checkpoint.Start(); err != nil {
+			r.Watchdog.Stop()
+			return nil, err
+		}
+	case r.Ledger == nil && r.StartCursor != 0:
+		s.cursor = r.StartCursor
+		fmt.Fprintf(os.Stderr, "> resuming scan at cursor %d (START_CURSOR)\n", s.cursor)
+	}
+
+	atomic.AddInt32(&scansRunning, 1)
+	if !r.ExcludeKeys.Empty() {
+		fmt.Fprintf(os.Stderr, "> excluding keys matching %s\n", r.ExcludeKeys)
+	}
+	r.Dashboard.Start()
+	return s, nil
+}
+
+// hooks returns the purge hooks that follow the scan.
+func (s *scanRun) hooks() purge.Hooks {
+	return purge.Hooks{
+		PreScan:  s.preScan,
+		PostScan: s.postScan,
+		PreRead:  s.preRead,
+		PreVisit: s.preVisit,
+		PostStep: s.postStep,
+		PostRead: func(ctx context.Context, read purge.ReadResult) error {
+			return s.visit()
+		},
+	}
+}
+
+func (s *scanRun) preScan(ctx context.Context, step *purge.ScanStep) error {
+	if isInterrupted() {
+		return errInterrupted
+	}
+	r := s.r
+	s.stepStarted = time.Now()
+	s.cursor = step.Cursor
+	step.Count = int64(r.scanCount())
+	s.batchSpan = r.Tracer.StartBatch(step.Cursor)
+	s.span = r.Tracer.StartCommand(s.batchSpan, "SCAN", attr("redis.scan.count", r.scanCount()))
+	return nil
+}
+
+// postScan drops internal and excluded keys from the step.
+func (s *scanRun) postScan(ctx context.Context, step *purge.ScanStep) error {
+	r := s.r
+	liveStats.Scanning(step.NextCursor, s.totalKeys)
+	s.span.Set("redis.scan.keys", len(step.Keys))
+	s.endSpan(nil)
+	r.Watchdog.Progress()
+	if r.Debug {
+		fmt.Fprintf(os.Stderr, "> scan cursor: %d, key count: %d\n", step.NextCursor, len(step.Keys))
+	}
+
+	s.stepKeys = int64(len(step.Keys))
+	if r.Progress {
+		s.progress.Report(s.scanned, s.stepKeys, s.matched)
+	}
+	s.visited = s.scanned
+	s.scanned += s.stepKeys
+	s.stepMatchedFrom = s.matched
+
+	keys := step.Keys[:0:0]
+	for _, key := range step.Keys {
+		if r.isInternalKey(key) {
+			continue
+		}
+		r.Events.KeyScanned(key)
+		if r.ExcludeKeys.Matches(key) {
+			s.excluded++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	step.Keys = keys
+	return nil
+}
+
+func (s *scanRun) preRead(ctx context.Context, step *purge.ScanStep) error {
+	s.span = s.r.Tracer.Start(s.batchSpan, "fetch values", attr("purge.keys", len(step.Keys)))
+	return nil
+}
+
+func (s *scanRun) preVisit(ctx context.Context, step *purge.ScanStep) error {
+	s.endSpan(nil)
+	if step.NextCursor != 0 {
+		s.r.Batches.Observe(time.Since(s.stepStarted))
+	}
+	s.span = s.r.Tracer.Start(s.batchSpan, "visit keys", attr("purge.keys", len(step.Keys)))
+	return nil
+}
+
+// postStep records a step whose keys have all been visited in the ledger and
+// checkpoint, and stops the scan once the ledger's session time is up.
+func (s *scanRun) postStep(ctx context.Context, step *purge.ScanStep) error {
+	r := s.r
+	stepMatched := s.matched - s.stepMatchedFrom
+	s.span.Set("purge.matched_keys", stepMatched)
+	s.endSpan(nil)
+	s.batchSpan.Set("redis.scan.next_cursor", step.NextCursor)
+	s.batchSpan.Set("purge.scanned_keys", s.stepKeys)
+	s.batchSpan.Set("purge.matched_keys", stepMatched)
+
+	r.Events.Progress(s.scanned, s.totalKeys, s.matched)
+	s.batchSpan.End(nil)
+	s.batchSpan = nil
+
+	timeUp, err := r.Ledger.Advance(step.NextCursor, s.stepKeys)
+	if err != nil {
+		return err
+	}
+	if err = r.Checkpoint.Advance(step.NextCursor, s.stepKeys, stepMatched); err != nil {
+		return err
+	}
+	if timeUp {
+		fmt.Fprintf(os.Stderr, "> session time is up at cursor %d; run again to carry on\n", step.NextCursor)
+		return purge.ErrStop
+	}
+	return nil
+}
+
+// visit is called as each key is visited, before it's acted on: it waits
+// while the dashboard pauses the run, and returns errInterrupted once the
+// run is interrupted.
+func (s *scanRun) visit() error {
+	r := s.r
+	r.Dashboard.WaitWhilePaused(r.Watchdog)
+	if isInterrupted() {
+		return errInterrupted
+	}
+	s.visited++
+	r.Watchdog.Progress()
+	if r.Progress {
+		s.progress.Visited(s.visited, s.matched)
+	}
+	return nil
+}
+
+// acted records that a visited key was acted on, and whether it matched.
+func (s *scanRun) acted(key string, matched bool) {
+	r := s.r
+	r.Watchdog.Progress()
+	if !matched {
+		return
+	}
+	s.matched++
+	r.Ledger.Match(key)
+	if r.Progress {
+		s.progress.Visited(s.visited, s.matched)
+	}
+}
+
+// endSpan ends the SCAN, fetch or visit span in progress, if any.
+func (s *scanRun) endSpan(err error) {
+	s.span.End(err)
+	s.span = nil
+}
+
+// end ends the scan with err, the error that ended it, if any, which it
+// returns. An interrupted scan reports where to resume, and a failed one
+// saves its checkpoint.
+func (s *scanRun) end(err error) error {
+	r := s.r
+	if err != nil {
+		s.endSpan(err)
+		s.batchSpan.End(err)
+	}
+	switch {
+	case errors.Is(err, errInterrupted):
+		s.interrupted()
+	case err == nil && r.Progress:
+		s.progress.Finish(s.scanned, s.matched)
+	}
+
+	r.Dashboard.Stop()
+	if !r.ExcludeKeys.Empty() {
+		fmt.Fprintf(os.Stderr, "> skipped %d keys matching %s\n", s.excluded, r.ExcludeKeys)
+	}
+	if err != nil {
+		if saveErr := r.Checkpoint.Save(s.cursor, err); saveErr != nil {
+			fmt.Fprintf(os.Stderr, "> %s\n", saveErr)
+		}
+	}
+	atomic.AddInt32(&scansRunning, -1)
+	r.Watchdog.Stop()
+	return err
+}
+
+// interrupted reports where an interrupted scan stopped, and how to resume
+// it.
+func (s *scanRun) interrupted() {
+	r := s.r
+	r.Dashboard.Stop()
+	if r.Progress {
+		s.progress.Finish(s.scanned, s.matched)
+	}
+	resume := fmt.Sprintf("START_CURSOR=%d", s.cursor)
+	if r.Ledger != nil {
+		resume = "the same LEDGER_FILE"
+	} else if r.Checkpoint != nil {
+		resume = "--resume and the same " + r.Checkpoint.Setting()
+	}
+	fmt.Fprintf(os.Stderr, "> interrupted at cursor %d after scanning %d of %d keys, %d matched; resume with %s\n",
+		s.cursor, s.scanned, s.totalKeys, s.matched, resume)
+}
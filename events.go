@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// purgeEvents is the event bus of a run: features that observe the run, such
+// as output sinks and the verifier, register callbacks for its events rather
+// than being called from the scan and delete loops directly. Events on a nil
+// purgeEvents go nowhere.
+type purgeEvents struct {
+	// Describe, if set, looks up the type and TTL of every match before it
+	// is published.
+	Describe func(key string) (keyType string, ttl int64, err error)
+
+	keyScanned []func(key string)
+	match      []func(record purge.Record)
+	deleted    []func(key string, size int)
+	errors     []func(key string, err error)
+	progress   []func(visited, total, matched int64)
+}
+
+// OnKeyScanned registers fn to be called with every key a scan returns,
+// other than the run's internal keys.
+func (e *purgeEvents) OnKeyScanned(fn func(key string)) {
+	e.keyScanned = append(e.keyScanned, fn)
+}
+
+// OnMatch registers fn to be called with every key the run lists or acts on.
+func (e *purgeEvents) OnMatch(fn func(record purge.Record)) {
+	e.match = append(e.match, fn)
+}
+
+// OnDelete registers fn to be called with every key the run deletes (or
+// expires, quarantines, or deletes fields or elements of).
+func (e *purgeEvents) OnDelete(fn func(key string, size int)) {
+	e.deleted = append(e.deleted, fn)
+}
+
+// OnError registers fn to be called with every key that couldn't be read or
+// deleted, and why.
+func (e *purgeEvents) OnError(fn func(key string, err error)) {
+	e.errors = append(e.errors, fn)
+}
+
+// OnProgress registers fn to be called after every SCAN batch, with the keys
+// visited so far, the total keys in the keyspace, and the keys matched so
+// far.
+func (e *purgeEvents) OnProgress(fn func(visited, total, matched int64)) {
+	e.progress = append(e.progress, fn)
+}
+
+// KeyScanned publishes a scanned key.
+func (e *purgeEvents) KeyScanned(key string) {
+	if e == nil {
+		return
+	}
+	for _, fn := range e.keyScanned {
+		fn(key)
+	}
+}
+
+// Match publishes a matched key.
+func (e *purgeEvents) Match(record purge.Record) {
+	if e == nil {
+		return
+	}
+	if e.Describe != nil {
+		keyType, ttl, err := e.Describe(record.Key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "> couldn't look up type and TTL of %#v: %s\n", record.Key, err)
+		} else {
+			record.Type, record.KeyTTL = keyType, &ttl
+		}
+	}
+	for _, fn := range e.match {
+		fn(record)
+	}
+}
+
+// Deleted publishes a deleted key.
+func (e *purgeEvents) Deleted(key string, size int) {
+	if e == nil {
+		return
+	}
+	for _, fn := range e.deleted {
+		fn(key, size)
+	}
+}
+
+// Error publishes a key that couldn't be read or deleted.
+func (e *purgeEvents) Error(key string, err error) {
+	if e == nil {
+		return
+	}
+	for _, fn := range e.errors {
+		fn(key, err)
+	}
+}
+
+// Progress publishes the progress of a scan.
+func (e *purgeEvents) Progress(visited, total, matched int64) {
+	if e == nil {
+		return
+	}
+	for _, fn := range e.progress {
+		fn(visited, total, matched)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// evictionCandidate is a key that could be deleted to free memory, with the
+// signals used to score it.
+type evictionCandidate struct {
+	Key    string
+	Size   int64
+	TTL    time.Duration
+	Idle   time.Duration
+	Freq   int64
+	UseLFU bool
+	Score  float64
+}
+
+func (e *evictionCandidate) String() string {
+	ttl := "none"
+	if e.TTL >= 0 {
+		ttl = e.TTL.Round(time.Second).String()
+	}
+	usage := fmt.Sprintf("idle = %s", e.Idle)
+	if e.UseLFU {
+		usage = fmt.Sprintf("freq = %d", e.Freq)
+	}
+	return fmt.Sprintf("%s (size = %d, %s, ttl = %s, score = %.3f)", e.Key, e.Size, usage, ttl, e.Score)
+}
+
+// evictabilityScore combines how cold a key is, how long it will live, and
+// how much memory it uses into a score between 0 and 1; higher scores are
+// better candidates for deletion.
+//
+// Coldness counts for half the score: the idle time (OBJECT IDLETIME), or the
+// inverse of the LFU frequency counter (OBJECT FREQ) when the server uses an
+// LFU eviction policy. Keys without a TTL, or with a long TTL, score higher
+// than keys that will soon expire anyway (20%), and larger keys score higher
+// than small ones (30%).
+func (e *evictionCandidate) evictabilityScore() float64 {
+	var coldness float64
+	if e.UseLFU {
+		coldness = 1.0 / (1.0 + float64(e.Freq))
+	} else {
+		idle := e.Idle.Seconds()
+		coldness = idle / (idle + 3600)
+	}
+
+	longevity := 1.0
+	if e.TTL >= 0 {
+		ttl := e.TTL.Seconds()
+		longevity = ttl / (ttl + 3600)
+	}
+
+	size := float64(e.Size)
+	bulk := size / (size + 1<<20)
+
+	return 0.5*coldness + 0.2*longevity + 0.3*bulk
+}
+
+// evictionAssistant finds the keys that would best free FreeTargetBytes.
+type evictionAssistant struct {
+	FreeTargetBytes int64
+
+	// Oversample is how many times FreeTargetBytes of candidates to collect
+	// before choosing the best of them and ending the scan.
+	Oversample int64
+
+	useLFU bool
+}
+
+// listEvictionCandidates scans keys matching search's key pattern, scoring
+// each for evictability, until it has collected Oversample times the free
+// target in candidates (or run out of keys), and then lists the
+// highest-scoring candidates that together free at least the target.
+func (r redisSearch) listEvictionCandidates(search *searchCondition, assistant *evictionAssistant) error {
+	fmt.Fprintf(os.Stderr, "> finding keys on %s to free %d bytes\n", r.String(), assistant.FreeTargetBytes)
+
+	var candidates []*evictionCandidate
+	var candidateBytes int64
+	collectBytes := assistant.FreeTargetBytes * assistant.Oversample
+
+	err := r.scanKeysDo(search.KeyPattern, "", func(key string) (bool, error) {
+		candidate, err := r.evictionCandidate(key, assistant)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "> couldn't score %#v (%s), skipping\n", key, err)
+			return false, nil
+		}
+		if candidate == nil {
+			return false, nil
+		}
+		candidates = append(candidates, candidate)
+		candidateBytes += candidate.Size
+		if candidateBytes >= collectBytes {
+			return true, errStopScan
+		}
+		return true, nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	var selectedKeys, selectedBytes int64
+	for _, candidate := range candidates {
+		if selectedBytes >= assistant.FreeTargetBytes {
+			break
+		}
+		candidate.Key = r.KeyDisplay.Format(candidate.Key)
+		fmt.Println(candidate)
+		selectedKeys++
+		selectedBytes += candidate.Size
+	}
+
+	fmt.Fprintf(os.Stderr, "> selected %d of %d scored keys, freeing about %d of %d target bytes\n",
+		selectedKeys, len(candidates), selectedBytes, assistant.FreeTargetBytes)
+	if selectedBytes < assistant.FreeTargetBytes {
+		fmt.Fprintf(os.Stderr, "> warning: not enough keys to meet the free target\n")
+	}
+	return nil
+}
+
+// evictionCandidate gathers the eviction signals for key, returning nil if
+// the key has disappeared.
+func (r redisSearch) evictionCandidate(key string, assistant *evictionAssistant) (*evictionCandidate, error) {
+	ctx := context.Background()
+	size, err := r.Client.MemoryUsage(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("MEMORY USAGE: %w", err)
+	}
+	ttl, err := r.Client.PTTL(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("PTTL: %w", err)
+	}
+	if ttl == -2 {
+		return nil, nil
+	}
+
+	candidate := &evictionCandidate{Key: key, Size: size, TTL: ttl}
+	if !assistant.useLFU {
+		candidate.Idle, err = r.Client.ObjectIdleTime(ctx, key).Result()
+		// Redis refuses OBJECT IDLETIME under an LFU maxmemory-policy, so
+		// switch to OBJECT FREQ for the rest of the run.
+		if err != nil && strings.Contains(strings.ToUpper(err.Error()), "LFU") {
+			assistant.useLFU = true
+		} else if err != nil {
+			return nil, fmt.Errorf("OBJECT IDLETIME: %w", err)
+		}
+	}
+	if assistant.useLFU {
+		candidate.UseLFU = true
+		candidate.Freq, err = r.Client.Do(ctx, "object", "freq", key).Int64()
+		if err != nil {
+			return nil, fmt.Errorf("OBJECT FREQ: %w", err)
+		}
+	}
+	candidate.Score = candidate.evictabilityScore()
+	return candidate, nil
+}
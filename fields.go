@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// matchedFields returns the hash fields that a match of s is confined to,
+// which can be deleted instead of the whole key: HASH_FIELD, or else the
+// fields compared by HASH_MATCH if there's no other search.
+func matchedFields(s *searchCondition) ([]string, error) {
+	if s.AccessMode != valueAccessHash {
+		return nil, fmt.Errorf("DELETE_FIELDS requires ACCESS_MODE=hash")
+	}
+	if s.HashField != "" {
+		return []string{s.HashField}, nil
+	}
+	if len(s.HashMatch) == 0 || s.ReadsWholeValue() {
+		return nil, fmt.Errorf("DELETE_FIELDS requires HASH_FIELD, or HASH_MATCH without search values or size limits")
+	}
+	var fields []string
+	seen := map[string]bool{}
+	for _, condition := range s.HashMatch {
+		if !seen[condition.Field] {
+			seen[condition.Field] = true
+			fields = append(fields, condition.Field)
+		}
+	}
+	return fields, nil
+}
+
+// deleteFields HDELs DeleteFields from key, leaving the rest of the hash.
+func (r redisSearch) deleteFields(key string) error {
+	return r.Client.HDel(context.Background(), key, r.DeleteFields...).Err()
+}
+
+// envDeleteFields sets r.DeleteFields to the fields that matches of search
+// are confined to, if DELETE_FIELDS is set.
+func (r *redisSearch) envDeleteFields(search *searchCondition) error {
+	if !envBool("DELETE_FIELDS", "false") {
+		return nil
+	}
+	if r.ExpireSeconds > 0 || r.QuarantinePrefix != "" {
+		return fmt.Errorf("DELETE_FIELDS can't be used with EXPIRE_SECONDS or QUARANTINE_PREFIX")
+	}
+	fields, err := matchedFields(search)
+	if err != nil {
+		return err
+	}
+	r.DeleteFields = fields
+	if r.Output != nil {
+		r.Output.DeleteAction, r.Output.DeleteFields = "hdel", fields
+	}
+	if r.Verifier != nil {
+		r.Verifier.Fields = fields
+	}
+	return nil
+}
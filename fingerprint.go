@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fingerprintVersion is the format version of keyFingerprint strings, so
+// that fingerprints saved by older versions can still be compared.
+const fingerprintVersion = 1
+
+// A keyFingerprint summarizes a set of matching keys and their sizes in a
+// few numbers, so that runs can cheaply tell whether the set has changed.
+// The hash is a sum of per-key hashes, so it doesn't depend on the order in
+// which SCAN returns keys.
+type keyFingerprint struct {
+	Count int64
+	Size  int64
+	Hash  uint64
+}
+
+// Add adds a matching key of size bytes to the fingerprint.
+func (f *keyFingerprint) Add(key string, size int) {
+	keyHash := fnv.New64a()
+	fmt.Fprintf(keyHash, "%s\x00%d", key, size)
+	f.Count++
+	f.Size += int64(size)
+	f.Hash += keyHash.Sum64()
+}
+
+func (f keyFingerprint) String() string {
+	return fmt.Sprintf("v%d:%d:%d:%016x", fingerprintVersion, f.Count, f.Size, f.Hash)
+}
+
+// parseKeyFingerprint parses a fingerprint printed by keyFingerprint.String.
+func parseKeyFingerprint(s string) (keyFingerprint, error) {
+	var f keyFingerprint
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 4 || parts[0] != fmt.Sprintf("v%d", fingerprintVersion) {
+		return f, fmt.Errorf("bad fingerprint %#v: expected v%d:count:size:hash", s, fingerprintVersion)
+	}
+	var err error
+	if f.Count, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return f, fmt.Errorf("bad fingerprint count %#v: %w", parts[1], err)
+	}
+	if f.Size, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return f, fmt.Errorf("bad fingerprint size %#v: %w", parts[2], err)
+	}
+	if f.Hash, err = strconv.ParseUint(parts[3], 16, 64); err != nil {
+		return f, fmt.Errorf("bad fingerprint hash %#v: %w", parts[3], err)
+	}
+	return f, nil
+}
+
+// fingerprintMatchingKeys prints the fingerprint of the keys matching
+// search, without listing them. If previous is not empty, it's compared
+// with the new fingerprint, and changed reports whether they differ.
+func (r redisSearch) fingerprintMatchingKeys(search *searchCondition, previous string) (changed bool, err error) {
+	var previousFingerprint keyFingerprint
+	if previous != "" {
+		if previousFingerprint, err = parseKeyFingerprint(previous); err != nil {
+			return false, err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "> fingerprinting keys on %s with value matching %s\n", r.String(), search)
+	var fingerprint keyFingerprint
+	err = r.matchingKeysDo(search, func(key string, size int) error {
+		fingerprint.Add(key, size)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Println(fingerprint)
+	fmt.Fprintf(os.Stderr, "> %d keys (total size: %d) matching %s\n", fingerprint.Count, fingerprint.Size, search)
+	if previous == "" {
+		return false, nil
+	}
+	if fingerprint != previousFingerprint {
+		fmt.Fprintf(os.Stderr, "> matching keys changed since fingerprint %s (was %d keys, total size: %d)\n",
+			previousFingerprint, previousFingerprint.Count, previousFingerprint.Size)
+		return true, nil
+	}
+	fmt.Fprintf(os.Stderr, "> matching keys unchanged since the previous fingerprint\n")
+	return false, nil
+}
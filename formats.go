@@ -0,0 +1,14 @@
+package main
+
+import "fmt"
+
+// checkFormatVersion checks that version, the format version of what, is one
+// this build reads. Every version from 1 up to current is read, earlier ones
+// being upgraded as they're read, so that a purge started by one release can
+// be resumed or restored by a later one.
+func checkFormatVersion(what string, version, current int) error {
+	if version < 1 || version > current {
+		return fmt.Errorf("%s has version %d, but this build of redis-purge reads versions up to %d", what, version, current)
+	}
+	return nil
+}
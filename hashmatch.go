@@ -0,0 +1,10 @@
+package main
+
+import "github.com/greensnark/redis-purge/purge"
+
+// parseHashMatch parses a HASH_MATCH specification: ;-separated field
+// comparisons such as status=deleted;plan!=enterprise;notes~spam, all of
+// which must hold.
+func parseHashMatch(spec string) ([]hashFieldCondition, error) {
+	return purge.ParseFieldConditions(spec)
+}
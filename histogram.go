@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// sizeHistogram counts matched values (and, if All is set, every value read)
+// in power-of-two size buckets, to help choose SIZE_THRESHOLD and SIZE_MAX.
+type sizeHistogram struct {
+	All bool
+
+	// Bucket 0 counts empty values; bucket i > 0 counts values of
+	// 2^(i-1) to 2^i-1 bytes.
+	matched [bits.UintSize + 1]int64
+	scanned [bits.UintSize + 1]int64
+}
+
+// envSizeHistogram returns the histogram configured by SIZE_HISTOGRAM, or nil
+// if sizes aren't reported.
+func envSizeHistogram() (*sizeHistogram, error) {
+	switch mode := envDefault("SIZE_HISTOGRAM", "n"); mode {
+	case "n", "no", "false":
+		return nil, nil
+	case "y", "yes", "true", "matched":
+		return &sizeHistogram{}, nil
+	case "all":
+		return &sizeHistogram{All: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown SIZE_HISTOGRAM %#v (expected matched or all)", mode)
+	}
+}
+
+func sizeBucket(size int) int {
+	return bits.Len(uint(size))
+}
+
+// Record counts a matched value of size bytes. Record on a nil sizeHistogram
+// does nothing.
+func (h *sizeHistogram) Record(size int) {
+	if h != nil {
+		h.matched[sizeBucket(size)]++
+	}
+}
+
+// Scanned counts a value of size bytes that was read, whether or not it
+// matched. Scanned on a nil sizeHistogram, or one without All, does nothing.
+func (h *sizeHistogram) Scanned(size int) {
+	if h != nil && h.All {
+		h.scanned[sizeBucket(size)]++
+	}
+}
+
+// Report prints the histograms to stderr. Report on a nil sizeHistogram does
+// nothing.
+func (h *sizeHistogram) Report() {
+	if h == nil {
+		return
+	}
+	reportSizeHistogram("matched", h.matched[:])
+	if h.All {
+		reportSizeHistogram("read", h.scanned[:])
+	}
+}
+
+func reportSizeHistogram(what string, buckets []int64) {
+	var total, largest int64
+	first, last := -1, -1
+	for i, count := range buckets {
+		if count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		total += count
+		if count > largest {
+			largest = count
+		}
+	}
+	fmt.Fprintf(os.Stderr, "> value sizes of %d %s keys:\n", total, what)
+	for i := first; i >= 0 && i <= last; i++ {
+		low, high := 0, 0
+		if i > 0 {
+			low, high = 1<<uint(i-1), 1<<uint(i)-1
+		}
+		bar := strings.Repeat("#", int(40*buckets[i]/largest))
+		line := fmt.Sprintf(">   %10d-%-10d bytes: %8d keys (%5.1f%%) %s",
+			low, high, buckets[i], percentage(buckets[i], total), bar)
+		fmt.Fprintln(os.Stderr, strings.TrimRight(line, " "))
+	}
+}
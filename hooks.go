@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// keyHooks are the commands run before and after each key is matched and
+// deleted, such as to log, notify, or veto keys, as purge hooks. The
+// pre-match, post-match and pre-delete commands veto a key by exiting with a
+// non-zero status.
+type keyHooks struct {
+	PreMatch   string
+	PostMatch  string
+	PreDelete  string
+	PostDelete string
+
+	// Action is what the run does with matching keys, list or delete, unless
+	// a rule says otherwise.
+	Action  string
+	DryRun  bool
+	Quiet   bool
+	Timeout time.Duration
+}
+
+// envKeyHooks returns the hooks configured by PRE_MATCH_HOOK,
+// POST_MATCH_HOOK, PRE_DELETE_HOOK and POST_DELETE_HOOK, or nil if none are
+// set.
+func envKeyHooks(action string, dryRun, quiet bool) *keyHooks {
+	hooks := &keyHooks{
+		PreMatch:   os.Getenv("PRE_MATCH_HOOK"),
+		PostMatch:  os.Getenv("POST_MATCH_HOOK"),
+		PreDelete:  os.Getenv("PRE_DELETE_HOOK"),
+		PostDelete: os.Getenv("POST_DELETE_HOOK"),
+		Action:     action,
+		DryRun:     dryRun,
+		Quiet:      quiet,
+		Timeout:    time.Duration(envInt("HOOK_TIMEOUT", 30)) * time.Second,
+	}
+	if hooks.PreMatch == "" && hooks.PostMatch == "" && hooks.PreDelete == "" && hooks.PostDelete == "" {
+		return nil
+	}
+	return hooks
+}
+
+// Hooks returns the commands as purge hooks, for keys actioned by rule (or
+// by the run, if rule is empty) with action (or the run's Action, if action
+// is empty). A vetoed key returns purge.ErrSkip. Hooks on a nil keyHooks
+// returns no hooks.
+func (h *keyHooks) Hooks(action, rule string) purge.Hooks {
+	var hooks purge.Hooks
+	if h == nil {
+		return hooks
+	}
+	if h.PreMatch != "" {
+		hooks.PreMatch = func(ctx context.Context, key string) error {
+			return h.veto("PRE_MATCH_HOOK", h.PreMatch, key, h.env("pre-match", key, action, rule))
+		}
+	}
+	if h.PostMatch != "" {
+		hooks.PostMatch = func(ctx context.Context, match purge.Match) error {
+			env := append(h.env("post-match", match.Key, action, rule), "PURGE_SIZE="+strconv.Itoa(match.Size))
+			return h.veto("POST_MATCH_HOOK", h.PostMatch, match.Key, env)
+		}
+	}
+	if h.PreDelete != "" {
+		hooks.PreDelete = func(ctx context.Context, match purge.Match) error {
+			env := append(h.env("pre-delete", match.Key, "delete", rule), "PURGE_SIZE="+strconv.Itoa(match.Size))
+			return h.veto("PRE_DELETE_HOOK", h.PreDelete, match.Key, env)
+		}
+	}
+	if h.PostDelete != "" {
+		hooks.PostDelete = func(ctx context.Context, match purge.Match, deleteErr error) {
+			env := h.env("post-delete", match.Key, "delete", rule)
+			var failed *purge.DeleteError
+			if errors.As(deleteErr, &failed) {
+				deleteErr = failed.Err
+			}
+			if deleteErr != nil {
+				env = append(env, "PURGE_DELETE_ERROR="+deleteErr.Error())
+			}
+			if err := h.run(h.PostDelete, env); err != nil {
+				h.report("> POST_DELETE_HOOK failed for %#v: %s\n", match.Key, err)
+			}
+		}
+	}
+	return hooks
+}
+
+// env returns the environment of a hook run for key, on top of this
+// process's: PURGE_HOOK, PURGE_KEY, PURGE_ACTION, PURGE_RULE and
+// PURGE_DRY_RUN.
+func (h *keyHooks) env(hook, key, action, rule string) []string {
+	if action == "" {
+		action = h.Action
+	}
+	env := append(os.Environ(), "PURGE_HOOK="+hook, "PURGE_KEY="+key, "PURGE_ACTION="+action)
+	if rule != "" {
+		env = append(env, "PURGE_RULE="+rule)
+	}
+	if h.DryRun {
+		env = append(env, "PURGE_DRY_RUN=y")
+	}
+	return env
+}
+
+// veto runs the setting's command, returning purge.ErrSkip if it fails.
+func (h *keyHooks) veto(setting, command, key string, env []string) error {
+	err := h.run(command, env)
+	if err == nil {
+		return nil
+	}
+	if !h.Quiet {
+		h.report("> %s vetoed %#v: %s\n", setting, key, err)
+	}
+	return purge.ErrSkip
+}
+
+// run runs command in the shell, with env, and with its output on stderr,
+// since stdout is for matches.
+func (h *keyHooks) run(command string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	cmd.Env, cmd.Stdout, cmd.Stderr = env, os.Stderr, os.Stderr
+	progressLine.Hide()
+	defer progressLine.Show()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", h.Timeout)
+	}
+	return err
+}
+
+func (h *keyHooks) report(format string, args ...interface{}) {
+	progressLine.Hide()
+	fmt.Fprintf(os.Stderr, format, args...)
+	progressLine.Show()
+}
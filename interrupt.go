@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errInterrupted is returned by a scan stopped by an interrupt.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted is closed when a scan is interrupted, asking it to stop once
+// its in-flight command returns.
+var interrupted = make(chan struct{})
+
+// interruptOnce closes interrupted.
+var interruptOnce sync.Once
+
+// interrupt asks the scans in progress to stop, as an interrupt does.
+func interrupt() {
+	interruptOnce.Do(func() { close(interrupted) })
+}
+
+// scansRunning counts the scans in progress, which stop gracefully when
+// interrupted.
+var scansRunning int32
+
+// isInterrupted reports whether the run has been interrupted.
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, or until the run is interrupted.
+func sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-interrupted:
+	}
+}
+
+// exitOnInterrupt stops the run when it's interrupted. A scan stops issuing
+// commands, and the run reports what it has done so far and where to resume
+// before exiting with 130; otherwise, or when interrupted again, the run
+// exits at once. The atExit hooks run either way, so that an interrupted run
+// still releases its lock and flushes its output.
+func exitOnInterrupt() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, interruptSignals...)
+	go func() {
+		sig := <-signals
+		if atomic.LoadInt32(&scansRunning) > 0 {
+			fmt.Fprintf(os.Stderr, "\n> interrupted by %s, stopping after the current command (interrupt again to exit at once)\n", sig)
+			interrupt()
+			sig = <-signals
+		}
+		fmt.Fprintf(os.Stderr, "\n> interrupted by %s, exiting\n", sig)
+		exit(130)
+	}()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// keyDisplay is how keys are written to output, so that keys that aren't
+// printable UTF-8 can't corrupt it.
+type keyDisplay int
+
+const (
+	// keyDisplayRaw writes keys as they are.
+	keyDisplayRaw keyDisplay = iota
+	// keyDisplayEscape writes printable UTF-8 as is, backslashes as \\, and
+	// every other byte as \xNN.
+	keyDisplayEscape
+	keyDisplayHex
+	keyDisplayBase64
+)
+
+// envKeyDisplay returns the key display configured by KEY_DISPLAY.
+func envKeyDisplay() (keyDisplay, error) {
+	switch display := strings.ToLower(envDefault("KEY_DISPLAY", "raw")); display {
+	case "raw":
+		return keyDisplayRaw, nil
+	case "escape":
+		return keyDisplayEscape, nil
+	case "hex":
+		return keyDisplayHex, nil
+	case "base64":
+		return keyDisplayBase64, nil
+	default:
+		return keyDisplayRaw, fmt.Errorf("unknown KEY_DISPLAY %#v (expected raw, escape, hex or base64)", display)
+	}
+}
+
+// Format formats key for output.
+func (d keyDisplay) Format(key string) string {
+	switch d {
+	case keyDisplayEscape:
+		return escapeKey(key)
+	case keyDisplayHex:
+		return hex.EncodeToString([]byte(key))
+	case keyDisplayBase64:
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return key
+}
+
+// Parse parses a key formatted by Format, such as a line of a key file.
+func (d keyDisplay) Parse(formatted string) (string, error) {
+	switch d {
+	case keyDisplayEscape:
+		return unescapeKey(formatted)
+	case keyDisplayHex:
+		key, err := hex.DecodeString(formatted)
+		return string(key), err
+	case keyDisplayBase64:
+		key, err := base64.StdEncoding.DecodeString(formatted)
+		return string(key), err
+	}
+	return formatted, nil
+}
+
+func escapeKey(key string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(key); {
+		c, size := utf8.DecodeRuneInString(key[i:])
+		switch {
+		case c == '\\':
+			escaped.WriteString(`\\`)
+		case c == utf8.RuneError && size <= 1, !unicode.IsPrint(c):
+			for _, b := range []byte(key[i : i+size]) {
+				fmt.Fprintf(&escaped, `\x%02x`, b)
+			}
+		default:
+			escaped.WriteString(key[i : i+size])
+		}
+		i += size
+	}
+	return escaped.String()
+}
+
+func unescapeKey(escaped string) (string, error) {
+	var key strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '\\' {
+			key.WriteByte(escaped[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(escaped[i:], `\\`):
+			key.WriteByte('\\')
+			i++
+		case strings.HasPrefix(escaped[i:], `\x`) && i+4 <= len(escaped):
+			b, err := strconv.ParseUint(escaped[i+2:i+4], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape %#v in key %#v", escaped[i:i+4], escaped)
+			}
+			key.WriteByte(byte(b))
+			i += 3
+		default:
+			return "", fmt.Errorf("invalid escape at offset %d of key %#v", i, escaped)
+		}
+	}
+	return key.String(), nil
+}
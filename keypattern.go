@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A keyPatternList matches keys against a list of Redis glob patterns and
+// regular expressions.
+type keyPatternList struct {
+	globs   []string
+	regexps []*regexp.Regexp
+	source  []string
+}
+
+// parseKeyPatternList parses a comma-separated list of key patterns. Each
+// pattern is a Redis glob pattern, or a regular expression if it's enclosed
+// in slashes, like /^tmp:[0-9]+$/.
+func parseKeyPatternList(spec string) (keyPatternList, error) {
+	var patterns keyPatternList
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		patterns.source = append(patterns.source, pattern)
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return keyPatternList{}, fmt.Errorf("bad key regexp %s: %w", pattern, err)
+			}
+			patterns.regexps = append(patterns.regexps, re)
+		} else {
+			patterns.globs = append(patterns.globs, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// Empty reports whether k has no patterns.
+func (k keyPatternList) Empty() bool {
+	return len(k.source) == 0
+}
+
+// Matches reports whether key matches any of the patterns in k.
+func (k keyPatternList) Matches(key string) bool {
+	for _, glob := range k.globs {
+		if keyPatternMatches(glob, key) {
+			return true
+		}
+	}
+	for _, re := range k.regexps {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k keyPatternList) String() string {
+	return strings.Join(k.source, ",")
+}
+
+// keyPatternMatches reports whether key matches the Redis glob pattern,
+// following the same rules as the KEYS and SCAN MATCH commands: * matches
+// any run of bytes, ? matches any single byte, [abc], [^abc] and [a-z]
+// match byte sets, and \ escapes the following byte.
+func keyPatternMatches(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if keyPatternMatches(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == key[0] {
+						matched = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if key[0] >= start && key[0] <= end {
+						matched = true
+					}
+					pattern = pattern[2:]
+				case pattern[0] == key[0]:
+					matched = true
+				}
+				pattern = pattern[1:]
+			}
+			if negate {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			key = key[1:]
+			// Like Redis, treat an unterminated [ as running to the end of
+			// the pattern.
+			if len(pattern) == 0 {
+				return len(key) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(key) == 0
+}
+
+// keyPrefix returns the prefix of key up to and including the first
+// delimiter, or all of key if it doesn't contain delimiter.
+func keyPrefix(key, delimiter string) string {
+	if index := strings.Index(key, delimiter); index >= 0 {
+		return key[:index+len(delimiter)]
+	}
+	return key
+}
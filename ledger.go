@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ledgerVersion is the format version of ledger files. Version 1 didn't
+// record the Action.
+const ledgerVersion = 2
+
+// A purgeLedger records the cumulative progress of a purge that is run in
+// several time-boxed sessions, so that each session carries on from where
+// the last one stopped.
+type purgeLedger struct {
+	Version int `json:"version"`
+	// Target, Condition and Action identify the purge, which each session
+	// must repeat.
+	Target    string `json:"target"`
+	Condition string `json:"condition"`
+	Action    string `json:"action"`
+
+	// Cursor is the SCAN cursor to resume from.
+	Cursor uint64 `json:"cursor"`
+	Done   bool   `json:"done"`
+
+	Sessions  int       `json:"sessions"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// TotalKeys is the size of the keyspace when the last session started.
+	TotalKeys   int64 `json:"total_keys"`
+	ScannedKeys int64 `json:"scanned_keys"`
+	MatchedKeys int64 `json:"matched_keys"`
+
+	// Prefixes counts matched keys by their prefix up to the first ":".
+	Prefixes map[string]int64 `json:"prefixes"`
+
+	// Tags are the OPERATION_TAGS of the latest session.
+	Tags operationTags `json:"tags,omitempty"`
+
+	path     string
+	deadline time.Time
+	readOnly bool
+}
+
+// envPurgeLedger opens the ledger in LEDGER_FILE for a run of action on
+// condition on target, creating it if it doesn't exist yet, or returns nil if
+// LEDGER_FILE is not set. A ledger of another purge is refused, except that
+// a dry run may read the ledger of the purge it previews, which it doesn't
+// update. Each session lasts at most SESSION_DURATION seconds, if set.
+func envPurgeLedger(target, condition, action, previews string) (*purgeLedger, error) {
+	path := os.Getenv("LEDGER_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	ledger, err := readPurgeLedger(path)
+	if os.IsNotExist(err) {
+		now := time.Now().UTC()
+		ledger = &purgeLedger{
+			Version:   ledgerVersion,
+			Target:    target,
+			Condition: condition,
+			Action:    action,
+			StartedAt: now,
+			UpdatedAt: now,
+			Prefixes:  map[string]int64{},
+			path:      path,
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		if ledger.Action == "" {
+			// A version 1 ledger, which didn't record its action.
+			ledger.Action = action
+		}
+		if ledger.Target != target || ledger.Condition != condition || (ledger.Action != action && ledger.Action != previews) {
+			return nil, fmt.Errorf("ledger %s is for a run to %s %s on %s, not to %s %s on %s; remove it to start a new purge",
+				path, ledger.Action, ledger.Condition, ledger.Target, action, condition, target)
+		}
+	}
+	if duration := envInt("SESSION_DURATION", 0); duration > 0 {
+		ledger.deadline = time.Now().Add(time.Duration(duration) * time.Second)
+	}
+	return ledger, nil
+}
+
+func readPurgeLedger(path string) (*purgeLedger, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ledger := &purgeLedger{}
+	if err = json.Unmarshal(data, ledger); err != nil {
+		return nil, fmt.Errorf("couldn't parse ledger %s: %w", path, err)
+	}
+	if err = checkFormatVersion("ledger "+path, ledger.Version, ledgerVersion); err != nil {
+		return nil, err
+	}
+	// The ledger is saved in the current format from now on.
+	ledger.Version = ledgerVersion
+	if ledger.Prefixes == nil {
+		ledger.Prefixes = map[string]int64{}
+	}
+	ledger.path = path
+	return ledger, nil
+}
+
+// Start begins a session of a scan of a keyspace of totalKeys keys, and
+// returns the cursor to scan from. Start on a nil purgeLedger returns 0.
+func (l *purgeLedger) Start(totalKeys int64) uint64 {
+	if l == nil {
+		return 0
+	}
+	session := l.Sessions + 1
+	if !l.readOnly {
+		l.Sessions = session
+	}
+	l.TotalKeys = totalKeys
+	fmt.Fprintf(os.Stderr, "> ledger %s: session %d, resuming at cursor %d after %d scanned keys\n",
+		l.path, session, l.Cursor, l.ScannedKeys)
+	if !l.deadline.IsZero() {
+		fmt.Fprintf(os.Stderr, "> ledger %s: session ends at %s\n", l.path, l.deadline.Format(time.RFC3339))
+	}
+	return l.Cursor
+}
+
+// Match records a matched key. Match on a nil purgeLedger does nothing.
+func (l *purgeLedger) Match(key string) {
+	if l == nil {
+		return
+	}
+	l.MatchedKeys++
+	l.Prefixes[keyPrefix(key, ":")]++
+}
+
+// Advance records that a SCAN batch of scanned keys has been fully handled,
+// and that the scan carries on at cursor, and saves the ledger. It reports
+// whether the session's time is up. Advance on a nil purgeLedger saves
+// nothing and returns false.
+func (l *purgeLedger) Advance(cursor uint64, scanned int64) (timeUp bool, err error) {
+	if l == nil {
+		return false, nil
+	}
+	l.Cursor = cursor
+	l.ScannedKeys += scanned
+	l.Done = cursor == 0
+	if err = l.save(); err != nil {
+		return false, err
+	}
+	return !l.Done && !l.deadline.IsZero() && time.Now().After(l.deadline), nil
+}
+
+// ReadOnly stops the ledger being saved, for dry runs, which shouldn't
+// advance the real purge.
+func (l *purgeLedger) ReadOnly() {
+	if l == nil {
+		return
+	}
+	l.readOnly = true
+	fmt.Fprintf(os.Stderr, "> dry run: ledger %s will not be updated\n", l.path)
+}
+
+// save writes the ledger to a temporary file, then renames it over the
+// ledger file, so that an interrupted save doesn't lose the ledger.
+func (l *purgeLedger) save() error {
+	if l.readOnly {
+		return nil
+	}
+	l.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return fmt.Errorf("couldn't save ledger %s: %w", l.path, err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(append(data, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), l.path)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't save ledger %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// printLedgerStatus prints the overall progress of the purge recorded in the
+// ledger at path.
+func printLedgerStatus(path string) error {
+	if path == "" {
+		return fmt.Errorf("LEDGER_FILE is not set")
+	}
+	l, err := readPurgeLedger(path)
+	if err != nil {
+		return err
+	}
+	state := "in progress"
+	if l.Done {
+		state = "complete"
+	}
+	action := l.Action
+	if action == "" {
+		action = "purge"
+	}
+	fmt.Printf("%s of %s on %s: %s\n", action, l.Condition, l.Target, state)
+	fmt.Printf("sessions: %d, started %s, last updated %s\n",
+		l.Sessions, l.StartedAt.Format(time.RFC3339), l.UpdatedAt.Format(time.RFC3339))
+	if len(l.Tags) > 0 {
+		fmt.Printf("tags: %s\n", l.Tags)
+	}
+	if l.Done {
+		fmt.Printf("scanned %d keys, matched %d\n", l.ScannedKeys, l.MatchedKeys)
+	} else {
+		// The keyspace size changes between sessions, and SCAN may return
+		// keys more than once, so this is only an estimate.
+		complete := percentage(l.ScannedKeys, l.TotalKeys)
+		if complete > 99.9 {
+			complete = 99.9
+		}
+		fmt.Printf("scanned %d of about %d keys (%.1f%%), matched %d, next cursor %d\n",
+			l.ScannedKeys, l.TotalKeys, complete, l.MatchedKeys, l.Cursor)
+	}
+
+	prefixes := make([]string, 0, len(l.Prefixes))
+	for prefix := range l.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if l.Prefixes[prefixes[i]] != l.Prefixes[prefixes[j]] {
+			return l.Prefixes[prefixes[i]] > l.Prefixes[prefixes[j]]
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	for _, prefix := range prefixes {
+		fmt.Printf("  %s %d matched\n", prefix, l.Prefixes[prefix])
+	}
+	return nil
+}
+
+// openLedger sets up r.Ledger for a purge of condition, which deletes the
+// keys it matches if deletes is set, if LEDGER_FILE is set, and reports
+// whether the ledger says the purge is already complete.
+func (r *redisSearch) openLedger(condition string, deletes bool) (complete bool, err error) {
+	previews := ""
+	if r.DryRun && deletes {
+		previews = "delete"
+	}
+	if r.Ledger, err = envPurgeLedger(r.String(), condition, r.checkpointAction(deletes), previews); err != nil || r.Ledger == nil {
+		return false, err
+	}
+	if r.Ledger.Done {
+		fmt.Fprintf(os.Stderr, "> ledger %s: purge is complete after %d sessions; remove the ledger to start again\n",
+			r.Ledger.path, r.Ledger.Sessions)
+		return true, nil
+	}
+	if r.DryRun {
+		r.Ledger.ReadOnly()
+	}
+	if len(r.Tags) > 0 {
+		r.Ledger.Tags = r.Tags
+	}
+	return false, nil
+}
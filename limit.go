@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// deleteLimit caps the number of keys a run deletes, to limit the damage of
+// a search that turns out to match more than expected.
+type deleteLimit struct {
+	Max int64
+
+	// Abort fails the run when it reaches Max; otherwise the run stops
+	// deleting and ends cleanly.
+	Abort bool
+
+	deletes int64
+}
+
+// envDeleteLimit returns the limit configured by MAX_DELETES and
+// MAX_DELETES_ACTION, or nil if MAX_DELETES is not set.
+func envDeleteLimit() (*deleteLimit, error) {
+	max, err := envLimit("MAX_DELETES")
+	if err != nil || max <= 0 {
+		return nil, err
+	}
+	limit := &deleteLimit{Max: max}
+	switch action := envDefault("MAX_DELETES_ACTION", "abort"); action {
+	case "abort":
+		limit.Abort = true
+	case "stop":
+	default:
+		return nil, fmt.Errorf("unknown MAX_DELETES_ACTION %#v (expected abort or stop)", action)
+	}
+	return limit, nil
+}
+
+// Allow returns nil if another key may be deleted, counting it. Once Max
+// keys have been allowed, it returns an error if Abort is set, or
+// errStopScan to end the scan. Allow on a nil deleteLimit allows every key.
+func (l *deleteLimit) Allow(key string) error {
+	if l == nil {
+		return nil
+	}
+	if l.deletes < l.Max {
+		l.deletes++
+		return nil
+	}
+	if l.Abort {
+		return fmt.Errorf("MAX_DELETES=%d reached at key %#v, aborting", l.Max, key)
+	}
+	fmt.Fprintf(os.Stderr, "> MAX_DELETES=%d reached at key %#v, not deleting any more keys\n", l.Max, key)
+	return errStopScan
+}
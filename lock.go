@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// instanceLockTTL is how long an instance lock survives without being
+// renewed, so that the lock of a crashed run expires.
+const instanceLockTTL = 30 * time.Second
+
+// releaseLockScript deletes the lock key only if it's still ours.
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// queueLockScript takes the lock for the waiter ARGV[1] if it's first in the
+// queue KEYS[2], and otherwise queues it, returning its place in the queue.
+// Waiters refresh their heartbeat in KEYS[3] every time they try, and those
+// that stopped trying ARGV[3] milliseconds ago are dropped from the queue.
+var queueLockScript = redis.NewScript(`
+local stale = redis.call("zrangebyscore", KEYS[3], "-inf", ARGV[2] - ARGV[3])
+for _, waiter in ipairs(stale) do
+	redis.call("zrem", KEYS[2], waiter)
+	redis.call("zrem", KEYS[3], waiter)
+end
+redis.call("zadd", KEYS[2], "NX", ARGV[2], ARGV[1])
+redis.call("zadd", KEYS[3], ARGV[2], ARGV[1])
+if redis.call("zrank", KEYS[2], ARGV[1]) == 0 and redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[3]) then
+	redis.call("zrem", KEYS[2], ARGV[1])
+	redis.call("zrem", KEYS[3], ARGV[1])
+	return 0
+end
+redis.call("pexpire", KEYS[2], ARGV[3])
+redis.call("pexpire", KEYS[3], ARGV[3])
+return redis.call("zrank", KEYS[2], ARGV[1]) + 1
+`)
+
+// renewLockScript extends the lock key's TTL only if it's still ours.
+var renewLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// instanceLockHolder is stored in the lock key, to tell other runs who holds
+// the lock.
+type instanceLockHolder struct {
+	Owner   string    `json:"owner"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+
+	Tags operationTags `json:"tags,omitempty"`
+}
+
+// An instanceLock is held in the target Redis itself for the duration of a
+// run, so that two heavy runs never scan the same instance at once. Runs
+// waiting for the lock queue for it in a sorted set, and take it in turn.
+type instanceLock struct {
+	Key  string
+	Wait time.Duration
+
+	// Tags are recorded in the lock key, to tell other runs what the
+	// holder is running for.
+	Tags operationTags
+
+	client *redis.Client
+	value  string
+	stop   chan struct{}
+}
+
+// envInstanceLock returns the instance lock configured by INSTANCE_LOCK, or
+// nil if the lock is disabled.
+func envInstanceLock(client *redis.Client) *instanceLock {
+	if !envBool("INSTANCE_LOCK", "false") {
+		return nil
+	}
+	return &instanceLock{
+		Key:    envDefault("INSTANCE_LOCK_KEY", "redis-purge:lock"),
+		Wait:   time.Duration(envInt("INSTANCE_LOCK_WAIT", 0)) * time.Second,
+		client: client,
+	}
+}
+
+// QueueKey is the sorted set of the runs waiting for the lock, in the order
+// they started waiting.
+func (l *instanceLock) QueueKey() string {
+	return l.Key + ":queue"
+}
+
+// WaitersKey is the sorted set of the last time each waiting run tried to
+// take the lock, to tell the runs still waiting from those that crashed.
+func (l *instanceLock) WaitersKey() string {
+	return l.Key + ":waiters"
+}
+
+// Acquire takes the lock, queueing up to Wait behind the runs that hold the
+// lock or are already waiting for it, and keeps it renewed until Release.
+func (l *instanceLock) Acquire() error {
+	holder, err := json.Marshal(instanceLockHolder{
+		Owner:   operatorName(),
+		PID:     os.Getpid(),
+		Started: time.Now().UTC(),
+		Tags:    l.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	l.value = string(holder)
+
+	ctx := context.Background()
+	keys := []string{l.Key, l.QueueKey(), l.WaitersKey()}
+	deadline := time.Now().Add(l.Wait)
+	for {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		place, err := queueLockScript.Run(ctx, l.client, keys, l.value, now, instanceLockTTL.Milliseconds()).Int()
+		if err != nil {
+			return fmt.Errorf("couldn't take lock %#v: %w", l.Key, err)
+		}
+		if place == 0 {
+			break
+		}
+
+		currentHolder, err := l.client.Get(ctx, l.Key).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("couldn't read lock key %#v: %w", l.Key, err)
+		}
+		if time.Now().After(deadline) {
+			l.leaveQueue()
+			return fmt.Errorf("another run holds lock %#v: %s", l.Key, formatLockHolder(currentHolder))
+		}
+		fmt.Fprintf(os.Stderr, "> waiting for lock %#v, held by %s: %d in the queue\n", l.Key, formatLockHolder(currentHolder), place)
+		time.Sleep(5 * time.Second)
+	}
+
+	l.stop = make(chan struct{})
+	go l.renew()
+	return nil
+}
+
+// leaveQueue drops this run from the lock's queue, once it stops waiting.
+func (l *instanceLock) leaveQueue() {
+	ctx := context.Background()
+	if err := l.client.ZRem(ctx, l.QueueKey(), l.value).Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't leave the queue for lock %#v: %s\n", l.Key, err)
+	}
+	l.client.ZRem(ctx, l.WaitersKey(), l.value)
+}
+
+func (l *instanceLock) renew() {
+	ticker := time.NewTicker(instanceLockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			renewed, err := renewLockScript.Run(context.Background(), l.client, []string{l.Key}, l.value, instanceLockTTL.Milliseconds()).Int()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "> couldn't renew lock %#v: %s\n", l.Key, err)
+			} else if renewed == 0 {
+				fmt.Fprintf(os.Stderr, "> warning: lost lock %#v to another run\n", l.Key)
+			}
+		}
+	}
+}
+
+// Release gives up the lock, if we still hold it.
+func (l *instanceLock) Release() {
+	if l.stop == nil {
+		return
+	}
+	close(l.stop)
+	l.stop = nil
+	if err := releaseLockScript.Run(context.Background(), l.client, []string{l.Key}, l.value).Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't release lock %#v: %s\n", l.Key, err)
+	}
+}
+
+// printStatus prints who holds the lock, and the runs queued for it in the
+// order they'll take it.
+func (l *instanceLock) printStatus() error {
+	ctx := context.Background()
+	holder, err := l.client.Get(ctx, l.Key).Result()
+	switch {
+	case err == redis.Nil:
+		fmt.Printf("lock %s is free\n", l.Key)
+	case err != nil:
+		return fmt.Errorf("couldn't read lock key %#v: %w", l.Key, err)
+	default:
+		fmt.Printf("lock %s is held by %s\n", l.Key, formatLockHolder(holder))
+	}
+
+	// Waiters that stopped trying are in the queue until the next waiter
+	// drops them, so they're left out here.
+	cutoff := time.Now().Add(-instanceLockTTL).UnixNano() / int64(time.Millisecond)
+	live, err := l.client.ZRangeByScore(ctx, l.WaitersKey(), &redis.ZRangeBy{Min: strconv.FormatInt(cutoff, 10), Max: "+inf"}).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't read lock waiters %#v: %w", l.WaitersKey(), err)
+	}
+	waiting := map[string]bool{}
+	for _, waiter := range live {
+		waiting[waiter] = true
+	}
+	queue, err := l.client.ZRangeWithScores(ctx, l.QueueKey(), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't read lock queue %#v: %w", l.QueueKey(), err)
+	}
+	place := 0
+	for _, waiter := range queue {
+		value, _ := waiter.Member.(string)
+		if !waiting[value] {
+			continue
+		}
+		place++
+		since := time.Unix(0, int64(waiter.Score)*int64(time.Millisecond)).UTC()
+		fmt.Printf("%d. %s, waiting since %s\n", place, formatLockHolder(value), since.Format(time.RFC3339))
+	}
+	if place == 0 {
+		fmt.Printf("no runs are waiting for it\n")
+	}
+	return nil
+}
+
+// formatLockHolder formats the instanceLockHolder stored as value for
+// messages, or returns value as it is if it isn't one.
+func formatLockHolder(value string) string {
+	var holder instanceLockHolder
+	if err := json.Unmarshal([]byte(value), &holder); err != nil || holder.Owner == "" {
+		return value
+	}
+	formatted := fmt.Sprintf("%s (pid %d, started %s)", holder.Owner, holder.PID, holder.Started.Format(time.RFC3339))
+	if len(holder.Tags) > 0 {
+		formatted += " " + holder.Tags.String()
+	}
+	return formatted
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// envNoTouch returns the connection hook configured by NO_TOUCH, which
+// turns on CLIENT NO-TOUCH (Redis 7.2 and newer) for every connection, so
+// that reading every value doesn't reset the idle times and access
+// frequencies the server evicts keys by. NO_TOUCH=auto (the default) turns
+// it on where the server supports it (on connections made before its
+// capabilities are detected, where it doesn't fail), NO_TOUCH=y requires it,
+// and NO_TOUCH=n leaves it off.
+func envNoTouch() func(ctx context.Context, cn *redis.Conn) error {
+	required := true
+	switch strings.ToLower(envDefault("NO_TOUCH", "auto")) {
+	case "auto":
+		required = false
+	default:
+		if !envBool("NO_TOUCH", "auto") {
+			return nil
+		}
+	}
+	return func(ctx context.Context, cn *redis.Conn) error {
+		if !required && serverCaps != nil && !serverCaps.NoTouch {
+			return nil
+		}
+		cmd := redis.NewStatusCmd(ctx, "client", "no-touch", "on")
+		err := cn.Process(ctx, cmd)
+		if err != nil && required {
+			// go-redis unwraps errors from connection hooks, so this one
+			// isn't wrapped, to keep its explanation.
+			return fmt.Errorf("couldn't turn on CLIENT NO-TOUCH, which needs Redis 7.2 or newer (NO_TOUCH=y): %s", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An orderedKey is a matched key waiting to be deleted in order.
+type orderedKey struct {
+	Key  string
+	Size int
+}
+
+// largestFirstOrder buffers matched keys so that they can be deleted largest
+// first, reclaiming as much memory as possible if a purge is cut short. At
+// most BufferSize keys are held in memory; beyond that, sorted runs of keys
+// are spilled to temporary files and merged when the keys are deleted.
+type largestFirstOrder struct {
+	BufferSize int
+
+	buffer []orderedKey
+	runs   []*os.File
+	keys   int64
+}
+
+// envDeleteOrder returns the delete order configured by DELETE_ORDER and
+// DELETE_ORDER_BUFFER, or nil if keys are deleted in scan order.
+func envDeleteOrder() (*largestFirstOrder, error) {
+	switch order := envDefault("DELETE_ORDER", "scan"); order {
+	case "scan":
+		return nil, nil
+	case "largest-first":
+		return &largestFirstOrder{BufferSize: envInt("DELETE_ORDER_BUFFER", 100000)}, nil
+	default:
+		return nil, fmt.Errorf("unknown DELETE_ORDER %#v (expected scan or largest-first)", order)
+	}
+}
+
+// Add buffers a matched key.
+func (o *largestFirstOrder) Add(key string, size int) error {
+	o.buffer = append(o.buffer, orderedKey{Key: key, Size: size})
+	o.keys++
+	if o.BufferSize > 0 && len(o.buffer) >= o.BufferSize {
+		return o.spill()
+	}
+	return nil
+}
+
+func (o *largestFirstOrder) sortBuffer() {
+	sort.SliceStable(o.buffer, func(i, j int) bool {
+		return o.buffer[i].Size > o.buffer[j].Size
+	})
+}
+
+// spill writes the buffer to a temporary file as a sorted run.
+func (o *largestFirstOrder) spill() error {
+	o.sortBuffer()
+	run, err := ioutil.TempFile("", "redis-purge-order-")
+	if err != nil {
+		return fmt.Errorf("couldn't spill matched keys to disk: %w", err)
+	}
+	o.runs = append(o.runs, run)
+	out := bufio.NewWriter(run)
+	for _, key := range o.buffer {
+		// Keys are hex-encoded, so that any key fits on one line.
+		fmt.Fprintf(out, "%d %s\n", key.Size, keyDisplayHex.Format(key.Key))
+	}
+	if err = out.Flush(); err != nil {
+		return fmt.Errorf("couldn't spill matched keys to disk: %w", err)
+	}
+	if _, err = run.Seek(0, 0); err != nil {
+		return err
+	}
+	o.buffer = o.buffer[:0]
+	return nil
+}
+
+// Do calls fn for each buffered key, largest first, until fn returns an
+// error, and then removes any spilled runs.
+func (o *largestFirstOrder) Do(fn func(key string, size int) error) error {
+	defer o.Close()
+	o.sortBuffer()
+	if len(o.runs) > 0 {
+		fmt.Fprintf(os.Stderr, "> merging %d matched keys from memory and %d runs on disk\n", o.keys, len(o.runs))
+	}
+
+	var heads orderedRuns
+	if len(o.buffer) > 0 {
+		heads = append(heads, &orderedRun{next: o.buffer})
+	}
+	for _, run := range o.runs {
+		heads = append(heads, &orderedRun{scanner: bufio.NewScanner(run)})
+	}
+	for i := 0; i < len(heads); {
+		if err := heads[i].advance(); err != nil {
+			return err
+		}
+		if heads[i].done {
+			heads = append(heads[:i], heads[i+1:]...)
+			continue
+		}
+		i++
+	}
+	heap.Init(&heads)
+
+	for len(heads) > 0 {
+		run := heads[0]
+		if err := fn(run.head.Key, run.head.Size); err != nil {
+			return err
+		}
+		if err := run.advance(); err != nil {
+			return err
+		}
+		if run.done {
+			heap.Pop(&heads)
+		} else {
+			heap.Fix(&heads, 0)
+		}
+	}
+	return nil
+}
+
+// Close drops the buffered keys and removes any spilled runs.
+func (o *largestFirstOrder) Close() {
+	for _, run := range o.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+	o.runs = nil
+	o.buffer = nil
+	o.keys = 0
+}
+
+// An orderedRun is a sorted run of keys, either in memory or on disk, with
+// its largest remaining key at head.
+type orderedRun struct {
+	head orderedKey
+	done bool
+
+	next    []orderedKey
+	scanner *bufio.Scanner
+}
+
+func (r *orderedRun) advance() error {
+	if r.scanner == nil {
+		if len(r.next) == 0 {
+			r.done = true
+			return nil
+		}
+		r.head, r.next = r.next[0], r.next[1:]
+		return nil
+	}
+	if !r.scanner.Scan() {
+		r.done = true
+		return r.scanner.Err()
+	}
+	line := r.scanner.Text()
+	space := strings.IndexByte(line, ' ')
+	if space < 0 {
+		return fmt.Errorf("couldn't read spilled matched keys: malformed line %#v", line)
+	}
+	size, err := strconv.Atoi(line[:space])
+	if err != nil {
+		return fmt.Errorf("couldn't read spilled matched keys: %w", err)
+	}
+	key, err := keyDisplayHex.Parse(line[space+1:])
+	if err != nil {
+		return fmt.Errorf("couldn't read spilled matched keys: %w", err)
+	}
+	r.head = orderedKey{Key: key, Size: size}
+	return nil
+}
+
+// orderedRuns is a max-heap of runs by head size.
+type orderedRuns []*orderedRun
+
+func (h orderedRuns) Len() int            { return len(h) }
+func (h orderedRuns) Less(i, j int) bool  { return h[i].head.Size > h[j].head.Size }
+func (h orderedRuns) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *orderedRuns) Push(x interface{}) { *h = append(*h, x.(*orderedRun)) }
+func (h *orderedRuns) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
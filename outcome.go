@@ -0,0 +1,73 @@
+package main
+
+import "github.com/greensnark/redis-purge/purge"
+
+// The exit codes of complete runs with EXIT_CODES=y, beyond 1 for a fatal
+// error and 130 for an interrupted run, which every run exits with. 2 is left
+// to ALERT_EXIT_CODE and the other checks that already exit with it.
+const (
+	exitMatches        = 0
+	exitNoMatches      = 3
+	exitPartialFailure = 4
+)
+
+// runOutcome counts what a run's outcome depends on: the keys it matched, and
+// those it failed to delete, even on retry.
+type runOutcome struct {
+	matched  int64
+	toDelete int64
+	deleted  int64
+}
+
+// envRunOutcome returns the outcome to exit with, if EXIT_CODES is y, or nil
+// if it's not.
+func envRunOutcome() *runOutcome {
+	if !envBool("EXIT_CODES", "false") {
+		return nil
+	}
+	return &runOutcome{}
+}
+
+// Subscribe counts the events of a run. Subscribe on a nil runOutcome does
+// nothing.
+func (o *runOutcome) Subscribe(events *purgeEvents) {
+	if o == nil {
+		return
+	}
+	events.OnMatch(func(record purge.Record) {
+		o.matched++
+		if record.Action == "delete" {
+			o.toDelete++
+		}
+	})
+	events.OnDelete(func(key string, size int) {
+		o.deleted++
+	})
+}
+
+// Code returns the exit code of the run's outcome: exitPartialFailure if any
+// key failed to delete, else exitNoMatches if no key matched, or else
+// exitMatches.
+func (o *runOutcome) Code() int {
+	switch {
+	case o.toDelete > o.deleted:
+		return exitPartialFailure
+	case o.matched == 0:
+		return exitNoMatches
+	}
+	return exitMatches
+}
+
+// Exit exits with the code of the run's outcome, if it's not 0. Exit on a nil
+// runOutcome does nothing.
+func (o *runOutcome) Exit(r redisSearch) {
+	if o == nil {
+		return
+	}
+	code := o.Code()
+	if code == exitMatches {
+		return
+	}
+	r.Results.Finish()
+	exit(code)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// formatRecord formats r as a line of console output, with its action in
+// color if color is set.
+func formatRecord(r purge.Record, color bool) string {
+	var line bytes.Buffer
+	if r.Rule != "" {
+		fmt.Fprintf(&line, "[%s] ", r.Rule)
+	}
+	action := ""
+	if r.DryRun {
+		action = "WOULD "
+	}
+	if r.Action != "list" {
+		action += strings.ToUpper(r.Action) + " "
+	}
+	if color && actionColor(r) != "" {
+		action = "\033[" + actionColor(r) + "m" + strings.TrimSpace(action) + "\033[0m "
+	}
+	line.WriteString(action)
+	fmt.Fprintf(&line, "%s (size = %d", r.Key, r.Size)
+	if r.Owner != "" {
+		fmt.Fprintf(&line, ", owner = %s", r.Owner)
+	}
+	if len(r.Fields) > 0 {
+		fmt.Fprintf(&line, ", fields = %s", strings.Join(r.Fields, ","))
+	}
+	if r.TTL > 0 {
+		fmt.Fprintf(&line, ", ttl = %d", r.TTL)
+	}
+	if r.KeyTTL != nil {
+		fmt.Fprintf(&line, ", key_ttl = %d", *r.KeyTTL)
+	}
+	if len(r.Tags) > 0 {
+		fmt.Fprintf(&line, ", %s", r.Tags)
+	}
+	line.WriteString(")")
+	return line.String()
+}
+
+// matchOutput writes every match to several sinks at once.
+type matchOutput struct {
+	// DryRun marks every delete as one that a dry run would have done.
+	DryRun bool
+
+	// Tags are stamped on every match.
+	Tags operationTags
+
+	// KeyDisplay formats the key of every match.
+	KeyDisplay keyDisplay
+
+	// DeleteAction, if set, replaces the delete action of matches, for runs
+	// that expire or quarantine keys instead, which set DeleteTTL on them.
+	DeleteAction string
+	DeleteTTL    int
+
+	// DeleteFields are stamped on matches of runs that delete only those
+	// fields of hashes.
+	DeleteFields []string
+
+	sinks   []purge.OutputSink
+	names   []string
+	matches int64
+	closed  bool
+}
+
+// envMatchOutput opens the sinks listed in OUTPUT_SINKS, a comma-separated
+// list defaulting to stdout, with the stdout sink writing OUTPUT_FORMAT. With
+// QUIET=y, or TUI=y on a terminal, which the dashboard is drawn over, sinks
+// writing to stdout are left out.
+func envMatchOutput() (*matchOutput, error) {
+	format := envDefault("OUTPUT_FORMAT", "text")
+	if format != "text" && format != "json" && format != "csv" && format != "keys" {
+		return nil, fmt.Errorf("unknown OUTPUT_FORMAT %#v (expected text, json, csv or keys)", format)
+	}
+	tmpl, err := envOutputTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if tmpl != nil && format != "text" {
+		return nil, fmt.Errorf("OUTPUT_TEMPLATE can't be used with OUTPUT_FORMAT=%s", format)
+	}
+	quiet := envBool("QUIET", "false") || envBool("TUI", "false") && isTerminal(os.Stdout)
+	output := &matchOutput{}
+	for _, spec := range strings.Split(envDefault("OUTPUT_SINKS", "stdout"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		if spec == "stdout" && format != "text" {
+			spec = map[string]string{"json": "ndjson", "csv": "csv", "keys": "keys"}[format]
+		}
+		if quiet && isStdoutSink(spec) {
+			continue
+		}
+		sink, err := openOutputSink(spec, tmpl)
+		if err != nil {
+			output.Close()
+			return nil, fmt.Errorf("output sink %#v: %w", spec, err)
+		}
+		output.Add(spec, sink)
+	}
+	return output, nil
+}
+
+// isStdoutSink reports whether the sink specified as spec writes to stdout.
+func isStdoutSink(spec string) bool {
+	switch spec {
+	case "stdout", "ndjson", "ndjson:-", "csv", "csv:-", "keys", "keys:-":
+		return true
+	}
+	return false
+}
+
+// openOutputSink opens a sink specified as stdout, file:PATH, ndjson[:PATH],
+// csv[:PATH], keys[:PATH] or an http(s) URL. The stdout and file sinks format
+// lines with tmpl, if not nil.
+func openOutputSink(spec string, tmpl *template.Template) (purge.OutputSink, error) {
+	kind, path := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, path = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "stdout":
+		return &textSink{out: os.Stdout, template: tmpl, color: useColor(os.Stdout), terminal: isTerminal(os.Stdout)}, nil
+	case "file":
+		file, err := createOutputFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &textSink{out: file, closer: file, template: tmpl}, nil
+	case "ndjson":
+		if path == "" || path == "-" {
+			return &ndjsonSink{encoder: json.NewEncoder(os.Stdout)}, nil
+		}
+		file, err := createOutputFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &ndjsonSink{encoder: json.NewEncoder(file), closer: file}, nil
+	case "csv":
+		columns, err := envCSVColumns()
+		if err != nil {
+			return nil, err
+		}
+		if path == "" || path == "-" {
+			return newCSVSink(os.Stdout, nil, columns)
+		}
+		file, err := createOutputFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return newCSVSink(file, file, columns)
+	case "keys":
+		if path == "" || path == "-" {
+			return &textSink{out: os.Stdout, template: keysTemplate, terminal: isTerminal(os.Stdout)}, nil
+		}
+		file, err := createOutputFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &textSink{out: file, closer: file, template: keysTemplate}, nil
+	case "http", "https":
+		return &httpBatchSink{
+			URL:       spec,
+			BatchSize: envInt("OUTPUT_HTTP_BATCH", 100),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %#v: expected stdout, file:PATH, ndjson[:PATH], csv[:PATH], keys[:PATH] or an http(s) URL", kind)
+}
+
+func createOutputFile(path string) (*os.File, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing file path")
+	}
+	return os.Create(path)
+}
+
+// Add adds a sink, named for error messages.
+func (m *matchOutput) Add(name string, sink purge.OutputSink) {
+	m.sinks = append(m.sinks, sink)
+	m.names = append(m.names, name)
+}
+
+// Match writes record to every sink. A sink that fails is reported, but
+// doesn't stop the run. Match on a nil matchOutput does nothing.
+func (m *matchOutput) Match(record purge.Record) {
+	if m == nil {
+		return
+	}
+	m.matches++
+	if record.Action == "delete" {
+		record.DryRun = m.DryRun
+		if m.DeleteAction != "" {
+			record.Action, record.TTL, record.Fields = m.DeleteAction, m.DeleteTTL, m.DeleteFields
+		}
+	}
+	record.Tags = purge.Tags(m.Tags)
+	record.Key = m.KeyDisplay.Format(record.Key)
+	for i, sink := range m.sinks {
+		if err := sink.Match(record); err != nil {
+			fmt.Fprintf(os.Stderr, "> output sink %s failed: %s\n", m.names[i], err)
+		}
+	}
+}
+
+// Matches returns the number of keys matched so far, not counting retries.
+// Matches on a nil matchOutput returns 0.
+func (m *matchOutput) Matches() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.matches
+}
+
+// Close closes every sink, once. Close on a nil matchOutput does nothing.
+func (m *matchOutput) Close() {
+	if m == nil || m.closed {
+		return
+	}
+	m.closed = true
+	for i, sink := range m.sinks {
+		if err := sink.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "> output sink %s failed: %s\n", m.names[i], err)
+		}
+	}
+}
+
+// envOutputTemplate parses OUTPUT_TEMPLATE, or returns nil if it isn't set.
+// The template is executed with each purge.Record, and can quote values with
+// the json function.
+func envOutputTemplate() (*template.Template, error) {
+	text := os.Getenv("OUTPUT_TEMPLATE")
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("OUTPUT_TEMPLATE").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			valueJSON, err := json.Marshal(v)
+			return string(valueJSON), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OUTPUT_TEMPLATE: %w", err)
+	}
+	return tmpl, nil
+}
+
+// keysTemplate formats the lines of keys sinks: just the key, for xargs and
+// other tools that read a key per line.
+var keysTemplate = template.Must(template.New("keys").Parse("{{.Key}}"))
+
+// textSink writes one line of console output per match, or one execution of
+// template, if set.
+type textSink struct {
+	out      io.Writer
+	closer   io.Closer
+	template *template.Template
+	// color colors the actions of lines not formatted with template.
+	color bool
+	// terminal hides the progress line while writing, since out is a
+	// terminal, which stderr may be too.
+	terminal bool
+}
+
+func (t *textSink) Match(record purge.Record) error {
+	if t.terminal {
+		progressLine.Hide()
+		defer progressLine.Show()
+	}
+	if t.template == nil {
+		_, err := fmt.Fprintln(t.out, formatRecord(record, t.color))
+		return err
+	}
+	var line bytes.Buffer
+	if err := t.template.Execute(&line, record); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	_, err := t.out.Write(line.Bytes())
+	return err
+}
+
+func (t *textSink) Close() error {
+	if t.closer == nil {
+		return nil
+	}
+	return t.closer.Close()
+}
+
+// ndjsonSink writes one JSON object per line per match.
+type ndjsonSink struct {
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+func (n *ndjsonSink) Match(record purge.Record) error {
+	return n.encoder.Encode(record)
+}
+
+func (n *ndjsonSink) Close() error {
+	if n.closer == nil {
+		return nil
+	}
+	return n.closer.Close()
+}
+
+// csvColumns are the columns csvSink can write, by name.
+var csvColumns = map[string]func(record purge.Record) string{
+	"key":     func(r purge.Record) string { return r.Key },
+	"size":    func(r purge.Record) string { return strconv.Itoa(r.Size) },
+	"action":  func(r purge.Record) string { return r.Action },
+	"rule":    func(r purge.Record) string { return r.Rule },
+	"owner":   func(r purge.Record) string { return r.Owner },
+	"dry_run": func(r purge.Record) string { return strconv.FormatBool(r.DryRun) },
+	"fields":  func(r purge.Record) string { return strings.Join(r.Fields, ",") },
+	"ttl":     func(r purge.Record) string { return strconv.Itoa(r.TTL) },
+	"type":    func(r purge.Record) string { return r.Type },
+	"key_ttl": func(r purge.Record) string {
+		if r.KeyTTL == nil {
+			return ""
+		}
+		return strconv.FormatInt(*r.KeyTTL, 10)
+	},
+	"tags": func(r purge.Record) string { return r.Tags.String() },
+}
+
+// envCSVColumns returns the columns listed in OUTPUT_COLUMNS.
+func envCSVColumns() ([]string, error) {
+	var columns []string
+	for _, column := range strings.Split(envDefault("OUTPUT_COLUMNS", "key,size,action,rule,owner"), ",") {
+		if column = strings.TrimSpace(column); column == "" {
+			continue
+		}
+		if csvColumns[column] == nil {
+			return nil, fmt.Errorf("unknown OUTPUT_COLUMNS column %#v", column)
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no OUTPUT_COLUMNS")
+	}
+	return columns, nil
+}
+
+// outputDescribesKeys returns whether the output needs each matched key's
+// type and TTL looked up: for REPORT_TTL, OUTPUT_FORMAT=json, an
+// OUTPUT_TEMPLATE using them, or CSV output with the type or key_ttl columns.
+func outputDescribesKeys() bool {
+	format := os.Getenv("OUTPUT_FORMAT")
+	if format == "json" || envBool("REPORT_TTL", "false") {
+		return true
+	}
+	if tmpl := os.Getenv("OUTPUT_TEMPLATE"); strings.Contains(tmpl, ".Type") || strings.Contains(tmpl, ".KeyTTL") {
+		return true
+	}
+	writesCSV := format == "csv"
+	for _, spec := range strings.Split(os.Getenv("OUTPUT_SINKS"), ",") {
+		spec = strings.TrimSpace(spec)
+		writesCSV = writesCSV || spec == "csv" || strings.HasPrefix(spec, "csv:")
+	}
+	if !writesCSV {
+		return false
+	}
+	columns, _ := envCSVColumns()
+	for _, column := range columns {
+		if column == "type" || column == "key_ttl" {
+			return true
+		}
+	}
+	return false
+}
+
+// csvSink writes a header row of column names, and then a row per match.
+type csvSink struct {
+	writer  *csv.Writer
+	closer  io.Closer
+	columns []string
+}
+
+func newCSVSink(out io.Writer, closer io.Closer, columns []string) (*csvSink, error) {
+	sink := &csvSink{writer: csv.NewWriter(out), closer: closer, columns: columns}
+	sink.writer.Write(columns)
+	sink.writer.Flush()
+	return sink, sink.writer.Error()
+}
+
+func (c *csvSink) Match(record purge.Record) error {
+	row := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		row[i] = csvColumns[column](record)
+	}
+	c.writer.Write(row)
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvSink) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// httpBatchSink POSTs matches to URL as NDJSON, BatchSize matches at a time.
+type httpBatchSink struct {
+	URL       string
+	BatchSize int
+
+	// client times out, so that a hung endpoint can't stall the run.
+	client *http.Client
+	batch  bytes.Buffer
+	count  int
+}
+
+func (h *httpBatchSink) Match(record purge.Record) error {
+	if err := json.NewEncoder(&h.batch).Encode(record); err != nil {
+		return err
+	}
+	h.count++
+	if h.count < h.BatchSize {
+		return nil
+	}
+	return h.flush()
+}
+
+func (h *httpBatchSink) flush() error {
+	if h.count == 0 {
+		return nil
+	}
+	count := h.count
+	h.count = 0
+	defer h.batch.Reset()
+
+	resp, err := h.client.Post(h.URL, "application/x-ndjson", &h.batch)
+	if err != nil {
+		return fmt.Errorf("POST of %d matches: %w", count, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST of %d matches: %s", count, resp.Status)
+	}
+	return nil
+}
+
+func (h *httpBatchSink) Close() error {
+	return h.flush()
+}
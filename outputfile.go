@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// outputFile redirects the run's standard output (its matched keys and
+// reports) to a temporary file beside Path, which is renamed to Path once the
+// run completes, so that Path never holds a partial report.
+type outputFile struct {
+	Path string
+
+	file   *os.File
+	stdout *os.File
+}
+
+// envOutputFile redirects standard output to OUTPUT_FILE, and returns the
+// redirection, or nil if OUTPUT_FILE isn't set.
+func envOutputFile() (*outputFile, error) {
+	path := os.Getenv("OUTPUT_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".partial-")
+	if err != nil {
+		return nil, err
+	}
+	// TempFile creates files only their owner can read, unlike os.Create.
+	if err = file.Chmod(0644); err != nil {
+		return nil, err
+	}
+	out := &outputFile{Path: path, file: file, stdout: os.Stdout}
+	os.Stdout = file
+	return out, nil
+}
+
+// Finish restores standard output and, if the run completed, renames the
+// output to Path; otherwise the partial output is left where it is. Finish
+// on a nil outputFile does nothing.
+func (o *outputFile) Finish(completed bool) {
+	if o == nil || o.file == nil {
+		return
+	}
+	os.Stdout = o.stdout
+	err := o.file.Sync()
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	partial := o.file.Name()
+	o.file = nil
+	if err == nil && completed {
+		err = os.Rename(partial, o.Path)
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "> couldn't write OUTPUT_FILE %s: %s; output left in %s\n", o.Path, err, partial)
+	case !completed:
+		fmt.Fprintf(os.Stderr, "> run didn't complete: partial output left in %s\n", partial)
+	}
+}
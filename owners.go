@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const unknownOwner = "(unknown)"
+
+// keyOwnership maps keys to the teams that own them, using a static file of
+// key prefixes, an HTTP lookup service, or both, and totals matches per
+// owner for the run summary.
+type keyOwnership struct {
+	// prefixes are the static prefix -> owner mappings, longest prefix first.
+	prefixes []ownerPrefix
+
+	// lookupURL is an HTTP service that maps a key prefix to its owner.
+	lookupURL string
+	delimiter string
+	client    *http.Client
+	cache     map[string]string
+
+	totals map[string]*ownerTotal
+}
+
+type ownerPrefix struct {
+	prefix, owner string
+}
+
+type ownerTotal struct {
+	keys, bytes int64
+}
+
+// envKeyOwnership returns the key ownership configured by KEY_OWNERS_FILE
+// and KEY_OWNERS_URL, or nil if neither is set.
+func envKeyOwnership() (*keyOwnership, error) {
+	ownersFile := os.Getenv("KEY_OWNERS_FILE")
+	lookupURL := os.Getenv("KEY_OWNERS_URL")
+	if ownersFile == "" && lookupURL == "" {
+		return nil, nil
+	}
+
+	owners := &keyOwnership{
+		lookupURL: lookupURL,
+		delimiter: envDefault("KEY_OWNERS_DELIMITER", ":"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		cache:     map[string]string{},
+		totals:    map[string]*ownerTotal{},
+	}
+	if ownersFile != "" {
+		file, err := os.Open(ownersFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if owners.prefixes, err = readOwnerPrefixes(file); err != nil {
+			return nil, fmt.Errorf("%s: %w", ownersFile, err)
+		}
+	}
+	return owners, nil
+}
+
+// readOwnerPrefixes reads "prefix owner" lines, ignoring blank lines and
+// lines starting with #.
+func readOwnerPrefixes(in io.Reader) ([]ownerPrefix, error) {
+	var prefixes []ownerPrefix
+	scanner := bufio.NewScanner(in)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"prefix owner\", got %#v", lineNumber, line)
+		}
+		prefixes = append(prefixes, ownerPrefix{prefix: fields[0], owner: fields[1]})
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+	})
+	return prefixes, scanner.Err()
+}
+
+// Owner returns the owner of key, or unknownOwner.
+func (k *keyOwnership) Owner(key string) string {
+	for _, prefix := range k.prefixes {
+		if strings.HasPrefix(key, prefix.prefix) {
+			return prefix.owner
+		}
+	}
+	if k.lookupURL == "" {
+		return unknownOwner
+	}
+
+	keyPrefix := keyPrefix(key, k.delimiter)
+	if owner, ok := k.cache[keyPrefix]; ok {
+		return owner
+	}
+	owner, err := k.lookup(keyPrefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> owner lookup failed for prefix %#v: %s\n", keyPrefix, err)
+		owner = unknownOwner
+	}
+	k.cache[keyPrefix] = owner
+	return owner
+}
+
+// lookup asks the KEY_OWNERS_URL service for the owner of keyPrefix. The
+// service may reply with JSON {"owner": "team"} or the plain owner name.
+func (k *keyOwnership) lookup(keyPrefix string) (string, error) {
+	lookupURL := k.lookupURL
+	if strings.Contains(lookupURL, "{prefix}") {
+		lookupURL = strings.Replace(lookupURL, "{prefix}", url.QueryEscape(keyPrefix), -1)
+	} else {
+		separator := "?"
+		if strings.Contains(lookupURL, "?") {
+			separator = "&"
+		}
+		lookupURL += separator + "prefix=" + url.QueryEscape(keyPrefix)
+	}
+
+	resp, err := k.client.Get(lookupURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return unknownOwner, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("GET %s: %s", lookupURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+
+	var ownerResponse struct {
+		Owner string `json:"owner"`
+	}
+	owner := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &ownerResponse) == nil {
+		owner = ownerResponse.Owner
+	}
+	if owner == "" {
+		return unknownOwner, nil
+	}
+	return owner, nil
+}
+
+// Record counts a matched key of size bytes against its owner, and returns
+// the owner for the key's output. Record on a nil keyOwnership records
+// nothing and returns "".
+func (k *keyOwnership) Record(key string, size int) string {
+	if k == nil {
+		return ""
+	}
+	owner := k.Owner(key)
+	total := k.totals[owner]
+	if total == nil {
+		total = &ownerTotal{}
+		k.totals[owner] = total
+	}
+	total.keys++
+	total.bytes += int64(size)
+	return owner
+}
+
+// Report prints the per-owner totals of matched keys to stderr.
+func (k *keyOwnership) Report(verb string) {
+	if k == nil {
+		return
+	}
+	owners := make([]string, 0, len(k.totals))
+	for owner := range k.totals {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		total := k.totals[owner]
+		fmt.Fprintf(os.Stderr, "> owner %s: %s %d keys (total size: %d, average size: %.1f)\n",
+			owner, verb, total.keys, total.bytes, average(total.bytes, total.keys))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// planVersion is the format version of plan files.
+const planVersion = 1
+
+// A planHeader is the first line of a plan file, describing the run that
+// marked its keys.
+type planHeader struct {
+	Version   int           `json:"version"`
+	Target    string        `json:"target"`
+	Condition string        `json:"condition"`
+	MarkedBy  string        `json:"marked_by"`
+	MarkedAt  time.Time     `json:"marked_at"`
+	Tags      operationTags `json:"tags,omitempty"`
+}
+
+// A planKey is a line of a plan file: a key marked for deletion.
+type planKey struct {
+	// Key is escaped as with KEY_DISPLAY=escape.
+	Key  string `json:"key"`
+	Size int    `json:"size"`
+}
+
+// markPlan writes the keys a listing run matches to a plan file, to be
+// reviewed before a later sweep deletes them.
+type markPlan struct {
+	Path string
+
+	file *os.File
+	out  *bufio.Writer
+	hash hash.Hash
+	keys int64
+	err  error
+}
+
+// envMarkPlan returns the plan configured by MARK_FILE, or nil if matched
+// keys aren't marked.
+func envMarkPlan() *markPlan {
+	path := os.Getenv("MARK_FILE")
+	if path == "" {
+		return nil
+	}
+	return &markPlan{Path: path}
+}
+
+// Open creates the plan file, which mustn't exist yet, and writes its header.
+func (p *markPlan) Open(header planHeader) error {
+	file, err := os.OpenFile(p.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't create plan file: %w", err)
+	}
+	p.file = file
+	p.hash = sha256.New()
+	p.out = bufio.NewWriter(io.MultiWriter(file, p.hash))
+	header.Version = planVersion
+	p.write(header)
+	return p.err
+}
+
+func (p *markPlan) write(line interface{}) {
+	if p.err != nil {
+		return
+	}
+	lineJSON, err := json.Marshal(line)
+	if err == nil {
+		_, err = p.out.Write(append(lineJSON, '\n'))
+	}
+	if err != nil {
+		p.err = fmt.Errorf("couldn't write to plan file %s: %w", p.Path, err)
+	}
+}
+
+// Mark adds a matched key to the plan.
+func (p *markPlan) Mark(record purge.Record) {
+	p.write(planKey{Key: escapeKey(record.Key), Size: record.Size})
+	p.keys++
+}
+
+// Close flushes and closes the plan file, reporting its checksum for
+// SWEEP_CHECKSUM. Close on a nil markPlan does nothing.
+func (p *markPlan) Close() error {
+	if p == nil {
+		return nil
+	}
+	if p.file == nil {
+		return p.err
+	}
+	if p.err == nil {
+		if err := p.out.Flush(); err != nil {
+			p.err = fmt.Errorf("couldn't write to plan file %s: %w", p.Path, err)
+		}
+	}
+	p.file.Close()
+	p.file = nil
+	if p.err != nil {
+		return p.err
+	}
+	sum := hex.EncodeToString(p.hash.Sum(nil))
+	fmt.Fprintf(os.Stderr, "> marked %d keys in %s; review it, then sweep with SWEEP_FILE=%s SWEEP_CHECKSUM=%s\n", p.keys, p.Path, p.Path, sum)
+	return nil
+}
+
+// sweepPlan is a plan file of marked keys, which a deleting run deletes
+// instead of scanning the keyspace.
+type sweepPlan struct {
+	Path     string
+	Checksum string
+}
+
+// envSweepPlan returns the plan configured by SWEEP_FILE and SWEEP_CHECKSUM,
+// or nil if deleting runs scan the keyspace.
+func envSweepPlan() *sweepPlan {
+	path := os.Getenv("SWEEP_FILE")
+	if path == "" {
+		return nil
+	}
+	return &sweepPlan{Path: path, Checksum: os.Getenv("SWEEP_CHECKSUM")}
+}
+
+// Do checks that the plan was marked for condition on target and, if
+// Checksum is set, that it hasn't changed since it was reviewed, and then
+// calls fn for each marked key until fn returns an error.
+func (p *sweepPlan) Do(target, condition string, fn func(key string, size int) error) error {
+	planJSON, err := os.Open(p.Path)
+	if err != nil {
+		return fmt.Errorf("couldn't open plan file: %w", err)
+	}
+	defer planJSON.Close()
+
+	if p.Checksum != "" {
+		hash := sha256.New()
+		if _, err = io.Copy(hash, planJSON); err != nil {
+			return fmt.Errorf("couldn't read plan file %s: %w", p.Path, err)
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != p.Checksum {
+			return fmt.Errorf("plan file %s has changed since it was reviewed: its sha256 is %s, not SWEEP_CHECKSUM %s", p.Path, sum, p.Checksum)
+		}
+		if _, err = planJSON.Seek(0, 0); err != nil {
+			return err
+		}
+	}
+
+	in := bufio.NewReader(planJSON)
+	line, err := in.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("couldn't read plan file %s: %w", p.Path, err)
+	}
+	var header planHeader
+	if err = json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("couldn't read plan file %s header: %w", p.Path, err)
+	}
+	if err = checkFormatVersion("plan file "+p.Path, header.Version, planVersion); err != nil {
+		return err
+	}
+	if header.Target != target || header.Condition != condition {
+		return fmt.Errorf("plan file %s was marked for %s on %s, not %s on %s", p.Path, header.Condition, header.Target, condition, target)
+	}
+	fmt.Fprintf(os.Stderr, "> sweeping keys marked by %s at %s from %s\n", header.MarkedBy, header.MarkedAt.Format(time.RFC3339), p.Path)
+
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("couldn't read plan file %s: %w", p.Path, err)
+		}
+		var marked planKey
+		if err = json.Unmarshal(line, &marked); err != nil {
+			return fmt.Errorf("couldn't read line %d of plan file %s: %w", lineNumber, p.Path, err)
+		}
+		key, err := keyDisplayEscape.Parse(marked.Key)
+		if err != nil {
+			return fmt.Errorf("couldn't read line %d of plan file %s: %w", lineNumber, p.Path, err)
+		}
+		if err = fn(key, marked.Size); err != nil {
+			return err
+		}
+	}
+}
+
+// openMarkPlan opens mark, if not nil, for a listing run of condition, and
+// marks every key the run lists in it.
+func (r redisSearch) openMarkPlan(mark *markPlan, condition string) error {
+	if mark == nil {
+		return nil
+	}
+	err := mark.Open(planHeader{
+		Target:    r.String(),
+		Condition: condition,
+		MarkedBy:  operatorName(),
+		MarkedAt:  time.Now().UTC(),
+		Tags:      r.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	r.Events.OnMatch(mark.Mark)
+	return nil
+}
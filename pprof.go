@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+)
+
+// servePprof serves the Go runtime's profiles on PPROF_ADDR, if set, so that
+// CPU and memory profiles can be captured from a long-running purge, with
+// go tool pprof http://PPROF_ADDR/debug/pprof/profile.
+func servePprof() error {
+	addr := os.Getenv("PPROF_ADDR")
+	if addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	// The handlers are registered on a mux of their own, rather than
+	// http.DefaultServeMux, so that they're only ever served here.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "> pprof server stopped: %s\n", err)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "> serving profiles on http://%s/debug/pprof/\n", listener.Addr())
+	return nil
+}
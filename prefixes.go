@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// noPrefix is the prefix reported for keys without the prefix delimiter.
+const noPrefix = "(no prefix)"
+
+// prefixReport counts matched keys and their total size by key prefix, to
+// show which application namespaces the matches came from.
+type prefixReport struct {
+	Delimiter string
+	Top       int
+
+	counts map[string]int64
+	sizes  map[string]int64
+}
+
+// envPrefixReport returns the report configured by PREFIX_REPORT,
+// PREFIX_DELIMITER and PREFIX_REPORT_TOP, or nil if PREFIX_REPORT isn't set.
+func envPrefixReport() *prefixReport {
+	if !envBool("PREFIX_REPORT", "false") {
+		return nil
+	}
+	return &prefixReport{
+		Delimiter: envDefault("PREFIX_DELIMITER", ":"),
+		Top:       envInt("PREFIX_REPORT_TOP", 20),
+		counts:    map[string]int64{},
+		sizes:     map[string]int64{},
+	}
+}
+
+// Record counts a matched key. Record on a nil prefixReport does nothing.
+func (p *prefixReport) Record(record purge.Record) {
+	if p == nil {
+		return
+	}
+	prefix := noPrefix
+	if strings.Contains(record.Key, p.Delimiter) {
+		prefix = keyPrefix(record.Key, p.Delimiter)
+	}
+	p.counts[prefix]++
+	p.sizes[prefix] += int64(record.Size)
+}
+
+// Report prints the matched keys by prefix to stderr, most keys first, up to
+// Top prefixes. Report on a nil prefixReport does nothing.
+func (p *prefixReport) Report() {
+	if p == nil {
+		return
+	}
+	var total int64
+	prefixes := make([]string, 0, len(p.counts))
+	for prefix, count := range p.counts {
+		prefixes = append(prefixes, prefix)
+		total += count
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if p.counts[prefixes[i]] != p.counts[prefixes[j]] {
+			return p.counts[prefixes[i]] > p.counts[prefixes[j]]
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	fmt.Fprintf(os.Stderr, "> matched keys by prefix (up to the first %#v) of %d matched keys:\n", p.Delimiter, total)
+	for i, prefix := range prefixes {
+		if p.Top > 0 && i >= p.Top {
+			fmt.Fprintf(os.Stderr, ">   %d more prefixes\n", len(prefixes)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, ">   %s %d keys (%.1f%%), total size: %d\n",
+			prefix, p.counts[prefix], percentage(p.counts[prefix], total), p.sizes[prefix])
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The presentation of list and delete runs: what listMatchingKeys and
+// deleteMatchingKeys are about to do, and what they did, from their
+// purgeResults, on stderr.
+
+// presentStart says that a run is about to action ("list" or "delete") the
+// keys matching search, unless Quiet.
+func (r redisSearch) presentStart(search *searchCondition, action string) {
+	if r.Quiet {
+		return
+	}
+	if action == "delete" {
+		fmt.Fprintf(os.Stderr, "> deleting keys from %s with value matching %s\n", r.String(), search)
+	} else {
+		fmt.Fprintf(os.Stderr, "> listing keys on %s with value matching %s\n", r.String(), search)
+	}
+}
+
+// presentDeleteFailure says that key couldn't be deleted, as soon as it
+// happens, above the progress line.
+func (r redisSearch) presentDeleteFailure(key string, err error) {
+	progressLine.Hide()
+	fmt.Fprintln(os.Stderr, paint(os.Stderr, colorRed, fmt.Sprintf("> failed to delete key %#v: %s, continuing", key, err)))
+	progressLine.Show()
+}
+
+// presentListing prints the totals of a listing run, and the reports on the
+// keys it matched. With COUNT_ONLY, the totals are also written to stdout.
+func (r redisSearch) presentListing(search *searchCondition, result purgeResult) {
+	fmt.Fprintln(os.Stderr, paint(os.Stderr, colorBold, fmt.Sprintf("> found %d keys (total size: %d, average size: %.1f) matching %s",
+		result.Matched, result.MatchedBytes, average(result.MatchedBytes, result.Matched), search)))
+	if r.CountOnly {
+		fmt.Printf("%d %d\n", result.Matched, result.MatchedBytes)
+	}
+	r.presentReports()
+}
+
+// presentDeletion prints the verification of a delete run that ended with
+// err, if it completed, its totals, and the reports on the keys it matched.
+func (r redisSearch) presentDeletion(search *searchCondition, result purgeResult, err error) {
+	if err == nil && !r.DryRun {
+		r.Verifier.Report(r.Client)
+	}
+	summary := fmt.Sprintf("> %s %d keys (%d total size, average size: %.1f) matching %s, %d keys deleted on retry, %d keys failed delete",
+		r.deletedVerb(), result.Deleted, result.DeletedBytes, average(result.DeletedBytes, result.Deleted), search, result.Retried, result.Failed)
+	// A summary with failures stands out from one without.
+	summaryColor := colorGreen
+	if result.Failed > 0 {
+		summaryColor = colorRed
+	}
+	fmt.Fprintln(os.Stderr, paint(os.Stderr, summaryColor, summary))
+	r.presentReports()
+}
+
+// presentReports prints the reports on the keys a run matched, of those
+// enabled.
+func (r redisSearch) presentReports() {
+	r.Owners.Report("matched")
+	r.Protected.Report()
+	r.Schemas.Report()
+	r.Sizes.Report()
+	r.Prefixes.Report()
+	r.TTLs.Report()
+}
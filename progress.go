@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanProgress reports how far a keyspace scan has got, how fast, and about
+// how long it has left. On a terminal it redraws a single status line in
+// place; elsewhere (CI, cron, container logs) it logs a summary line every
+// Interval, or every Keys keys, instead, so that logs aren't flooded with
+// overwritten lines.
+type scanProgress struct {
+	TotalKeys int64
+	Interval  time.Duration
+	// Keys, if > 0, is how many keys are visited between summary lines, as
+	// well as every Interval.
+	Keys     int64
+	Terminal bool
+
+	started    time.Time
+	lastReport time.Time
+	lastKeys   int64
+	// startBytes is liveStats' count of matched bytes when the scan started.
+	startBytes int64
+}
+
+func newScanProgress(totalKeys int64) *scanProgress {
+	now := time.Now()
+	return &scanProgress{
+		TotalKeys:  totalKeys,
+		Interval:   time.Duration(envInt("PROGRESS_INTERVAL", 30)) * time.Second,
+		Keys:       envInt64("PROGRESS_KEYS", 0),
+		Terminal:   isTerminal(os.Stderr),
+		started:    now,
+		lastReport: now,
+		startBytes: liveStats.MatchedBytes(),
+	}
+}
+
+// rates returns the time since the scan started and the rates of keys
+// visited and bytes matched since.
+func (p *scanProgress) rates(visited int64, now time.Time) (elapsed time.Duration, keyRate, byteRate float64) {
+	elapsed = now.Sub(p.started)
+	if elapsed > 0 {
+		keyRate = float64(visited) / elapsed.Seconds()
+		byteRate = float64(liveStats.MatchedBytes()-p.startBytes) / elapsed.Seconds()
+	}
+	return elapsed, keyRate, byteRate
+}
+
+// Report records that a batch of batchSize keys starting at key index
+// visited is being visited, with matched keys matched so far.
+func (p *scanProgress) Report(visited, batchSize, matched int64) {
+	if p.Terminal {
+		_, keyRate, byteRate := p.rates(visited, time.Now())
+		// The parts are in order of importance, since the last are left out
+		// of a line too long for the terminal.
+		progressLine.Draw(
+			fmt.Sprintf("Visiting keys %d-%d of %d (%.2f%%)", visited, visited+batchSize, p.TotalKeys, percentage(visited+batchSize, p.TotalKeys)),
+			"eta "+estimateRemaining(visited, p.TotalKeys, keyRate),
+			fmt.Sprintf("%.1f keys/s", keyRate),
+			fmt.Sprintf("%.0f bytes/s matched", byteRate))
+		return
+	}
+	p.Visited(visited, matched)
+}
+
+// Visited records that visited keys have been visited, with matched keys
+// matched so far, logging a summary line if one is due. It's called for each
+// key, as well as each batch, so that a batch that takes a long time to
+// visit, such as with throttled deletes, doesn't leave the log silent.
+func (p *scanProgress) Visited(visited, matched int64) {
+	if p.Terminal {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.lastReport) < p.Interval && (p.Keys <= 0 || visited-p.lastKeys < p.Keys) {
+		return
+	}
+	p.lastReport, p.lastKeys = now, visited
+	p.logSummary(visited, matched, now)
+}
+
+// Finish logs a final summary line for non-terminal output, so that logs
+// always record the end state of the scan.
+func (p *scanProgress) Finish(visited, matched int64) {
+	if p.Terminal {
+		progressLine.Erase()
+		return
+	}
+	p.logSummary(visited, matched, time.Now())
+}
+
+func (p *scanProgress) logSummary(visited, matched int64, now time.Time) {
+	elapsed, keyRate, byteRate := p.rates(visited, now)
+	fmt.Fprintf(os.Stderr, "> progress: visited %d of %d keys (%.2f%%), matched %d, %.1f keys/s, %.0f bytes/s matched, elapsed %s, eta %s\n",
+		visited, p.TotalKeys, percentage(visited, p.TotalKeys), matched, keyRate, byteRate,
+		elapsed.Round(time.Second), estimateRemaining(visited, p.TotalKeys, keyRate))
+}
+
+// estimateRemaining returns a printable estimate of the time needed to visit
+// the rest of total keys at rate keys/s, or "?" if there's no estimate yet.
+func estimateRemaining(visited, total int64, rate float64) string {
+	if rate <= 0 {
+		return "?"
+	}
+	remaining := total - visited
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second).String()
+}
+
+// progressLine is the status line a scanProgress redraws on a terminal.
+// Output to the same terminal hides it while writing, so that the two don't
+// garble each other.
+var progressLine terminalLine
+
+// A terminalLine is a status line, redrawn in place at the bottom of a
+// terminal.
+type terminalLine struct {
+	mu   sync.Mutex
+	text string
+}
+
+// Draw draws parts, joined with commas, as the status line, leaving out the
+// last parts, or else truncating the first, to fit the width of the terminal.
+func (l *terminalLine) Draw(parts ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.text = fitLine(parts, terminalWidth())
+	// \033[K clears the rest of a longer line drawn before.
+	fmt.Fprint(os.Stderr, l.text+"\033[K\r")
+}
+
+// Hide clears the status line, if drawn, until Show draws it again.
+func (l *terminalLine) Hide() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.text != "" {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+// Show draws the status line again after Hide.
+func (l *terminalLine) Show() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.text != "" {
+		fmt.Fprint(os.Stderr, l.text+"\033[K\r")
+	}
+}
+
+// Erase clears the status line for good, until it's drawn anew.
+func (l *terminalLine) Erase() {
+	l.Hide()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.text = ""
+}
+
+// terminalWidth returns the width of the terminal on stderr, or else
+// COLUMNS, or else 80.
+func terminalWidth() int {
+	if columns := terminalColumns(os.Stderr); columns > 0 {
+		return columns
+	}
+	if columns := envInt("COLUMNS", 0); columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+// fitLine joins parts with commas, leaving out as many of the last parts,
+// and then truncating the first, as needed to fit in fewer than width
+// columns, since a line as wide as the terminal may wrap.
+func fitLine(parts []string, width int) string {
+	for n := len(parts); n > 1; n-- {
+		if line := strings.Join(parts[:n], ", "); len(line) < width {
+			return line
+		}
+	}
+	line := parts[0]
+	if len(line) >= width {
+		if width <= 4 {
+			return ""
+		}
+		line = line[:width-4] + "..."
+	}
+	return line
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// keyProtection keeps a run from acting on protected keys. Unlike excluded
+// keys, which are skipped unread, protected keys are read and matched as
+// usual, and every protected key that would have matched is reported, so
+// that near misses can be audited.
+type keyProtection struct {
+	Patterns keyPatternList
+
+	// silent protects keys without reporting them.
+	silent bool
+
+	nearMisses     int64
+	nearMissesSize int64
+}
+
+// envKeyProtection returns the protection configured by
+// PROTECTED_KEY_PATTERNS, or nil if no keys are protected.
+func envKeyProtection() (*keyProtection, error) {
+	patterns, err := parseKeyPatternList(os.Getenv("PROTECTED_KEY_PATTERNS"))
+	if err != nil || patterns.Empty() {
+		return nil, err
+	}
+	return &keyProtection{Patterns: patterns}, nil
+}
+
+// Protects reports whether key, which matched a search (or the named rule),
+// is protected, reporting it if so. Protects on a nil keyProtection protects
+// nothing.
+func (p *keyProtection) Protects(key string, size int, rule string) bool {
+	if p == nil || !p.Patterns.Matches(key) {
+		return false
+	}
+	if p.silent {
+		return true
+	}
+	p.nearMisses++
+	p.nearMissesSize += int64(size)
+	if rule != "" {
+		fmt.Fprintf(os.Stderr, "> [%s] protected key %#v (size = %d) matched, leaving it alone\n", rule, key, size)
+	} else {
+		fmt.Fprintf(os.Stderr, "> protected key %#v (size = %d) matched, leaving it alone\n", key, size)
+	}
+	return true
+}
+
+// Guard returns an error if key is protected, as a final check before any
+// destructive command, whichever path led to it. Guard on a nil
+// keyProtection allows every key.
+func (p *keyProtection) Guard(key string) error {
+	if p == nil || !p.Patterns.Matches(key) {
+		return nil
+	}
+	return fmt.Errorf("key %#v is protected by PROTECTED_KEY_PATTERNS %s", key, p.Patterns)
+}
+
+// Report prints the count of protected keys that matched. Report on a nil
+// keyProtection does nothing.
+func (p *keyProtection) Report() {
+	if p == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "> %d protected keys (total size: %d) matching %s matched and were left alone\n",
+		p.nearMisses, p.nearMissesSize, p.Patterns)
+}
+
+// quiet returns a copy of p that protects the same keys, but doesn't report
+// or count them, for passes that don't act on keys. quiet on a nil
+// keyProtection returns nil.
+func (p *keyProtection) quiet() *keyProtection {
+	if p == nil {
+		return nil
+	}
+	return &keyProtection{Patterns: p.Patterns, silent: true}
+}
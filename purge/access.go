@@ -0,0 +1,289 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// An AccessMode says how the values of keys are read: as strings, hashes,
+// collections or RedisJSON documents.
+type AccessMode int
+
+const (
+	AccessString AccessMode = iota
+	AccessHash
+	AccessList
+	AccessSet
+	AccessZSet
+	AccessStream
+	AccessJSON
+)
+
+// CollectionPageSize is the number of elements read per command from
+// collection values, so that huge collections aren't read in one reply.
+const CollectionPageSize = 1000
+
+// ParseAccessMode returns the access mode called accessMode, in any case:
+// string, list, set, zset, stream or json, or else hash.
+func ParseAccessMode(accessMode string) AccessMode {
+	switch strings.ToLower(accessMode) {
+	case "string":
+		return AccessString
+	case "list":
+		return AccessList
+	case "set":
+		return AccessSet
+	case "zset":
+		return AccessZSet
+	case "stream":
+		return AccessStream
+	case "json":
+		return AccessJSON
+	default:
+		return AccessHash
+	}
+}
+
+func (v AccessMode) String() string {
+	switch v {
+	case AccessString:
+		return "string"
+	case AccessHash:
+		return "hash"
+	case AccessList:
+		return "list"
+	case AccessSet:
+		return "set"
+	case AccessZSet:
+		return "zset"
+	case AccessStream:
+		return "stream"
+	case AccessJSON:
+		return "json"
+	default:
+		return "?"
+	}
+}
+
+// IsCollection reports whether values read with v are collections of
+// elements, which can be matched element by element.
+func (v AccessMode) IsCollection() bool {
+	return v == AccessList || v == AccessSet || v == AccessZSet || v == AccessStream
+}
+
+// RedisType returns the Redis type (as reported by TYPE) of keys read with
+// v.
+func (v AccessMode) RedisType() string {
+	if v == AccessJSON {
+		return "ReJSON-RL"
+	}
+	return v.String()
+}
+
+// Get reads the value of key: a string as is, a hash as its fields and values
+// concatenated (see HashAsBytes), a collection as its elements concatenated,
+// and a RedisJSON document as JSON. A missing key returns redis.Nil for
+// strings and JSON documents, and an empty value otherwise.
+func (v AccessMode) Get(ctx context.Context, c *redis.Client, key string) (body []byte, err error) {
+	switch v {
+	case AccessString:
+		return c.Get(ctx, key).Bytes()
+	case AccessHash:
+		hashValue, err := c.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("valueAccessHash[%#v]: %w", key, err)
+		}
+		return HashAsBytes(hashValue), nil
+	case AccessJSON:
+		return JSONGet(ctx, c, key, "")
+	case AccessList, AccessSet, AccessZSet, AccessStream:
+		elements, err := v.Elements(ctx, c, key)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Join(elements, nil), nil
+	}
+	panic(fmt.Sprintf("impossible AccessMode: %d", v))
+}
+
+// Elements reads the elements of the collection at key, CollectionPageSize
+// at a time: the members of sets and sorted sets (without their scores), and
+// one element per stream entry, of the entry's field values concatenated in
+// field name order.
+func (v AccessMode) Elements(ctx context.Context, c *redis.Client, key string) ([][]byte, error) {
+	switch v {
+	case AccessList:
+		return listElements(ctx, c, key)
+	case AccessSet:
+		return setElements(ctx, c, key)
+	case AccessZSet:
+		return zsetElements(ctx, c, key)
+	case AccessStream:
+		return streamElements(ctx, c, key)
+	}
+	return nil, fmt.Errorf("access mode %s values have no elements", v)
+}
+
+// A ValueSource says which part of a key's value a search reads: the whole
+// value, read according to AccessMode, only HashField of a hash, or only the
+// parts of a JSON document selected by JSONPath.
+type ValueSource struct {
+	AccessMode AccessMode
+	HashField  string
+	JSONPath   string
+}
+
+// Get reads the part of the value of key that v says, returning redis.Nil if
+// there's no such value.
+func (v ValueSource) Get(ctx context.Context, c *redis.Client, key string) (body []byte, err error) {
+	if v.AccessMode == AccessHash && v.HashField != "" {
+		return c.HGet(ctx, key, v.HashField).Bytes()
+	}
+	if v.AccessMode == AccessJSON {
+		return JSONGet(ctx, c, key, v.JSONPath)
+	}
+	return v.AccessMode.Get(ctx, c, key)
+}
+
+// HashAsBytes returns the fields and values of a hash, concatenated, which is
+// how hashes are matched and sized.
+func HashAsBytes(valueHash map[string]string) []byte {
+	byteBuf := &bytes.Buffer{}
+	for key, value := range valueHash {
+		byteBuf.Write([]byte(key))
+		byteBuf.Write([]byte(value))
+	}
+	return byteBuf.Bytes()
+}
+
+// JSONGet reads the RedisJSON document at key with JSON.GET, or only the
+// parts of it selected by path, if path is not empty. A path that selects
+// nothing is treated like a missing key, returning redis.Nil.
+func JSONGet(ctx context.Context, c *redis.Client, key, path string) ([]byte, error) {
+	return JSONDocument(c.Do(ctx, JSONGetArgs(key, path)...), key, path)
+}
+
+// JSONGetArgs returns the JSON.GET command for JSONGet, for callers that
+// pipeline it.
+func JSONGetArgs(key, path string) []interface{} {
+	args := []interface{}{"json.get", key}
+	if path != "" {
+		args = append(args, path)
+	}
+	return args
+}
+
+// JSONDocument returns the document read by a JSON.GET command from
+// JSONGetArgs.
+func JSONDocument(cmd *redis.Cmd, key, path string) ([]byte, error) {
+	document, err := cmd.Text()
+	if err == redis.Nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("valueAccessJSON[%#v]: %w", key, err)
+	}
+	// JSONPath queries ($...) return a JSON array of everything selected.
+	if document == "[]" && path != "" {
+		return nil, redis.Nil
+	}
+	return []byte(document), nil
+}
+
+func listElements(ctx context.Context, c *redis.Client, key string) ([][]byte, error) {
+	var elements [][]byte
+	for start := int64(0); ; start += CollectionPageSize {
+		page, err := c.LRange(ctx, key, start, start+CollectionPageSize-1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("valueAccessList[%#v]: %w", key, err)
+		}
+		for _, element := range page {
+			elements = append(elements, []byte(element))
+		}
+		if len(page) < CollectionPageSize {
+			return elements, nil
+		}
+	}
+}
+
+func setElements(ctx context.Context, c *redis.Client, key string) ([][]byte, error) {
+	var elements [][]byte
+	var cursor uint64
+	for {
+		members, nextCursor, err := c.SScan(ctx, key, cursor, "", CollectionPageSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("valueAccessSet[%#v]: %w", key, err)
+		}
+		for _, member := range members {
+			elements = append(elements, []byte(member))
+		}
+		if nextCursor == 0 {
+			return elements, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// zsetElements returns the members of the sorted set at key, without their
+// scores.
+func zsetElements(ctx context.Context, c *redis.Client, key string) ([][]byte, error) {
+	var elements [][]byte
+	var cursor uint64
+	for {
+		membersAndScores, nextCursor, err := c.ZScan(ctx, key, cursor, "", CollectionPageSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("valueAccessZSet[%#v]: %w", key, err)
+		}
+		for i := 0; i < len(membersAndScores); i += 2 {
+			elements = append(elements, []byte(membersAndScores[i]))
+		}
+		if nextCursor == 0 {
+			return elements, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// streamElements returns one element per entry of the stream at key: the
+// entry's field values, concatenated in field name order.
+func streamElements(ctx context.Context, c *redis.Client, key string) ([][]byte, error) {
+	var elements [][]byte
+	start := "-"
+	for {
+		entries, err := c.XRangeN(ctx, key, start, "+", CollectionPageSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("valueAccessStream[%#v]: %w", key, err)
+		}
+		// XRANGE's start is inclusive, so every page after the first repeats
+		// the last entry of the previous page.
+		if start != "-" && len(entries) > 0 && entries[0].ID == start {
+			entries = entries[1:]
+		}
+		for _, entry := range entries {
+			elements = append(elements, streamEntryAsBytes(entry))
+		}
+		if len(entries) == 0 {
+			return elements, nil
+		}
+		start = entries[len(entries)-1].ID
+	}
+}
+
+func streamEntryAsBytes(entry redis.XMessage) []byte {
+	fields := make([]string, 0, len(entry.Values))
+	for field := range entry.Values {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var byteBuf bytes.Buffer
+	for _, field := range fields {
+		fmt.Fprint(&byteBuf, entry.Values[field])
+	}
+	return byteBuf.Bytes()
+}
@@ -0,0 +1,110 @@
+package purge
+
+// acMinPatterns is the number of search patterns from which Matcher counts
+// occurrences with an Aho–Corasick automaton: for fewer, one bytes.Count per
+// pattern is faster.
+const acMinPatterns = 4
+
+// An acAutomaton is an Aho–Corasick automaton, which finds the occurrences
+// of many patterns in one pass over a value. Transitions are a table indexed
+// by state and byte class, where bytes that appear in no pattern share a
+// class, so that each byte costs one lookup.
+type acAutomaton struct {
+	lengths []int
+	classOf [256]int32
+	classes int
+	// next[state*classes+class] is the state after reading a byte of class.
+	next []int32
+	// outputs[state] are the patterns that end at state.
+	outputs [][]int
+}
+
+func newACAutomaton(patterns [][]byte) *acAutomaton {
+	a := &acAutomaton{lengths: make([]int, len(patterns)), classes: 1}
+	for _, pattern := range patterns {
+		for _, b := range pattern {
+			if a.classOf[b] == 0 {
+				a.classOf[b] = int32(a.classes)
+				a.classes++
+			}
+		}
+	}
+
+	// Build the trie of patterns; state 0 is the root, so 0 also marks
+	// missing children until they're filled in below.
+	a.next = make([]int32, a.classes)
+	a.outputs = [][]int{nil}
+	for i, pattern := range patterns {
+		a.lengths[i] = len(pattern)
+		state := 0
+		for _, b := range pattern {
+			slot := state*a.classes + int(a.classOf[b])
+			if a.next[slot] == 0 {
+				a.next = append(a.next, make([]int32, a.classes)...)
+				a.outputs = append(a.outputs, nil)
+				a.next[slot] = int32(len(a.outputs) - 1)
+			}
+			state = int(a.next[slot])
+		}
+		a.outputs[state] = append(a.outputs[state], i)
+	}
+
+	// Breadth first, link each state to the state of its longest proper
+	// suffix, and turn missing children into transitions along that link.
+	fail := make([]int32, len(a.outputs))
+	var queue []int32
+	for class := 0; class < a.classes; class++ {
+		if child := a.next[class]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := int(queue[0])
+		queue = queue[1:]
+		a.outputs[state] = append(a.outputs[state], a.outputs[fail[state]]...)
+		for class := 0; class < a.classes; class++ {
+			slot := state*a.classes + class
+			suffixNext := a.next[int(fail[state])*a.classes+class]
+			if child := a.next[slot]; child != 0 {
+				fail[child] = suffixNext
+				queue = append(queue, child)
+			} else {
+				a.next[slot] = suffixNext
+			}
+		}
+	}
+	return a
+}
+
+// patternsMatch reports whether value contains any (or, if matchAll, each)
+// of the patterns at least occurrences times, counting non-overlapping
+// occurrences of each pattern as bytes.Count does.
+func (a *acAutomaton) patternsMatch(value []byte, occurrences int, matchAll bool) bool {
+	counts := make([]int, len(a.lengths))
+	// nextStart[p] is where the next counted occurrence of pattern p may
+	// start, after the end of the last one.
+	nextStart := make([]int, len(a.lengths))
+	satisfied := 0
+	state := 0
+	for i, b := range value {
+		state = int(a.next[state*a.classes+int(a.classOf[b])])
+		for _, pattern := range a.outputs[state] {
+			start := i + 1 - a.lengths[pattern]
+			if start < nextStart[pattern] || counts[pattern] >= occurrences {
+				continue
+			}
+			counts[pattern]++
+			nextStart[pattern] = i + 1
+			if counts[pattern] == occurrences {
+				if !matchAll {
+					return true
+				}
+				satisfied++
+				if satisfied == len(a.lengths) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
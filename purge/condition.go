@@ -0,0 +1,228 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A Condition specifies how to find a Redis value of interest
+type Condition struct {
+	// AccessMode specifies how redis values should be read, whether
+	// as simple strings, or hashes.
+	AccessMode AccessMode
+
+	// HashField, in hash access mode, restricts the search to a single
+	// field of each hash, read with HGET instead of HGETALL.
+	HashField string
+
+	// JSONPath, in json access mode, restricts the search to the parts of
+	// each document selected by a JSONPath (or legacy RedisJSON path)
+	// expression, passed to JSON.GET.
+	JSONPath string
+
+	// MatchElements, in collection access modes (e.g. list), matches each
+	// element of the collection separately, selecting the key if any element
+	// matches. Otherwise the elements are concatenated and matched as one
+	// value.
+	MatchElements bool
+
+	// HashMatch, in hash access mode, requires the named hash fields to
+	// satisfy comparisons, read with HMGET of just those fields. If there
+	// are no Search patterns or size limits, the rest of the hash is never
+	// read.
+	HashMatch []FieldCondition
+
+	// KeyPattern is a Redis glob pattern that restricts the search to
+	// matching keys, passed to SCAN as its MATCH argument. An empty
+	// KeyPattern searches all keys.
+	KeyPattern string
+
+	// SizeThreshold is the minimum size of a search value to be considered
+	SizeThreshold int
+
+	// SizeMax is the maximum size of a search value to be considered, if > 0
+	SizeMax int
+
+	// Search is the list of alternative exact or substring matches for a
+	// value to be considered. A value is considered if it matches any of
+	// the Search patterns; an empty Search matches any value.
+	Search []string
+
+	// Occurrences is the minimum number of occurrences of a search string
+	// for a value to be considered. If Occurrences == 0, requires an exact
+	// match of Search to the value.
+	Occurrences int
+
+	// MatchAll requires a value to match every Search pattern, instead of
+	// any one of them.
+	MatchAll bool
+
+	// Negate inverts the Search match, so that only values that do not
+	// match the Search patterns are considered. SizeThreshold still applies
+	// as usual.
+	Negate bool
+}
+
+// ValueSource returns the ValueSource to read values for s.
+func (s *Condition) ValueSource() ValueSource {
+	return ValueSource{AccessMode: s.AccessMode, HashField: s.HashField, JSONPath: s.JSONPath}
+}
+
+// ReadsWholeValue reports whether s needs the value from ValueSource, rather
+// than only the fields compared by HashMatch.
+func (s *Condition) ReadsWholeValue() bool {
+	return len(s.Search) > 0 || s.SizeThreshold > 0 || s.SizeMax > 0
+}
+
+// MatchesAll reports whether s matches every key that fits its key pattern
+// and size limits, having no search values or HashMatch.
+func (s *Condition) MatchesAll() bool {
+	return len(s.Search) == 0 && len(s.HashMatch) == 0
+}
+
+// Validate returns an error if s can never match any value.
+func (s *Condition) Validate() error {
+	if s.HashField != "" && s.AccessMode != AccessHash {
+		return fmt.Errorf("HashField requires AccessHash")
+	}
+	if s.JSONPath != "" && s.AccessMode != AccessJSON {
+		return fmt.Errorf("JSONPath requires AccessJSON")
+	}
+	if s.MatchElements && !s.AccessMode.IsCollection() {
+		return fmt.Errorf("MatchElements requires a collection AccessMode, not %s", s.AccessMode)
+	}
+	if len(s.HashMatch) > 0 && s.AccessMode != AccessHash {
+		return fmt.Errorf("HashMatch requires AccessHash")
+	}
+	if s.MatchAll && s.Occurrences <= 0 && len(s.Search) > 1 {
+		return fmt.Errorf("MatchAll with %d search values requires Occurrences > 0", len(s.Search))
+	}
+	if s.SizeMax > 0 && s.SizeMax < s.SizeThreshold {
+		return fmt.Errorf("SizeMax %d is smaller than SizeThreshold %d", s.SizeMax, s.SizeThreshold)
+	}
+	if s.Negate && len(s.Search) == 0 {
+		return fmt.Errorf("Negate requires a search value")
+	}
+	return nil
+}
+
+func (s *Condition) searchDescription() string {
+	if len(s.Search) == 0 {
+		return "(any)"
+	}
+	quotedPatterns := make([]string, len(s.Search))
+	for i, pattern := range s.Search {
+		quotedPatterns[i] = fmt.Sprintf("%#v", pattern)
+	}
+	joiner := " OR "
+	if s.MatchAll {
+		joiner = " AND "
+	}
+	description := strings.Join(quotedPatterns, joiner)
+	if s.Negate {
+		return "NOT (" + description + ")"
+	}
+	return description
+}
+
+func (s *Condition) String() string {
+	var description bytes.Buffer
+	fmt.Fprintf(&description, "(access-mode=%s)", s.AccessMode.String())
+	if s.HashField != "" {
+		fmt.Fprintf(&description, " (field=%s)", s.HashField)
+	}
+	if s.JSONPath != "" {
+		fmt.Fprintf(&description, " (path=%s)", s.JSONPath)
+	}
+	if s.MatchElements {
+		fmt.Fprint(&description, " (per-element)")
+	}
+	if len(s.HashMatch) > 0 {
+		fmt.Fprintf(&description, " (fields: %s)", DescribeFieldConditions(s.HashMatch))
+	}
+	if s.KeyPattern != "" {
+		fmt.Fprintf(&description, " (keys=%s)", s.KeyPattern)
+	}
+	fmt.Fprintf(&description, " Search=%s", s.searchDescription())
+	if s.SizeThreshold > 0 {
+		fmt.Fprintf(&description, " (size >= %d bytes)", s.SizeThreshold)
+	}
+	if s.SizeMax > 0 {
+		fmt.Fprintf(&description, " (size <= %d bytes)", s.SizeMax)
+	}
+	if len(s.Search) > 0 {
+		if s.Occurrences <= 0 {
+			fmt.Fprint(&description, " (exact match)")
+		} else {
+			fmt.Fprintf(&description, " (match >= %d occurrences)", s.Occurrences)
+		}
+	}
+	return description.String()
+}
+
+// Matcher returns a function that accepts a Redis key's value and returns
+// true if the value satisfies the Condition s
+func (s *Condition) Matcher() func(value []byte) bool {
+	searchBytes := make([][]byte, len(s.Search))
+	for i, pattern := range s.Search {
+		searchBytes[i] = []byte(pattern)
+	}
+
+	var automaton *acAutomaton
+	if s.Occurrences > 0 && len(searchBytes) >= acMinPatterns {
+		automaton = newACAutomaton(searchBytes)
+	}
+
+	return func(value []byte) bool {
+		if !s.SizeMatches(len(value)) {
+			return false
+		}
+
+		if len(searchBytes) == 0 {
+			return true
+		}
+
+		if automaton != nil {
+			return automaton.patternsMatch(value, s.Occurrences, s.MatchAll) != s.Negate
+		}
+		return s.patternsMatch(value, searchBytes) != s.Negate
+	}
+}
+
+// SizeMatches reports whether size is within SizeThreshold and SizeMax.
+func (s *Condition) SizeMatches(size int) bool {
+	return size >= s.SizeThreshold && (s.SizeMax <= 0 || size <= s.SizeMax)
+}
+
+func (s *Condition) patternsMatch(value []byte, patterns [][]byte) bool {
+	for _, pattern := range patterns {
+		matched := s.patternMatches(value, pattern)
+		if matched && !s.MatchAll {
+			return true
+		}
+		if !matched && s.MatchAll {
+			return false
+		}
+	}
+	return s.MatchAll
+}
+
+func (s *Condition) patternMatches(value, pattern []byte) bool {
+	if s.Occurrences <= 0 {
+		return bytes.Equal(value, pattern)
+	}
+	return bytes.Count(value, pattern) >= s.Occurrences
+}
+
+// Match reads the value of key with c and checks it against s, using
+// valueMatches from s.Matcher(), returning the value read and its size. A
+// missing key doesn't match. A Reader matches keys the same way, with more
+// ways to read their values.
+func (s *Condition) Match(ctx context.Context, c *redis.Client, key string, valueMatches func(value []byte) bool) (value []byte, size int, matched bool, err error) {
+	r := &Reader{client: c, cond: s, valueMatches: valueMatches}
+	return r.read(ctx, key, nil)
+}
@@ -0,0 +1,57 @@
+// Package purge is the search engine of redis-purge: it finds the keys of a
+// Redis database whose values match a Condition, and lists or deletes them,
+// for Go services that purge keys themselves instead of running the
+// redis-purge command.
+//
+// A Condition says how values are read (AccessMode, HashField, JSONPath,
+// MatchElements), which keys are read (KeyPattern), and which values match:
+// exactly or by Occurrences of any (or, with MatchAll, every) Search pattern,
+// optionally Negated, within size limits, and with HashMatch comparisons of
+// hash fields. A Purger scans a database for keys matching a Condition:
+//
+//	purger := &purge.Purger{Client: client, Unlink: true}
+//	stats, err := purger.Delete(ctx, &purge.Condition{
+//		AccessMode: purge.AccessHash,
+//		HashMatch:  []purge.FieldCondition{{Field: "state", Op: "=", Value: "expired"}},
+//		KeyPattern: "session:*",
+//	}, func(match purge.Match) error {
+//		log.Printf("deleted %s (%d bytes)", match.Key, match.Size)
+//		return nil
+//	})
+//
+// Purger.Matches returns the matching keys as a MatchIterator instead, which
+// scans lazily, as far as it's read, for callers that act on matches their
+// own way:
+//
+//	matches := purger.Matches(ctx, cond)
+//	for matches.Next() {
+//		if err := archive(matches.Match().Key); err == nil {
+//			matches.Delete()
+//		}
+//	}
+//	if err := matches.Err(); err != nil {
+//		...
+//	}
+//
+// A Purger's ReadOptions say how values are read: a SCAN step's values
+// together in one round trip, on several workers, streamed in chunks, or
+// only their sizes. Its Hooks are called around each SCAN step and before
+// and after each key is read, matched and deleted, for logging, progress,
+// checkpoints, notifications, or vetoes: a hook returning ErrSkip skips the
+// key, and ErrStop ends the scan early. Hooks.Delete runs the delete hooks
+// around a delete done some other way.
+//
+// An OutputSink receives a Record of every matched key, with what was done
+// to it. The redis-purge command's stdout, file, NDJSON, CSV and HTTP sinks
+// implement it, and several can receive a purge's matches at once.
+//
+// The lower layers are exported too, for callers that scan or read values
+// their own way: Purger.Keys iterates over the keys of a scan, Scan runs one
+// SCAN step, a Reader reads and matches the values of keys as a Purger does,
+// ValueSource.Get and AccessMode.Elements read values, and Condition.Matcher,
+// Condition.Match and Condition.StreamMatcher match them.
+//
+// The redis-purge command adds everything a purge of a production database
+// needs around this engine: dry runs, confirmations and approvals, backups,
+// throttling, replicas, checkpoints, reports and more. See its README.
+package purge
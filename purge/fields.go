@@ -0,0 +1,109 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A FieldCondition compares one field of a hash with a value.
+type FieldCondition struct {
+	Field string
+
+	// Op is one of "=" (equals), "!=" (not equals), "~" (contains) or "!~"
+	// (does not contain).
+	Op    string
+	Value string
+}
+
+func (h FieldCondition) String() string {
+	return h.Field + h.Op + h.Value
+}
+
+// Matches reports whether the field value satisfies h. present is false if
+// the hash has no such field. A missing field satisfies no condition, not
+// even != or !~, so that status!=active doesn't match every hash without a
+// status.
+func (h FieldCondition) Matches(value string, present bool) bool {
+	if !present {
+		return false
+	}
+	switch h.Op {
+	case "=":
+		return value == h.Value
+	case "!=":
+		return value != h.Value
+	case "~":
+		return strings.Contains(value, h.Value)
+	case "!~":
+		return !strings.Contains(value, h.Value)
+	}
+	panic(fmt.Sprintf("impossible FieldCondition op: %#v", h.Op))
+}
+
+// ParseFieldConditions parses ;-separated field comparisons such as
+// status=deleted;plan!=enterprise;notes~spam, all of which must hold.
+func ParseFieldConditions(spec string) ([]FieldCondition, error) {
+	var conditions []FieldCondition
+	for _, comparison := range strings.Split(spec, ";") {
+		if strings.TrimSpace(comparison) == "" {
+			continue
+		}
+		opIndex := strings.IndexAny(comparison, "!=~")
+		if opIndex <= 0 {
+			return nil, fmt.Errorf("bad field comparison %#v: expected field=value, field!=value, field~value or field!~value", comparison)
+		}
+		op := comparison[opIndex : opIndex+1]
+		if op == "!" {
+			if opIndex+1 >= len(comparison) || (comparison[opIndex+1] != '=' && comparison[opIndex+1] != '~') {
+				return nil, fmt.Errorf("bad field comparison %#v: ! must be followed by = or ~", comparison)
+			}
+			op = comparison[opIndex : opIndex+2]
+		}
+		conditions = append(conditions, FieldCondition{
+			Field: comparison[:opIndex],
+			Op:    op,
+			Value: comparison[opIndex+len(op):],
+		})
+	}
+	return conditions, nil
+}
+
+// DescribeFieldConditions describes conditions, all of which must hold.
+func DescribeFieldConditions(conditions []FieldCondition) string {
+	descriptions := make([]string, len(conditions))
+	for i, condition := range conditions {
+		descriptions[i] = condition.String()
+	}
+	return strings.Join(descriptions, " AND ")
+}
+
+// MatchFields reads just the fields named in conditions from the hash at key
+// with HMGET, and reports whether they satisfy every condition. The fields
+// and values read are returned concatenated, as HashAsBytes would.
+func MatchFields(ctx context.Context, c *redis.Client, key string, conditions []FieldCondition) (matched bool, fieldValues []byte, err error) {
+	fields := make([]string, len(conditions))
+	for i, condition := range conditions {
+		fields[i] = condition.Field
+	}
+	values, err := c.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return false, nil, fmt.Errorf("HMGET %#v: %w", key, err)
+	}
+
+	var byteBuf bytes.Buffer
+	for i, condition := range conditions {
+		value, present := values[i].(string)
+		if !condition.Matches(value, present) {
+			return false, nil, nil
+		}
+		if present {
+			byteBuf.WriteString(condition.Field)
+			byteBuf.WriteString(value)
+		}
+	}
+	return true, byteBuf.Bytes(), nil
+}
@@ -0,0 +1,229 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrSkip, returned by a hook, skips the key it was called with: the key is
+// counted in Stats.Skipped, and the scan carries on.
+var ErrSkip = errors.New("purge: key skipped by hook")
+
+// ErrStop, returned by a hook, ends the scan early without an error, as if
+// the keyspace had been scanned. The scan can be resumed from the iterator's
+// Cursor.
+var ErrStop = errors.New("purge: scan stopped by hook")
+
+// A ScanStep is one SCAN step of a scan of the keyspace, as seen by the step
+// hooks.
+type ScanStep struct {
+	// Cursor is the cursor the step scans from, which is where a scan
+	// stopped part way through the step resumes.
+	Cursor uint64
+	// Count is the COUNT hint passed to SCAN. PreScan may change it.
+	Count int64
+	// NextCursor is the cursor SCAN returned, 0 at the end of the keyspace.
+	NextCursor uint64
+	// Keys are the keys SCAN returned. PostScan may drop keys from it, so
+	// that they're skipped without being counted, and the keys PreMatch
+	// skips are dropped from it before PreRead and PreVisit.
+	Keys []string
+}
+
+// Hooks are called as a Purger works through the keyspace, for callers to log,
+// notify, veto keys, or follow the scan's progress. Any of them may be nil. A
+// hook returning ErrSkip vetoes the key, ErrStop ends the scan early, and any
+// other error ends the scan with it.
+type Hooks struct {
+	// PreScan is called before each SCAN step.
+	PreScan func(ctx context.Context, step *ScanStep) error
+
+	// PostScan is called with the keys of each SCAN step, before any of them
+	// is matched.
+	PostScan func(ctx context.Context, step *ScanStep) error
+
+	// PreRead is called with the keys of each SCAN step that passed
+	// PreMatch, before their values are read, if they're read ahead
+	// together: see Reader.ReadsAhead.
+	PreRead func(ctx context.Context, step *ScanStep) error
+
+	// PreVisit is called with the keys of each SCAN step that passed
+	// PreMatch, once any values read ahead have been read, before the first
+	// of them is returned.
+	PreVisit func(ctx context.Context, step *ScanStep) error
+
+	// PostStep is called once every key of a SCAN step has been returned
+	// and acted on, when the iterator is advanced past them. A scan that
+	// ends part way through a step never calls it for that step.
+	PostStep func(ctx context.Context, step *ScanStep) error
+
+	// PreMatch is called with each scanned key, before its value is read.
+	PreMatch func(ctx context.Context, key string) error
+
+	// PostRead is called with what was read of each key, whether or not it
+	// matched or could be read, before PostMatch.
+	PostRead func(ctx context.Context, read ReadResult) error
+
+	// PostMatch is called with each matching key, before it's returned from
+	// MatchIterator.Next, so that a vetoed key isn't counted in Stats.Matched.
+	PostMatch func(ctx context.Context, match Match) error
+
+	// PreDelete is called with each key just before it's deleted, or in a
+	// DryRun, would have been.
+	PreDelete func(ctx context.Context, match Match) error
+
+	// PostDelete is called with each key that was deleted, or failed to be,
+	// with the error. It's not called for keys PreDelete vetoed.
+	PostDelete func(ctx context.Context, match Match, err error)
+}
+
+// A DeleteError is a key that failed to delete, as returned by Hooks.Delete
+// and MatchIterator.Delete.
+type DeleteError struct {
+	Key string
+	Err error
+}
+
+func (e *DeleteError) Error() string {
+	return fmt.Sprintf("couldn't delete %#v: %s", e.Key, e.Err)
+}
+
+func (e *DeleteError) Unwrap() error {
+	return e.Err
+}
+
+// Delete deletes match with del, calling PreDelete before and PostDelete
+// after, as MatchIterator.Delete does, for callers that delete matches their
+// own way, or found earlier. It returns the error from PreDelete, such as
+// ErrSkip for a vetoed key, or a DeleteError if del fails.
+func (h Hooks) Delete(ctx context.Context, match Match, del func(ctx context.Context, key string) error) error {
+	if h.PreDelete != nil {
+		if err := h.PreDelete(ctx, match); err != nil {
+			return err
+		}
+	}
+	err := del(ctx, match.Key)
+	if err != nil {
+		err = &DeleteError{Key: match.Key, Err: err}
+	}
+	if h.PostDelete != nil {
+		h.PostDelete(ctx, match, err)
+	}
+	return err
+}
+
+// ChainHooks returns Hooks that call each of hooks in turn, stopping at the
+// first that returns an error. PostDelete hooks are all called.
+func ChainHooks(hooks ...Hooks) Hooks {
+	var chain Hooks
+	for _, h := range hooks {
+		chain.PreScan = chainSteps(chain.PreScan, h.PreScan)
+		chain.PostScan = chainSteps(chain.PostScan, h.PostScan)
+		chain.PreRead = chainSteps(chain.PreRead, h.PreRead)
+		chain.PreVisit = chainSteps(chain.PreVisit, h.PreVisit)
+		chain.PostStep = chainSteps(chain.PostStep, h.PostStep)
+		chain.PreMatch = chainKeys(chain.PreMatch, h.PreMatch)
+		chain.PostRead = chainReads(chain.PostRead, h.PostRead)
+		chain.PostMatch = chainMatches(chain.PostMatch, h.PostMatch)
+		chain.PreDelete = chainMatches(chain.PreDelete, h.PreDelete)
+		chain.PostDelete = chainDeletes(chain.PostDelete, h.PostDelete)
+	}
+	return chain
+}
+
+func chainSteps(first, then func(context.Context, *ScanStep) error) func(context.Context, *ScanStep) error {
+	if first == nil {
+		return then
+	}
+	if then == nil {
+		return first
+	}
+	return func(ctx context.Context, step *ScanStep) error {
+		if err := first(ctx, step); err != nil {
+			return err
+		}
+		return then(ctx, step)
+	}
+}
+
+func chainKeys(first, then func(context.Context, string) error) func(context.Context, string) error {
+	if first == nil {
+		return then
+	}
+	if then == nil {
+		return first
+	}
+	return func(ctx context.Context, key string) error {
+		if err := first(ctx, key); err != nil {
+			return err
+		}
+		return then(ctx, key)
+	}
+}
+
+func chainReads(first, then func(context.Context, ReadResult) error) func(context.Context, ReadResult) error {
+	if first == nil {
+		return then
+	}
+	if then == nil {
+		return first
+	}
+	return func(ctx context.Context, read ReadResult) error {
+		if err := first(ctx, read); err != nil {
+			return err
+		}
+		return then(ctx, read)
+	}
+}
+
+func chainMatches(first, then func(context.Context, Match) error) func(context.Context, Match) error {
+	if first == nil {
+		return then
+	}
+	if then == nil {
+		return first
+	}
+	return func(ctx context.Context, match Match) error {
+		if err := first(ctx, match); err != nil {
+			return err
+		}
+		return then(ctx, match)
+	}
+}
+
+func chainDeletes(first, then func(context.Context, Match, error)) func(context.Context, Match, error) {
+	if first == nil {
+		return then
+	}
+	if then == nil {
+		return first
+	}
+	return func(ctx context.Context, match Match, err error) {
+		first(ctx, match, err)
+		then(ctx, match, err)
+	}
+}
+
+// hookAllows handles the error from a hook called by it: it returns true if
+// the key may be acted on, or counts a skipped key, or ends the iteration,
+// with any error other than ErrStop, and returns false.
+func (it *KeyIterator) hookAllows(err error) bool {
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, ErrSkip) {
+		it.stats.Skipped++
+		return false
+	}
+	it.end(err)
+	return false
+}
+
+// end ends the iteration with err, unless it's ErrStop.
+func (it *KeyIterator) end(err error) {
+	if !errors.Is(err, ErrStop) {
+		it.err = err
+	}
+	it.done = true
+}
@@ -0,0 +1,178 @@
+package purge
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Keys returns an iterator of the keys matching the glob keyPattern ("" for
+// all keys) and, if keyType is not empty, of that Redis type, for callers
+// that read keys their own way. It scans the keyspace only as far as it's
+// read, and calls the step hooks and PreMatch, but no others.
+func (p *Purger) Keys(ctx context.Context, keyPattern, keyType string) *KeyIterator {
+	it := &KeyIterator{
+		purger:     p,
+		ctx:        ctx,
+		client:     p.readClient(),
+		keyPattern: keyPattern,
+		keyType:    keyType,
+		count:      p.ScanCount,
+		cursor:     p.StartCursor,
+	}
+	if it.count <= 0 {
+		it.count = DefaultScanCount
+	}
+	return it
+}
+
+func (p *Purger) readClient() *redis.Client {
+	if p.ReadClient != nil {
+		return p.ReadClient
+	}
+	return p.Client
+}
+
+// A KeyIterator steps through the keys of a database, running a SCAN step at
+// a time as it's advanced with Next. It isn't safe for concurrent use.
+type KeyIterator struct {
+	purger     *Purger
+	ctx        context.Context
+	client     *redis.Client
+	keyPattern string
+	keyType    string
+	count      int64
+
+	// readAhead, if not nil, reads the values of the keys of each step that
+	// passed PreMatch, before PreVisit.
+	readAhead func(keys []string)
+
+	// cursor is where the next step scans from, and step is the step whose
+	// keys are being returned, or nil before the first step.
+	cursor uint64
+	step   *ScanStep
+	keys   []string
+	key    string
+	stats  Stats
+	err    error
+	done   bool
+}
+
+// Next advances to the next key, returning false once there are no more, or
+// the scan failed, a hook stopped it, or ctx ended, as Err then says.
+func (it *KeyIterator) Next() bool {
+	for !it.done {
+		if err := it.ctx.Err(); err != nil {
+			it.end(err)
+			return false
+		}
+		if len(it.keys) > 0 {
+			it.key = it.keys[0]
+			it.keys = it.keys[1:]
+			return true
+		}
+		if step := it.step; step != nil {
+			var err error
+			if hook := it.purger.Hooks.PostStep; hook != nil {
+				err = hook(it.ctx, step)
+			}
+			if err == nil || errors.Is(err, ErrStop) {
+				// The step is done with, so a resumed scan starts after it.
+				it.step = nil
+			}
+			if err != nil {
+				it.end(err)
+				return false
+			}
+			if step.NextCursor == 0 {
+				it.done = true
+				return false
+			}
+		}
+		it.scan()
+	}
+	return false
+}
+
+// scan runs the next SCAN step, and sets the keys to return from it.
+func (it *KeyIterator) scan() {
+	hooks := it.purger.Hooks
+	step := &ScanStep{Cursor: it.cursor, Count: it.count}
+	it.step, it.keys = step, nil
+	if hooks.PreScan != nil {
+		if err := hooks.PreScan(it.ctx, step); err != nil {
+			it.end(err)
+			return
+		}
+	}
+	keys, nextCursor, err := Scan(it.ctx, it.client, step.Cursor, it.keyPattern, step.Count, it.keyType)
+	if err != nil {
+		it.end(err)
+		return
+	}
+	step.Keys, step.NextCursor = keys, nextCursor
+	it.cursor = nextCursor
+	it.stats.Scanned += int64(len(keys))
+	if hooks.PostScan != nil {
+		if err := hooks.PostScan(it.ctx, step); err != nil {
+			it.end(err)
+			return
+		}
+	}
+
+	if hooks.PreMatch != nil {
+		var visitKeys []string
+		for _, key := range step.Keys {
+			if it.hookAllows(hooks.PreMatch(it.ctx, key)) {
+				visitKeys = append(visitKeys, key)
+			} else if it.done {
+				return
+			}
+		}
+		step.Keys = visitKeys
+	}
+	if it.readAhead != nil && len(step.Keys) > 0 {
+		if hooks.PreRead != nil {
+			if err := hooks.PreRead(it.ctx, step); err != nil {
+				it.end(err)
+				return
+			}
+		}
+		it.readAhead(step.Keys)
+	}
+	if hooks.PreVisit != nil {
+		if err := hooks.PreVisit(it.ctx, step); err != nil {
+			it.end(err)
+			return
+		}
+	}
+	it.keys = step.Keys
+}
+
+// Key returns the key Next advanced to.
+func (it *KeyIterator) Key() string {
+	return it.key
+}
+
+// Cursor returns the cursor to start another scan from, with
+// Purger.StartCursor, to carry on from where this one stopped: the cursor of
+// the SCAN step whose keys are being returned, so that none of them is
+// missed.
+func (it *KeyIterator) Cursor() uint64 {
+	if it.step != nil {
+		return it.step.Cursor
+	}
+	return it.cursor
+}
+
+// Stats returns the counts of what the iterator has done so far.
+func (it *KeyIterator) Stats() Stats {
+	return it.stats
+}
+
+// Err returns the error that ended the iteration, if any: a failed SCAN, an
+// error from a hook, or the end of ctx.
+func (it *KeyIterator) Err() error {
+	return it.err
+}
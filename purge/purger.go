@@ -0,0 +1,261 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultScanCount is the COUNT passed to SCAN unless a Purger's ScanCount
+// is set.
+const DefaultScanCount = 50
+
+// A Purger lists, or deletes, the keys of a Redis database whose values match
+// a Condition, scanning the keyspace with SCAN so that the server is never
+// blocked for long.
+type Purger struct {
+	Client *redis.Client
+
+	// ReadClient, if not nil, is the client that keys are scanned and values
+	// read with, such as a replica's, while keys are still deleted with
+	// Client.
+	ReadClient *redis.Client
+
+	// StartCursor is the SCAN cursor to start from, such as an iterator's
+	// Cursor, to resume an earlier scan. 0 scans the whole keyspace.
+	StartCursor uint64
+
+	// ReadOptions say how values are read.
+	ReadOptions ReadOptions
+
+	// ScanCount is the COUNT hint passed to SCAN: roughly how many keys each
+	// SCAN step returns. 0 means DefaultScanCount.
+	ScanCount int64
+
+	// ScanType passes SCAN the type of keys the Condition reads, so that
+	// keys of other types are never returned. It needs Redis 6 or newer.
+	ScanType bool
+
+	// Unlink deletes keys with UNLINK, which frees their memory in the
+	// background, rather than DEL. It needs Redis 4 or newer.
+	Unlink bool
+
+	// DryRun makes Delete report the keys it would delete, without deleting
+	// them.
+	DryRun bool
+
+	// Hooks are called around each SCAN step, and before and after each key
+	// is matched and deleted.
+	Hooks Hooks
+}
+
+// A Match is a key whose value matched a Condition.
+type Match struct {
+	Key string
+	// Size is the size of the value matched, as read by the Condition.
+	Size int
+	// Value is the value matched, or nil if it was matched without being
+	// held in memory, by its size or as it was streamed.
+	Value []byte
+}
+
+// Stats count what a List or Delete did.
+type Stats struct {
+	Scanned      int64
+	Matched      int64
+	MatchedBytes int64
+	Deleted      int64
+	DeletedBytes int64
+	// Errors counts the keys that couldn't be read or deleted, which are
+	// skipped.
+	Errors int64
+	// Skipped counts the keys that Hooks skipped.
+	Skipped int64
+}
+
+// List calls fn with each key matching cond. An error from fn, or the end of
+// ctx, stops the scan and is returned, with the stats so far.
+func (p *Purger) List(ctx context.Context, cond *Condition, fn func(Match) error) (Stats, error) {
+	matches := p.Matches(ctx, cond)
+	for matches.Next() {
+		if err := fn(matches.Match()); err != nil {
+			return matches.Stats(), err
+		}
+	}
+	return matches.Stats(), matches.Err()
+}
+
+// Delete deletes each key matching cond, then calls fn, if not nil, with it.
+// Keys that fail to delete are counted as errors, and the scan carries on. An
+// error from fn, or the end of ctx, stops the scan and is returned, with the
+// stats so far.
+func (p *Purger) Delete(ctx context.Context, cond *Condition, fn func(Match) error) (Stats, error) {
+	matches := p.Matches(ctx, cond)
+	for matches.Next() {
+		match := matches.Match()
+		if err := matches.Delete(); err != nil {
+			// A key that failed to delete, or was skipped, is counted in the
+			// stats, and any other error ends the iteration.
+			continue
+		}
+		if fn == nil {
+			continue
+		}
+		if err := fn(match); err != nil {
+			return matches.Stats(), err
+		}
+	}
+	return matches.Stats(), matches.Err()
+}
+
+func (p *Purger) deleteKey(ctx context.Context, key string) error {
+	if p.Unlink {
+		return p.Client.Unlink(ctx, key).Err()
+	}
+	return p.Client.Del(ctx, key).Err()
+}
+
+// Matches returns an iterator of the keys matching cond, which scans the
+// keyspace only as far as it's read, for callers that act on matches
+// themselves:
+//
+//	matches := purger.Matches(ctx, cond)
+//	for matches.Next() {
+//		match := matches.Match()
+//		...
+//	}
+//	if err := matches.Err(); err != nil {
+//		...
+//	}
+func (p *Purger) Matches(ctx context.Context, cond *Condition) *MatchIterator {
+	keyType := ""
+	if p.ScanType {
+		keyType = cond.AccessMode.RedisType()
+	}
+	it := &MatchIterator{keys: p.Keys(ctx, cond.KeyPattern, keyType)}
+	if err := cond.Validate(); err != nil {
+		it.keys.end(fmt.Errorf("invalid condition %s: %w", cond, err))
+		return it
+	}
+	it.reader = NewReader(it.keys.client, cond, p.ReadOptions)
+	if it.reader.ReadsAhead() {
+		it.keys.readAhead = func(keys []string) {
+			it.ahead = make(map[string]ReadResult, len(keys))
+			for _, read := range it.reader.ReadBatch(ctx, keys) {
+				it.ahead[read.Key] = read
+			}
+		}
+	}
+	return it
+}
+
+// A MatchIterator steps through the keys matching a Condition, reading a
+// SCAN step at a time as it's advanced with Next. It isn't safe for
+// concurrent use.
+type MatchIterator struct {
+	keys   *KeyIterator
+	reader *Reader
+	// ahead holds the values of the current SCAN step's keys, if the reader
+	// ReadsAhead.
+	ahead map[string]ReadResult
+	match Match
+	// pending is set while the match Next advanced to hasn't been deleted.
+	pending bool
+}
+
+// ErrNoMatch is returned by MatchIterator.Delete called without a match to
+// delete: before Next, after Next returned false, or a second time for the
+// same match.
+var ErrNoMatch = errors.New("purge: no match to delete")
+
+// Next advances to the next matching key, returning false once there are no
+// more, or the scan failed, a hook stopped it, or ctx ended, as Err then
+// says.
+func (it *MatchIterator) Next() bool {
+	keys := it.keys
+	hooks := keys.purger.Hooks
+	it.pending = false
+	for keys.Next() {
+		key := keys.Key()
+		read, ok := it.ahead[key]
+		if !ok {
+			read = it.reader.Read(keys.ctx, key)
+		}
+		if read.Err != nil {
+			keys.stats.Errors++
+		}
+		if hooks.PostRead != nil && !keys.hookAllows(hooks.PostRead(keys.ctx, read)) {
+			continue
+		}
+		if read.Err != nil || !read.Matched {
+			continue
+		}
+		match := Match{Key: key, Size: read.Size, Value: read.Value}
+		if hooks.PostMatch != nil && !keys.hookAllows(hooks.PostMatch(keys.ctx, match)) {
+			continue
+		}
+		keys.stats.Matched++
+		keys.stats.MatchedBytes += int64(read.Size)
+		it.match, it.pending = match, true
+		return true
+	}
+	return false
+}
+
+// Match returns the matching key Next advanced to.
+func (it *MatchIterator) Match() Match {
+	return it.match
+}
+
+// Delete deletes the matching key Next advanced to, or, in a DryRun, only
+// counts it as deleted, calling PreDelete and PostDelete as Hooks.Delete
+// does. A key that fails to delete is counted as an error, and returns a
+// DeleteError. A key that PreDelete skipped returns ErrSkip, and any other
+// error from it ends the iteration. Each match can only be deleted once:
+// Delete without a match returns ErrNoMatch.
+func (it *MatchIterator) Delete() error {
+	if !it.pending {
+		return ErrNoMatch
+	}
+	it.pending = false
+	keys := it.keys
+	purger := keys.purger
+	err := purger.Hooks.Delete(keys.ctx, it.match, func(ctx context.Context, key string) error {
+		if purger.DryRun {
+			return nil
+		}
+		return purger.deleteKey(ctx, key)
+	})
+	var deleteErr *DeleteError
+	switch {
+	case errors.As(err, &deleteErr):
+		keys.stats.Errors++
+		return err
+	case err != nil:
+		keys.hookAllows(err)
+		return err
+	}
+	keys.stats.Deleted++
+	keys.stats.DeletedBytes += int64(it.match.Size)
+	return nil
+}
+
+// Cursor returns the cursor to resume the scan from, as KeyIterator.Cursor
+// does.
+func (it *MatchIterator) Cursor() uint64 {
+	return it.keys.Cursor()
+}
+
+// Stats returns the counts of what the iterator has done so far.
+func (it *MatchIterator) Stats() Stats {
+	return it.keys.Stats()
+}
+
+// Err returns the error that ended the iteration, if any: an invalid
+// condition, a failed SCAN, an error from a hook, or the end of ctx. Keys
+// that couldn't be read are counted in Stats, not returned.
+func (it *MatchIterator) Err() error {
+	return it.keys.Err()
+}
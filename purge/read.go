@@ -0,0 +1,327 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ReadOptions say how a Reader reads values. The zero ReadOptions read each
+// value whole, one key at a time.
+type ReadOptions struct {
+	// Concurrency is the number of workers matching the values of a SCAN
+	// step read ahead together. Only matching is done in parallel: matches
+	// are still returned one at a time, in scan order.
+	Concurrency int
+
+	// HashScan reads whole hashes with HSCAN, matching them as they're read,
+	// instead of holding them in memory.
+	HashScan bool
+
+	// StringChunkSize, if > 0, reads strings with GETRANGE, this many bytes
+	// at a time, matching them as they're read.
+	StringChunkSize int
+
+	// MemorySizes sizes values with MEMORY USAGE, and, for conditions that
+	// need only sizes, reads sizes instead of values for any type of key.
+	MemorySizes bool
+
+	// KeepValues reads values whole even where sizes alone would match
+	// them, for callers that look at the values of matching keys.
+	KeepValues bool
+
+	// KeepUnmatchedValues reads the values of keys whose sizes rule them
+	// out, too, for callers that look at the values of keys that don't
+	// match. It implies KeepValues.
+	KeepUnmatchedValues bool
+}
+
+// A Reader reads the values of keys and matches them against a Condition.
+// It's safe for concurrent use.
+type Reader struct {
+	client       *redis.Client
+	cond         *Condition
+	options      ReadOptions
+	valueMatches func(value []byte) bool
+}
+
+// NewReader returns a Reader of the values of keys with c, matching them
+// against cond.
+func NewReader(c *redis.Client, cond *Condition, options ReadOptions) *Reader {
+	if options.KeepUnmatchedValues {
+		options.KeepValues = true
+	}
+	return &Reader{client: c, cond: cond, options: options, valueMatches: cond.Matcher()}
+}
+
+// A ReadResult is what a Reader read of a key.
+type ReadResult struct {
+	Key string
+	// Value is the value read, or nil if the key is missing or was matched
+	// without being held in memory, by its size or as it was streamed.
+	Value   []byte
+	Size    int
+	Matched bool
+	// Err is the error reading the key, if any. A missing key is not an
+	// error: it just doesn't match.
+	Err error
+}
+
+// Read reads the value of key and matches it.
+func (r *Reader) Read(ctx context.Context, key string) ReadResult {
+	return r.ReadShared(ctx, key, nil)
+}
+
+// ReadShared is Read, but if values is not nil, it caches the values already
+// read for key by source, so that Readers of several Conditions can share
+// them. Values are then always read whole.
+func (r *Reader) ReadShared(ctx context.Context, key string, values map[ValueSource][]byte) ReadResult {
+	result := ReadResult{Key: key}
+	result.Value, result.Size, result.Matched, result.Err = r.read(ctx, key, values)
+	return result
+}
+
+func (r *Reader) read(ctx context.Context, key string, values map[ValueSource][]byte) (value []byte, size int, matched bool, err error) {
+	cond := r.cond
+	if len(cond.HashMatch) > 0 {
+		var fieldValues []byte
+		matched, fieldValues, err = MatchFields(ctx, r.client, key, cond.HashMatch)
+		if err != nil || !matched {
+			return nil, 0, false, err
+		}
+		if !cond.ReadsWholeValue() {
+			return fieldValues, len(fieldValues), true, nil
+		}
+	}
+
+	if cond.MatchElements {
+		value, matched, err = r.matchElements(ctx, key)
+		return value, len(value), matched, err
+	}
+
+	if values == nil && r.ReadsSizesOnly() {
+		size, matched, err = r.matchSize(ctx, key)
+		return nil, size, matched, err
+	}
+	if values == nil && r.PrechecksSizes() {
+		if size, possible := r.precheckSize(ctx, key); !possible {
+			return nil, size, false, nil
+		}
+	}
+
+	source := cond.ValueSource()
+	if _, fetched := values[source]; !fetched && r.StreamsValues() {
+		size, matched, err = r.streamMatch(ctx, key)
+		return nil, size, matched, err
+	}
+
+	value, fetched := values[source]
+	if !fetched {
+		value, err = source.Get(ctx, r.client, key)
+		if err == redis.Nil {
+			// The key (or hash field) doesn't exist, so there's nothing to match.
+			return nil, 0, false, nil
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if values != nil {
+			values[source] = value
+		}
+	}
+	return value, len(value), r.valueMatches(value), nil
+}
+
+// matchElements reads the elements of the collection at key, and reports
+// whether any of them matches. The returned value is all the elements
+// concatenated.
+func (r *Reader) matchElements(ctx context.Context, key string) (value []byte, matched bool, err error) {
+	elements, err := r.cond.AccessMode.Elements(ctx, r.client, key)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, element := range elements {
+		if r.valueMatches(element) {
+			matched = true
+			break
+		}
+	}
+	return bytes.Join(elements, nil), matched, nil
+}
+
+// ReadsAhead reports whether the values of a SCAN step's keys are best read
+// together, with ReadBatch, before they're matched: with Concurrency, or to
+// read them in one round trip.
+func (r *Reader) ReadsAhead() bool {
+	return r.options.Concurrency > 1 || r.batchesReads() || r.ReadsSizesOnly()
+}
+
+// batchesReads reports whether values are read a SCAN step at a time, in one
+// round trip: strings with MGET, and whole hashes, hash fields and JSON
+// documents in a pipeline. Collections are still read a page at a time per
+// key.
+func (r *Reader) batchesReads() bool {
+	cond := r.cond
+	if len(cond.HashMatch) > 0 || cond.MatchElements || r.StreamsValues() || r.ReadsSizesOnly() {
+		return false
+	}
+	switch cond.AccessMode {
+	case AccessString, AccessHash, AccessJSON:
+		return true
+	}
+	return false
+}
+
+// A batchValue is a value read by readBatch.
+type batchValue struct {
+	value []byte
+	// missing is set if the key (or hash field) doesn't exist, or, reading
+	// strings with MGET, isn't a string.
+	missing bool
+	// skipped is set if the value wasn't read, since its size, from
+	// precheckSizes, can't match.
+	skipped bool
+	size    int
+	err     error
+}
+
+// ReadBatch reads and matches the values of keys, on Concurrency workers,
+// returning the results in the order of keys.
+func (r *Reader) ReadBatch(ctx context.Context, keys []string) []ReadResult {
+	if r.ReadsSizesOnly() {
+		return r.matchSizes(ctx, keys)
+	}
+	results := make([]ReadResult, len(keys))
+	source := r.cond.ValueSource()
+	var batch []batchValue
+	if r.batchesReads() {
+		batch = r.readBatch(ctx, keys)
+	}
+
+	match := func(i int) {
+		result := &results[i]
+		result.Key = keys[i]
+		var values map[ValueSource][]byte
+		if batch != nil {
+			if batch[i].missing {
+				return
+			}
+			if batch[i].skipped {
+				result.Size = batch[i].size
+				return
+			}
+			if batch[i].err != nil {
+				result.Err = batch[i].err
+				return
+			}
+			values = map[ValueSource][]byte{source: batch[i].value}
+		}
+		result.Value, result.Size, result.Matched, result.Err = r.read(ctx, keys[i], values)
+	}
+
+	if r.options.Concurrency > 1 {
+		indexes := make(chan int)
+		var workers sync.WaitGroup
+		for worker := 0; worker < r.options.Concurrency && worker < len(keys); worker++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for i := range indexes {
+					match(i)
+				}
+			}()
+		}
+		for i := range keys {
+			indexes <- i
+		}
+		close(indexes)
+		workers.Wait()
+	} else {
+		for i := range keys {
+			match(i)
+		}
+	}
+	return results
+}
+
+// readBatch reads the values of keys in one round trip, after skipping those
+// that precheckSizes rules out.
+func (r *Reader) readBatch(ctx context.Context, keys []string) []batchValue {
+	if !r.PrechecksSizes() {
+		return r.readValues(ctx, keys)
+	}
+	values := r.precheckSizes(ctx, keys)
+	var readKeys []string
+	var readIndexes []int
+	for i, value := range values {
+		if !value.skipped {
+			readKeys = append(readKeys, keys[i])
+			readIndexes = append(readIndexes, i)
+		}
+	}
+	if len(readKeys) > 0 {
+		for i, value := range r.readValues(ctx, readKeys) {
+			values[readIndexes[i]] = value
+		}
+	}
+	return values
+}
+
+// readValues reads the values of keys in one round trip.
+func (r *Reader) readValues(ctx context.Context, keys []string) []batchValue {
+	values := make([]batchValue, len(keys))
+	source := r.cond.ValueSource()
+	if source.AccessMode == AccessString {
+		replies, err := r.client.MGet(ctx, keys...).Result()
+		for i := range values {
+			if err != nil {
+				values[i].err = err
+				continue
+			}
+			value, ok := replies[i].(string)
+			values[i] = batchValue{value: []byte(value), missing: !ok}
+		}
+		return values
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]redis.Cmder, len(keys))
+	for i, key := range keys {
+		switch {
+		case source.AccessMode == AccessHash && source.HashField != "":
+			cmds[i] = pipe.HGet(ctx, key, source.HashField)
+		case source.AccessMode == AccessHash:
+			cmds[i] = pipe.HGetAll(ctx, key)
+		default:
+			cmds[i] = pipe.Do(ctx, JSONGetArgs(key, source.JSONPath)...)
+		}
+	}
+	// Exec returns the first command's error, which is also reported with
+	// that command.
+	pipe.Exec(ctx)
+	for i, cmd := range cmds {
+		var value []byte
+		var err error
+		switch cmd := cmd.(type) {
+		case *redis.StringCmd:
+			value, err = cmd.Bytes()
+		case *redis.StringStringMapCmd:
+			var hashValue map[string]string
+			if hashValue, err = cmd.Result(); err != nil {
+				err = fmt.Errorf("valueAccessHash[%#v]: %w", keys[i], err)
+			}
+			value = HashAsBytes(hashValue)
+		case *redis.Cmd:
+			value, err = JSONDocument(cmd, keys[i], source.JSONPath)
+		}
+		if err == redis.Nil {
+			values[i].missing = true
+			continue
+		}
+		values[i] = batchValue{value: value, err: err}
+	}
+	return values
+}
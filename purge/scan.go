@@ -0,0 +1,43 @@
+package purge
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Scan runs one SCAN step from cursor, returning up to about count keys
+// matching the glob keyPattern ("" for all keys) and, if keyType is not empty,
+// of that type, which needs Redis 6 or newer.
+func Scan(ctx context.Context, c *redis.Client, cursor uint64, keyPattern string, count int64, keyType string) (keys []string, nextCursor uint64, err error) {
+	if keyType == "" {
+		return c.Scan(ctx, cursor, keyPattern, count).Result()
+	}
+
+	args := []interface{}{"scan", cursor}
+	if keyPattern != "" {
+		args = append(args, "match", keyPattern)
+	}
+	args = append(args, "count", count, "type", keyType)
+	reply, err := c.Do(ctx, args...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) != 2 {
+		return nil, 0, fmt.Errorf("unexpected SCAN reply: %v", reply)
+	}
+	cursorText, _ := parts[0].(string)
+	if nextCursor, err = strconv.ParseUint(cursorText, 10, 64); err != nil {
+		return nil, 0, fmt.Errorf("bad SCAN cursor %#v: %w", parts[0], err)
+	}
+	replyKeys, _ := parts[1].([]interface{})
+	for _, key := range replyKeys {
+		if key, ok := key.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nextCursor, nil
+}
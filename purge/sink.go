@@ -0,0 +1,61 @@
+package purge
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Record is a matched key as written to an OutputSink: the Match, and
+// what the purge did or would have done to it.
+type Record struct {
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+
+	// DryRun is set for keys that a dry run would have deleted.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Fields are the hash fields deleted from keys of which only some
+	// fields were deleted.
+	Fields []string `json:"fields,omitempty"`
+
+	// TTL is the TTL in seconds set on keys that were expired or
+	// quarantined instead of deleted.
+	TTL int `json:"ttl,omitempty"`
+
+	// Type and KeyTTL, if looked up, are the key's Redis type and its
+	// remaining TTL in seconds when it was matched, or -1 if it doesn't
+	// expire.
+	Type   string `json:"type,omitempty"`
+	KeyTTL *int64 `json:"key_ttl,omitempty"`
+
+	// Tags label the purge the key was matched by.
+	Tags Tags `json:"tags,omitempty"`
+}
+
+// Tags are key=value labels for a purge, such as a ticket ID or the reason
+// for it.
+type Tags map[string]string
+
+// String formats t as space-separated key=value pairs, sorted by key.
+func (t Tags) String() string {
+	pairs := make([]string, 0, len(t))
+	for key, value := range t {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// An OutputSink receives the records of the keys matched by a purge, such as
+// a console, a file or a message queue. A purge can write to several sinks at
+// once.
+type OutputSink interface {
+	// Match writes one matched key.
+	Match(record Record) error
+
+	// Close writes any buffered records and releases the sink.
+	Close() error
+}
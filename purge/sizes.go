@@ -0,0 +1,138 @@
+package purge
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ReadsSizesOnly reports whether matching needs only the sizes of values,
+// which are then read without the values themselves: exactly, with STRLEN or
+// HSTRLEN, for strings and hash fields, or for any key with MEMORY USAGE if
+// MemorySizes is set. With KeepValues, values are read whole as usual.
+func (r *Reader) ReadsSizesOnly() bool {
+	cond := r.cond
+	if len(cond.Search) > 0 || len(cond.HashMatch) > 0 || cond.MatchElements || r.options.KeepValues {
+		return false
+	}
+	if r.options.MemorySizes {
+		return true
+	}
+	source := cond.ValueSource()
+	return source.AccessMode == AccessString || (source.AccessMode == AccessHash && source.HashField != "")
+}
+
+// sizeArgs returns the command that sizes the value of key.
+func (r *Reader) sizeArgs(key string) []interface{} {
+	if r.options.MemorySizes {
+		return []interface{}{"memory", "usage", key}
+	}
+	return lengthArgs(key, r.cond.ValueSource())
+}
+
+// lengthArgs returns the command that reads the exact length of the string
+// or hash field value of key from source.
+func lengthArgs(key string, source ValueSource) []interface{} {
+	if source.AccessMode == AccessHash {
+		return []interface{}{"hstrlen", key, source.HashField}
+	}
+	return []interface{}{"strlen", key}
+}
+
+// valueSize returns the size read by cmd, a command from sizeArgs for key.
+// exists is false if the key (or hash field) doesn't exist.
+func (r *Reader) valueSize(ctx context.Context, cmd *redis.Cmd, key string) (size int, exists bool, err error) {
+	length, err := cmd.Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if length == 0 && !r.options.MemorySizes {
+		// STRLEN and HSTRLEN return 0 for missing keys and fields, too.
+		if source := r.cond.ValueSource(); source.AccessMode == AccessHash {
+			exists, err = r.client.HExists(ctx, key, source.HashField).Result()
+		} else {
+			var count int64
+			count, err = r.client.Exists(ctx, key).Result()
+			exists = count > 0
+		}
+		return 0, exists, err
+	}
+	return int(length), true, nil
+}
+
+// matchSize sizes the value of key and checks the size, for conditions where
+// ReadsSizesOnly.
+func (r *Reader) matchSize(ctx context.Context, key string) (size int, matched bool, err error) {
+	size, exists, err := r.valueSize(ctx, r.client.Do(ctx, r.sizeArgs(key)...), key)
+	return size, exists && r.cond.SizeMatches(size), err
+}
+
+// matchSizes sizes and matches the values of keys in one pipeline, for
+// conditions where ReadsSizesOnly.
+func (r *Reader) matchSizes(ctx context.Context, keys []string) []ReadResult {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Do(ctx, r.sizeArgs(key)...)
+	}
+	// Exec returns the first command's error, which is also reported with
+	// that command.
+	pipe.Exec(ctx)
+
+	results := make([]ReadResult, len(keys))
+	for i, key := range keys {
+		size, exists, err := r.valueSize(ctx, cmds[i], key)
+		results[i] = ReadResult{Key: key, Size: size, Matched: exists && r.cond.SizeMatches(size), Err: err}
+	}
+	return results
+}
+
+// PrechecksSizes reports whether values are strings or hash fields whose
+// exact lengths are read before the values, so that values that can't
+// satisfy SizeThreshold or SizeMax aren't read at all. Hashes and
+// collections can't be ruled out by their lengths, since their elements may
+// be empty, and are always read. With KeepUnmatchedValues, values are always
+// read.
+func (r *Reader) PrechecksSizes() bool {
+	cond := r.cond
+	if (cond.SizeThreshold <= 0 && cond.SizeMax <= 0) || len(cond.HashMatch) > 0 || cond.MatchElements || r.options.KeepUnmatchedValues || r.ReadsSizesOnly() {
+		return false
+	}
+	source := cond.ValueSource()
+	return source.AccessMode == AccessString || (source.AccessMode == AccessHash && source.HashField != "")
+}
+
+// precheckSizes reads the lengths of the values of keys in one pipeline,
+// marking those that can't match as skipped. Keys whose lengths can't be
+// read, such as keys of another type, are read and reported as usual.
+func (r *Reader) precheckSizes(ctx context.Context, keys []string) []batchValue {
+	source := r.cond.ValueSource()
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Do(ctx, lengthArgs(key, source)...)
+	}
+	pipe.Exec(ctx)
+
+	values := make([]batchValue, len(keys))
+	for i, cmd := range cmds {
+		length, err := cmd.Int64()
+		if err == nil && !r.cond.SizeMatches(int(length)) {
+			values[i] = batchValue{skipped: true, size: int(length)}
+		}
+	}
+	return values
+}
+
+// precheckSize reads the length of the value of key, reporting whether the
+// value can match, as precheckSizes does for a batch.
+func (r *Reader) precheckSize(ctx context.Context, key string) (size int, possible bool) {
+	length, err := r.client.Do(ctx, lengthArgs(key, r.cond.ValueSource())...).Int64()
+	if err != nil {
+		return 0, true
+	}
+	return int(length), r.cond.SizeMatches(int(length))
+}
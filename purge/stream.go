@@ -0,0 +1,180 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// A StreamMatcher applies a Condition to a value written to it in
+// chunks, holding only as much of the value as it needs to match patterns
+// that span chunks.
+type StreamMatcher struct {
+	search   *Condition
+	patterns [][]byte
+
+	size int
+
+	// prefix holds the start of the value, for exact matches: once the value
+	// is longer than every pattern, it can't exactly match any of them.
+	prefix    []byte
+	prefixMax int
+
+	// counts and tails, per pattern, count the pattern's occurrences and
+	// hold the end of the value that could start an occurrence spanning the
+	// next chunk.
+	counts []int
+	tails  [][]byte
+}
+
+// StreamMatcher returns a StreamMatcher of s, for values written to it as
+// they're read.
+func (s *Condition) StreamMatcher() *StreamMatcher {
+	m := &StreamMatcher{
+		search: s,
+		counts: make([]int, len(s.Search)),
+		tails:  make([][]byte, len(s.Search)),
+	}
+	for _, pattern := range s.Search {
+		m.patterns = append(m.patterns, []byte(pattern))
+		if len(pattern) > m.prefixMax {
+			m.prefixMax = len(pattern)
+		}
+	}
+	return m
+}
+
+// Write adds the next chunk of the value.
+func (m *StreamMatcher) Write(chunk []byte) {
+	m.size += len(chunk)
+	if m.search.Occurrences <= 0 {
+		if len(m.prefix) <= m.prefixMax {
+			m.prefix = append(m.prefix, chunk...)
+		}
+		return
+	}
+
+	for i, pattern := range m.patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+		window := append(m.tails[i], chunk...)
+		// Count non-overlapping occurrences as bytes.Count would, keeping
+		// the unmatched end of the window for the next chunk.
+		for {
+			index := bytes.Index(window, pattern)
+			if index < 0 {
+				break
+			}
+			m.counts[i]++
+			window = window[index+len(pattern):]
+		}
+		if len(window) >= len(pattern) {
+			window = window[len(window)-len(pattern)+1:]
+		}
+		m.tails[i] = append([]byte(nil), window...)
+	}
+}
+
+// Matched reports whether the whole value written satisfies the search, as
+// s.Matcher() would for the same value.
+func (m *StreamMatcher) Matched() bool {
+	s := m.search
+	if m.size < s.SizeThreshold || (s.SizeMax > 0 && m.size > s.SizeMax) {
+		return false
+	}
+	if len(m.patterns) == 0 {
+		return true
+	}
+	if s.Occurrences <= 0 {
+		return s.patternsMatch(m.prefix, m.patterns) != s.Negate
+	}
+
+	for i, pattern := range m.patterns {
+		count := m.counts[i]
+		if len(pattern) == 0 {
+			count = m.size + 1
+		}
+		patternMatched := count >= s.Occurrences
+		if patternMatched && !s.MatchAll {
+			return !s.Negate
+		}
+		if !patternMatched && s.MatchAll {
+			return s.Negate
+		}
+	}
+	return s.MatchAll != s.Negate
+}
+
+// Size returns the size of the value written so far.
+func (m *StreamMatcher) Size() int {
+	return m.size
+}
+
+// StreamsValues reports whether values are matched as they're streamed from
+// Redis, with HashScan or StringChunkSize, instead of being read whole.
+func (r *Reader) StreamsValues() bool {
+	switch r.cond.ValueSource() {
+	case ValueSource{AccessMode: AccessHash}:
+		return r.options.HashScan
+	case ValueSource{AccessMode: AccessString}:
+		return r.options.StringChunkSize > 0
+	}
+	return false
+}
+
+// streamMatch matches the value of key as it's streamed from Redis, and
+// returns its size.
+func (r *Reader) streamMatch(ctx context.Context, key string) (size int, matched bool, err error) {
+	if r.cond.AccessMode == AccessString {
+		return r.streamStringMatch(ctx, key)
+	}
+	return r.streamHashMatch(ctx, key)
+}
+
+// streamHashMatch reads the hash at key with HSCAN, CollectionPageSize fields
+// at a time, matching it as it's read, and returns the size of the hash, as
+// HashAsBytes would measure it.
+func (r *Reader) streamHashMatch(ctx context.Context, key string) (size int, matched bool, err error) {
+	matcher := r.cond.StreamMatcher()
+	var cursor uint64
+	for {
+		fieldsAndValues, nextCursor, err := r.client.HScan(ctx, key, cursor, "", CollectionPageSize).Result()
+		if err != nil {
+			return 0, false, fmt.Errorf("HSCAN %#v: %w", key, err)
+		}
+		for _, fieldOrValue := range fieldsAndValues {
+			matcher.Write([]byte(fieldOrValue))
+		}
+		if nextCursor == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+	// HGETALL of a missing key is an empty hash, so match it the same way.
+	return matcher.Size(), matcher.Matched(), nil
+}
+
+// streamStringMatch reads the string at key with GETRANGE, StringChunkSize
+// bytes at a time, matching it as it's read. A missing key doesn't match.
+func (r *Reader) streamStringMatch(ctx context.Context, key string) (size int, matched bool, err error) {
+	matcher := r.cond.StreamMatcher()
+	chunkSize := int64(r.options.StringChunkSize)
+	for start := int64(0); ; start += chunkSize {
+		chunk, err := r.client.GetRange(ctx, key, start, start+chunkSize-1).Bytes()
+		if err != nil {
+			return 0, false, fmt.Errorf("GETRANGE %#v: %w", key, err)
+		}
+		if start == 0 && len(chunk) == 0 {
+			// GETRANGE can't tell an empty string from a missing key.
+			count, err := r.client.Exists(ctx, key).Result()
+			if err != nil || count == 0 {
+				return 0, false, err
+			}
+		}
+		matcher.Write(chunk)
+		if int64(len(chunk)) < chunkSize {
+			return matcher.Size(), matcher.Matched(), nil
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// A failedKey is a matching key a run couldn't delete.
+type failedKey struct {
+	Key  string
+	Size int
+	// Err is why the key couldn't be deleted, the last time it was tried.
+	Err error
+}
+
+// A purgeResult is what listMatchingKeys or deleteMatchingKeys did: the
+// totals of the keys it matched and deleted, and the keys it couldn't
+// delete, even on retry. Matching and deleted keys aren't kept, so that the
+// result stays small however many keys match.
+type purgeResult struct {
+	Action   string
+	Failures []failedKey
+
+	Matched      int64
+	MatchedBytes int64
+	Deleted      int64
+	DeletedBytes int64
+	Retried      int64
+	Failed       int64
+}
+
+// match records a matching key of size.
+func (p *purgeResult) match(size int) {
+	p.Matched++
+	p.MatchedBytes += int64(size)
+}
+
+// deleted records that a matching key was deleted, with its value of size.
+func (p *purgeResult) deleted(size int, retried bool) {
+	p.Deleted++
+	p.DeletedBytes += int64(size)
+	if retried {
+		p.Retried++
+	}
+}
+
+// failed records that key, of size, couldn't be deleted, with err.
+func (p *purgeResult) failed(key string, size int, err error) {
+	p.Failures = append(p.Failures, failedKey{Key: key, Size: size, Err: err})
+	p.Failed = int64(len(p.Failures))
+}
+
+// failedKeys returns the keys in Failures.
+func (p *purgeResult) failedKeys() []string {
+	keys := make([]string, len(p.Failures))
+	for i, failure := range p.Failures {
+		keys[i] = failure.Key
+	}
+	return keys
+}
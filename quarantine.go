@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// quarantineKey renames key into the QuarantinePrefix namespace, instead of
+// deleting it, and sets QuarantineTTL on the quarantined key if it's set.
+// An earlier quarantined copy of key is never overwritten.
+func (r redisSearch) quarantineKey(key string) error {
+	ctx := context.Background()
+	quarantinedKey := r.QuarantinePrefix + key
+	renamed, err := r.Client.RenameNX(ctx, key, quarantinedKey).Result()
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		// The key's already gone, so there's nothing to quarantine.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !renamed {
+		return fmt.Errorf("already quarantined as %#v", quarantinedKey)
+	}
+	if r.QuarantineTTL > 0 {
+		return r.Client.Expire(ctx, quarantinedKey, time.Duration(r.QuarantineTTL)*time.Second).Err()
+	}
+	return nil
+}
+
+// deleteAction describes what the run does to keys it deletes, for plans
+// and records of the run.
+func (r redisSearch) deleteAction() string {
+	switch {
+	case len(r.DeleteFields) > 0:
+		return "hdel fields " + strings.Join(r.DeleteFields, ", ")
+	case r.DeleteElements != nil:
+		return "remove matching elements with " + elementRemoveCommands[r.DeleteElements.AccessMode]
+	case r.QuarantinePrefix != "" && r.QuarantineTTL > 0:
+		return fmt.Sprintf("quarantine to %s (ttl %ds)", r.QuarantinePrefix, r.QuarantineTTL)
+	case r.QuarantinePrefix != "":
+		return "quarantine to " + r.QuarantinePrefix
+	case r.ExpireSeconds > 0:
+		return fmt.Sprintf("expire (ttl %ds)", r.ExpireSeconds)
+	}
+	return "delete"
+}
+
+// keepsDeletedKeys reports whether deleted keys live on, expiring,
+// quarantined or with only some fields or elements deleted, rather than
+// being deleted at once.
+func (r redisSearch) keepsDeletedKeys() bool {
+	return r.ExpireSeconds > 0 || r.QuarantinePrefix != "" || len(r.DeleteFields) > 0 || r.DeleteElements != nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkMatchRatio returns an error if MAX_MATCH_PERCENT is set and more than
+// that percentage of the keyspace is estimated to match search, from
+// MATCH_RATIO_SAMPLE random keys, unless OVERRIDE_MATCH_RATIO is set. This
+// guards against a too-generic search deleting most of the database.
+func (r redisSearch) checkMatchRatio(search *searchCondition) error {
+	maxPercent, err := envLimit("MAX_MATCH_PERCENT")
+	if err != nil || maxPercent <= 0 {
+		return err
+	}
+	estimator := r.estimator()
+	totalKeys, err := estimator.countKeys()
+	if err != nil || totalKeys == 0 {
+		return err
+	}
+	samples := envInt("MATCH_RATIO_SAMPLE", 1000)
+	fmt.Fprintf(os.Stderr, "> estimating the share of keys matching %s from %d random keys\n", search, samples)
+	keys, _, err := estimator.sampleMatchingKeys(search, samples)
+	if err != nil {
+		return fmt.Errorf("couldn't estimate matching keys: %w", err)
+	}
+	percent := 100 * float64(keys) / float64(totalKeys)
+	if percent <= float64(maxPercent) {
+		fmt.Fprintf(os.Stderr, "> about %.1f%% of keys match, within MAX_MATCH_PERCENT=%d\n", percent, maxPercent)
+		return nil
+	}
+	if envBool("OVERRIDE_MATCH_RATIO", "false") {
+		fmt.Fprintf(os.Stderr, "> warning: about %.1f%% of keys match, more than MAX_MATCH_PERCENT=%d; deleting anyway since OVERRIDE_MATCH_RATIO is set\n",
+			percent, maxPercent)
+		return nil
+	}
+	return fmt.Errorf("about %.1f%% of the %d keys on %s match, more than MAX_MATCH_PERCENT=%d; set OVERRIDE_MATCH_RATIO=y to delete them anyway",
+		percent, totalKeys, r.String(), maxPercent)
+}
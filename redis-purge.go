@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -11,35 +11,454 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/greensnark/redis-purge/purge"
 )
 
 func main() {
-	if len(os.Args) < 2 {
+	args, resume := parseCommandLine(os.Args[1:])
+	rulesFile := os.Getenv("RULES_FILE")
+	freeTargetBytes := envInt64("FREE_TARGET_BYTES", 0)
+	if len(args) < 1 && rulesFile == "" && freeTargetBytes <= 0 {
 		usage()
 	}
 
+	exitOnInterrupt()
+	printStatsOnSignal()
+	reportError("couldn't start pprof server", servePprof())
+
+	output, err := envOutputFile()
+	reportError("couldn't create OUTPUT_FILE", err)
+	// Runs that fail or are interrupted leave their output partial; other
+	// exit codes, such as ALERT_EXIT_CODE, come from complete runs.
+	atExit(func() { output.Finish(exitCode != 1 && exitCode != 130) })
+	defer output.Finish(true)
+
 	redisDB := redis.NewClient(redisOptions())
 	defer redisDB.Close()
+	replica := envReadReplica()
+	if replica != nil {
+		defer replica.Close()
+	}
 
 	search := redisSearch{
-		Client:   redisDB,
-		Options:  redisOptions(),
-		Debug:    os.Getenv("DEBUG") != "",
-		Progress: envBool("PROGRESS", "true"),
+		Client:           redisDB,
+		Replica:          replica,
+		Options:          redisOptions(),
+		Debug:            os.Getenv("DEBUG") != "",
+		Progress:         envBool("PROGRESS", "true") && !envBool("QUIET", "false"),
+		Quiet:            envBool("QUIET", "false"),
+		Retrier:          envDeleteRetrier(),
+		Verifier:         envPurgeVerifier(),
+		Schemas:          envSchemaReport(),
+		DryRun:           envBool("DRY_RUN", "false"),
+		QuarantinePrefix: os.Getenv("QUARANTINE_PREFIX"),
+		HashScan:         envBool("HASH_SCAN", "false"),
+		StringChunkSize:  envInt("STRING_CHUNK_SIZE", 0),
+		Concurrency:      envInt("CONCURRENCY", 1),
+		ScanCount:        envInt("SCAN_COUNT", defaultScanCount),
+		MemorySizes:      strings.EqualFold(os.Getenv("SIZE_MODE"), "memory"),
+		StartCursor:      uint64(envInt64("START_CURSOR", 0)),
+		Events:           &purgeEvents{},
+	}
+	// A mistyped EXPIRE_SECONDS would delete the keys instead of expiring
+	// them, so it's refused rather than ignored.
+	expireSeconds, err := envLimit("EXPIRE_SECONDS")
+	reportError("invalid EXPIRE_SECONDS", err)
+	quarantineTTL, err := envLimit("QUARANTINE_TTL")
+	reportError("invalid QUARANTINE_TTL", err)
+	search.ExpireSeconds, search.QuarantineTTL = int(expireSeconds), int(quarantineTTL)
+
+	hookAction := "list"
+	if envBool("DELETE_MATCHING_KEYS", "false") {
+		hookAction = "delete"
+	}
+	search.Hooks = envKeyHooks(hookAction, search.DryRun, search.Quiet)
+	search.Events.OnDelete(func(key string, size int) {
+		search.Verifier.Deleted(key)
+	})
+	if replica != nil {
+		fmt.Fprintf(os.Stderr, "> scanning and reading keys on replica %s; keys are matched again on %s before being deleted\n", replica.Options().Addr, search.String())
 	}
 
-	needle := &searchCondition{
-		AccessMode:    parseValueAccessMode(os.Getenv("ACCESS_MODE")),
-		Search:        os.Args[1],
-		SizeThreshold: envInt("SIZE_THRESHOLD", 0),
-		Occurrences:   envInt("REQUIRED_MATCH_COUNT", 0),
+	owners, err := envKeyOwnership()
+	reportError("error loading key owners", err)
+	search.Owners = owners
+
+	search.ExcludeKeys, err = parseKeyPatternList(os.Getenv("EXCLUDE_KEY_PATTERNS"))
+	reportError("invalid EXCLUDE_KEY_PATTERNS", err)
+
+	search.Protected, err = envKeyProtection()
+	reportError("invalid PROTECTED_KEY_PATTERNS", err)
+
+	search.Caps = detectCapabilities(redisDB)
+	serverCaps = search.Caps
+	search.ScanType = envScanType(search.Caps)
+	search.Unlink, err = envUnlink(search.Caps)
+	reportError("invalid DELETE_COMMAND", err)
+	search.checkCapabilities()
+
+	search.Watchdog, err = envScanWatchdog(redisDB)
+	reportError("invalid watchdog settings", err)
+
+	search.Dashboard, err = envRunDashboard(search.String())
+	reportError("invalid TUI setting", err)
+	if search.Dashboard != nil {
+		// The dashboard shows progress itself.
+		search.Progress = false
 	}
 
-	if envBool("DELETE_MATCHING_KEYS", "false") {
-		reportError("error deleting keys matching: "+needle.String(), search.deleteMatchingKeys(needle, envBool("WAIT_AND_REDELETE", "false")))
+	if search.Verifier != nil {
+		search.Verifier.Expiring = search.ExpireSeconds > 0
+	}
+	if search.ExpireSeconds > 0 && search.QuarantinePrefix != "" {
+		reportError("invalid QUARANTINE_PREFIX", fmt.Errorf("keys can't be both expired (EXPIRE_SECONDS) and quarantined"))
+	}
+
+	search.ErrorStreak, err = envErrorStreak()
+	reportError("invalid MAX_CONSECUTIVE_ERRORS", err)
+	search.Backup = envKeyBackup()
+	search.Throttle, err = envDeleteThrottle()
+	reportError("invalid DELETES_PER_SECOND", err)
+	search.Batches = envBatchSizer()
+	search.Sizes, err = envSizeHistogram()
+	reportError("invalid SIZE_HISTOGRAM", err)
+	search.Window, err = envMaintenanceWindow()
+	reportError("invalid ALLOWED_WINDOW settings", err)
+
+	search.DeleteLimit, err = envDeleteLimit()
+	reportError("invalid MAX_DELETES settings", err)
+	// checkMatchRatio reads MAX_MATCH_PERCENT only once it's about to
+	// delete, so a mistyped value is caught here, before the run starts.
+	_, err = envLimit("MAX_MATCH_PERCENT")
+	reportError("invalid MAX_MATCH_PERCENT", err)
+
+	search.Tags, err = envOperationTags()
+	reportError("invalid OPERATION_TAGS", err)
+
+	search.KeyDisplay, err = envKeyDisplay()
+	reportError("invalid KEY_DISPLAY", err)
+
+	if len(args) > 0 && args[0] == "--resume" {
+		resume = true
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "--":
+			args = args[1:]
+		case "wizard":
+			reportError("wizard failed", search.runWizard(os.Stdin))
+			return
+		case "status":
+			lock := envInstanceLock(search.Client)
+			if lock != nil {
+				reportError("couldn't read instance lock", lock.printStatus())
+			}
+			ledgerFile := os.Getenv("LEDGER_FILE")
+			checkpointed := os.Getenv("CHECKPOINT_FILE") != "" || os.Getenv("CHECKPOINT_KEY") != ""
+			switch {
+			case ledgerFile != "" || !checkpointed && lock == nil:
+				reportError("couldn't read ledger", printLedgerStatus(ledgerFile))
+			case checkpointed:
+				reportError("couldn't read checkpoint", search.printCheckpointStatus())
+			}
+			return
+		case "print-acl":
+			reportError("couldn't work out ACL", search.printRunACL(args[1:], rulesFile, freeTargetBytes))
+			return
+		case "verify-absence":
+			absent, err := search.verifyAbsence(args[1:])
+			reportError("couldn't verify absence", err)
+			if !absent {
+				exit(2)
+			}
+			return
+		case "undo":
+			backupFile := os.Getenv("BACKUP_FILE")
+			if len(args) > 1 {
+				backupFile = args[1]
+			}
+			if backupFile == "" {
+				reportError("can't undo", fmt.Errorf("no backup file given"))
+			}
+			reportError("couldn't undo", search.undoBackup(backupFile, envBool("UNDO_REPLACE", "false")))
+			return
+		}
+	}
+
+	search.CountOnly = envBool("COUNT_ONLY", "false")
+	if search.CountOnly {
+		// Matches are still counted, just not written anywhere.
+		search.Output = &matchOutput{}
+	} else {
+		search.Output, err = envMatchOutput()
+		reportError("couldn't open output", err)
+	}
+	search.Output.DryRun = search.DryRun
+	search.Output.Tags = search.Tags
+	search.Output.KeyDisplay = search.KeyDisplay
+	if outputDescribesKeys() {
+		search.Events.Describe = search.describeKey
+	}
+	search.Events.OnMatch(search.Output.Match)
+	if search.Prefixes = envPrefixReport(); search.Prefixes != nil {
+		search.Events.OnMatch(search.Prefixes.Record)
+	}
+	if search.TTLs = envTTLReport(); search.TTLs != nil {
+		search.Events.OnMatch(search.TTLs.Record)
+	}
+	liveStats.Subscribe(search.Events)
+	search.Dashboard.Subscribe(search.Events)
+	search.Tracer, err = envRunTracer()
+	reportError("invalid OpenTelemetry settings", err)
+	if search.Tracer != nil {
+		search.Tracer.root.Set("purge.target", search.String())
+		search.Tracer.root.Set("purge.dry_run", search.DryRun)
+		for key, value := range search.Tags {
+			search.Tracer.root.Set("purge.tag."+key, value)
+		}
+		search.Tracer.Subscribe(search.Events)
+		atExit(func() { search.Tracer.Finish(exitError) })
+		defer search.Tracer.Finish(nil)
+	}
+	summary := envRunSummary()
+	if summary != nil {
+		summary.Target, summary.DryRun, summary.Tags = search.String(), search.DryRun, search.Tags
+		summary.Subscribe(search.Events)
+		atExit(func() { summary.Finish(exitCode, exitError) })
+		defer summary.Finish(0, nil)
+	}
+	outcome := envRunOutcome()
+	outcome.Subscribe(search.Events)
+	switch {
+	case search.QuarantinePrefix != "":
+		search.Output.DeleteAction, search.Output.DeleteTTL = "quarantine", search.QuarantineTTL
+	case search.ExpireSeconds > 0:
+		search.Output.DeleteAction, search.Output.DeleteTTL = "expire", search.ExpireSeconds
+	}
+	if search.DryRun {
+		fmt.Fprintf(os.Stderr, "> dry run: no keys will be deleted\n")
+	}
+	atExit(search.Output.Close)
+	defer search.Output.Close()
+
+	search.Results, err = envResultServer()
+	reportError("couldn't start results server", err)
+	defer search.Results.Finish()
+	if search.Results != nil {
+		search.Output.Add("results server", search.Results)
+	}
+
+	if lock := envInstanceLock(redisDB); lock != nil {
+		lock.Tags = search.Tags
+		reportError("couldn't lock "+search.String(), lock.Acquire())
+		atExit(lock.Release)
+		defer lock.Release()
+		search.InternalKeys = append(search.InternalKeys, lock.Key, lock.QueueKey(), lock.WaitersKey())
+	}
+
+	if rulesFile != "" {
+		if envBool("DELETE_FIELDS", "false") {
+			reportError("invalid DELETE_FIELDS", fmt.Errorf("DELETE_FIELDS can't be used with RULES_FILE"))
+		}
+		if envBool("DELETE_ELEMENTS", "false") {
+			reportError("invalid DELETE_ELEMENTS", fmt.Errorf("DELETE_ELEMENTS can't be used with RULES_FILE"))
+		}
+		if envDefault("DELETE_ORDER", "scan") != "scan" {
+			reportError("invalid DELETE_ORDER", fmt.Errorf("DELETE_ORDER can't be used with RULES_FILE"))
+		}
+		if envInt("WATCH_INTERVAL", 0) > 0 {
+			reportError("invalid WATCH_INTERVAL settings", fmt.Errorf("WATCH_INTERVAL can't be used with RULES_FILE"))
+		}
+		if os.Getenv("MARK_FILE") != "" || os.Getenv("SWEEP_FILE") != "" {
+			reportError("invalid MARK_FILE or SWEEP_FILE", fmt.Errorf("MARK_FILE and SWEEP_FILE can't be used with RULES_FILE"))
+		}
+		rules, err := loadPurgeRules(rulesFile)
+		reportError("error loading rules from "+rulesFile, err)
+		if summary != nil {
+			summary.Condition = "rules from " + rulesFile
+		}
+		for _, rule := range rules {
+			if rule.deletes() {
+				reportError("refusing to delete every key for rule "+rule.Name, checkDeleteAll(rule.condition))
+			}
+		}
+		complete, err := search.openLedger("rules from "+rulesFile, len(deleteConditions(rules)) > 0)
+		reportError("couldn't open ledger", err)
+		if complete {
+			return
+		}
+		reportError("couldn't open checkpoint", search.openCheckpoint("rules from "+rulesFile, search.checkpointAction(len(deleteConditions(rules)) > 0), resume))
+		recordRun := func() {}
+		if conditions := deleteConditions(rules); len(conditions) > 0 {
+			skip, record, err := search.guardRerun(conditions)
+			reportError("couldn't check for repeated runs", err)
+			if skip {
+				return
+			}
+			recordRun = record
+			reportError("delete not approved", search.requireApproval(conditions))
+			if !search.DryRun {
+				reportError("not deleting", search.Window.Allow(search.Watchdog))
+			}
+			reportError("couldn't open backup", search.openBackup("rules from "+rulesFile))
+		}
+		reportKeyspaceChange := func() {}
+		if len(deleteConditions(rules)) > 0 {
+			reportKeyspaceChange, err = search.keyspaceDiff()
+			reportError("couldn't take keyspace snapshot", err)
+		}
+		reportError("error applying rules from "+rulesFile, search.applyRules(rules, envBool("WAIT_AND_REDELETE", "false")))
+		reportKeyspaceChange()
+		recordRun()
+		search.alertOnMatch()
+		outcome.Exit(search)
+		return
+	}
+
+	needle, err := envSearchCondition(args)
+	reportError("invalid search condition", err)
+	if summary != nil {
+		summary.Condition = needle.String()
+	}
+	reportError("invalid DELETE_FIELDS", search.envDeleteFields(needle))
+	reportError("invalid DELETE_ELEMENTS", search.envDeleteElements(needle))
+
+	if freeTargetBytes > 0 {
+		if search.Caps.Version != "" && !search.Caps.MemoryUsage {
+			reportError("can't find eviction candidates", fmt.Errorf("FREE_TARGET_BYTES needs MEMORY USAGE, which Redis %s doesn't support", search.Caps.Version))
+		}
+		assistant := &evictionAssistant{
+			FreeTargetBytes: freeTargetBytes,
+			Oversample:      envInt64("FREE_TARGET_OVERSAMPLE", 3),
+		}
+		reportError("error finding eviction candidates", search.listEvictionCandidates(needle, assistant))
+		return
+	}
+
+	if envBool("FINGERPRINT", "false") {
+		changed, err := search.fingerprintMatchingKeys(needle, os.Getenv("FINGERPRINT_PREVIOUS"))
+		reportError("error fingerprinting keys matching: "+needle.String(), err)
+		if changed {
+			exit(2)
+		}
+		return
+	}
+
+	deleting := envBool("DELETE_MATCHING_KEYS", "false")
+	complete, err := search.openLedger(needle.String(), deleting)
+	reportError("couldn't open ledger", err)
+	if complete {
+		return
+	}
+
+	watcher, err := envMatchWatcher()
+	reportError("invalid WATCH_INTERVAL settings", err)
+	if watcher != nil && search.Ledger != nil {
+		reportError("invalid WATCH_INTERVAL settings", fmt.Errorf("WATCH_INTERVAL can't be used with LEDGER_FILE"))
+	}
+
+	search.DeleteOrder, err = envDeleteOrder()
+	reportError("invalid DELETE_ORDER", err)
+	if search.DeleteOrder != nil {
+		if search.Ledger != nil {
+			reportError("invalid DELETE_ORDER", fmt.Errorf("DELETE_ORDER can't be used with LEDGER_FILE"))
+		}
+		atExit(search.DeleteOrder.Close)
+	}
+
+	mark := envMarkPlan()
+	if mark != nil && (deleting || watcher != nil) {
+		reportError("invalid MARK_FILE", fmt.Errorf("MARK_FILE marks the keys a listing run matches, so can't be used with DELETE_MATCHING_KEYS or WATCH_INTERVAL"))
+	}
+	search.Sweep = envSweepPlan()
+	if search.Sweep != nil && (!deleting || watcher != nil || search.Ledger != nil || search.DeleteOrder != nil) {
+		reportError("invalid SWEEP_FILE", fmt.Errorf("SWEEP_FILE needs DELETE_MATCHING_KEYS, and can't be used with WATCH_INTERVAL, LEDGER_FILE or DELETE_ORDER"))
+	}
+
+	reportError("couldn't open checkpoint", search.openCheckpoint(needle.String(), search.checkpointAction(deleting), resume))
+	if search.Checkpoint != nil && (watcher != nil || search.DeleteOrder != nil || search.Sweep != nil) {
+		setting := search.Checkpoint.Setting()
+		reportError("invalid "+setting, fmt.Errorf("%s can't be used with WATCH_INTERVAL, DELETE_ORDER or SWEEP_FILE", setting))
+	}
+
+	if deleting {
+		skip, recordRun, err := search.guardRerun([]string{needle.String()})
+		reportError("couldn't check for repeated runs", err)
+		if skip {
+			return
+		}
+		reportError("refusing to delete every key", checkDeleteAll(needle))
+		reportError("too many keys match", search.checkMatchRatio(needle))
+		reportError("delete not approved", search.requireApproval([]string{needle.String()}))
+		reportError("delete not confirmed", search.confirmDelete(needle))
+		if !search.DryRun {
+			reportError("not deleting", search.Window.Allow(search.Watchdog))
+		}
+		reportError("couldn't open backup", search.openBackup(needle.String()))
+		reportKeyspaceChange, err := search.keyspaceDiff()
+		reportError("couldn't take keyspace snapshot", err)
+		reportError("error deleting keys matching: "+needle.String(), watcher.Run(search, needle, !search.DryRun && search.ExpireSeconds == 0, func() error {
+			search.presentStart(needle, "delete")
+			result, err := search.deleteMatchingKeys(needle, envBool("WAIT_AND_REDELETE", "false"))
+			search.presentDeletion(needle, result, err)
+			return err
+		}))
+		reportKeyspaceChange()
+		recordRun()
 	} else {
-		reportError("error listing keys matching: "+needle.String(), search.listMatchingKeys(needle))
+		reportError("couldn't open plan", search.openMarkPlan(mark, needle.String()))
+		reportError("error listing keys matching: "+needle.String(), watcher.Run(search, needle, false, func() error {
+			search.presentStart(needle, "list")
+			result, err := search.listMatchingKeys(needle)
+			search.presentListing(needle, result)
+			return err
+		}))
+		reportError("couldn't write plan", mark.Close())
 	}
+	search.alertOnMatch()
+	outcome.Exit(search)
+}
+
+// envSearchCondition returns the search condition for values args,
+// configured by the environment.
+func envSearchCondition(args []string) (*searchCondition, error) {
+	hashMatch, err := parseHashMatch(os.Getenv("HASH_MATCH"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HASH_MATCH: %w", err)
+	}
+
+	// Malformed size limits and counts are refused, since ignoring them
+	// would widen what the search matches.
+	sizeThreshold, err := envLimit("SIZE_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	sizeMax, err := envLimit("SIZE_MAX")
+	if err != nil {
+		return nil, err
+	}
+	occurrences, err := envLimit("REQUIRED_MATCH_COUNT")
+	if err != nil {
+		return nil, err
+	}
+
+	needle := &searchCondition{
+		AccessMode:    purge.ParseAccessMode(os.Getenv("ACCESS_MODE")),
+		HashField:     os.Getenv("HASH_FIELD"),
+		JSONPath:      os.Getenv("JSON_PATH"),
+		HashMatch:     hashMatch,
+		MatchElements: envBool("MATCH_ELEMENTS", "false"),
+		KeyPattern:    os.Getenv("KEY_PATTERN"),
+		Search:        parseSearchPatterns(args, os.Getenv("SEARCH_DELIMITER")),
+		SizeThreshold: int(sizeThreshold),
+		SizeMax:       int(sizeMax),
+		Occurrences:   int(occurrences),
+		MatchAll:      parseSearchMode(os.Getenv("SEARCH_MODE")),
+		Negate:        envBool("INVERT_MATCH", "false"),
+	}
+	return needle, needle.Validate()
 }
 
 func usage() {
@@ -48,29 +467,424 @@ func usage() {
 [REDIS_ADDR=...]           \
 [TLS=y]                    \
 [ACCESS_MODE=hash]         \
+[HASH_FIELD=field]         \
+[HASH_SCAN=y]              \
+[STRING_CHUNK_SIZE=n]      \
+[CONCURRENCY=n]            \
+[SCAN_COUNT=n|auto]        \
+[START_CURSOR=n]           \
+[READ_REPLICA_ADDR=host:port] \
+[NO_TOUCH=auto]            \
+[BATCH_TARGET_MS=50]       \
+[JSON_PATH='$.path']       \
+[HASH_MATCH='f=v;g!=w']    \
+[MATCH_ELEMENTS=y]         \
+[KEY_PATTERN=session:*]    \
+[SCAN_TYPE=auto]           \
+[EXCLUDE_KEY_PATTERNS=...] \
+[PROTECTED_KEY_PATTERNS=...] \
 [DELETE_MATCHING_KEYS=yes] \
+[ALLOW_MATCH_ALL=y]        \
+[DRY_RUN=y]                \
+[MAX_DELETES=n]            \
+[DELETES_PER_SECOND=n]     \
+[ALLOWED_WINDOW='01:00-05:00 UTC'] \
+[MAX_MATCH_PERCENT=n]      \
+[DELETE_ORDER=largest-first] \
+[DELETE_COMMAND=auto]      \
+[MARK_FILE=plan.ndjson]    \
+[SWEEP_FILE=plan.ndjson]   \
+[EXPIRE_SECONDS=n]         \
+[QUARANTINE_PREFIX=purge:quarantine:] \
+[DELETE_FIELDS=y]          \
+[DELETE_ELEMENTS=y]        \
 [REQUIRED_MATCH_COUNT=n]   \
 [SIZE_THRESHOLD=x]         \
+[SIZE_MAX=y]               \
+[SIZE_MODE=memory]         \
 [WAIT_AND_REDELETE=n]      \
 [CLEAN_DELETE_MIN=500]     \
-	%s [value]
+[AUTO_RETRY=n]             \
+[MAX_CONSECUTIVE_ERRORS=n] \
+[BACKUP=y]                 \
+[BACKUP_FILE=path]         \
+[VERIFY_SAMPLE=n]          \
+[APPROVAL_URL=...]         \
+[CONFIRM_DELETE=count]     \
+[PRE_MATCH_HOOK=cmd]       \
+[POST_MATCH_HOOK=cmd]      \
+[PRE_DELETE_HOOK=cmd]      \
+[POST_DELETE_HOOK=cmd]     \
+[KEY_OWNERS_FILE=owners]   \
+[INSTANCE_LOCK=y]          \
+[RERUN_WINDOW=n]           \
+[RESULTS_ADDR=:8080]       \
+[OUTPUT_SINKS=stdout,...]  \
+[COUNT_ONLY=y]             \
+[OUTPUT_FORMAT=json]       \
+[OUTPUT_COLUMNS=key,size]  \
+[OUTPUT_FILE=report.txt]   \
+[OUTPUT_TEMPLATE='{{.Key}}'] \
+[SUMMARY_FILE=summary.json] \
+[OPERATION_TAGS=k=v,...]   \
+[KEY_DISPLAY=escape]       \
+[SEARCH_DELIMITER=,]       \
+[SEARCH_MODE=any]          \
+[INVERT_MATCH=y]           \
+[FINGERPRINT=y]            \
+[SCHEMA_REPORT=y]          \
+[SIZE_HISTOGRAM=all]       \
+[PREFIX_REPORT=y]          \
+[REPORT_TTL=y]             \
+[KEYSPACE_SNAPSHOT=y]      \
+[ALERT_ON_MATCH=y]         \
+[EXIT_CODES=y]             \
+[WATCH_INTERVAL=n]         \
+[RATE_ALERT_THRESHOLD=n]   \
+[PROGRESS=n]               \
+[QUIET=y]                  \
+[COLOR=auto]               \
+[PROGRESS_INTERVAL=30]     \
+[PROGRESS_KEYS=n]          \
+[TUI=y]                    \
+[STALL_TIMEOUT=n]          \
+[OTEL_EXPORTER_OTLP_ENDPOINT=url] \
+[PPROF_ADDR=localhost:6060] \
+[LEDGER_FILE=ledger.json]  \
+[SESSION_DURATION=n]       \
+[CHECKPOINT_FILE=checkpoint.json] \
+[CHECKPOINT_KEY=key]       \
+[CHECKPOINT_INTERVAL=10]   \
+[CONFIG_FILE=job.toml]     \
+	%s [value...]
+
+%[1]s list|delete|count [--config job.toml] [--flag value...] [--] [value...]
+
+%[1]s run PROFILE [--config redis-purge.toml] [--flag value...] [--] [value...]
+
+[RULES_FILE=rules.json] %[1]s
+
+%[1]s wizard
+
+LEDGER_FILE=ledger.json %[1]s status
+
+CHECKPOINT_FILE=checkpoint.json %[1]s --resume [value...]
+
+CHECKPOINT_KEY=key %[1]s status
+
+[...] %[1]s print-acl [value...]
+
+[VERIFY_KEYS_FILE=keys.txt] [VERIFY_REPORT_SECRET=secret] \
+%[1]s verify-absence [value...]
+
+[UNDO_REPLACE=y] [DRY_RUN=y] %[1]s undo backup.ndjson
+
+FREE_TARGET_BYTES=n [FREE_TARGET_OVERSAMPLE=3] %[1]s
 
 Deletes all keys with a given value if run with DELETE_MATCHING_KEYS=yes
 or DELETE_MATCHING_KEYS=y in the environment, otherwise lists the keys with
 the given value.
 
+The list, delete and count commands take the same settings as flags, named
+after the environment variables in lower case with dashes, before the
+values: %[1]s delete --key-pattern 'session:*' --dry-run bad-value is
+DELETE_MATCHING_KEYS=y KEY_PATTERN='session:*' DRY_RUN=y %[1]s bad-value.
+Flags take precedence over the environment, which is used for any setting not
+given as a flag. A flag of a y/n setting may be given bare (--dry-run) or with
+a value (--tls=false). list lists the matching keys, delete deletes them and
+count counts them and their total size, as with COUNT_ONLY=y, whatever
+DELETE_MATCHING_KEYS and COUNT_ONLY are set to. %[1]s --help lists the
+commands, and %[1]s delete --help (and so on) lists every flag, with the
+variable it may be set with instead. Secrets, such as APPROVAL_TOKEN_SECRET,
+and the OTEL_* variables are only read from the environment. The values follow
+the flags, or a --, so a value that is also the name of a subcommand needs no
+escaping: %[1]s list -- wizard.
+
+If --config (or CONFIG_FILE) names a config file, any setting given neither as
+a flag nor in the environment is read from the file, as are the values if none
+are given, so that a recurring purge can be kept under version control rather
+than in a long list of variables. Config files are TOML: settings are named
+after the variables, in lower case with underscores or dashes, optionally
+grouped in tables named after the sections of --help ([connection],
+[search], [safety] and so on); strings are quoted, numbers are decimal
+integers, booleans are true or false, arrays (for values and the
+comma-separated settings) are [...], and # starts a comment. Unknown settings
+and tables are errors, so typos aren't ignored. Whether a run deletes is up
+to its command: the file can't set DELETE_MATCHING_KEYS or COUNT_ONLY.
+
+A config file may also define named profiles, in [profiles.NAME] tables (and
+[profiles.NAME.safety] and so on), which %[1]s run NAME runs. A profile's
+command key is list (the default), delete or count, and its other settings,
+including its own safety caps such as max_deletes, take precedence over the
+rest of the file; flags and the environment still take precedence over both,
+and the settings they override are named when the run starts. run reads
+--config, or CONFIG_FILE, or else redis-purge.toml, and lists the file's
+profiles if no profile is named.
+
+Without any [value] (or HASH_MATCH), every key fitting KEY_PATTERN and the
+size limits matches. Since deleting them all is rarely intended, a deleting
+run with no search values (or a deleting rule in RULES_FILE without any)
+is refused unless ALLOW_MATCH_ALL=y is set, as for a purge by size alone:
+ALLOW_MATCH_ALL=y SIZE_THRESHOLD=1000000 DELETE_MATCHING_KEYS=y %[1]s ''
+
+If DRY_RUN=y (not the default), deletes go through the motions, including
+retries and reporting, without issuing any destructive commands:
+each key that would be deleted is printed as WOULD DELETE, and the summary
+counts the keys that would have been deleted. Approval isn't requested, and
+WAIT_AND_REDELETE and VERIFY_SAMPLE are skipped, since no keys are deleted.
+
+If MAX_DELETES is set, a run deletes at most MAX_DELETES keys (counting
+those it would delete in a dry run, and including deletes by matching rules
+in RULES_FILE), as a limit on the damage a broader than expected search can
+do. If MAX_DELETES_ACTION is abort (the default), the run fails when another
+key matches after MAX_DELETES keys have been deleted; if MAX_DELETES_ACTION
+is stop, the run stops scanning there and ends as usual.
+
+If DELETES_PER_SECOND is a number >0, destructive commands (DEL or UNLINK, or
+the EXPIRE, RENAMENX, HDEL or element removals that replace it) are paced to
+at most DELETES_PER_SECOND a second, so that a purge doesn't saturate
+replication links or cause latency spikes on a busy instance. Scanning and
+matching aren't throttled, and dry runs aren't slowed down.
+
+If ALLOWED_WINDOW is set to a daily window of the form HH:MM-HH:MM [zone],
+such as '01:00-05:00 UTC' or '22:00-02:00 Europe/Paris' (the zone defaults to
+UTC), destructive commands are only sent inside the window. Outside it, if
+OUTSIDE_WINDOW_ACTION is refuse (the default), the run refuses to start
+deleting, and a run still deleting when the window closes stops there; if
+OUTSIDE_WINDOW_ACTION is pause, deletes wait for the window to open again
+(which STALL_TIMEOUT doesn't count as a stall). Dry runs ignore the window.
+
+If MAX_MATCH_PERCENT is set, the share of the keyspace matching the search
+is estimated from MATCH_RATIO_SAMPLE (default 1000) random keys before
+deleting, and the run aborts without deleting anything if more than
+MAX_MATCH_PERCENT percent of keys match, as protection against a too-generic
+search string wiping the whole database. OVERRIDE_MATCH_RATIO=y deletes them
+anyway. MAX_MATCH_PERCENT doesn't apply with RULES_FILE.
+
+If DELETE_ORDER=largest-first (rather than scan, the default), matching keys
+are buffered until the scan is done, and then deleted biggest first, so that
+a purge cut short (by an interrupt, or MAX_DELETES) has reclaimed as much
+memory as possible. Up to DELETE_ORDER_BUFFER (default 100000) keys are held
+in memory; more are spilled to sorted temporary files, which are merged for
+the deletes and removed afterwards. Each key is matched again just before
+it's deleted, since it may have changed since the scan. DELETE_ORDER can't be
+used with RULES_FILE or LEDGER_FILE.
+
+Deletes can be split into a mark and a sweep, with review and sign-off in
+between. If MARK_FILE is set, a listing run also writes the keys it matches
+to the plan file MARK_FILE (which mustn't already exist), as JSON lines: a
+header with the target, condition, who marked the keys and when, then a line
+per key, escaped as with KEY_DISPLAY=escape. It ends by printing the plan's
+SHA-256. If SWEEP_FILE is set, a deleting run deletes the keys in the plan
+file SWEEP_FILE instead of scanning the keyspace, matching each again just
+before deleting it, and skipping those that are gone or no longer match. The
+sweep must have the same target and search condition as the mark. If
+SWEEP_CHECKSUM is set, the sweep refuses to start unless the plan's SHA-256
+is SWEEP_CHECKSUM, so that the plan deleted is the plan that was approved.
+MARK_FILE and SWEEP_FILE can't be used with RULES_FILE or WATCH_INTERVAL,
+nor SWEEP_FILE with LEDGER_FILE or DELETE_ORDER.
+
+If EXPIRE_SECONDS is set, keys are expired instead of deleted: every key
+that would be deleted is given a TTL of EXPIRE_SECONDS with EXPIRE, and shown
+as EXPIRE, giving applications a grace period in which a mistaken purge can be
+undone with PERSIST. WAIT_AND_REDELETE is skipped, since expiring keys still
+exist, and VERIFY_SAMPLE checks that expired keys are absent or have a TTL.
+
+If QUARANTINE_PREFIX is set (e.g. QUARANTINE_PREFIX=purge:quarantine:), keys
+are quarantined instead of deleted: every key that would be deleted is renamed
+with RENAMENX to QUARANTINE_PREFIX followed by its name, and shown as
+QUARANTINE, so that suspected-bad keys can be inspected, and restored by
+renaming them back, before they're removed for good. If QUARANTINE_TTL is set
+to a number of seconds, quarantined keys expire after that long. A key whose
+quarantined copy already exists fails to delete, rather than overwriting the
+copy. Keys starting with QUARANTINE_PREFIX are never searched, and
+WAIT_AND_REDELETE is skipped. QUARANTINE_PREFIX can't be used with
+EXPIRE_SECONDS. Renaming keys across hash slots isn't possible on Redis
+Cluster, so there the prefix must keep keys in their slots.
+
+If DELETE_FIELDS=y (not the default), and the match is confined to
+specific hash fields, only those fields are deleted, with HDEL, instead of the
+whole key, preserving the rest of the hash. The fields deleted are HASH_FIELD
+if it's set, or else the fields compared by HASH_MATCH, which must then be
+the whole search, with no [value] or size limits. For example,
+DELETE_FIELDS=y ACCESS_MODE=hash HASH_FIELD=ssn DELETE_MATCHING_KEYS=y
+%[1]s 123-45-6789 deletes only the ssn field of the matching hashes.
+WAIT_AND_REDELETE is skipped, and VERIFY_SAMPLE checks that the deleted
+fields are gone. DELETE_FIELDS can't be used with RULES_FILE,
+EXPIRE_SECONDS or QUARANTINE_PREFIX.
+
+If DELETE_ELEMENTS=y (not the default), with MATCH_ELEMENTS=y and
+ACCESS_MODE=list, set or zset, only the matching elements of each matching
+collection are removed, with LREM, SREM or ZREM, instead of the whole key,
+for surgical cleanup of mixed-content collections. Every copy of a matching
+list element is removed, and Redis deletes a collection left empty. For
+example, DELETE_ELEMENTS=y MATCH_ELEMENTS=y ACCESS_MODE=set
+DELETE_MATCHING_KEYS=y %[1]s bad-member removes bad-member from every set
+that has it. WAIT_AND_REDELETE is skipped, and VERIFY_SAMPLE checks that no
+matching elements are left. DELETE_ELEMENTS can't be used with RULES_FILE,
+EXPIRE_SECONDS, QUARANTINE_PREFIX or DELETE_FIELDS.
+
 If TLS=y (the default), then the redis server connection will use TLS
 (rediss://), instead of the plaintext redis protocol.
 
 If ACCESS_MODE is hash, values will be treated as redis hashes. If ACCESS_MODE
-is string, values will be treated as simple strings. If unspecified,
-ACCESS_MODE defaults to hash.
+is string, values will be treated as simple strings. If ACCESS_MODE is list,
+values will be treated as lists, read with LRANGE. If ACCESS_MODE is set,
+values will be treated as sets, read with SSCAN. If ACCESS_MODE is zset,
+values will be treated as sorted sets, read with ZSCAN; only members are
+matched, not scores. If ACCESS_MODE is stream, values will be treated as
+streams, read with XRANGE; each entry is an element made of its field values,
+in field name order. If ACCESS_MODE is json, values will be treated as
+RedisJSON documents, read with JSON.GET, and matched as JSON text. If
+unspecified, ACCESS_MODE defaults to hash.
+
+The elements of list, set, zset and stream values are concatenated and
+matched as a single value, unless MATCH_ELEMENTS=y (not the default), in
+which case each element is matched separately, and the key is selected if
+any element matches. SIZE_THRESHOLD and SIZE_MAX then apply to each element.
+Sizes are always the total size of all elements. Set and zset members are
+read in no particular order, so use MATCH_ELEMENTS=y or REQUIRED_MATCH_COUNT
+to search them.
+
+If HASH_FIELD is set with ACCESS_MODE=hash, only that field of each hash is
+matched, read with HGET instead of reading the whole hash with HGETALL.
+Hashes without the field are skipped. Sizes are the size of the field value.
+
+If HASH_SCAN=y (not the default) with ACCESS_MODE=hash, whole hashes are
+read with HSCAN, 1000 fields at a time, and matched as they're read, instead
+of being read in one HGETALL. This keeps huge hashes from blocking Redis or
+filling the tool's memory, at the cost of more round trips per hash.
+
+If STRING_CHUNK_SIZE is set to a number of bytes with ACCESS_MODE=string,
+strings are read with GETRANGE, STRING_CHUNK_SIZE bytes at a time, and
+matched as they're read, so that huge strings can be searched for
+substrings without reading them into memory. Substrings spanning two chunks
+are still found.
+
+If CONCURRENCY is set to a number above 1 (the default), the values of
+each SCAN batch are read and matched by that many workers in parallel,
+which speeds up searches dominated by round trips to Redis. Matches are
+still listed, deleted and reported one at a time in scan order, and only
+one batch of values is held in memory at once. CONCURRENCY doesn't apply
+to RULES_FILE runs.
+
+With ACCESS_MODE=string, the values of each SCAN batch are read in one
+MGET rather than one GET per key, unless STRING_CHUNK_SIZE or
+HASH_MATCH is set. Keys that aren't strings are then skipped silently,
+instead of being reported as WRONGTYPE errors. Whole hashes (unless
+HASH_SCAN is set), hash fields and JSON documents are likewise read in one
+pipeline per batch; lists, sets, sorted sets and streams are still read a
+page at a time per key.
+
+SCAN_COUNT (default 50) is the COUNT hint passed to SCAN, and so
+roughly the number of keys in each batch. Larger batches mean fewer round
+trips and faster runs, but each SCAN, MGET or pipeline then keeps Redis
+busy for longer, and more values are held in memory at once.
+
+If READ_REPLICA_ADDR is set to the address of a replica of the target,
+keys are scanned and values read on the replica, connecting as to the
+target, so that the read load of a purge stays off the primary. Deletes (and
+expires, quarantines, and field and element removals) still go to the
+target, and since the replica may lag behind, each key is matched again on
+the target just before it's acted on, and skipped if it no longer matches.
+
+NO_TOUCH controls whether connections turn on CLIENT NO-TOUCH, so that
+reading every value doesn't reset the idle times and access frequencies that
+Redis evicts keys by, or that FREE_TARGET_BYTES scores them by. With
+NO_TOUCH=auto (the default), it's turned on on Redis 7.2 and newer, which
+support it; NO_TOUCH=y refuses to run without it, and NO_TOUCH=n leaves
+it off.
+
+At startup, the server's capabilities are detected from its version, in INFO
+server, and, if COMMAND INFO is allowed, from the commands it hasn't had
+renamed or disabled, as managed services often do. Optional commands are
+only used where they're available: keys are deleted with UNLINK, which frees
+large values in the background, on Redis 4.0 and newer, and with DEL
+otherwise (DELETE_COMMAND=unlink or del forces either); SCAN TYPE and CLIENT
+NO-TOUCH are used as above; and SIZE_MODE=memory falls back to sizing values
+by their length without MEMORY USAGE, which FREE_TARGET_BYTES refuses to run
+without. Settings that force a command the server lacks, such as SCAN_TYPE=y
+on Redis 5, are warned about. A server that can't be asked, for lack of INFO,
+is reported, and only DEL and plain SCAN are used. Set DEBUG to see what was
+detected.
+
+With SCAN_COUNT=auto, the count adapts to how long each batch's SCAN and
+value reads take: it starts at 50, doubles while batches take under half of
+BATCH_TARGET_MS (default 50) milliseconds, and halves when they take
+longer, staying between SCAN_COUNT_MIN (default 10) and SCAN_COUNT_MAX
+(default 5000). A loaded server so gets smaller batches without manual
+tuning. With DEBUG set, every change of count is reported.
+
+If JSON_PATH is set with ACCESS_MODE=json, only the parts of each document
+selected by the path are matched, passing the path to JSON.GET. A JSONPath
+such as '$.user.email' selects a JSON array of all matching values; documents
+where it selects nothing are skipped. Sizes are the size of the selected JSON.
+
+If HASH_MATCH is set with ACCESS_MODE=hash, hashes are only selected if their
+fields satisfy every one of a ;-separated list of comparisons: field=value
+(equals), field!=value (not equals), field~value (contains) and field!~value
+(does not contain). A hash missing a compared field is never selected, not
+even by field!=value or field!~value, so that status!=active doesn't select
+every hash without a status. The compared fields are read with HMGET. If no
+[value], SIZE_THRESHOLD or SIZE_MAX is given, the rest of the hash is never
+read, and sizes are the size of the compared fields:
+HASH_MATCH='status=deleted;plan!=enterprise' %[1]s ''
+
+If KEY_PATTERN is set to a Redis glob pattern, only keys matching the pattern
+are considered. The pattern is passed to the server as the SCAN MATCH
+argument, so non-matching keys are never fetched. Progress counts only keys
+matching KEY_PATTERN, so the progress percentage is an underestimate.
+
+SCAN is passed the TYPE of keys that ACCESS_MODE reads, so that keys of other
+types are never returned, if SCAN_TYPE=y, or if SCAN_TYPE=auto (the default)
+and the server is Redis 6 or newer, which supports SCAN TYPE. With
+SCAN_TYPE=n, keys of every type are scanned, and keys of the wrong type are
+skipped with a WRONGTYPE error. When applying rules, TYPE is only passed if
+every rule reads the same type.
+
+If EXCLUDE_KEY_PATTERNS is set to a comma-separated list of key patterns,
+keys matching any of the patterns are skipped without fetching their values.
+Each pattern is a Redis glob pattern, or a regular expression if enclosed in
+slashes: EXCLUDE_KEY_PATTERNS='config:*,/^user:[0-9]+:profile$/'.
+
+If PROTECTED_KEY_PATTERNS is set to a comma-separated list of key patterns,
+like EXCLUDE_KEY_PATTERNS, keys matching any of the patterns are never listed
+or deleted. Unlike excluded keys, protected keys are still read and matched,
+and each protected key that would have matched is reported on stderr, with a
+count in the summary, so that near misses can be audited. Use
+EXCLUDE_KEY_PATTERNS to skip irrelevant keys cheaply, and
+PROTECTED_KEY_PATTERNS for keys that must never be touched. As a final
+guardrail against misconfigured searches, every delete, expire, quarantine or
+field or element removal also refuses protected keys itself, whichever path
+led to it (retries, WAIT_AND_REDELETE, rules or largest-first deletes), and
+reports the refusal as a failed delete.
 
 If SIZE_THRESHOLD is set to a number of bytes in the environment, only keys
 with values at least as large as SIZE_THRESHOLD will be considered.
 
+If SIZE_MAX is set to a number of bytes in the environment, only keys with
+values no larger than SIZE_MAX will be considered.
+
+With no search values, only sizes matter, so strings and hash fields
+(HASH_FIELD) are sized with STRLEN and HSTRLEN instead of being read,
+with the same sizes. If SIZE_MODE=memory, keys of any access mode are
+sized with MEMORY USAGE instead, so that huge hashes and collections are
+never transferred just to be measured; sizes are then the memory Redis uses
+for the whole key, including overheads. Values are still read whole when
+SCHEMA_REPORT or VERIFY_SAMPLE needs them.
+
+With search values and SIZE_THRESHOLD or SIZE_MAX, the lengths of
+strings and hash fields are checked first, with STRLEN or HSTRLEN, and
+values that can't fit the limits are never read, saving bandwidth when most
+values are too small (or too large). Whole hashes and collections can't be
+ruled out by their HLEN or LLEN, since their elements may be empty, so
+they're always read.
+
 If REQUIRED_MATCH_COUNT is a number >0, then keys are selected if the value
-contains the search pattern _at least_ that many times.
+contains the search pattern _at least_ that many times. With four or more
+search values, the occurrences of all of them are counted in a single pass
+over each value (with an Aho–Corasick automaton), so long lists of search
+values cost little more than one.
 
 If WAIT_AND_REDELETE=y (not the default), when deleting keys, wait and
 confirm that the keys have really been deleted, re-deleting them if necessary,
@@ -80,193 +894,787 @@ redis keys, waiting CLEAN_DELETE_WAIT_MS milliseconds after each iteration.
 The tool will only exit once CLEAN_DELETE_MIN consecutive checks no longer
 find the keys to be deleted.
 
+If AUTO_RETRY is a number >0, deletes that fail are retried at the end of the
+run, up to AUTO_RETRY times, waiting AUTO_RETRY_BACKOFF_MS milliseconds
+(default 1000) before the first retry and twice as long before each later
+one. Only the failed keys are retried; each is checked again against the
+search first, and keys that have since disappeared or stopped matching are
+left alone. The summary counts the keys deleted on retry, and the keys that
+still failed after the last retry.
+
+If MAX_CONSECUTIVE_ERRORS is a number >0, the run aborts, with its summary
+and with LEDGER_FILE (if set) left at the last completed SCAN batch, once
+that many key reads or deletes in a row have failed, rather than skipping its
+way through thousands of failures caused by an expired credential or a broken
+replica. WRONGTYPE errors, from keys of another type than the search reads,
+don't count.
+
+If BACKUP=y (not the default), destructive runs DUMP each key, with its TTL,
+just before deleting it (or expiring, quarantining, or deleting fields or
+elements of it), appending it to BACKUP_FILE (default
+redis-purge-backup-<time>.ndjson), which mustn't already exist. A key that
+can't be backed up isn't deleted. The backup is a file of JSON lines: a
+header describing the run, then one line per key, with the key escaped as
+with KEY_DISPLAY=escape, its base64 DUMP and its TTL in milliseconds (0 for
+none). Dry runs make no backup.
+
+%[1]s undo backup.ndjson (or just %[1]s undo, with BACKUP_FILE set) reverses
+a run by RESTOREing the keys in its backup file, with the TTLs they had when
+they were backed up. Keys that exist again are left alone, unless
+UNDO_REPLACE=y (not the default), which replaces them with the backed up
+value. The keys of a run that expired them (EXPIRE_SECONDS) or deleted fields
+or elements of them (DELETE_FIELDS, DELETE_ELEMENTS) still exist, so their
+backup records this, and undoing it always replaces them. With DRY_RUN=y, the
+keys that would be restored are listed, and nothing is restored.
+
+If VERIFY_SAMPLE is a number >0, deleting runs end with an assurance
+check: up to VERIFY_SAMPLE of the deleted keys, sampled at random, are
+checked to be absent, and up to VERIFY_SAMPLE of the keys that were read but
+not deleted are checked to still exist with the value they had when they were
+read. If VERIFY_REPLICA_ADDRS is set to a comma-separated list of replica
+addresses, the deleted keys are also checked to be absent on each replica.
+Each failed check is logged, followed by a count of the checks that passed.
+
 [value] is required to be an exact string match to the redis key's value if
 REQUIRED_MATCH_COUNT is not set. If REQUIRED_MATCH_COUNT is set, [value] is
 required to be a simple substring of the redis key's value with at least
 REQUIRED_MATCH_COUNT occurrences.
+
+If SCHEMA_REPORT=y (not the default), each matched value is classified by
+its detected format, from magic bytes and by trying to parse it: empty, gzip,
+zlib, zstd, json, msgpack, text, protobuf or binary. The summary then
+includes a breakdown of matched keys by format, showing which decodings a
+more precise follow-up search would need. Hash values are classified as the
+concatenation of their fields and values, so use HASH_FIELD to classify a
+single field. Values matched as they're streamed (HASH_SCAN,
+STRING_CHUNK_SIZE) can't be classified.
+
+If SIZE_HISTOGRAM=y (or matched; not the default), the summary includes a
+histogram of the sizes of matched values, in power-of-two buckets, to help
+choose SIZE_THRESHOLD and SIZE_MAX. If SIZE_HISTOGRAM=all, it also includes
+a histogram of every value read, matching or not, except with RULES_FILE.
+
+If PREFIX_REPORT=y (not the default), the summary includes the number and
+total size of matched keys by prefix, up to and including the first
+PREFIX_DELIMITER (default ":"), most matches first, showing which application
+namespaces the matches came from. Only the PREFIX_REPORT_TOP (default 20)
+largest prefixes are listed, or all of them if PREFIX_REPORT_TOP is 0. Keys
+without the delimiter are counted as (no prefix).
+
+If REPORT_TTL=y (not the default), each matched key's remaining TTL is looked
+up when it's matched, and shown in output lines as key_ttl (in seconds, -1
+if the key doesn't expire), and the summary (and SUMMARY_FILE, as
+matched_by_ttl) counts matched keys with no expiry, and expiring within a
+minute, an hour, a day, or later, since keys about to expire anyway may not
+need deleting.
+
+If KEYSPACE_SNAPSHOT=y (not the default), destructive runs take a cheap
+snapshot of the keyspace before and after the run, counting keys by prefix
+(up to the first ":") among the first KEYSPACE_SNAPSHOT_SAMPLE (default
+10000) keys that SCAN returns, and scaling the counts up to the whole
+keyspace. The summary then includes the estimated change in keys per prefix,
+the prefixes that shrank most first, so that reviewers can see that only the
+intended namespaces shrank. Dry runs take no snapshots.
+
+If FINGERPRINT=y (not the default), the matching keys are not listed.
+Instead, a compact fingerprint of them is printed, v1:count:size:hash, where
+hash combines the names and sizes of all matching keys regardless of the
+order they're found in. If FINGERPRINT_PREVIOUS is set to the fingerprint of
+an earlier run, the run exits with status 2 if the matching keys have
+changed since, so that cron jobs can alert when keys matching a search
+reappear or change.
+
+If ALERT_ON_MATCH=y (not the default), the run exits with status
+ALERT_EXIT_CODE (default 2) if any key matched, listed or deleted, so that
+monitoring can run searches for keys that must never exist and alert when
+they do.
+
+A run exits with status 1 on a fatal error, such as a failed connection, a
+bad setting or an aborted scan, and 130 if interrupted. If EXIT_CODES=y (not
+the default), a complete run also says how it went, so that wrapper scripts
+and cron jobs can branch on it: 0 if keys matched and were all listed or
+deleted, 3 if no key matched, and 4 if some matching keys failed to delete,
+even on retry (AUTO_RETRY). Otherwise a complete run exits with 0. Either
+way, ALERT_ON_MATCH and the other checks that exit with status 2 come first.
+
+If WATCH_INTERVAL is set to a number of seconds, the search (and delete, if
+DELETE_MATCHING_KEYS is set) is repeated every WATCH_INTERVAL seconds until
+interrupted, and the rate of new matching keys per minute is reported after
+each pass, and served by the results server's /status. When deleting, every
+key matched after the first pass is new; otherwise, the growth in matching
+keys since the last pass is counted. If RATE_ALERT_THRESHOLD is set, a JSON
+alert with the rate, condition, target and OPERATION_TAGS is posted to
+RATE_ALERT_URL whenever the rate rises above RATE_ALERT_THRESHOLD new keys per
+minute, catching an upstream bug that keeps writing data that has to be
+purged. WATCH_INTERVAL can't be used with LEDGER_FILE or RULES_FILE.
+
+An interrupted run (Ctrl-C, or SIGTERM or SIGHUP outside Windows) releases
+its instance lock and flushes its output before exiting with status 130. An
+interrupted scan first stops issuing commands once its in-flight command
+returns, skips retries, and reports its summaries so far and the cursor to
+resume from: run again with START_CURSOR set to it (or, with a LEDGER_FILE,
+with the same ledger) to carry on. Interrupting again exits at once.
+
+If PROGRESS=y (the default), scan progress is reported on stderr. When
+stderr is a terminal, progress is shown on a single line that is updated in
+place, fitted to the terminal's width (or COLUMNS) by leaving out the rates,
+and then the estimate, as needed, and cleared while matches and failed
+deletes are printed, so that they don't run into it. Otherwise, such as in CI
+or kubectl logs, a progress summary line is logged every PROGRESS_INTERVAL
+seconds (default 30), even in the middle of a SCAN batch, and, if
+PROGRESS_KEYS is set, every PROGRESS_KEYS keys visited. Either way, progress
+includes the keys visited per second, the total size of the values matched
+per second, and the time remaining, estimated from the size of the keyspace
+(DBSIZE) and the scan rate so far.
+
+If TUI=y (not the default), scans are shown on a full-screen dashboard on
+stderr instead, which needs stdin and stderr to be a terminal: the keys
+scanned of the keyspace, with a bar, the estimate and rates, the keys matched
+and deleted and the errors so far, and the latest matches and errors. Press p
+(or space) to pause the run after the key in hand, and again to resume it; a
+paused run isn't taken to have stalled. Press a or q to abort the run, as an
+interrupt does. Messages printed during a scan are hidden by the dashboard
+until it closes at the end of the scan, and matches aren't written to stdout
+when it's the same terminal: use OUTPUT_SINKS to keep them. Where keys
+can't be read as they're pressed (on Windows), press Enter after each.
+
+If STALL_TIMEOUT is set to a number of seconds, a watchdog checks that scans
+keep making progress. If a scan goes STALL_TIMEOUT seconds without reading a
+SCAN batch or finishing with a key, the watchdog dumps the stacks of all
+goroutines and the Redis server's PING time and LATENCY LATEST to stderr. If
+STALL_ACTION is abort (the default), the run then exits with an error,
+releasing its lock; if STALL_ACTION is warn, the run carries on, and the
+watchdog reports again if the scan stalls again after making progress.
+
+On SIGUSR1 (kill -USR1 <pid>; not on Windows), the run prints a snapshot of its
+stats to stderr, and carries on: the SCAN cursor it carries on from, the keys
+scanned so far of about how many, the keys matched and deleted and their
+total size, errors, the rates of each since the run started, and an estimate
+of the time remaining.
+
+If OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set,
+the run is traced with OpenTelemetry, and its spans are exported with OTLP over
+HTTP, as JSON (OTEL_EXPORTER_OTLP_PROTOCOL=http/json; other protocols aren't
+supported), to the endpoint's /v1/traces (or to the traces endpoint as is).
+The run is one trace, under a redis-purge span with the target and
+OPERATION_TAGS. Each SCAN batch is a scan batch span, with the cursor and the
+keys scanned, matched and deleted, and errors, and with a SCAN span, a fetch
+values span for the values read in a batch (see SCAN_COUNT and CONCURRENCY),
+and a visit keys span in which the keys are matched, read one by one if they
+weren't fetched with the batch, and deleted. OTEL_EXPORTER_OTLP_HEADERS,
+OTEL_SERVICE_NAME (redis-purge by default) and OTEL_RESOURCE_ATTRIBUTES are
+used as usual. Spans are exported every 10 seconds or 256 spans; if the
+endpoint can't be reached, they're dropped, rather than holding up the run.
+
+If PPROF_ADDR is set (e.g. PPROF_ADDR=localhost:6060), the Go runtime's
+profiles are served on it under /debug/pprof/, so that CPU and memory
+profiles of the tool itself can be captured from a long-running purge, such as
+with go tool pprof http://localhost:6060/debug/pprof/profile. The profiles
+aren't authenticated, and reveal the tool's command line, with the search
+values, so bind PPROF_ADDR to localhost.
+
+If RERUN_WINDOW is set to a number of seconds, a destructive run that repeats
+an identical run (with the same target, action and search condition or
+RULES_FILE rules) that completed in the last RERUN_WINDOW seconds is caught,
+such as a job submitted twice by accident. Each completed destructive run is
+recorded in the target Redis under the key "redis-purge:run:" followed by a
+hash of the run, expiring after RERUN_WINDOW seconds. If RERUN_ACTION is skip
+(the default), a repeated run is skipped with a message saying who completed
+the identical run and when; if RERUN_ACTION is warn, it only warns, and runs
+anyway. FORCE=y runs a repeated run anyway. Dry runs are never caught or
+recorded, and a run with a LEDGER_FILE is recorded once its last session
+completes.
+
+If LEDGER_FILE is set, the purge can be run in several sessions, each
+carrying on from where the last one stopped. The ledger, a JSON file, records
+the SCAN cursor the next session resumes from and the cumulative totals of
+scanned and matched keys, and matched keys per prefix (up to the first ":").
+It is saved after every SCAN batch, so an interrupted session loses little
+work. If SESSION_DURATION is set to a number of seconds, each session stops
+after the first SCAN batch that ends after SESSION_DURATION seconds: for
+example, a nightly cron job with SESSION_DURATION=1800 purges a large instance
+in 30 minute doses. Once the scan reaches the end of the keyspace, the ledger
+is marked complete, and further runs do nothing until it is removed. A ledger
+belongs to one search condition (or RULES_FILE) on one target, with one action
+(list, delete or dry-run delete), and may not be used for another. Dry runs of
+a delete read the ledger of the delete, but don't update it.
+%[1]s status prints the overall progress recorded in LEDGER_FILE (after the
+instance lock's holder and queue, with INSTANCE_LOCK=y).
+
+If CHECKPOINT_FILE is set, a scan that crashes or is interrupted can be
+resumed without rescanning the keys it already visited. The checkpoint, a JSON
+file, records the target, search condition and action of the run, the SCAN
+cursor it reached and its totals of scanned and matched keys. It is saved
+every CHECKPOINT_INTERVAL seconds (10 by default), and whenever the scan fails
+or is interrupted. Run again with --resume before the search values, and the
+same environment, to carry on from the checkpoint:
+CHECKPOINT_FILE=checkpoint.json %[1]s --resume [value...]. A run that finds a
+checkpoint refuses to start without --resume, and a resumed run refuses a
+checkpoint of another target, condition or action. The checkpoint is removed
+once the scan completes. Keys matched before the checkpoint was saved, but
+after the cursor it records, are visited again, which is harmless for
+idempotent actions such as deletes. CHECKPOINT_FILE may not be combined with
+LEDGER_FILE, WATCH_INTERVAL, DELETE_ORDER or SWEEP_FILE.
+
+If CHECKPOINT_KEY is set instead, the checkpoint is kept in that key of the
+target Redis, so that other operators, or a job rescheduled on another
+machine, can follow and resume the run without the original machine's
+filesystem. The checkpoint also records the run's status: running, interrupted
+or failed (with the error), and who last updated it. A resumed run refuses a
+running checkpoint that was updated in the last 3 CHECKPOINT_INTERVALs, whose
+run may still be going, unless FORCE=y is set. The key is never matched by the
+run itself. CHECKPOINT_KEY=key %[1]s status prints the checkpoint (as does
+%[1]s status with CHECKPOINT_FILE, if LEDGER_FILE isn't set).
+
+To search for a value that is also the name of a subcommand (such as
+"wizard", "status", "print-acl", "verify-absence" or "undo") or "--resume",
+precede it with --: %[1]s -- wizard
+
+Multiple [value] arguments may be given, in which case a key is selected if
+its value matches any of them. If SEARCH_DELIMITER is set, each [value] is
+also split on that delimiter, so SEARCH_DELIMITER=, %[1]s foo,bar is the
+same as %[1]s foo bar.
+
+If SEARCH_MODE is any (the default), a key is selected if its value matches
+any of the [value] arguments. If SEARCH_MODE is all, a key is selected only if
+its value matches every [value] argument. SEARCH_MODE=all requires
+REQUIRED_MATCH_COUNT to be set, since a value can't exactly match several
+different values: SEARCH_MODE=all REQUIRED_MATCH_COUNT=1 SIZE_THRESHOLD=4096
+%[1]s session expired selects values of at least 4096 bytes that contain both
+"session" and "expired".
+
+If INVERT_MATCH=y (not the default), keys are selected if their value does
+NOT match the search: INVERT_MATCH=y REQUIRED_MATCH_COUNT=1 %[1]s
+schema_version selects values that don't contain "schema_version".
+SIZE_THRESHOLD still applies as usual.
+
+If APPROVAL_URL is set, deletes must be approved before any key is deleted.
+The plan for the run (id, target, action, conditions, estimated_keys,
+requested_by, requested_at) is POSTed as JSON to APPROVAL_URL, and the tool
+waits for a decision. The webhook may reply with JSON {"status": "approved",
+"token": "..."} or {"status": "rejected", "reason": "..."} to decide
+immediately, or with {"poll_url": "..."} to say where to poll for the
+decision. APPROVAL_POLL_URL sets a poll URL if the webhook doesn't; {id} in
+the poll URL is replaced by the plan id. The poll URL is fetched every
+APPROVAL_POLL_INTERVAL seconds (default 10) until it returns the same
+approved/rejected JSON, for at most APPROVAL_TIMEOUT seconds (default 3600).
+If there's no poll URL, the operator is prompted to paste an approval token.
+If APPROVAL_TOKEN_SECRET is set, approval tokens must be the hex
+HMAC-SHA256 of the plan id keyed with that secret.
+
+If CONFIRM_DELETE is set, deletes (other than with RULES_FILE) ask for
+confirmation before any key is deleted. With CONFIRM_DELETE=count, the
+matching keys are first counted with a full scan; with CONFIRM_DELETE=sample,
+their count and total size are estimated from CONFIRM_SAMPLE (default 1000)
+random keys instead, which is much quicker on a large keyspace, but only a
+rough guide. The count is printed ("N keys / M bytes will be deleted"), and
+the delete goes ahead only if the operator types yes.
+
+PRE_MATCH_HOOK, POST_MATCH_HOOK, PRE_DELETE_HOOK and POST_DELETE_HOOK are
+shell commands run for each key: before its value is read, once it matches,
+just before it's deleted (in dry runs too), and once it's deleted or failed
+to be, for custom logging, notifications or vetoes. A pre-match, post-match
+or pre-delete hook that exits with a non-zero status, or runs for longer than
+HOOK_TIMEOUT seconds (default 30), vetoes the key, which is then left alone.
+Hooks see the key in PURGE_KEY, the hook in PURGE_HOOK, the action (list or
+delete) in PURGE_ACTION, the value's size in PURGE_SIZE (after a match), the
+rule in PURGE_RULE (with RULES_FILE), the delete's error in
+PURGE_DELETE_ERROR, and PURGE_DRY_RUN=y in dry runs. Their output goes to
+stderr. Each hook is a process per key, so keep KEY_PATTERN narrow with
+PRE_MATCH_HOOK.
+
+If INSTANCE_LOCK=y (not the default), the run takes a lock in the target
+Redis itself, in the key INSTANCE_LOCK_KEY (default "redis-purge:lock"), so
+that two runs never scan the same instance at once. The lock records who holds
+it, is renewed while the run lasts, and expires 30 seconds after a crashed run
+stops renewing it. If another run holds the lock, the run waits up to
+INSTANCE_LOCK_WAIT seconds (default 0) for it, and fails if the lock isn't
+released in time. Waiting runs queue for the lock in the sorted set
+INSTANCE_LOCK_KEY:queue and take it in the order they started waiting; a
+waiter that crashes is dropped from the queue 30 seconds after it last tried
+the lock. INSTANCE_LOCK=y %[1]s status prints who holds the lock and the runs
+queued for it. The lock key and its queue are never searched.
+
+If OPERATION_TAGS is set to a comma-separated list of key=value tags (such
+as OPERATION_TAGS=ticket=OPS-1234,reason=gdpr,requester=alice), the tags are
+stamped on everything the run records, so that any of its artifacts can be
+traced back to the request for it: each output line and NDJSON record
+(as "tags"), the approval plan, the instance lock and the LEDGER_FILE.
+
+Matched keys are written to each of the comma-separated OUTPUT_SINKS
+(default stdout): stdout writes a line per key to stdout; file:PATH writes the
+same lines to the file PATH; ndjson:PATH writes a JSON object per line, with
+the key, size, action, rule and owner, to PATH (or to stdout if PATH is - or
+omitted); csv:PATH writes a header row and then a CSV row per key to PATH (or
+to stdout), with the comma-separated OUTPUT_COLUMNS (default
+key,size,action,rule,owner; also dry_run, fields, ttl, type, key_ttl and
+tags); keys:PATH writes just the key, a line per key, to PATH (or to
+stdout); and an http:// or https:// URL is sent batches of OUTPUT_HTTP_BATCH
+(default 100) of the same JSON lines, POSTed as application/x-ndjson (timing
+out after 30 seconds). A failing sink is reported but doesn't stop the run:
+OUTPUT_SINKS=stdout,ndjson:matches.ndjson,https://hooks.example.com/purge
+
+If COUNT_ONLY=y (not the default), matched keys aren't written to any sink,
+for a quick impact assessment of a search matching millions of keys; they're
+only counted, and a listing run ends by printing the number of matching keys
+and their total size to stdout, separated by a space. Deleting runs still
+delete every matching key.
+
+If QUIET=y (not the default), a run prints no per-key lines (the sinks writing
+to stdout are left out, as are the re-deleting lines of WAIT_AND_REDELETE and
+the RESTORE lines of undo) and no progress, just its summary, for cron jobs and
+other runs whose log should only say what they did. Errors, reports and the
+sinks writing to files or URLs are unaffected.
+
+If COLOR is auto (the default), output to a terminal is colored, so that
+failures stand out among thousands of lines: the actions of matches written
+to stdout as text are red (yellow for the WOULD DELETE and so on of a dry
+run), errors are red, the summary of a deleting run is green, or red if any
+delete failed, and the summary of a listing run is bold. Output that's piped
+or redirected isn't colored, nor is any output if NO_COLOR is set or TERM is
+dumb. COLOR=y colors output wherever it goes, and COLOR=n never does.
+
+If OUTPUT_FORMAT=json (rather than text, the default), the stdout sink writes
+a JSON object per line, as ndjson does, for jq or other automation to
+consume, and every record (in every sink) also carries the key's Redis type
+and its remaining TTL in seconds when it was matched (-1 if it doesn't
+expire), as type and key_ttl, at the cost of a TYPE and TTL per match. If
+OUTPUT_FORMAT=csv, the stdout sink writes CSV, as csv does; the type and TTL
+are only looked up if OUTPUT_COLUMNS includes type or key_ttl. If
+OUTPUT_FORMAT=keys, the stdout sink writes just the keys, as keys does.
+
+Stdout only ever carries records: the stdout sinks' matches, and the reports
+of subcommands, COUNT_ONLY, FINGERPRINT and FREE_TARGET_BYTES (and
+SUMMARY_FILE=-, if asked for). Progress, summaries, warnings, errors and
+DEBUG output all go to stderr, so that a listing run can be piped into
+another command: OUTPUT_FORMAT=keys KEY_PATTERN='session:*' %[1]s null |
+xargs -n 100 redis-cli del. Keys with whitespace or control bytes in them
+are best passed through KEY_DISPLAY, or written as JSON.
+
+If OUTPUT_TEMPLATE is set to a Go text/template, the stdout and file:PATH
+sinks write a line per key by executing it with the match's Key, Size,
+Action, Rule, Owner, DryRun, Fields, TTL (set by EXPIRE_SECONDS or
+QUARANTINE_TTL), Type and KeyTTL (the key's type and remaining TTL, looked up
+only if the template uses them) and Tags; {{json .Key}} quotes a value as
+JSON. For example: OUTPUT_TEMPLATE='{{.Key}}	{{.Size}}	{{.KeyTTL}}'.
+OUTPUT_TEMPLATE can only be used with OUTPUT_FORMAT=text.
+
+If OUTPUT_FILE is set, everything the run writes to stdout (the stdout sink,
+and the reports of subcommands, FINGERPRINT and FREE_TARGET_BYTES) is written
+to a temporary file beside OUTPUT_FILE instead, which is renamed to
+OUTPUT_FILE when the run completes, so that OUTPUT_FILE is never a partial
+report. A run that fails or is interrupted leaves its partial output in the
+temporary file, and says where. Progress and diagnostics stay on stderr.
+
+If SUMMARY_FILE is set, a JSON summary of the run is written to it (or to
+stdout, if SUMMARY_FILE is -) when the run ends, however it ends: the target,
+condition, status (completed, failed or interrupted, or with EXIT_CODES=y, no
+matches or partial failure), exit code and error,
+start and finish times and duration, the keys scanned, matched, deleted and
+failed to delete, the bytes matched and deleted, the number of read and
+delete errors, and OPERATION_TAGS. In a dry run, the deleted counts are of
+the keys that would have been deleted.
+
+If KEY_DISPLAY is set, keys are formatted the same way in every sink, the
+results server, the WAIT_AND_REDELETE and FREE_TARGET_BYTES listings and
+verify-absence reports, so that keys with non-UTF-8 or control bytes can't
+corrupt the output: raw (the default) writes keys as they are; escape writes
+printable UTF-8 as is, backslashes as \\ and every other byte as \xNN; hex and
+base64 encode the whole key. Each format round-trips losslessly, and
+VERIFY_KEYS_FILE is read in the same format, so a list of formatted keys can
+be fed back to verify-absence.
+
+If RESULTS_ADDR is set (e.g. RESULTS_ADDR=:8080), matches are served over
+HTTP while the run is in progress. GET /matches?cursor=n&limit=m returns JSON
+{"matches": [...], "next_cursor": n, "done": false} with up to limit
+(default 1000) matches from cursor on; GET /matches/stream streams matches as
+server-sent events, resuming from ?cursor=n or the Last-Event-ID header, and
+ends with a "done" event; GET /status returns the match count and whether the
+run is done. At least the last RESULTS_BUFFER (default 100000) matches are
+kept. After the run, results are served for RESULTS_LINGER more seconds
+(default 0).
+
+If KEY_OWNERS_FILE or KEY_OWNERS_URL is set, each matched key is annotated
+with the team that owns it, and the summary includes match counts per owner.
+KEY_OWNERS_FILE is a file of "prefix owner" lines (blank lines and lines
+starting with # are ignored); the owner with the longest matching prefix wins.
+Keys not covered by KEY_OWNERS_FILE are looked up with KEY_OWNERS_URL, an
+HTTP service that is sent the key's prefix up to and including the first
+KEY_OWNERS_DELIMITER (default ":"), either in place of {prefix} in the URL,
+or as a prefix= query parameter. The service should reply with JSON
+{"owner": "team"} or the plain owner name; 404 means no known owner.
+Lookups are cached per prefix.
+
+If FREE_TARGET_BYTES is set, [value] is not used. Instead, keys (matching
+KEY_PATTERN, if set) are scored for how safely they could be deleted to free
+memory, and the best candidates that together free at least FREE_TARGET_BYTES
+are listed; nothing is deleted. The evictability score combines how cold the
+key is (OBJECT IDLETIME, or OBJECT FREQ under an LFU eviction policy; 50%%),
+how long it has to live (keys with no TTL or a long TTL score higher than
+keys that will soon expire anyway; 20%%), and its size (MEMORY USAGE; 30%%).
+The scan stops once FREE_TARGET_OVERSAMPLE (default 3) times
+FREE_TARGET_BYTES of candidates have been scored, and the best of those are
+chosen.
+
+%[1]s wizard interactively builds a search condition, previews a sample of
+the keys it matches, and prints the equivalent %[1]s command line to run.
+REDIS_ADDR and TLS are used for the preview as usual.
+
+%[1]s print-acl [value...] prints an ACL SETUSER command for a Redis user
+with just the commands and key patterns that the run configured by the rest
+of the environment (and RULES_FILE or FREE_TARGET_BYTES) needs, so that the
+run needn't be given admin credentials. The user is named ACL_USER (default
+"redis-purge"), and <password> must be replaced with its password. SCAN,
+DBSIZE and RANDOMKEY aren't limited by key patterns, so the user can still
+see every key name.
+
+%[1]s verify-absence [value...] deletes nothing, but checks that no keys
+match the search condition, on the target and on each VERIFY_REPLICA_ADDRS
+replica, as periodic proof that purged data hasn't reappeared. If
+VERIFY_KEYS_FILE is set, it instead checks that none of the keys listed in
+that file (one per line) exist. It prints a JSON report of the servers
+checked, the condition or keys file, the number of keys checked, who checked
+and when, any keys found (up to 100) and OPERATION_TAGS, signed with an
+HMAC-SHA256 keyed with VERIFY_REPORT_SECRET. Without VERIFY_REPORT_SECRET
+the report only carries a plain SHA-256 checksum. The run exits with status
+2 if any key was found.
+
+If RULES_FILE is set, [value] is not used. Instead, RULES_FILE names a JSON
+file containing a list of rules, and all the rules are applied in a single
+pass over the keyspace. Each rule has its own key pattern, search condition,
+action and limit, and its own counts in the final summary. For example:
+
+  [{"name": "stale-sessions", "key_pattern": "session:*",
+    "access_mode": "hash", "search": ["expired"], "required_match_count": 1,
+    "action": "delete", "limit": 10000},
+   {"name": "big-nulls", "key_pattern": "*", "access_mode": "string",
+    "search": ["null"], "size_threshold": 0, "action": "list"}]
+
+key_pattern is a Redis glob pattern (as used by SCAN MATCH) and defaults to
+"*". access_mode, hash_field, json_path, hash_match, match_elements, search,
+search_mode, required_match_count, size_threshold, size_max and invert_match
+behave like ACCESS_MODE, HASH_FIELD, JSON_PATH, HASH_MATCH, MATCH_ELEMENTS,
+[value], SEARCH_MODE, REQUIRED_MATCH_COUNT, SIZE_THRESHOLD, SIZE_MAX and
+INVERT_MATCH. action is list (the default) or delete. If limit
+is > 0, the rule stops acting on keys once it has matched limit keys.
 `,
 		os.Args[0])
 
 	os.Exit(1)
 }
 
-type valueAccessMode int
+// The search engine is the purge package's, which the CLI configures from the
+// environment.
+type (
+	valueAccessMode    = purge.AccessMode
+	valueSource        = purge.ValueSource
+	searchCondition    = purge.Condition
+	hashFieldCondition = purge.FieldCondition
+)
 
 const (
-	valueAccessString valueAccessMode = iota
-	valueAccessHash
+	valueAccessString = purge.AccessString
+	valueAccessHash   = purge.AccessHash
+	valueAccessList   = purge.AccessList
+	valueAccessSet    = purge.AccessSet
+	valueAccessZSet   = purge.AccessZSet
+	valueAccessStream = purge.AccessStream
+	valueAccessJSON   = purge.AccessJSON
 )
 
-func (v valueAccessMode) String() string {
-	switch v {
-	case valueAccessString:
-		return "string"
-	case valueAccessHash:
-		return "hash"
-	default:
-		return "?"
-	}
-}
-
-func (v valueAccessMode) Get(c *redis.Client, key string) (body []byte, err error) {
-	switch v {
-	case valueAccessString:
-		return c.Get(context.Background(), key).Bytes()
-	case valueAccessHash:
-		hashValue, err := c.HGetAll(context.Background(), key).Result()
-		if err != nil {
-			return nil, fmt.Errorf("valueAccessHash[%#v]: %w", key, err)
-		}
-		return hashAsBytes(hashValue), nil
-	}
-	panic(fmt.Sprintf("impossible valueAccessMode: %d", v))
-}
-
-func hashAsBytes(valueHash map[string]string) []byte {
-	byteBuf := &bytes.Buffer{}
-	for key, value := range valueHash {
-		byteBuf.Write([]byte(key))
-		byteBuf.Write([]byte(value))
-	}
-	return byteBuf.Bytes()
-}
-
-func parseValueAccessMode(accessMode string) valueAccessMode {
-	switch strings.ToLower(accessMode) {
-	case "string":
-		return valueAccessString
-	default:
-		return valueAccessHash
-	}
-}
-
 type redisSearch struct {
 	Client   *redis.Client
 	Options  *redis.Options
 	Debug    bool
 	Progress bool
-}
+	// Quiet prints no per-key lines or progress, just the run's summary.
+	Quiet bool
 
-func (r redisSearch) String() string {
-	return fmt.Sprintf("redis[%s tls=%v]", r.Options.Addr, r.Options.TLSConfig != nil)
-}
+	// Caps are the optional commands the server supports.
+	Caps *serverCapabilities
+	// Unlink deletes keys with UNLINK, rather than DEL.
+	Unlink bool
+
+	// Owners annotates matched keys with their owning team, if configured.
+	Owners *keyOwnership
+
+	// ExcludeKeys are skipped by every scan, without fetching their values.
+	ExcludeKeys keyPatternList
+
+	// Events publishes the run's scanned, matched and deleted keys, errors
+	// and progress to the features that observe it, such as Output.
+	Events *purgeEvents
+
+	// Protected keys are matched, but never acted on.
+	Protected *keyProtection
+
+	// Results serves matches over HTTP while the run is in progress, if
+	// configured. It is also one of the Output sinks.
+	Results *resultServer
+
+	// Output writes matched keys to the configured sinks.
+	Output *matchOutput
+
+	// CountOnly writes no matched keys, but just their count and total size
+	// in listing runs.
+	CountOnly bool
+
+	// DryRun goes through the motions of deleting keys, without issuing any
+	// destructive commands.
+	DryRun bool
+
+	// Schemas, if not nil, counts matched values by detected format.
+	Schemas *schemaReport
+
+	// Sizes, if not nil, counts matched (or all) values by size.
+	Sizes *sizeHistogram
+
+	// Prefixes, if not nil, counts matched keys by prefix.
+	Prefixes *prefixReport
+
+	// TTLs, if not nil, counts matched keys by remaining TTL.
+	TTLs *ttlReport
+
+	// Watchdog, if not nil, watches scans for stalls.
+	Watchdog *scanWatchdog
+
+	// Dashboard, if not nil, shows scans in progress on a full-screen
+	// terminal view, with keys to pause, resume or abort them.
+	Dashboard *runDashboard
+
+	// ScanCount is the COUNT hint passed to SCAN: roughly how many keys each
+	// SCAN batch returns.
+	ScanCount int
+
+	// Replica, if not nil, is a replica of Client that keys are scanned and
+	// values read from, leaving only deletes, and checks that keys still
+	// match just before deleting them, to Client.
+	Replica *redis.Client
+
+	// Tracer, if not nil, records spans of the run's SCAN batches.
+	Tracer *runTracer
+
+	// Checkpoint, if set, saves the progress of the scan every so often, for
+	// a crashed or interrupted run to be resumed.
+	Checkpoint *scanCheckpoint
+
+	// StartCursor is the SCAN cursor that scans start at, to resume an
+	// interrupted scan, unless a Ledger says where to resume.
+	StartCursor uint64
+
+	// MemorySizes sizes values with MEMORY USAGE, without reading them, for
+	// searches that only match sizes.
+	MemorySizes bool
+
+	// Batches, if not nil, adapts the SCAN count to how long batches take,
+	// instead of using ScanCount.
+	Batches *batchSizer
+
+	// Concurrency, if > 1, is the number of workers that read and match the
+	// values of each SCAN batch in parallel.
+	Concurrency int
 
-// A searchCondition specifies how to find a Redis value of interest
-type searchCondition struct {
-	// AccessMode specifies how redis values should be read, whether
-	// as simple strings, or hashes.
-	AccessMode valueAccessMode
+	// ScanType passes SCAN the TYPE of keys each search reads, so that keys
+	// of other types are never returned.
+	ScanType bool
 
-	// SizeThreshold is the minimum size of a search value to be considered
-	SizeThreshold int
+	// HashScan reads whole hashes with HSCAN, matching them as they're
+	// read, instead of reading them into memory with HGETALL.
+	HashScan bool
 
-	// Search is the exact or substring match for a value to be considered
-	Search string
+	// StringChunkSize, if > 0, reads strings with GETRANGE, StringChunkSize
+	// bytes at a time, matching them as they're read, instead of reading
+	// them into memory with GET.
+	StringChunkSize int
 
-	// Occurrences is the minimum number of occurrences of a search string
-	// for a value to be considered. If Occurrences == 0, requires an exact
-	// match of Search to the value.
-	Occurrences int
+	// InternalKeys are keys the tool itself keeps in Redis, which are never
+	// searched.
+	InternalKeys []string
+
+	// ExpireSeconds, if > 0, sets the TTL of keys to be deleted to
+	// ExpireSeconds instead of deleting them.
+	ExpireSeconds int
+
+	// QuarantinePrefix, if set, renames keys to be deleted into the
+	// namespace of keys starting with QuarantinePrefix instead; quarantined
+	// keys are never searched. QuarantineTTL, if > 0, is the TTL of the
+	// quarantined keys.
+	QuarantinePrefix string
+	QuarantineTTL    int
+
+	// DeleteFields, if set, are HDELed from keys to be deleted instead,
+	// leaving the rest of the hash.
+	DeleteFields []string
+
+	// DeleteElements, if set, is the search whose matching elements are
+	// removed from collections to be deleted instead, leaving the rest of
+	// the collection.
+	DeleteElements *searchCondition
+
+	// Tags are the run's OPERATION_TAGS, stamped on its output and records.
+	Tags operationTags
+
+	// DeleteOrder, if not nil, buffers matched keys to delete them largest
+	// first, rather than in scan order.
+	DeleteOrder *largestFirstOrder
+
+	// KeyDisplay is how keys are written to output.
+	KeyDisplay keyDisplay
+
+	// ErrorStreak, if not nil, aborts the run after too many consecutive
+	// fetch or delete errors.
+	ErrorStreak *errorStreak
+
+	// Sweep, if not nil, is the plan file of keys that deleting runs delete,
+	// instead of scanning the keyspace.
+	Sweep *sweepPlan
+
+	// Window, if not nil, is the daily window outside which destructive
+	// commands are paused or refused.
+	Window *maintenanceWindow
+
+	// Throttle, if not nil, limits the rate of destructive commands.
+	Throttle *deleteThrottle
+
+	// Backup, if not nil, DUMPs keys to a backup file before they're
+	// deleted.
+	Backup *keyBackup
+
+	// DeleteLimit, if not nil, caps the number of keys deleted.
+	DeleteLimit *deleteLimit
+
+	// Ledger, if set, tracks a purge run in several sessions, and scans
+	// resume from where it left off.
+	Ledger *purgeLedger
+
+	// Retrier retries failed deletes at the end of a run.
+	Retrier deleteRetrier
+
+	// Verifier, if not nil, samples deleted and kept keys to check once the
+	// deletes are done.
+	Verifier *purgeVerifier
+
+	// Hooks, if not nil, are the commands run before and after each key is
+	// matched and deleted, which may veto keys.
+	Hooks *keyHooks
 }
 
-func (s *searchCondition) searchDescription() string {
-	if s.Search == "" {
-		return "(any)"
-	}
-	return fmt.Sprintf("%#v", s.Search)
+func (r redisSearch) String() string {
+	return fmt.Sprintf("redis[%s tls=%v]", r.Options.Addr, r.Options.TLSConfig != nil)
 }
 
-func (s *searchCondition) String() string {
-	var description bytes.Buffer
-	fmt.Fprintf(&description, "(access-mode=%s) Search=%s", s.AccessMode.String(), s.searchDescription())
-	if s.SizeThreshold > 0 {
-		fmt.Fprintf(&description, " (size >= %d bytes)", s.SizeThreshold)
-	}
-	if s.Search != "" {
-		if s.Occurrences <= 0 {
-			fmt.Fprint(&description, " (exact match)")
-		} else {
-			fmt.Fprintf(&description, " (match >= %d occurrences)", s.Occurrences)
-		}
+// checkDeleteAll returns an error if deleting keys matching s would delete
+// every key fitting its key pattern and size limits, unless ALLOW_MATCH_ALL
+// is set.
+func checkDeleteAll(s *searchCondition) error {
+	if !s.MatchesAll() || envBool("ALLOW_MATCH_ALL", "false") {
+		return nil
 	}
-	return description.String()
+	return fmt.Errorf("%s has no search values, so it matches every key; set ALLOW_MATCH_ALL=y to delete them all", s)
 }
 
-// Matcher returns a function that accepts a Redis key's value and returns
-// true if the value satisfies the searchCondition s
-func (s *searchCondition) Matcher() func(value []byte) bool {
-	searchBytes := []byte(s.Search)
-
-	return func(value []byte) bool {
-		if len(value) < s.SizeThreshold {
-			return false
-		}
+func parseSearchMode(searchMode string) (matchAll bool) {
+	return strings.ToLower(searchMode) == "all"
+}
 
-		if len(searchBytes) == 0 {
-			return true
+// parseSearchPatterns returns the non-empty search patterns in args, first
+// splitting each arg on delimiter if delimiter is non-empty.
+func parseSearchPatterns(args []string, delimiter string) []string {
+	var patterns []string
+	for _, arg := range args {
+		parts := []string{arg}
+		if delimiter != "" {
+			parts = strings.Split(arg, delimiter)
 		}
-
-		if s.Occurrences <= 0 {
-			return bytes.Equal(value, searchBytes)
+		for _, part := range parts {
+			if part != "" {
+				patterns = append(patterns, part)
+			}
 		}
-
-		return bytes.Count(value, searchBytes) >= s.Occurrences
 	}
+	return patterns
 }
 
 func (r redisSearch) countKeys() (int64, error) {
-	return r.Client.DBSize(context.Background()).Result()
+	return r.reader().DBSize(context.Background()).Result()
 }
 
-func (r redisSearch) matchingKeysDo(search *searchCondition, action func(key string, value []byte) error) error {
-	valueMatches := search.Matcher()
-
-	var scanCursor uint64
-	var keys []string
-	var err error
-
-	totalKeys, err := r.countKeys()
+// matchingKeysDo scans the keyspace for keys matching search with the purge
+// engine, calling action with each matching key that isn't protected or
+// vetoed by a hook. An error from action stops the scan.
+func (r redisSearch) matchingKeysDo(search *searchCondition, action func(key string, size int) error) error {
+	run, err := r.startScan()
 	if err != nil {
-		return fmt.Errorf("couldn't count keys: %w", err)
+		return err
 	}
-
-	var visitingKeys int64
-
-	for {
-		keys, scanCursor, err = r.Client.Scan(context.Background(), scanCursor, "", 50).Result()
+	matches := r.purger(run, purge.Hooks{
+		PostRead: func(ctx context.Context, read purge.ReadResult) error {
+			if read.Err != nil {
+				fmt.Fprintf(os.Stderr, "> fetchValue error reading %#v (%s), skipping\n", read.Key, read.Err)
+				r.Events.Error(read.Key, read.Err)
+				return r.ErrorStreak.Failed(read.Err)
+			}
+			r.ErrorStreak.Succeeded()
+			if read.Matched || read.Value != nil || read.Size > 0 {
+				r.Sizes.Scanned(read.Size)
+			}
+			protected := read.Matched && r.Protected.Protects(read.Key, read.Size, "")
+			if (!read.Matched || protected) && read.Value != nil {
+				r.Verifier.Kept(read.Key, search.ValueSource(), read.Value)
+			}
+			if protected {
+				return purge.ErrSkip
+			}
+			return nil
+		},
+	}, r.Hooks.Hooks("", "")).Matches(context.Background(), search)
+
+	for matches.Next() {
+		match := matches.Match()
+		r.Schemas.Record(match.Value, match.Size)
+		r.Sizes.Record(match.Size)
+		err := action(match.Key, match.Size)
+		run.acted(match.Key, true)
 		if err != nil {
-			return err
-		}
-		if r.Debug {
-			fmt.Fprintf(os.Stderr, "> scan cursor: %d, key count: %d\n", scanCursor, len(keys))
+			return run.end(err)
 		}
+	}
+	return run.end(matches.Err())
+}
 
-		if r.Progress {
-			fmt.Fprintf(os.Stderr, "Visiting keys %d-%d of %d (%.2f%%)\r",
-				visitingKeys, visitingKeys+int64(len(keys)), totalKeys,
-				percentage(visitingKeys+int64(len(keys)), totalKeys))
+// scanKeysDo SCANs the whole keyspace with the purge engine, calling visit
+// for each key matching the glob keyPattern ("" for all keys) and, if
+// keyType is not empty, of that type. visit reports whether the key matched,
+// for progress reporting; an error from visit stops the scan.
+func (r redisSearch) scanKeysDo(keyPattern, keyType string, visit func(key string) (matched bool, err error)) error {
+	run, err := r.startScan()
+	if err != nil {
+		return err
+	}
+	keys := r.purger(run, r.Hooks.Hooks("", "")).Keys(context.Background(), keyPattern, keyType)
+	for keys.Next() {
+		if err := run.visit(); err != nil {
+			return run.end(err)
 		}
-		visitingKeys += int64(len(keys))
-
-		for _, key := range keys {
-			value, err := r.fetchValue(key, search.AccessMode)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "> fetchValue error reading %#v (%s), skipping\n", key, err)
-				continue
-			}
-
-			if valueMatches(value) {
-				if err = action(key, value); err != nil {
-					return err
-				}
-			}
+		matched, err := visit(keys.Key())
+		run.acted(keys.Key(), matched)
+		if err != nil {
+			return run.end(err)
 		}
+	}
+	return run.end(keys.Err())
+}
 
-		if scanCursor == 0 {
-			break
+func (r redisSearch) isInternalKey(key string) bool {
+	if r.QuarantinePrefix != "" && strings.HasPrefix(key, r.QuarantinePrefix) {
+		return true
+	}
+	for _, internalKey := range r.InternalKeys {
+		if key == internalKey {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
 func percentage(num, den int64) float64 {
@@ -283,36 +1691,133 @@ func average(sum, n int64) float64 {
 	return float64(sum) / float64(n)
 }
 
-func (r redisSearch) deleteMatchingKeys(search *searchCondition, repeatDeletes bool) error {
-	var deletedKeyCount, deletedValuesTotalSize, failedDeleteCount int64
-
-	fmt.Fprintf(os.Stderr, "> deleting keys from %s with value matching %s\n", r.String(), search)
-	defer func() {
-		fmt.Fprintf(os.Stderr, "> deleted %d keys (%d total size, average size: %.1f) matching %s, %d keys failed delete\n",
-			deletedKeyCount, deletedValuesTotalSize, average(deletedValuesTotalSize, deletedKeyCount), search, failedDeleteCount)
-	}()
-
+// deleteMatchingKeys deletes the keys matching search, returning what it did,
+// for presentDeletion to print, even if it fails part way.
+func (r redisSearch) deleteMatchingKeys(search *searchCondition, repeatDeletes bool) (purgeResult, error) {
+	result := purgeResult{Action: "delete"}
+	// The deleted keys are only kept to be re-deleted.
 	var deletedKeys []string
 
-	err := r.matchingKeysDo(search, func(key string, value []byte) error {
-		fmt.Printf("DELETE %s (size = %d)\n", key, len(value))
-		deletedKeys = append(deletedKeys, key)
-		if err := r.deleteKey(key); err != nil {
-			fmt.Fprintf(os.Stderr, "> failed to delete key %#v: %s, continuing\n", key, err)
-			failedDeleteCount++
-		} else {
-			deletedKeyCount++
-			deletedValuesTotalSize += int64(len(value))
+	hooks := r.actionHooks("delete", "")
+	deleteMatch := func(key string, size int) error {
+		err := hooks.Delete(context.Background(), purge.Match{Key: key, Size: size}, func(ctx context.Context, key string) error {
+			r.Events.Match(purge.Record{Key: key, Size: size, Action: "delete", Owner: r.Owners.Record(key, size)})
+			result.match(size)
+			return r.removeKey(key)
+		})
+		var failed *purge.DeleteError
+		switch {
+		case errors.Is(err, purge.ErrSkip):
+			return nil
+		case errors.As(err, &failed):
+			r.presentDeleteFailure(key, failed.Err)
+			r.Events.Error(key, failed.Err)
+			result.failed(key, size, failed.Err)
+			return r.ErrorStreak.Failed(failed.Err)
+		case err != nil:
+			return err
+		}
+		r.ErrorStreak.Succeeded()
+		r.Events.Deleted(key, size)
+		result.deleted(size, false)
+		if repeatDeletes {
+			deletedKeys = append(deletedKeys, key)
+		}
+		return nil
+	}
+	primary := r.primary().valueReader(search)
+	var err error
+	switch {
+	case r.Sweep != nil:
+		err = r.Sweep.Do(r.String(), search.String(), r.rematch(primary, deleteMatch))
+	case r.DeleteOrder != nil:
+		err = r.deleteLargestFirst(search, primary, deleteMatch)
+	case r.Replica != nil:
+		err = r.matchingKeysDo(search, r.rematch(primary, deleteMatch))
+	default:
+		err = r.matchingKeysDo(search, deleteMatch)
+	}
+	if errors.Is(err, errStopScan) {
+		err = nil
+	}
+
+	failures := map[string]*failedKey{}
+	for i := range result.Failures {
+		failures[result.Failures[i].Key] = &result.Failures[i]
+	}
+	failedKeys := r.Retrier.Retry(result.failedKeys(), func(key string) error {
+		read := primary.Read(context.Background(), key)
+		size, matched, err := read.Size, read.Matched, read.Err
+		if err == nil && matched {
+			err = r.deleteKey(key)
+		}
+		if err != nil {
+			failures[key].Err = err
+			return err
+		}
+		if !matched {
+			// A key that's gone or no longer matches needs no deleting.
+			return nil
+		}
+		r.Events.Deleted(key, size)
+		result.deleted(size, true)
+		if repeatDeletes {
+			deletedKeys = append(deletedKeys, key)
 		}
 		return nil
 	})
-	if err != nil || !repeatDeletes {
+	if len(failedKeys) < len(result.Failures) {
+		stillFailed := make([]failedKey, len(failedKeys))
+		for i, key := range failedKeys {
+			stillFailed[i] = *failures[key]
+		}
+		result.Failures = stillFailed
+		result.Failed = int64(len(stillFailed))
+	}
+
+	if err == nil && repeatDeletes {
+		err = r.repeatDeleteKeys(deletedKeys)
+	}
+	return result, err
+}
+
+// deleteLargestFirst buffers the keys matching search in DeleteOrder, and
+// then calls deleteMatch for each of them, largest first. Keys are matched
+// again with primary just before they're deleted, since they may have
+// changed since the scan.
+func (r redisSearch) deleteLargestFirst(search *searchCondition, primary *purge.Reader, deleteMatch func(key string, size int) error) error {
+	if err := r.matchingKeysDo(search, r.DeleteOrder.Add); err != nil {
+		r.DeleteOrder.Close()
 		return err
 	}
-	return r.repeatDeleteKeys(deletedKeys)
+	fmt.Fprintf(os.Stderr, "> deleting %d matching keys, largest first\n", r.DeleteOrder.keys)
+	return r.DeleteOrder.Do(r.rematch(primary, deleteMatch))
+}
+
+// rematch wraps deleteMatch to match keys found earlier again with primary
+// just before deleting them, skipping keys that are gone or no longer match.
+func (r redisSearch) rematch(primary *purge.Reader, deleteMatch func(key string, size int) error) func(key string, size int) error {
+	return func(key string, size int) error {
+		size, matched := r.matchesOnPrimary(key, primary)
+		if !matched {
+			// A key that's gone or no longer matches needs no deleting.
+			return nil
+		}
+		return deleteMatch(key, size)
+	}
 }
 
 func (r redisSearch) repeatDeleteKeys(keys []string) error {
+	if r.DryRun {
+		fmt.Fprintf(os.Stderr, "> dry run: not waiting to re-delete %d keys\n", len(keys))
+		return nil
+	}
+	if r.keepsDeletedKeys() {
+		// Expiring keys still exist, so they'd always look re-inserted, and
+		// re-quarantining a re-inserted key would clash with its first copy.
+		fmt.Fprintf(os.Stderr, "> keys are %s: not waiting to re-delete %d keys\n", r.deletedVerb(), len(keys))
+		return nil
+	}
 	cleanDeletePass := 0
 	deletePass := 0
 
@@ -357,7 +1862,11 @@ func (r redisSearch) deleteKeys(keys []string) (foundKeys bool, err error) {
 		}
 
 		foundKeys = true
-		fmt.Printf("DELETE %s\n", key)
+		if !r.Quiet {
+			// Re-deletes are diagnostics, since the keys were written to
+			// the sinks when first deleted.
+			fmt.Fprintf(os.Stderr, "> re-deleting %s\n", r.KeyDisplay.Format(key))
+		}
 		if err = r.deleteKey(key); err != nil {
 			return foundKeys, fmt.Errorf("key DELETE fail for %s: %w", key, err)
 		}
@@ -365,31 +1874,133 @@ func (r redisSearch) deleteKeys(keys []string) (foundKeys bool, err error) {
 	return foundKeys, nil
 }
 
-func (r redisSearch) listMatchingKeys(search *searchCondition) error {
-	var matchingKeyCount, matchingValuesTotalSize int64
-
-	fmt.Fprintf(os.Stderr, "> listing keys on %s with value matching %s\n", r.String(), search)
-	defer func() {
-		fmt.Fprintf(os.Stderr, "> found %d keys (total size: %d, average size: %.1f) matching %s\n",
-			matchingKeyCount, matchingValuesTotalSize, average(matchingValuesTotalSize, matchingKeyCount), search)
-	}()
-
-	return r.matchingKeysDo(search, func(key string, value []byte) error {
-		fmt.Printf("%s (size = %d)\n", key, len(value))
-		matchingKeyCount++
-		matchingValuesTotalSize += int64(len(value))
+// listMatchingKeys finds the keys matching search, returning what it found,
+// for presentListing to print, even if it fails part way.
+func (r redisSearch) listMatchingKeys(search *searchCondition) (purgeResult, error) {
+	result := purgeResult{Action: "list"}
+	err := r.matchingKeysDo(search, func(key string, size int) error {
+		r.Events.Match(purge.Record{Key: key, Size: size, Action: "list", Owner: r.Owners.Record(key, size)})
+		result.match(size)
 		return nil
 	})
+	return result, err
 }
 
-func (r redisSearch) fetchValue(key string, accessMode valueAccessMode) ([]byte, error) {
-	return accessMode.Get(r.Client, key)
+// describeKey returns the Redis type of key, and its TTL in seconds, or -1 if
+// it doesn't expire.
+func (r redisSearch) describeKey(key string) (keyType string, ttl int64, err error) {
+	ctx := context.Background()
+	pipe := r.reader().Pipeline()
+	typeCmd := pipe.Type(ctx, key)
+	ttlCmd := pipe.TTL(ctx, key)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return "", 0, err
+	}
+	ttl = -1
+	if remaining := ttlCmd.Val(); remaining > 0 {
+		ttl = int64(remaining / time.Second)
+	}
+	return typeCmd.Val(), ttl, nil
 }
 
+// deletedVerb describes deleted keys in summaries.
+func (r redisSearch) deletedVerb() string {
+	verb := "deleted"
+	if len(r.DeleteFields) > 0 {
+		verb = "deleted fields of"
+	} else if r.DeleteElements != nil {
+		verb = "removed elements of"
+	} else if r.QuarantinePrefix != "" {
+		verb = "quarantined"
+	} else if r.ExpireSeconds > 0 {
+		verb = "expired"
+	}
+	if r.DryRun {
+		return "would have " + verb
+	}
+	return verb
+}
+
+// deleteKey deletes key, as configured, once the maintenance window allows
+// it, and then runs POST_DELETE_HOOK for it, for deletes outside a scan,
+// such as retries.
 func (r redisSearch) deleteKey(key string) error {
+	if !r.DryRun {
+		if err := r.Window.Allow(r.Watchdog); err != nil {
+			return err
+		}
+	}
+	err := r.removeKey(key)
+	if postDelete := r.Hooks.Hooks("delete", "").PostDelete; postDelete != nil {
+		postDelete(context.Background(), purge.Match{Key: key}, err)
+	}
+	return err
+}
+
+// actionHooks returns the hooks run around each key matched by rule (or by
+// the run, if rule is empty), to be actioned with action: the key Hooks, and
+// before a delete, once PRE_DELETE_HOOK allows it, the checks that
+// MAX_DELETES and the maintenance window allow it too. A vetoed key doesn't
+// count towards MAX_DELETES. The window is checked before removeKey backs
+// the key up, and its refusal ends the scan rather than failing the key.
+func (r redisSearch) actionHooks(action, rule string) purge.Hooks {
+	return purge.ChainHooks(r.Hooks.Hooks(action, rule), purge.Hooks{
+		PreDelete: func(ctx context.Context, match purge.Match) error {
+			if err := r.DeleteLimit.Allow(match.Key); err != nil {
+				return err
+			}
+			if r.DryRun {
+				return nil
+			}
+			return r.Window.Allow(r.Watchdog)
+		},
+	})
+}
+
+// removeKey deletes key, or deletes just DeleteFields or the elements
+// matching DeleteElements if either is set, or quarantines it if
+// QuarantinePrefix is set, or sets its TTL to ExpireSeconds if that's set.
+// Protected keys are never deleted.
+func (r redisSearch) removeKey(key string) error {
+	if err := r.Protected.Guard(key); err != nil {
+		return err
+	}
+	if r.DryRun {
+		return nil
+	}
+	if err := r.Backup.Save(r.Client, key); err != nil {
+		return fmt.Errorf("not deleting %s: %w", r.KeyDisplay.Format(key), err)
+	}
+	r.Throttle.Wait()
+	if len(r.DeleteFields) > 0 {
+		return r.deleteFields(key)
+	}
+	if r.DeleteElements != nil {
+		return r.deleteElements(key)
+	}
+	if r.QuarantinePrefix != "" {
+		return r.quarantineKey(key)
+	}
+	if r.ExpireSeconds > 0 {
+		return r.Client.Expire(context.Background(), key, time.Duration(r.ExpireSeconds)*time.Second).Err()
+	}
+	if r.Unlink {
+		return r.Client.Unlink(context.Background(), key).Err()
+	}
 	return r.Client.Del(context.Background(), key).Err()
 }
 
+// alertOnMatch exits with ALERT_EXIT_CODE if ALERT_ON_MATCH is set and any
+// key matched, so that runs can guard against keys that must never exist.
+func (r redisSearch) alertOnMatch() {
+	if !envBool("ALERT_ON_MATCH", "false") || r.Output.Matches() == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "> alert: %d keys matched\n", r.Output.Matches())
+	r.Results.Finish()
+	exit(envInt("ALERT_EXIT_CODE", 2))
+}
+
 func envTLSConfig(tlsEnabled bool) *tls.Config {
 	if !tlsEnabled {
 		return nil
@@ -404,6 +2015,7 @@ func redisOptions() *redis.Options {
 		Addr:        envDefault("REDIS_ADDR", ":6379"),
 		ReadTimeout: time.Duration(envInt("READ_TIMEOUT", 180)) * time.Second,
 		TLSConfig:   envTLSConfig(envBool("TLS", "true")),
+		OnConnect:   envNoTouch(),
 	}
 }
 
@@ -424,15 +2036,69 @@ func envInt(name string, defval int) (intValue int) {
 	return intValue
 }
 
+func envInt64(name string, defval int64) (intValue int64) {
+	var err error
+	intValue, err = strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		return defval
+	}
+	return intValue
+}
+
+// envLimit returns the integer value of name, or 0 if it isn't set. Unlike
+// envInt64, it returns an error if name is set to anything but an integer,
+// since silently ignoring a mistyped limit or filter would run without it.
+func envLimit(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s=%#v is not an integer", name, value)
+	}
+	return limit, nil
+}
+
 func envBool(name, defval string) bool {
 	value := strings.ToLower(envDefault(name, defval))
 	return value == "y" || value == "yes" || value == "true" || value == "t" || value == "1"
 }
 
+// exitHooks are run by reportError before exiting, since deferred calls in
+// main don't run on os.Exit.
+var exitHooks []func()
+
+// exitCode is the code the run is exiting with, once exit is called, and
+// exitError the error it's failing with, if any.
+var (
+	exitCode  int
+	exitError error
+)
+
+// atExit registers hook to be run by exit.
+func atExit(hook func()) {
+	exitHooks = append(exitHooks, hook)
+}
+
+// exit runs the atExit hooks and exits with code.
+func exit(code int) {
+	exitCode = code
+	for _, hook := range exitHooks {
+		hook()
+	}
+	os.Exit(code)
+}
+
 func reportError(message string, err error) {
 	if err == nil {
 		return
 	}
-	fmt.Fprintf(os.Stderr, "> %s: %s\n", message, err)
-	os.Exit(1)
+	progressLine.Erase()
+	fmt.Fprintln(os.Stderr, paint(os.Stderr, colorRed, fmt.Sprintf("> %s: %s", message, err)))
+	exitError = fmt.Errorf("%s: %w", message, err)
+	if errors.Is(err, errInterrupted) {
+		exit(130)
+	}
+	exit(1)
 }
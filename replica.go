@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// envReadReplica returns a client for READ_REPLICA_ADDR, connecting like the
+// main client, or nil if keys are scanned and read on the target itself.
+func envReadReplica() *redis.Client {
+	addr := os.Getenv("READ_REPLICA_ADDR")
+	if addr == "" {
+		return nil
+	}
+	options := redisOptions()
+	options.Addr = addr
+	return redis.NewClient(options)
+}
+
+// reader returns the client that keys are scanned and values read with.
+func (r redisSearch) reader() *redis.Client {
+	if r.Replica != nil {
+		return r.Replica
+	}
+	return r.Client
+}
+
+// primary returns r reading from the target itself rather than a replica.
+func (r redisSearch) primary() redisSearch {
+	r.Replica = nil
+	return r
+}
+
+// matchesOnPrimary matches key again with primary, a reader of the target,
+// before a key matched on a replica, which may lag behind, is deleted. Keys
+// that are gone, no longer match, or can't be read are skipped.
+func (r redisSearch) matchesOnPrimary(key string, primary *purge.Reader) (size int, matched bool) {
+	read := primary.Read(context.Background(), key)
+	if read.Err != nil && !errors.Is(read.Err, redis.Nil) {
+		fmt.Fprintf(os.Stderr, "> couldn't match key %#v again on %s before deleting it: %s, skipping\n", key, r.String(), read.Err)
+	}
+	return read.Size, read.Err == nil && read.Matched
+}
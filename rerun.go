@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rerunKeyPrefix prefixes the keys that record completed runs.
+const rerunKeyPrefix = "redis-purge:run:"
+
+// A completedRun is stored in the target Redis when a destructive run
+// completes, for as long as identical runs should be caught.
+type completedRun struct {
+	ID          string        `json:"id"`
+	Action      string        `json:"action"`
+	Conditions  []string      `json:"conditions"`
+	CompletedBy string        `json:"completed_by"`
+	CompletedAt time.Time     `json:"completed_at"`
+	Tags        operationTags `json:"tags,omitempty"`
+}
+
+// rerunGuard catches destructive runs that repeat an identical run that
+// completed recently, such as a job submitted twice by accident.
+type rerunGuard struct {
+	// ID is the content-addressed ID of the run: a hash of its target,
+	// action and conditions.
+	ID  string
+	Key string
+
+	// Window is how long after a run completes an identical run is caught.
+	Window time.Duration
+
+	// Warn only warns about a repeated run, rather than skipping it.
+	Warn bool
+
+	run    completedRun
+	client *redis.Client
+}
+
+// envRerunGuard returns the guard configured by RERUN_WINDOW and
+// RERUN_ACTION for a run of action on keys matching conditions, or nil if
+// RERUN_WINDOW is not set.
+func (r redisSearch) envRerunGuard(action string, conditions []string) (*rerunGuard, error) {
+	window := envInt("RERUN_WINDOW", 0)
+	if window <= 0 {
+		return nil, nil
+	}
+	hash := sha256.Sum256([]byte(r.String() + "\x00" + action + "\x00" + strings.Join(conditions, "\x00")))
+	id := hex.EncodeToString(hash[:8])
+	guard := &rerunGuard{
+		ID:     id,
+		Key:    rerunKeyPrefix + id,
+		Window: time.Duration(window) * time.Second,
+		run: completedRun{
+			ID:         id,
+			Action:     action,
+			Conditions: conditions,
+			Tags:       r.Tags,
+		},
+		client: r.Client,
+	}
+	switch rerunAction := envDefault("RERUN_ACTION", "skip"); rerunAction {
+	case "skip":
+	case "warn":
+		guard.Warn = true
+	default:
+		return nil, fmt.Errorf("unknown RERUN_ACTION %#v (expected skip or warn)", rerunAction)
+	}
+	return guard, nil
+}
+
+// Check reports whether the run should be skipped, because an identical run
+// completed within Window and neither force nor Warn is set.
+func (g *rerunGuard) Check(force bool) (skip bool, err error) {
+	previous, err := g.client.Get(context.Background(), g.Key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("couldn't read run key %#v: %w", g.Key, err)
+	}
+	var run completedRun
+	if err = json.Unmarshal([]byte(previous), &run); err != nil {
+		return false, fmt.Errorf("couldn't parse run key %#v: %w", g.Key, err)
+	}
+	fmt.Fprintf(os.Stderr, "> an identical run %s (%s) completed at %s by %s\n",
+		g.ID, run.Action, run.CompletedAt.Format(time.RFC3339), run.CompletedBy)
+	switch {
+	case force:
+		fmt.Fprintf(os.Stderr, "> FORCE is set: running it again\n")
+		return false, nil
+	case g.Warn:
+		fmt.Fprintf(os.Stderr, "> warning: running it again; set RERUN_ACTION=skip to skip repeated runs\n")
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "> skipping this run; set FORCE=y to run it again\n")
+	return true, nil
+}
+
+// Record records that the run completed, so that identical runs within
+// Window are caught.
+func (g *rerunGuard) Record() error {
+	g.run.CompletedBy = operatorName()
+	g.run.CompletedAt = time.Now().UTC()
+	run, err := json.Marshal(g.run)
+	if err != nil {
+		return err
+	}
+	if err = g.client.Set(context.Background(), g.Key, run, g.Window).Err(); err != nil {
+		return fmt.Errorf("couldn't record run in %#v: %w", g.Key, err)
+	}
+	return nil
+}
+
+// guardRerun checks whether a destructive run of conditions repeats an
+// identical recent run, reporting whether it should be skipped. If it
+// shouldn't be skipped, it returns a func to record the run once it's
+// completed. Dry runs are never caught or recorded.
+func (r *redisSearch) guardRerun(conditions []string) (skip bool, recordRun func(), err error) {
+	noop := func() {}
+	if r.DryRun {
+		return false, noop, nil
+	}
+	guard, err := r.envRerunGuard(r.deleteAction(), conditions)
+	if err != nil || guard == nil {
+		return false, noop, err
+	}
+	r.InternalKeys = append(r.InternalKeys, guard.Key)
+	if skip, err = guard.Check(envBool("FORCE", "false")); err != nil || skip {
+		return skip, noop, err
+	}
+	return false, func() {
+		// A run in several sessions only completes with its last session.
+		if r.Ledger != nil && !r.Ledger.Done {
+			return
+		}
+		reportError("couldn't record completed run", guard.Record())
+	}, nil
+}
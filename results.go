@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// A servedRecord is a match as served by the results server, with the cursor
+// to continue from.
+type servedRecord struct {
+	Cursor int64 `json:"cursor"`
+	purge.Record
+}
+
+// resultServer serves the matches of an in-progress run over HTTP, both as
+// cursor-paginated pages and as a server-sent event stream, so that clients
+// can consume results while the scan is still running.
+type resultServer struct {
+	// Linger is how long to keep serving results after the run finishes.
+	Linger time.Duration
+
+	mu sync.Mutex
+	// records holds the most recent matches; records[0] has cursor base.
+	records []servedRecord
+	base    int64
+	limit   int
+	done    bool
+	// matchRate is the rate of new matching keys per minute, when watching.
+	matchRate *float64
+	// changed is closed and replaced whenever records or done change.
+	changed chan struct{}
+}
+
+// envResultServer starts the results server on RESULTS_ADDR, if set.
+func envResultServer() (*resultServer, error) {
+	addr := os.Getenv("RESULTS_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	results := &resultServer{
+		Linger:  time.Duration(envInt("RESULTS_LINGER", 0)) * time.Second,
+		limit:   envInt("RESULTS_BUFFER", 100000),
+		changed: make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/matches", results.serveMatches)
+	mux.HandleFunc("/matches/stream", results.serveStream)
+	mux.HandleFunc("/status", results.serveStatus)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "> results server stopped: %s\n", err)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "> serving results on http://%s/matches\n", listener.Addr())
+	return results, nil
+}
+
+// Match records a match, as an outputSink.
+func (s *resultServer) Match(record purge.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, servedRecord{
+		Cursor: s.base + int64(len(s.records)),
+		Record: record,
+	})
+	// Trim in bulk, so that we copy records only once every limit matches.
+	if s.limit > 0 && len(s.records) >= 2*s.limit {
+		dropped := len(s.records) - s.limit
+		s.records = append([]servedRecord(nil), s.records[dropped:]...)
+		s.base += int64(dropped)
+	}
+	s.notify()
+	return nil
+}
+
+// Close does nothing: the results server keeps serving until Finish.
+func (s *resultServer) Close() error {
+	return nil
+}
+
+// Finish marks the run as done, and keeps serving for Linger so that clients
+// can collect the last results.
+func (s *resultServer) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.done = true
+	s.notify()
+	s.mu.Unlock()
+	if s.Linger > 0 {
+		fmt.Fprintf(os.Stderr, "> run finished, serving results for another %s\n", s.Linger)
+		time.Sleep(s.Linger)
+	}
+}
+
+// SetMatchRate records the rate of new matching keys per minute, served by
+// /status.
+func (s *resultServer) SetMatchRate(perMinute float64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.matchRate = &perMinute
+	s.mu.Unlock()
+}
+
+func (s *resultServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// page returns up to limit records from cursor on, the cursor to continue
+// from, whether the run is done, and a channel closed on the next change.
+func (s *resultServer) page(cursor int64, limit int) (records []servedRecord, next int64, done bool, changed <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cursor < s.base {
+		cursor = s.base
+	}
+	start := int(cursor - s.base)
+	if start > len(s.records) {
+		start = len(s.records)
+	}
+	end := len(s.records)
+	if limit > 0 && end-start > limit {
+		end = start + limit
+	}
+	records = append([]servedRecord(nil), s.records[start:end]...)
+	return records, s.base + int64(end), s.done && end == len(s.records), s.changed
+}
+
+func queryInt(r *http.Request, name string, defval int64) int64 {
+	value, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	if err != nil {
+		return defval
+	}
+	return value
+}
+
+func (s *resultServer) serveMatches(w http.ResponseWriter, r *http.Request) {
+	records, next, done, _ := s.page(queryInt(r, "cursor", 0), int(queryInt(r, "limit", 1000)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Matches    []servedRecord `json:"matches"`
+		NextCursor int64          `json:"next_cursor"`
+		Done       bool           `json:"done"`
+	}{records, next, done})
+}
+
+func (s *resultServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	total, done, matchRate := s.base+int64(len(s.records)), s.done, s.matchRate
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Matches   int64    `json:"matches"`
+		Done      bool     `json:"done"`
+		MatchRate *float64 `json:"new_matches_per_minute,omitempty"`
+	}{total, done, matchRate})
+}
+
+// serveStream sends matches as server-sent events, starting from the cursor
+// query parameter or the Last-Event-ID header, until the run is done.
+func (s *resultServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	cursor := queryInt(r, "cursor", 0)
+	if lastID, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		cursor = lastID + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		records, next, done, changed := s.page(cursor, 1000)
+		for _, record := range records {
+			recordJSON, _ := json.Marshal(record)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", record.Cursor, recordJSON)
+		}
+		cursor = next
+		if done {
+			fmt.Fprint(w, "event: done\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		if len(records) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// deleteRetrier retries the deletes that failed during a run, re-checking
+// only the failed keys instead of scanning the whole keyspace again.
+type deleteRetrier struct {
+	// Attempts is how many times to retry the failed keys; 0 disables
+	// retries.
+	Attempts int
+
+	// Backoff is the wait before the first retry, doubled before each
+	// later retry.
+	Backoff time.Duration
+}
+
+func envDeleteRetrier() deleteRetrier {
+	return deleteRetrier{
+		Attempts: envInt("AUTO_RETRY", 0),
+		Backoff:  time.Duration(envInt("AUTO_RETRY_BACKOFF_MS", 1000)) * time.Millisecond,
+	}
+}
+
+// Retry calls retryDelete for each failed key, up to Attempts times with
+// exponential backoff, until no keys fail. retryDelete should re-check that the
+// key still qualifies for deletion before deleting it. Retry returns the keys
+// that still failed after the last attempt. An interrupted run leaves its
+// failed keys to the resumed run, and so does one whose maintenance window
+// has closed.
+func (d deleteRetrier) Retry(failedKeys []string, retryDelete func(key string) error) []string {
+	backoff := d.Backoff
+	for attempt := 1; attempt <= d.Attempts && len(failedKeys) > 0 && !isInterrupted(); attempt++ {
+		fmt.Fprintf(os.Stderr, "> retrying %d failed deletes in %s (attempt %d of %d)\n",
+			len(failedKeys), backoff, attempt, d.Attempts)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		var stillFailed []string
+		for i, key := range failedKeys {
+			err := retryDelete(key)
+			if errors.Is(err, errOutsideWindow) {
+				fmt.Fprintf(os.Stderr, "> not retrying %d failed deletes: %s\n", len(failedKeys)-i, err)
+				return append(stillFailed, failedKeys[i:]...)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "> retry %d failed to delete key %#v: %s\n", attempt, key, err)
+				stillFailed = append(stillFailed, key)
+			}
+		}
+		failedKeys = stillFailed
+	}
+	return failedKeys
+}
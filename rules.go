@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// A purgeRule pairs a key pattern and search condition with the action to
+// take on matching keys. Several rules can be applied in one keyspace scan,
+// each keeping its own counts.
+type purgeRule struct {
+	Name               string   `json:"name"`
+	KeyPattern         string   `json:"key_pattern"`
+	AccessMode         string   `json:"access_mode"`
+	HashField          string   `json:"hash_field"`
+	JSONPath           string   `json:"json_path"`
+	HashMatch          string   `json:"hash_match"`
+	MatchElements      bool     `json:"match_elements"`
+	Search             []string `json:"search"`
+	SearchMode         string   `json:"search_mode"`
+	RequiredMatchCount int      `json:"required_match_count"`
+	SizeThreshold      int      `json:"size_threshold"`
+	SizeMax            int      `json:"size_max"`
+	InvertMatch        bool     `json:"invert_match"`
+	Action             string   `json:"action"`
+
+	// Limit is the maximum number of keys the rule will act on; 0 means no
+	// limit.
+	Limit int64 `json:"limit"`
+
+	condition *searchCondition
+	// reader reads the values the rule matches, and primary reads them
+	// again from the target, before deleting keys matched on a replica.
+	reader, primary *purge.Reader
+	// hooks are run for the keys the rule matches and deletes.
+	hooks purge.Hooks
+
+	matchedKeyCount, matchedValuesTotalSize int64
+	deletedKeyCount, failedDeleteCount      int64
+}
+
+func (p *purgeRule) String() string {
+	return fmt.Sprintf("rule %#v (action=%s) %s", p.Name, p.Action, p.condition)
+}
+
+func (p *purgeRule) deletes() bool {
+	return p.Action == "delete"
+}
+
+func (p *purgeRule) limitReached() bool {
+	return p.Limit > 0 && p.matchedKeyCount >= p.Limit
+}
+
+// loadPurgeRules reads a JSON list of purgeRules from filename, filling in
+// defaults and checking that each rule is usable.
+func loadPurgeRules(filename string) ([]*purgeRule, error) {
+	ruleJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*purgeRule
+	if err = json.Unmarshal(ruleJSON, &rules); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules defined")
+	}
+
+	for i, rule := range rules {
+		if err = rule.init(i); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// commonKeyPattern returns the key pattern shared by all rules, so that it
+// can be used as the SCAN MATCH pattern, or "" if the rules' key patterns
+// differ.
+func commonKeyPattern(rules []*purgeRule) string {
+	pattern := rules[0].condition.KeyPattern
+	for _, rule := range rules[1:] {
+		if rule.condition.KeyPattern != pattern {
+			return ""
+		}
+	}
+	return pattern
+}
+
+// deleteConditions describes the rules in rules that delete keys, or returns
+// nil if none do.
+func deleteConditions(rules []*purgeRule) []string {
+	var conditions []string
+	for _, rule := range rules {
+		if rule.deletes() {
+			conditions = append(conditions, rule.String())
+		}
+	}
+	return conditions
+}
+
+func (p *purgeRule) init(index int) error {
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("rule-%d", index+1)
+	}
+	if p.KeyPattern == "" {
+		p.KeyPattern = "*"
+	}
+	p.Action = strings.ToLower(p.Action)
+	switch p.Action {
+	case "":
+		p.Action = "list"
+	case "list", "delete":
+	default:
+		return fmt.Errorf("rule %#v: unknown action %#v (expected list or delete)", p.Name, p.Action)
+	}
+
+	hashMatch, err := parseHashMatch(p.HashMatch)
+	if err != nil {
+		return fmt.Errorf("rule %#v: %w", p.Name, err)
+	}
+	p.condition = &searchCondition{
+		AccessMode:    purge.ParseAccessMode(p.AccessMode),
+		HashField:     p.HashField,
+		JSONPath:      p.JSONPath,
+		HashMatch:     hashMatch,
+		MatchElements: p.MatchElements,
+		KeyPattern:    p.KeyPattern,
+		Search:        parseSearchPatterns(p.Search, ""),
+		SizeThreshold: p.SizeThreshold,
+		SizeMax:       p.SizeMax,
+		Occurrences:   p.RequiredMatchCount,
+		MatchAll:      parseSearchMode(p.SearchMode),
+		Negate:        p.InvertMatch,
+	}
+	if err := p.condition.Validate(); err != nil {
+		return fmt.Errorf("rule %#v: %w", p.Name, err)
+	}
+	return nil
+}
+
+// applyRules scans the keyspace once, applying every one of rules to each
+// key. If repeatDeletes is set, keys deleted by any rule are then repeatedly
+// re-deleted as with WAIT_AND_REDELETE.
+func (r redisSearch) applyRules(rules []*purgeRule, repeatDeletes bool) error {
+	fmt.Fprintf(os.Stderr, "> applying %d rules to %s\n", len(rules), r.String())
+	for _, rule := range rules {
+		fmt.Fprintf(os.Stderr, ">   %s\n", rule)
+	}
+	defer func() {
+		for _, rule := range rules {
+			fmt.Fprintf(os.Stderr, "> %s: matched %d keys (total size: %d, average size: %.1f), %s %d keys, %d keys failed delete\n",
+				rule, rule.matchedKeyCount, rule.matchedValuesTotalSize,
+				average(rule.matchedValuesTotalSize, rule.matchedKeyCount),
+				r.deletedVerb(), rule.deletedKeyCount, rule.failedDeleteCount)
+		}
+		r.presentReports()
+	}()
+
+	for _, rule := range rules {
+		rule.reader = r.valueReader(rule.condition)
+		rule.primary = r.primary().valueReader(rule.condition)
+		rule.hooks = r.actionHooks(rule.Action, rule.Name)
+	}
+	var deletedKeys, failedKeys []string
+	failedRules := map[string]*purgeRule{}
+
+	err := r.scanKeysDo(commonKeyPattern(rules), r.commonScanType(rules), func(key string) (bool, error) {
+		values := map[valueSource][]byte{}
+		matchedAny := false
+
+		for _, rule := range rules {
+			if rule.limitReached() || !keyPatternMatches(rule.condition.KeyPattern, key) {
+				continue
+			}
+
+			read := rule.reader.ReadShared(context.Background(), key, values)
+			value, size, matched, err := read.Value, read.Size, read.Matched, read.Err
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "> [%s] fetchValue error reading %#v (%s), skipping\n", rule.Name, key, err)
+				r.Events.Error(key, err)
+				if err := r.ErrorStreak.Failed(err); err != nil {
+					return matchedAny, err
+				}
+				continue
+			}
+			r.ErrorStreak.Succeeded()
+			if !matched {
+				continue
+			}
+			if r.Protected.Protects(key, size, rule.Name) {
+				// Later rules would only find the same protected key.
+				break
+			}
+			if rule.deletes() && r.Replica != nil {
+				if size, matched = r.matchesOnPrimary(key, rule.primary); !matched {
+					continue
+				}
+			}
+			match := purge.Match{Key: key, Size: size, Value: value}
+			if postMatch := rule.hooks.PostMatch; postMatch != nil {
+				if err := postMatch(context.Background(), match); errors.Is(err, purge.ErrSkip) {
+					// A vetoed key is left alone by every rule.
+					break
+				} else if err != nil {
+					return matchedAny, err
+				}
+			}
+			record := func() {
+				matchedAny = true
+				r.Schemas.Record(value, size)
+				r.Sizes.Record(size)
+				rule.matchedKeyCount++
+				rule.matchedValuesTotalSize += int64(size)
+
+				r.Events.Match(purge.Record{
+					Key:    key,
+					Size:   size,
+					Action: rule.Action,
+					Rule:   rule.Name,
+					Owner:  r.Owners.Record(key, size),
+				})
+			}
+			if !rule.deletes() {
+				record()
+				continue
+			}
+
+			err = rule.hooks.Delete(context.Background(), match, func(ctx context.Context, key string) error {
+				record()
+				deletedKeys = append(deletedKeys, key)
+				return r.removeKey(key)
+			})
+			var failed *purge.DeleteError
+			switch {
+			case errors.Is(err, purge.ErrSkip):
+			case errors.As(err, &failed):
+				fmt.Fprintf(os.Stderr, "> [%s] failed to delete key %#v: %s, continuing\n", rule.Name, key, failed.Err)
+				r.Events.Error(key, failed.Err)
+				rule.failedDeleteCount++
+				failedKeys = append(failedKeys, key)
+				failedRules[key] = rule
+				if err := r.ErrorStreak.Failed(failed.Err); err != nil {
+					return matchedAny, err
+				}
+			case err != nil:
+				return matchedAny, err
+			default:
+				r.ErrorStreak.Succeeded()
+				r.Events.Deleted(key, size)
+				rule.deletedKeyCount++
+			}
+			// The key is gone, or vetoed, so later rules have nothing to act
+			// on.
+			break
+		}
+		if !matchedAny {
+			// Sample the key by whichever value the rules read first.
+			for source, value := range values {
+				r.Verifier.Kept(key, source, value)
+				break
+			}
+		}
+		return matchedAny, nil
+	})
+	if errors.Is(err, errStopScan) {
+		err = nil
+	}
+
+	r.Retrier.Retry(failedKeys, func(key string) error {
+		rule := failedRules[key]
+		read := rule.primary.Read(context.Background(), key)
+		size, matched, err := read.Size, read.Matched, read.Err
+		if err != nil || !matched {
+			// A key that's gone or no longer matches needs no deleting.
+			if err == nil {
+				rule.failedDeleteCount--
+			}
+			return err
+		}
+		if err := r.deleteKey(key); err != nil {
+			return err
+		}
+		r.Events.Deleted(key, size)
+		rule.failedDeleteCount--
+		rule.deletedKeyCount++
+		return nil
+	})
+
+	if err == nil && repeatDeletes && len(deletedKeys) > 0 {
+		err = r.repeatDeleteKeys(deletedKeys)
+	}
+	if err == nil && len(deleteConditions(rules)) > 0 && !r.DryRun {
+		r.Verifier.Report(r.Client)
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// envScanType reports whether to pass SCAN the TYPE of keys to return:
+// SCAN_TYPE=y or n forces it on or off, and SCAN_TYPE=auto (the default)
+// turns it on for Redis 6 and newer, which support it.
+func envScanType(caps *serverCapabilities) bool {
+	setting := strings.ToLower(envDefault("SCAN_TYPE", "auto"))
+	if setting != "auto" {
+		return envBool("SCAN_TYPE", "auto")
+	}
+	return caps.ScanType
+}
+
+// scanTypeFor returns the SCAN TYPE for keys matching search, or "" to scan
+// all types.
+func (r redisSearch) scanTypeFor(search *searchCondition) string {
+	if !r.ScanType {
+		return ""
+	}
+	return search.AccessMode.RedisType()
+}
+
+// commonScanType returns the SCAN TYPE shared by every rule, or "" to scan
+// all types if the rules read different types.
+func (r redisSearch) commonScanType(rules []*purgeRule) string {
+	keyType := ""
+	for i, rule := range rules {
+		ruleType := r.scanTypeFor(rule.condition)
+		if i > 0 && ruleType != keyType {
+			return ""
+		}
+		keyType = ruleType
+	}
+	return keyType
+}
+
+// defaultScanCount is the COUNT passed to SCAN unless SCAN_COUNT is set.
+const defaultScanCount = purge.DefaultScanCount
+
+// scan runs one SCAN step from cursor, returning keys matching the glob
+// keyPattern ("" for all keys) and, if keyType is not empty, of that type.
+func (r redisSearch) scan(cursor uint64, keyPattern, keyType string) (keys []string, nextCursor uint64, err error) {
+	return purge.Scan(context.Background(), r.reader(), cursor, keyPattern, int64(r.scanCount()), keyType)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// schemaReport counts matched values by their detected format, to show which
+// decodings a more precise follow-up search would need.
+type schemaReport struct {
+	counts map[string]int64
+	sizes  map[string]int64
+}
+
+// envSchemaReport returns a schemaReport if SCHEMA_REPORT is set, or nil.
+func envSchemaReport() *schemaReport {
+	if !envBool("SCHEMA_REPORT", "false") {
+		return nil
+	}
+	return &schemaReport{counts: map[string]int64{}, sizes: map[string]int64{}}
+}
+
+// Record counts a matched value of size bytes. value is nil for values that
+// were matched as they were streamed, which can't be classified. Record on a
+// nil schemaReport does nothing.
+func (s *schemaReport) Record(value []byte, size int) {
+	if s == nil {
+		return
+	}
+	format := "unknown (streamed)"
+	if value != nil {
+		format = detectValueFormat(value)
+	}
+	s.counts[format]++
+	s.sizes[format] += int64(size)
+}
+
+// Report prints the breakdown of matched values by format to stderr, most
+// common first. Report on a nil schemaReport does nothing.
+func (s *schemaReport) Report() {
+	if s == nil {
+		return
+	}
+	var total int64
+	formats := make([]string, 0, len(s.counts))
+	for format, count := range s.counts {
+		formats = append(formats, format)
+		total += count
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		if s.counts[formats[i]] != s.counts[formats[j]] {
+			return s.counts[formats[i]] > s.counts[formats[j]]
+		}
+		return formats[i] < formats[j]
+	})
+	fmt.Fprintf(os.Stderr, "> value formats of %d matched keys:\n", total)
+	for _, format := range formats {
+		fmt.Fprintf(os.Stderr, ">   %s: %d keys (%.1f%%), total size: %d\n",
+			format, s.counts[format], percentage(s.counts[format], total), s.sizes[format])
+	}
+}
+
+// detectValueFormat guesses the format of value from magic bytes and by
+// trying to parse it: empty, gzip, zlib, zstd, json, msgpack, text,
+// protobuf or binary.
+func detectValueFormat(value []byte) string {
+	switch {
+	case len(value) == 0:
+		return "empty"
+	case bytes.HasPrefix(value, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(value, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	case len(value) >= 2 && value[0] == 0x78 && (uint16(value[0])<<8|uint16(value[1]))%31 == 0:
+		return "zlib"
+	case looksLikeJSON(value):
+		return "json"
+	case looksLikeMsgpack(value):
+		return "msgpack"
+	case looksLikeText(value):
+		return "text"
+	case looksLikeProtobuf(value):
+		return "protobuf"
+	}
+	return "binary"
+}
+
+func looksLikeJSON(value []byte) bool {
+	trimmed := bytes.TrimSpace(value)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed)
+}
+
+// looksLikeText reports whether value is UTF-8 with no control characters
+// other than whitespace.
+func looksLikeText(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// looksLikeMsgpack reports whether value is exactly one msgpack map or
+// array; msgpack scalars are too easily confused with other formats.
+func looksLikeMsgpack(value []byte) bool {
+	first := value[0]
+	isContainer := (first >= 0x80 && first <= 0x9f) || (first >= 0xdc && first <= 0xdf)
+	if !isContainer {
+		return false
+	}
+	rest, ok := skipMsgpack(value, 0)
+	return ok && len(rest) == 0
+}
+
+// skipMsgpack skips one msgpack object at the start of b, returning the
+// rest of b, or false if b doesn't start with a valid object.
+func skipMsgpack(b []byte, depth int) ([]byte, bool) {
+	if len(b) == 0 || depth > 64 {
+		return nil, false
+	}
+	first, b := b[0], b[1:]
+	var length, elements uint64
+	switch {
+	case first <= 0x7f || first >= 0xe0, first == 0xc0, first == 0xc2, first == 0xc3:
+		return b, true
+	case first >= 0x80 && first <= 0x8f:
+		elements = 2 * uint64(first&0x0f)
+	case first >= 0x90 && first <= 0x9f:
+		elements = uint64(first & 0x0f)
+	case first >= 0xa0 && first <= 0xbf:
+		length = uint64(first & 0x1f)
+	case first == 0xcc || first == 0xd0:
+		length = 1
+	case first == 0xcd || first == 0xd1:
+		length = 2
+	case first == 0xca || first == 0xce || first == 0xd2:
+		length = 4
+	case first == 0xcb || first == 0xcf || first == 0xd3:
+		length = 8
+	case first >= 0xd4 && first <= 0xd8:
+		length = 1 + 1<<(first-0xd4)
+	case first == 0xc4 || first == 0xd9 || first == 0xc7:
+		if len(b) < 1 {
+			return nil, false
+		}
+		length, b = uint64(b[0]), b[1:]
+		if first == 0xc7 {
+			length++
+		}
+	case first == 0xc5 || first == 0xda || first == 0xc8 || first == 0xdc || first == 0xde:
+		if len(b) < 2 {
+			return nil, false
+		}
+		n := uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		switch first {
+		case 0xdc:
+			elements = n
+		case 0xde:
+			elements = 2 * n
+		case 0xc8:
+			length = n + 1
+		default:
+			length = n
+		}
+	case first == 0xc6 || first == 0xdb || first == 0xc9 || first == 0xdd || first == 0xdf:
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		switch first {
+		case 0xdd:
+			elements = n
+		case 0xdf:
+			elements = 2 * n
+		case 0xc9:
+			length = n + 1
+		default:
+			length = n
+		}
+	default:
+		return nil, false
+	}
+
+	if length > uint64(len(b)) || elements > uint64(len(b)) {
+		return nil, false
+	}
+	b = b[length:]
+	for i := uint64(0); i < elements; i++ {
+		var ok bool
+		if b, ok = skipMsgpack(b, depth+1); !ok {
+			return nil, false
+		}
+	}
+	return b, true
+}
+
+// looksLikeProtobuf reports whether value parses completely as a sequence of
+// protobuf fields, without nested groups.
+func looksLikeProtobuf(value []byte) bool {
+	for len(value) > 0 {
+		key, n := binary.Uvarint(value)
+		if n <= 0 || key>>3 == 0 {
+			return false
+		}
+		value = value[n:]
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(value); n <= 0 {
+				return false
+			}
+			value = value[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(value) < size {
+				return false
+			}
+			value = value[size:]
+		case 2:
+			length, n := binary.Uvarint(value)
+			if n <= 0 || length > uint64(len(value)-n) {
+				return false
+			}
+			value = value[n+int(length):]
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// interruptSignals stop a run, after running its exit hooks.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// statsSignals print the run's stats, without stopping it.
+var statsSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// interruptSignals stop a run, after running its exit hooks. Windows only
+// delivers Ctrl-C and Ctrl-Break, as os.Interrupt.
+var interruptSignals = []os.Signal{os.Interrupt}
+
+// statsSignals print the run's stats, without stopping it. Windows has no
+// SIGUSR1.
+var statsSignals []os.Signal
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A keyspaceSnapshot is a cheap signature of a keyspace: key counts per
+// prefix, from the first keys SCAN returns, scaled up to the whole keyspace.
+// SCAN returns keys in the same hash table order each time, so snapshots of
+// the same sample size taken before and after a run are comparable.
+type keyspaceSnapshot struct {
+	Prefixes  map[string]int64
+	Sampled   int64
+	TotalKeys int64
+}
+
+// snapshotKeyspace takes a snapshot of the first sampleSize keys.
+func (r redisSearch) snapshotKeyspace(sampleSize int64) (*keyspaceSnapshot, error) {
+	totalKeys, err := r.countKeys()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count keys: %w", err)
+	}
+	snapshot := &keyspaceSnapshot{Prefixes: map[string]int64{}, TotalKeys: totalKeys}
+	var cursor uint64
+	for snapshot.Sampled < sampleSize {
+		var keys []string
+		if keys, cursor, err = r.scan(cursor, "", ""); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if r.isInternalKey(key) {
+				continue
+			}
+			snapshot.Prefixes[keyPrefix(key, ":")]++
+			snapshot.Sampled++
+		}
+		if cursor == 0 {
+			// The whole keyspace was sampled, so the counts are exact.
+			snapshot.TotalKeys = snapshot.Sampled
+			break
+		}
+	}
+	return snapshot, nil
+}
+
+// Estimate returns the estimated number of keys with prefix in the whole
+// keyspace.
+func (s *keyspaceSnapshot) Estimate(prefix string) int64 {
+	if s.Sampled == 0 {
+		return 0
+	}
+	return s.Prefixes[prefix] * s.TotalKeys / s.Sampled
+}
+
+// reportKeyspaceDiff prints the change in estimated keys per prefix from
+// before to after, the prefixes that shrank most first.
+func reportKeyspaceDiff(before, after *keyspaceSnapshot) {
+	prefixSet := map[string]bool{}
+	for prefix := range before.Prefixes {
+		prefixSet[prefix] = true
+	}
+	for prefix := range after.Prefixes {
+		prefixSet[prefix] = true
+	}
+	prefixes := make([]string, 0, len(prefixSet))
+	delta := map[string]int64{}
+	for prefix := range prefixSet {
+		prefixes = append(prefixes, prefix)
+		delta[prefix] = after.Estimate(prefix) - before.Estimate(prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if delta[prefixes[i]] != delta[prefixes[j]] {
+			return delta[prefixes[i]] < delta[prefixes[j]]
+		}
+		return prefixes[i] < prefixes[j]
+	})
+
+	fmt.Fprintf(os.Stderr, "> keyspace change by prefix (estimated from %d keys before and %d after, of %d and %d):\n",
+		before.Sampled, after.Sampled, before.TotalKeys, after.TotalKeys)
+	unchanged := 0
+	for _, prefix := range prefixes {
+		if delta[prefix] == 0 {
+			unchanged++
+			continue
+		}
+		beforeKeys := before.Estimate(prefix)
+		fmt.Fprintf(os.Stderr, ">   %s: %d -> %d (%+d, %+.1f%%)\n",
+			prefix, beforeKeys, after.Estimate(prefix), delta[prefix], percentage(delta[prefix], beforeKeys))
+	}
+	fmt.Fprintf(os.Stderr, ">   %d prefixes unchanged\n", unchanged)
+}
+
+// keyspaceDiff snapshots the keyspace if KEYSPACE_SNAPSHOT is set, and
+// returns a func that snapshots it again and reports the change, to show
+// that a destructive run only shrank the namespaces it was meant to.
+func (r redisSearch) keyspaceDiff() (report func(), err error) {
+	noop := func() {}
+	if !envBool("KEYSPACE_SNAPSHOT", "false") {
+		return noop, nil
+	}
+	if r.DryRun {
+		fmt.Fprintf(os.Stderr, "> dry run: not taking keyspace snapshots, since nothing will change\n")
+		return noop, nil
+	}
+	sampleSize := envInt64("KEYSPACE_SNAPSHOT_SAMPLE", 10000)
+	before, err := r.snapshotKeyspace(sampleSize)
+	if err != nil {
+		return noop, err
+	}
+	return func() {
+		after, err := r.snapshotKeyspace(sampleSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "> couldn't take keyspace snapshot after the run: %s\n", err)
+			return
+		}
+		reportKeyspaceDiff(before, after)
+	}, nil
+}
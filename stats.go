@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// runStats keeps a running count of what the run has done, for a snapshot
+// printed on demand, with SIGUSR1, without interrupting the run.
+type runStats struct {
+	mu sync.Mutex
+
+	started      time.Time
+	cursor       uint64
+	scanned      int64
+	total        int64
+	matched      int64
+	matchedBytes int64
+	deleted      int64
+	deletedBytes int64
+	errors       int64
+}
+
+// liveStats are the stats of this run.
+var liveStats = &runStats{started: time.Now()}
+
+// Subscribe counts the events of a run.
+func (s *runStats) Subscribe(events *purgeEvents) {
+	events.OnKeyScanned(func(key string) {
+		s.mu.Lock()
+		s.scanned++
+		s.mu.Unlock()
+	})
+	events.OnMatch(func(record purge.Record) {
+		s.mu.Lock()
+		s.matched++
+		s.matchedBytes += int64(record.Size)
+		s.mu.Unlock()
+	})
+	events.OnDelete(func(key string, size int) {
+		s.mu.Lock()
+		s.deleted++
+		s.deletedBytes += int64(size)
+		s.mu.Unlock()
+	})
+	events.OnError(func(key string, err error) {
+		s.mu.Lock()
+		s.errors++
+		s.mu.Unlock()
+	})
+}
+
+// Scanning records the cursor that the scan carries on from, and the size of the
+// keyspace it's scanning.
+func (s *runStats) Scanning(cursor uint64, total int64) {
+	s.mu.Lock()
+	s.cursor, s.total = cursor, total
+	s.mu.Unlock()
+}
+
+// MatchedBytes returns the total size of the keys matched so far.
+func (s *runStats) MatchedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.matchedBytes
+}
+
+// A statsSnapshot is a copy of the stats at a moment.
+type statsSnapshot struct {
+	Elapsed      time.Duration
+	Scanned      int64
+	Total        int64
+	Matched      int64
+	MatchedBytes int64
+	Deleted      int64
+	Errors       int64
+}
+
+// Snapshot returns a copy of the stats.
+func (s *runStats) Snapshot() statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return statsSnapshot{
+		Elapsed:      time.Since(s.started),
+		Scanned:      s.scanned,
+		Total:        s.total,
+		Matched:      s.matched,
+		MatchedBytes: s.matchedBytes,
+		Deleted:      s.deleted,
+		Errors:       s.errors,
+	}
+}
+
+// Print prints a snapshot of the stats to stderr.
+func (s *runStats) Print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.started)
+	perSecond := func(n int64) float64 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(n) / elapsed.Seconds()
+	}
+	fmt.Fprintf(os.Stderr, "\n> stats after %s: next cursor %d, scanned %d of about %d keys (%.2f%%), matched %d (%d bytes), deleted %d (%d bytes), %d errors\n",
+		elapsed.Round(time.Second), s.cursor, s.scanned, s.total, percentage(s.scanned, s.total),
+		s.matched, s.matchedBytes, s.deleted, s.deletedBytes, s.errors)
+	fmt.Fprintf(os.Stderr, "> rates: %.1f keys/s scanned, %.1f keys/s matched, %.1f keys/s (%.0f bytes/s) deleted, eta %s\n",
+		perSecond(s.scanned), perSecond(s.matched), perSecond(s.deleted), perSecond(s.deletedBytes),
+		estimateRemaining(s.scanned, s.total, perSecond(s.scanned)))
+}
+
+// printStatsOnSignal prints liveStats whenever the run receives one of
+// statsSignals.
+func printStatsOnSignal() {
+	if len(statsSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, statsSignals...)
+	go func() {
+		for range signals {
+			liveStats.Print()
+		}
+	}()
+}
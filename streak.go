@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// errorStreak aborts a run after too many consecutive fetch or delete
+// errors, which usually mean something is broken, such as an expired
+// credential or a broken replica, rather than that some keys are bad.
+type errorStreak struct {
+	Max int
+
+	streak int
+}
+
+// envErrorStreak returns the streak configured by MAX_CONSECUTIVE_ERRORS, or
+// nil if runs never abort on errors.
+func envErrorStreak() (*errorStreak, error) {
+	max, err := envLimit("MAX_CONSECUTIVE_ERRORS")
+	if err != nil || max <= 0 {
+		return nil, err
+	}
+	return &errorStreak{Max: int(max)}, nil
+}
+
+// Failed records an error, and returns an error to abort the run if it makes
+// Max in a row. WRONGTYPE errors, from keys of another type than the search
+// reads, are neither counted nor break the streak. Failed on a nil
+// errorStreak never aborts.
+func (s *errorStreak) Failed(err error) error {
+	if s == nil || strings.Contains(err.Error(), "WRONGTYPE") {
+		return nil
+	}
+	s.streak++
+	if s.streak >= s.Max {
+		return fmt.Errorf("aborting after %d consecutive errors (MAX_CONSECUTIVE_ERRORS), the last: %w", s.streak, err)
+	}
+	return nil
+}
+
+// Succeeded ends the current streak. Succeeded on a nil errorStreak does
+// nothing.
+func (s *errorStreak) Succeeded() {
+	if s != nil {
+		s.streak = 0
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// summaryVersion is the format version of run summaries.
+const summaryVersion = 1
+
+// runSummary counts what a run did, from its events, for a JSON summary
+// written when the run ends.
+type runSummary struct {
+	Version         int              `json:"version"`
+	Target          string           `json:"target"`
+	Condition       string           `json:"condition,omitempty"`
+	DryRun          bool             `json:"dry_run,omitempty"`
+	Status          string           `json:"status"`
+	ExitCode        int              `json:"exit_code"`
+	Error           string           `json:"error,omitempty"`
+	StartedAt       time.Time        `json:"started_at"`
+	FinishedAt      time.Time        `json:"finished_at"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	ScannedKeys     int64            `json:"scanned_keys"`
+	MatchedKeys     int64            `json:"matched_keys"`
+	MatchedBytes    int64            `json:"matched_bytes"`
+	DeletedKeys     int64            `json:"deleted_keys"`
+	DeletedBytes    int64            `json:"deleted_bytes"`
+	FailedDeletes   int64            `json:"failed_deletes"`
+	Errors          int64            `json:"errors"`
+	MatchedByTTL    map[string]int64 `json:"matched_by_ttl,omitempty"`
+	Tags            operationTags    `json:"tags,omitempty"`
+
+	path     string
+	toDelete int64
+	finished bool
+}
+
+// envRunSummary returns a summary to be written to SUMMARY_FILE (or stdout,
+// if SUMMARY_FILE is -), or nil if SUMMARY_FILE isn't set.
+func envRunSummary() *runSummary {
+	path := os.Getenv("SUMMARY_FILE")
+	if path == "" {
+		return nil
+	}
+	return &runSummary{Version: summaryVersion, StartedAt: time.Now().UTC(), path: path}
+}
+
+// Subscribe counts the events of a run. Subscribe on a nil runSummary does
+// nothing.
+func (s *runSummary) Subscribe(events *purgeEvents) {
+	if s == nil {
+		return
+	}
+	events.OnKeyScanned(func(key string) {
+		s.ScannedKeys++
+	})
+	events.OnMatch(func(record purge.Record) {
+		s.MatchedKeys++
+		s.MatchedBytes += int64(record.Size)
+		if record.KeyTTL != nil {
+			if s.MatchedByTTL == nil {
+				s.MatchedByTTL = map[string]int64{}
+			}
+			s.MatchedByTTL[ttlBucket(*record.KeyTTL)]++
+		}
+		if record.Action == "delete" {
+			s.toDelete++
+		}
+	})
+	events.OnDelete(func(key string, size int) {
+		s.DeletedKeys++
+		s.DeletedBytes += int64(size)
+	})
+	events.OnError(func(key string, err error) {
+		s.Errors++
+	})
+}
+
+// Finish writes the summary of a run ending with exitCode, once. Finish on a
+// nil runSummary does nothing.
+func (s *runSummary) Finish(exitCode int, exitErr error) {
+	if s == nil || s.finished {
+		return
+	}
+	s.finished = true
+	s.FinishedAt = time.Now().UTC()
+	s.DurationSeconds = s.FinishedAt.Sub(s.StartedAt).Seconds()
+	s.ExitCode = exitCode
+	switch exitCode {
+	case 1:
+		s.Status = "failed"
+	case 130:
+		s.Status = "interrupted"
+	case exitNoMatches:
+		s.Status = "no matches"
+	case exitPartialFailure:
+		s.Status = "partial failure"
+	default:
+		s.Status = "completed"
+	}
+	if exitErr != nil {
+		s.Error = exitErr.Error()
+	}
+	if s.FailedDeletes = s.toDelete - s.DeletedKeys; s.FailedDeletes < 0 {
+		s.FailedDeletes = 0
+	}
+
+	summaryJSON, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		summaryJSON = append(summaryJSON, '\n')
+		if s.path == "-" {
+			_, err = os.Stdout.Write(summaryJSON)
+		} else {
+			err = ioutil.WriteFile(s.path, summaryJSON, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't write SUMMARY_FILE %s: %s\n", s.path, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// operationTags are key=value labels for a run, such as a ticket ID or the
+// reason for a purge, stamped on everything the run records so that any of
+// its artifacts can be traced back to the request for it.
+type operationTags map[string]string
+
+// envOperationTags parses OPERATION_TAGS, a comma-separated list of
+// key=value tags, such as ticket=OPS-1234,reason=gdpr,requester=alice.
+func envOperationTags() (operationTags, error) {
+	tags := operationTags{}
+	for _, tag := range strings.Split(os.Getenv("OPERATION_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		i := strings.Index(tag, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad tag %#v: expected key=value", tag)
+		}
+		tags[strings.TrimSpace(tag[:i])] = strings.TrimSpace(tag[i+1:])
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
+
+// String formats t as space-separated key=value pairs, sorted by key.
+func (t operationTags) String() string {
+	return purge.Tags(t).String()
+}
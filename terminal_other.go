@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import "os"
+
+// terminalColumns returns the width of the terminal f is attached to, or 0 if
+// it can't be told, as it can't here without a TIOCGWINSZ ioctl.
+func terminalColumns(f *os.File) int {
+	return 0
+}
+
+// setCbreak does nothing here, where keys are only read once Enter is
+// pressed.
+func setCbreak(f *os.File) (restore func(), err error) {
+	return func() {}, nil
+}
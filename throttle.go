@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+)
+
+// deleteThrottle paces destructive commands to at most a given rate, so that
+// a purge doesn't saturate replication links or cause latency spikes on a
+// busy instance.
+type deleteThrottle struct {
+	Interval time.Duration
+
+	next time.Time
+}
+
+// envDeleteThrottle returns the throttle configured by DELETES_PER_SECOND, or
+// nil if deletes aren't throttled.
+func envDeleteThrottle() (*deleteThrottle, error) {
+	perSecond, err := envLimit("DELETES_PER_SECOND")
+	if err != nil || perSecond <= 0 {
+		return nil, err
+	}
+	return &deleteThrottle{Interval: time.Second / time.Duration(perSecond)}, nil
+}
+
+// Wait blocks until the next destructive command may be sent. Wait on a nil
+// deleteThrottle returns at once.
+func (t *deleteThrottle) Wait() {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	if t.next.After(now) {
+		time.Sleep(t.next.Sub(now))
+		now = t.next
+	}
+	t.next = now.Add(t.Interval)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindClient   = 3
+	otlpStatusError      = 2
+)
+
+// traceExportSpans and traceExportInterval are how many spans, or how long,
+// a runTracer buffers before exporting them.
+const (
+	traceExportSpans    = 256
+	traceExportInterval = 10 * time.Second
+)
+
+// runTracer records OpenTelemetry spans for a run, its SCAN batches, their
+// value fetches and deletes, and exports them with OTLP over HTTP, as JSON,
+// so that a slow purge can be diagnosed alongside the traces of the rest of
+// the stack. A run is a single trace, under a root span that lasts the run.
+type runTracer struct {
+	Endpoint string
+	Headers  map[string]string
+	Resource []otlpAttribute
+
+	traceID  string
+	root     *traceSpan
+	batch    *traceSpan
+	pending  []otlpSpan
+	exported time.Time
+	failed   int
+	finished bool
+	client   *http.Client
+	// mu guards the spans, whose attributes may be set by events published
+	// from concurrent fetches.
+	mu sync.Mutex
+}
+
+// A traceSpan is a span being recorded.
+type traceSpan struct {
+	tracer *runTracer
+	span   otlpSpan
+	start  time.Time
+}
+
+// otlpSpan and the types below are the OTLP/JSON encoding of spans.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	// IntValue is a string, as the JSON encoding of 64-bit integers is.
+	IntValue  *string `json:"intValue,omitempty"`
+	BoolValue *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// attr returns an attribute of key, with a string, integer or bool value.
+func attr(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(value, 10)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+// envRunTracer returns the tracer configured by the standard OpenTelemetry
+// variables OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (or OTEL_EXPORTER_OTLP_ENDPOINT,
+// to which /v1/traces is added), OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES, or nil if neither endpoint
+// is set. Only the http/json protocol is supported.
+func envRunTracer() (*runTracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimRight(endpoint, "/") + "/v1/traces"
+	}
+	protocol := envDefault("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", envDefault("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json"))
+	if protocol != "http/json" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %#v: only http/json is supported", protocol)
+	}
+	headers, err := parseOTelPairs("OTEL_EXPORTER_OTLP_HEADERS")
+	if err != nil {
+		return nil, err
+	}
+	resourcePairs, err := parseOTelPairs("OTEL_RESOURCE_ATTRIBUTES")
+	if err != nil {
+		return nil, err
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" || resourcePairs["service.name"] == "" {
+		resourcePairs["service.name"] = envDefault("OTEL_SERVICE_NAME", "redis-purge")
+	}
+	t := &runTracer{
+		Endpoint: endpoint,
+		Headers:  headers,
+		traceID:  randomHex(16),
+		exported: time.Now(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	for key, value := range resourcePairs {
+		t.Resource = append(t.Resource, attr(key, value))
+	}
+	t.root = t.Start(nil, "redis-purge")
+	return t, nil
+}
+
+// parseOTelPairs parses the environment variable name as a comma-separated
+// list of key=value pairs with URL-encoded values, as the OpenTelemetry
+// variables are.
+func parseOTelPairs(name string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad %s entry %#v: expected key=value", name, pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("bad %s entry %#v: %w", name, pair, err)
+		}
+		pairs[strings.TrimSpace(pair[:i])] = value
+	}
+	return pairs, nil
+}
+
+func randomHex(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Subscribe counts the deletes and errors of each SCAN batch on its span.
+// Subscribe on a nil runTracer does nothing.
+func (t *runTracer) Subscribe(events *purgeEvents) {
+	if t == nil {
+		return
+	}
+	var deleted, errors int64
+	events.OnDelete(func(key string, size int) {
+		deleted++
+		t.batch.Set("purge.deleted_keys", deleted)
+	})
+	events.OnError(func(key string, err error) {
+		errors++
+		t.batch.Set("purge.errors", errors)
+	})
+	events.OnProgress(func(visited, total, matched int64) {
+		deleted, errors = 0, 0
+	})
+}
+
+// Start starts a span called name, as a child of parent, or of the run's root
+// span if parent is nil. Start on a nil runTracer returns nil.
+func (t *runTracer) Start(parent *traceSpan, name string, attrs ...otlpAttribute) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	s := &traceSpan{
+		tracer: t,
+		start:  time.Now(),
+		span: otlpSpan{
+			TraceID:    t.traceID,
+			SpanID:     randomHex(8),
+			Name:       name,
+			Kind:       otlpSpanKindInternal,
+			Attributes: attrs,
+		},
+	}
+	if parent == nil {
+		parent = t.root
+	}
+	if parent != nil {
+		s.span.ParentSpanID = parent.span.SpanID
+	}
+	return s
+}
+
+// StartBatch starts the span of a SCAN batch, which counts the batch's
+// deletes and errors. StartBatch on a nil runTracer returns nil.
+func (t *runTracer) StartBatch(cursor uint64) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	t.batch = t.Start(nil, "scan batch", attr("redis.scan.cursor", cursor))
+	return t.batch
+}
+
+// StartCommand starts the span of a Redis command, as a child of parent.
+// StartCommand on a nil runTracer returns nil.
+func (t *runTracer) StartCommand(parent *traceSpan, command string, attrs ...otlpAttribute) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	s := t.Start(parent, command, append([]otlpAttribute{attr("db.system", "redis"), attr("db.operation", command)}, attrs...)...)
+	s.span.Kind = otlpSpanKindClient
+	return s
+}
+
+// Set sets an attribute of the span. Set on a nil traceSpan does nothing.
+func (s *traceSpan) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for i := range s.span.Attributes {
+		if s.span.Attributes[i].Key == key {
+			s.span.Attributes[i] = attr(key, value)
+			return
+		}
+	}
+	s.span.Attributes = append(s.span.Attributes, attr(key, value))
+}
+
+// End ends the span, recording err, if not nil, as its error, and queues it
+// for export. End on a nil traceSpan does nothing.
+func (s *traceSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.span.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+	s.span.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err != nil {
+		s.span.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+	t.pending = append(t.pending, s.span)
+	if len(t.pending) >= traceExportSpans || time.Since(t.exported) >= traceExportInterval {
+		t.export()
+	}
+}
+
+// export posts the spans ended so far to the OTLP endpoint. Spans that
+// can't be exported are dropped, since tracing mustn't hold up the run.
+func (t *runTracer) export() {
+	spans := t.pending
+	t.pending = nil
+	t.exported = time.Now()
+	if len(spans) == 0 {
+		return
+	}
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{{Spans: spans}}}
+	resourceSpans.Resource.Attributes = t.Resource
+	resourceSpans.ScopeSpans[0].Scope.Name = "github.com/greensnark/redis-purge"
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil {
+		if t.failed == 0 {
+			fmt.Fprintf(os.Stderr, "> couldn't export traces to %s: %s\n", t.Endpoint, err)
+		}
+		t.failed += len(spans)
+	}
+}
+
+func (t *runTracer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST of traces: %s", resp.Status)
+	}
+	return nil
+}
+
+// Finish ends the run's root span, with err, if not nil, as its error, and
+// exports the remaining spans. Finish on a nil runTracer, or one already
+// finished, does nothing.
+func (t *runTracer) Finish(err error) {
+	if t == nil || t.finished {
+		return
+	}
+	t.finished = true
+	t.root.End(err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.export()
+	if t.failed > 0 {
+		fmt.Fprintf(os.Stderr, "> dropped %d spans that couldn't be exported to %s\n", t.failed, t.Endpoint)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// ttlBucket describes a remaining TTL in seconds, or -1 for none, as one of
+// a few coarse ranges.
+func ttlBucket(ttl int64) string {
+	switch {
+	case ttl < 0:
+		return "no expiry"
+	case ttl < 60:
+		return "expiring within a minute"
+	case ttl < 60*60:
+		return "expiring within an hour"
+	case ttl < 24*60*60:
+		return "expiring within a day"
+	default:
+		return "expiring later"
+	}
+}
+
+// ttlBuckets are the ttlBucket ranges, in order.
+var ttlBuckets = []string{
+	"no expiry", "expiring within a minute", "expiring within an hour",
+	"expiring within a day", "expiring later",
+}
+
+// ttlReport counts matched keys by their remaining TTL, since keys about to
+// expire anyway may not need deleting.
+type ttlReport struct {
+	counts map[string]int64
+}
+
+// envTTLReport returns a ttlReport if REPORT_TTL is set, or nil.
+func envTTLReport() *ttlReport {
+	if !envBool("REPORT_TTL", "false") {
+		return nil
+	}
+	return &ttlReport{counts: map[string]int64{}}
+}
+
+// Record counts a matched key by its KeyTTL. Record on a nil ttlReport does
+// nothing.
+func (t *ttlReport) Record(record purge.Record) {
+	if t == nil || record.KeyTTL == nil {
+		return
+	}
+	t.counts[ttlBucket(*record.KeyTTL)]++
+}
+
+// Report prints the matched keys by remaining TTL to stderr. Report on a nil
+// ttlReport does nothing.
+func (t *ttlReport) Report() {
+	if t == nil {
+		return
+	}
+	var total int64
+	for _, count := range t.counts {
+		total += count
+	}
+	fmt.Fprintf(os.Stderr, "> remaining TTLs of %d matched keys:\n", total)
+	for _, bucket := range ttlBuckets {
+		if count := t.counts[bucket]; count > 0 {
+			fmt.Fprintf(os.Stderr, ">   %s: %d keys (%.1f%%)\n", bucket, count, percentage(count, total))
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A keptSample is a key that a deleting run looked at and left alone, with
+// a digest of the value it had at the time.
+type keptSample struct {
+	Key    string
+	Source valueSource
+	Digest [sha256.Size]byte
+}
+
+// purgeVerifier samples the keys a run deletes and the keys it keeps, and
+// checks after the run that the deleted keys are gone and the kept keys are
+// unchanged, as assurance that the run did what it said.
+type purgeVerifier struct {
+	// SampleSize is how many deleted keys, and how many kept keys, to check.
+	SampleSize int
+
+	// Replicas are also checked for the absence of deleted keys.
+	Replicas []*redis.Client
+
+	// Expiring is set if deleted keys were given a TTL instead, so they
+	// need only be absent or expiring.
+	Expiring bool
+
+	// Fields, if set, were deleted from deleted keys instead, so only they
+	// need be absent.
+	Fields []string
+
+	// Elements, if set, is the search whose matching elements were removed
+	// from deleted keys instead, so only they need be absent.
+	Elements *searchCondition
+
+	rand        *rand.Rand
+	deleted     []string
+	deletedSeen int64
+	kept        []keptSample
+	keptSeen    int64
+}
+
+// envPurgeVerifier returns the verifier configured by VERIFY_SAMPLE and
+// VERIFY_REPLICA_ADDRS, or nil if verification is disabled.
+func envPurgeVerifier() *purgeVerifier {
+	sampleSize := envInt("VERIFY_SAMPLE", 0)
+	if sampleSize <= 0 {
+		return nil
+	}
+	verifier := &purgeVerifier{
+		SampleSize: sampleSize,
+		Replicas:   envReplicaClients(),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	return verifier
+}
+
+// envReplicaClients returns clients for the comma-separated replica
+// addresses in VERIFY_REPLICA_ADDRS, connecting like the main client.
+func envReplicaClients() []*redis.Client {
+	var replicas []*redis.Client
+	for _, addr := range strings.Split(os.Getenv("VERIFY_REPLICA_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		options := redisOptions()
+		options.Addr = addr
+		replicas = append(replicas, redis.NewClient(options))
+	}
+	return replicas
+}
+
+// sampleSlot picks where the seen'th item goes in a reservoir sample, or -1
+// if it isn't sampled.
+func (v *purgeVerifier) sampleSlot(seen int64) int {
+	if seen <= int64(v.SampleSize) {
+		return int(seen - 1)
+	}
+	if slot := v.rand.Int63n(seen); slot < int64(v.SampleSize) {
+		return int(slot)
+	}
+	return -1
+}
+
+// Deleted records a deleted key. Deleted on a nil purgeVerifier does nothing.
+func (v *purgeVerifier) Deleted(key string) {
+	if v == nil {
+		return
+	}
+	v.deletedSeen++
+	if slot := v.sampleSlot(v.deletedSeen); slot == len(v.deleted) {
+		v.deleted = append(v.deleted, key)
+	} else if slot >= 0 {
+		v.deleted[slot] = key
+	}
+}
+
+// Kept records a key that was read from source but not deleted. Kept on a nil
+// purgeVerifier does nothing.
+func (v *purgeVerifier) Kept(key string, source valueSource, value []byte) {
+	if v == nil {
+		return
+	}
+	v.keptSeen++
+	sample := keptSample{Key: key, Source: source, Digest: sha256.Sum256(value)}
+	if slot := v.sampleSlot(v.keptSeen); slot == len(v.kept) {
+		v.kept = append(v.kept, sample)
+	} else if slot >= 0 {
+		v.kept[slot] = sample
+	}
+}
+
+// Report checks the sampled keys against client (and the replicas), and
+// prints the assurance section of the run summary. Report on a nil
+// purgeVerifier does nothing.
+func (v *purgeVerifier) Report(client *redis.Client) {
+	if v == nil {
+		return
+	}
+	ctx := context.Background()
+	servers := append([]*redis.Client{client}, v.Replicas...)
+
+	absent := 0
+	for _, key := range v.deleted {
+		keyAbsent := true
+		for _, server := range servers {
+			if v.Expiring {
+				if !v.checkExpiring(ctx, server, key) {
+					keyAbsent = false
+				}
+				continue
+			}
+			if len(v.Fields) > 0 {
+				if !v.checkFieldsAbsent(ctx, server, key) {
+					keyAbsent = false
+				}
+				continue
+			}
+			if v.Elements != nil {
+				if !v.checkElementsAbsent(server, key) {
+					keyAbsent = false
+				}
+				continue
+			}
+			exists, err := server.Exists(ctx, key).Result()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "> assurance: couldn't check deleted key %#v on %s: %s\n", key, server.Options().Addr, err)
+				keyAbsent = false
+			} else if exists > 0 {
+				fmt.Fprintf(os.Stderr, "> assurance: deleted key %#v still exists on %s\n", key, server.Options().Addr)
+				keyAbsent = false
+			}
+		}
+		if keyAbsent {
+			absent++
+		}
+	}
+
+	unchanged := 0
+	for _, sample := range v.kept {
+		value, err := sample.Source.Get(context.Background(), client, sample.Key)
+		switch {
+		case err == redis.Nil:
+			fmt.Fprintf(os.Stderr, "> assurance: kept key %#v no longer exists\n", sample.Key)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "> assurance: couldn't read kept key %#v: %s\n", sample.Key, err)
+		case sha256.Sum256(value) != sample.Digest:
+			fmt.Fprintf(os.Stderr, "> assurance: kept key %#v has changed\n", sample.Key)
+		default:
+			unchanged++
+		}
+	}
+
+	deletedState := "absent"
+	if v.Expiring {
+		deletedState = "absent or expiring"
+	} else if len(v.Fields) > 0 {
+		deletedState = "without fields " + strings.Join(v.Fields, ", ")
+	} else if v.Elements != nil {
+		deletedState = "without matching elements"
+	}
+	fmt.Fprintf(os.Stderr, "> assurance: %d of %d sampled deleted keys (of %d deleted) are %s on %d servers\n",
+		absent, len(v.deleted), v.deletedSeen, deletedState, len(servers))
+	fmt.Fprintf(os.Stderr, "> assurance: %d of %d sampled kept keys (of %d kept) still exist unchanged\n",
+		unchanged, len(v.kept), v.keptSeen)
+}
+
+// checkExpiring reports whether an expired key is absent or has a TTL on
+// server.
+func (v *purgeVerifier) checkExpiring(ctx context.Context, server *redis.Client, key string) bool {
+	ttl, err := server.PTTL(ctx, key).Result()
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "> assurance: couldn't check expired key %#v on %s: %s\n", key, server.Options().Addr, err)
+		return false
+	case ttl == -1:
+		fmt.Fprintf(os.Stderr, "> assurance: expired key %#v has no TTL on %s\n", key, server.Options().Addr)
+		return false
+	}
+	return true
+}
+
+// checkFieldsAbsent reports whether key has none of Fields on server.
+func (v *purgeVerifier) checkFieldsAbsent(ctx context.Context, server *redis.Client, key string) bool {
+	for _, field := range v.Fields {
+		exists, err := server.HExists(ctx, key, field).Result()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "> assurance: couldn't check field %#v of deleted key %#v on %s: %s\n", field, key, server.Options().Addr, err)
+			return false
+		}
+		if exists {
+			fmt.Fprintf(os.Stderr, "> assurance: deleted field %#v of key %#v still exists on %s\n", field, key, server.Options().Addr)
+			return false
+		}
+	}
+	return true
+}
+
+// checkElementsAbsent reports whether key has no elements matching Elements
+// on server.
+func (v *purgeVerifier) checkElementsAbsent(server *redis.Client, key string) bool {
+	elements, err := redisSearch{Client: server}.matchingElements(key, v.Elements)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> assurance: couldn't check elements of deleted key %#v on %s: %s\n", key, server.Options().Addr, err)
+		return false
+	}
+	if len(elements) > 0 {
+		fmt.Fprintf(os.Stderr, "> assurance: %d matching elements of deleted key %#v still exist on %s\n", len(elements), key, server.Options().Addr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// matchWatcher repeats a run every Interval until interrupted, tracking the
+// rate at which new keys matching the search appear, so that an upstream bug
+// that keeps writing data we keep purging is caught.
+type matchWatcher struct {
+	Interval time.Duration
+
+	// RateThreshold, if > 0, is the rate of new matching keys per minute
+	// above which the rate is alerted to AlertURL.
+	RateThreshold float64
+	AlertURL      string
+
+	client *http.Client
+}
+
+// A matchRateAlert is posted to the rate alert webhook when the rate of new
+// matching keys rises above the threshold.
+type matchRateAlert struct {
+	Target        string        `json:"target"`
+	Condition     string        `json:"condition"`
+	NewMatches    int64         `json:"new_matches"`
+	Minutes       float64       `json:"minutes"`
+	PerMinute     float64       `json:"per_minute"`
+	RateThreshold float64       `json:"rate_threshold"`
+	At            time.Time     `json:"at"`
+	Tags          operationTags `json:"tags,omitempty"`
+}
+
+// envMatchWatcher returns the watcher configured by WATCH_INTERVAL,
+// RATE_ALERT_THRESHOLD and RATE_ALERT_URL, or nil if WATCH_INTERVAL is not
+// set.
+func envMatchWatcher() (*matchWatcher, error) {
+	interval := envInt("WATCH_INTERVAL", 0)
+	if interval <= 0 {
+		return nil, nil
+	}
+	watcher := &matchWatcher{
+		Interval:      time.Duration(interval) * time.Second,
+		RateThreshold: float64(envInt("RATE_ALERT_THRESHOLD", 0)),
+		AlertURL:      os.Getenv("RATE_ALERT_URL"),
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+	if watcher.RateThreshold > 0 && watcher.AlertURL == "" {
+		return nil, fmt.Errorf("RATE_ALERT_THRESHOLD needs RATE_ALERT_URL")
+	}
+	return watcher, nil
+}
+
+// Run calls pass, which searches r for keys matching search, once if w is
+// nil, or else every Interval until it fails or the run is interrupted.
+//
+// If pass deletes the keys it matches, every key matched after the first
+// pass is new; otherwise only the growth in matching keys since the last
+// pass is counted as new.
+func (w *matchWatcher) Run(r redisSearch, search *searchCondition, deletes bool, pass func() error) error {
+	if w == nil {
+		return pass()
+	}
+	fmt.Fprintf(os.Stderr, "> watching %s for keys matching %s every %s\n", r.String(), search, w.Interval)
+	var lastStart time.Time
+	var lastMatches int64
+	alerting := false
+	for passes := 0; ; passes++ {
+		start := time.Now()
+		before := r.Output.Matches()
+		if err := pass(); err != nil {
+			return err
+		}
+		matches := r.Output.Matches() - before
+
+		if passes > 0 {
+			newMatches := matches
+			if !deletes {
+				newMatches = matches - lastMatches
+			}
+			if newMatches < 0 {
+				newMatches = 0
+			}
+			elapsed := start.Sub(lastStart)
+			minutes := elapsed.Minutes()
+			perMinute := float64(newMatches) / minutes
+			fmt.Fprintf(os.Stderr, "> %d new keys matching %s in %s (%.1f per minute)\n",
+				newMatches, search, elapsed.Round(time.Second), perMinute)
+			r.Results.SetMatchRate(perMinute)
+
+			exceeded := w.RateThreshold > 0 && perMinute > w.RateThreshold
+			if exceeded && !alerting {
+				w.alert(matchRateAlert{
+					Target:        r.String(),
+					Condition:     search.String(),
+					NewMatches:    newMatches,
+					Minutes:       minutes,
+					PerMinute:     perMinute,
+					RateThreshold: w.RateThreshold,
+					At:            time.Now().UTC(),
+					Tags:          r.Tags,
+				})
+			}
+			alerting = exceeded
+		}
+		lastStart, lastMatches = start, matches
+		time.Sleep(w.Interval - time.Since(start))
+	}
+}
+
+// alert posts alert to AlertURL. A failed alert is reported, but doesn't stop
+// the watch.
+func (w *matchWatcher) alert(alert matchRateAlert) {
+	fmt.Fprintf(os.Stderr, "> alert: %.1f new matching keys per minute is above RATE_ALERT_THRESHOLD=%.0f\n",
+		alert.PerMinute, alert.RateThreshold)
+	alertJSON, err := json.Marshal(alert)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't send rate alert: %s\n", err)
+		return
+	}
+	resp, err := w.client.Post(w.AlertURL, "application/json", bytes.NewReader(alertJSON))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> couldn't send rate alert: %s\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		fmt.Fprintf(os.Stderr, "> rate alert webhook returned %s\n", resp.Status)
+	}
+}
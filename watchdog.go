@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// scanWatchdog notices when a run stops making progress, so that a hung
+// purge doesn't sit silently through a maintenance window.
+type scanWatchdog struct {
+	// Timeout is how long the run may go without progress before it's
+	// considered stalled.
+	Timeout time.Duration
+
+	// Abort exits the run when it stalls; otherwise the stall is reported
+	// and the watchdog keeps watching.
+	Abort bool
+
+	client *redis.Client
+	// lastProgress is the UnixNano time of the last progress, read and
+	// written atomically.
+	lastProgress int64
+	stop         chan struct{}
+}
+
+// envScanWatchdog returns the watchdog configured by STALL_TIMEOUT and
+// STALL_ACTION, or nil if STALL_TIMEOUT is not set.
+func envScanWatchdog(client *redis.Client) (*scanWatchdog, error) {
+	timeout := envInt("STALL_TIMEOUT", 0)
+	if timeout <= 0 {
+		return nil, nil
+	}
+	watchdog := &scanWatchdog{
+		Timeout: time.Duration(timeout) * time.Second,
+		client:  client,
+	}
+	switch action := envDefault("STALL_ACTION", "abort"); action {
+	case "abort":
+		watchdog.Abort = true
+	case "warn":
+	default:
+		return nil, fmt.Errorf("unknown STALL_ACTION %#v (expected abort or warn)", action)
+	}
+	return watchdog, nil
+}
+
+// Start starts watching for stalls, until Stop. Start on a nil scanWatchdog
+// does nothing.
+func (w *scanWatchdog) Start() {
+	if w == nil {
+		return
+	}
+	w.Progress()
+	w.stop = make(chan struct{})
+	go w.watch()
+}
+
+// Stop stops watching. Stop on a nil scanWatchdog does nothing.
+func (w *scanWatchdog) Stop() {
+	if w == nil || w.stop == nil {
+		return
+	}
+	close(w.stop)
+	w.stop = nil
+}
+
+// Progress records that the run has made progress. Progress on a nil
+// scanWatchdog does nothing.
+func (w *scanWatchdog) Progress() {
+	if w == nil {
+		return
+	}
+	atomic.StoreInt64(&w.lastProgress, time.Now().UnixNano())
+}
+
+func (w *scanWatchdog) watch() {
+	ticker := time.NewTicker(w.Timeout / 4)
+	defer ticker.Stop()
+	stop := w.stop
+	var reportedStall int64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			lastProgress := atomic.LoadInt64(&w.lastProgress)
+			stalledFor := time.Since(time.Unix(0, lastProgress))
+			if stalledFor < w.Timeout || lastProgress == reportedStall {
+				continue
+			}
+			reportedStall = lastProgress
+			w.reportStall(stalledFor)
+			if w.Abort {
+				reportError("scan stalled", fmt.Errorf("no progress for %s", stalledFor.Round(time.Second)))
+			}
+		}
+	}
+}
+
+// reportStall dumps goroutine stacks and the Redis server's latency to
+// stderr, to show where the run is stuck.
+func (w *scanWatchdog) reportStall(stalledFor time.Duration) {
+	fmt.Fprintf(os.Stderr, "> watchdog: no progress for %s, goroutines:\n", stalledFor.Round(time.Second))
+	pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pingStart := time.Now()
+	if err := w.client.Ping(ctx).Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "> watchdog: PING failed after %s: %s\n", time.Since(pingStart), err)
+	} else {
+		fmt.Fprintf(os.Stderr, "> watchdog: PING took %s\n", time.Since(pingStart))
+	}
+	if latest, err := w.client.Do(ctx, "latency", "latest").Result(); err == nil {
+		fmt.Fprintf(os.Stderr, "> watchdog: LATENCY LATEST: %v\n", latest)
+	}
+}
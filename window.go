@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is the daily time window in which destructive commands
+// are allowed. Outside it, deletes pause until the window opens, or are
+// refused.
+type maintenanceWindow struct {
+	// Start and End are offsets from midnight; a window with End before
+	// Start spans midnight.
+	Start, End time.Duration
+	Location   *time.Location
+	Pause      bool
+
+	paused bool
+}
+
+// envMaintenanceWindow returns the window configured by ALLOWED_WINDOW and
+// OUTSIDE_WINDOW_ACTION, or nil if deletes are allowed at any time.
+func envMaintenanceWindow() (*maintenanceWindow, error) {
+	spec := os.Getenv("ALLOWED_WINDOW")
+	if spec == "" {
+		return nil, nil
+	}
+	window, err := parseMaintenanceWindow(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch action := envDefault("OUTSIDE_WINDOW_ACTION", "refuse"); action {
+	case "refuse":
+	case "pause":
+		window.Pause = true
+	default:
+		return nil, fmt.Errorf("unknown OUTSIDE_WINDOW_ACTION %#v (expected refuse or pause)", action)
+	}
+	return window, nil
+}
+
+// parseMaintenanceWindow parses a window of the form "HH:MM-HH:MM [zone]",
+// where zone is a time zone name such as UTC (the default) or Europe/Paris.
+func parseMaintenanceWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("malformed window %#v (expected HH:MM-HH:MM [zone])", spec)
+	}
+	window := &maintenanceWindow{Location: time.UTC}
+	if len(fields) == 2 {
+		location, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone in window %#v: %w", spec, err)
+		}
+		window.Location = location
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("malformed window %#v (expected HH:MM-HH:MM [zone])", spec)
+	}
+	for i, offset := range []*time.Duration{&window.Start, &window.End} {
+		clock, err := time.Parse("15:04", times[i])
+		if err != nil {
+			return nil, fmt.Errorf("malformed time %#v in window %#v (expected HH:MM)", times[i], spec)
+		}
+		*offset = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
+	if window.Start == window.End {
+		return nil, fmt.Errorf("window %#v is empty", spec)
+	}
+	return window, nil
+}
+
+func (w *maintenanceWindow) String() string {
+	clock := func(offset time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes())%60)
+	}
+	return fmt.Sprintf("%s-%s %s", clock(w.Start), clock(w.End), w.Location)
+}
+
+// opensIn returns how long it is from now until the window next opens, or 0
+// if it is open.
+func (w *maintenanceWindow) opensIn(now time.Time) time.Duration {
+	now = now.In(w.Location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, w.Location)
+	offset := now.Sub(midnight)
+	open := offset >= w.Start && offset < w.End
+	if w.End < w.Start {
+		open = offset >= w.Start || offset < w.End
+	}
+	if open {
+		return 0
+	}
+	start := midnight.Add(w.Start)
+	if !start.After(now) {
+		start = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, w.Location).Add(w.Start)
+	}
+	return start.Sub(now)
+}
+
+// errOutsideWindow is returned by Allow outside the window, unless Pause is
+// set. It ends the run's deletes, rather than failing just the key.
+var errOutsideWindow = errors.New("outside ALLOWED_WINDOW")
+
+// windowPollInterval is how often a paused run checks that the window has
+// opened, and tells the watchdog it's still waiting.
+const windowPollInterval = time.Second
+
+// Allow returns nil if destructive commands may be sent now. Outside the
+// window, it waits for the window to open if Pause is set, keeping watchdog
+// from taking the wait for a stall, or returns an error. Allow on a nil
+// maintenanceWindow always allows.
+func (w *maintenanceWindow) Allow(watchdog *scanWatchdog) error {
+	if w == nil {
+		return nil
+	}
+	wait := w.opensIn(time.Now())
+	if wait == 0 {
+		if w.paused {
+			fmt.Fprintf(os.Stderr, "> ALLOWED_WINDOW %s is open, resuming deletes\n", w)
+			w.paused = false
+		}
+		return nil
+	}
+	if !w.Pause {
+		return fmt.Errorf("%w %s, which opens in %s", errOutsideWindow, w, wait.Round(time.Minute))
+	}
+	fmt.Fprintf(os.Stderr, "> outside ALLOWED_WINDOW %s: pausing deletes for %s\n", w, wait.Round(time.Second))
+	w.paused = true
+	for ; wait > 0; wait = w.opensIn(time.Now()) {
+		watchdog.Progress()
+		if wait > windowPollInterval {
+			wait = windowPollInterval
+		}
+		sleep(wait)
+		if isInterrupted() {
+			return errInterrupted
+		}
+	}
+	return w.Allow(watchdog)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/greensnark/redis-purge/purge"
+)
+
+// errStopScan is returned by a matchingKeysDo action to end the scan early
+// without reporting an error.
+var errStopScan = errors.New("scan stopped")
+
+// wizardPrompter asks questions on stderr and reads answers from in.
+type wizardPrompter struct {
+	in *bufio.Reader
+}
+
+func (w *wizardPrompter) ask(question, defaultAnswer string) (string, error) {
+	if defaultAnswer != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, defaultAnswer)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+	answer, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", err
+	}
+	answer = strings.TrimRight(answer, "\r\n")
+	if answer == "" {
+		return defaultAnswer, nil
+	}
+	return answer, nil
+}
+
+func (w *wizardPrompter) choose(question string, choices []string) (string, error) {
+	for {
+		answer, err := w.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, "/")), choices[0])
+		if err != nil {
+			return "", err
+		}
+		for _, choice := range choices {
+			if strings.EqualFold(answer, choice) {
+				return choice, nil
+			}
+		}
+		fmt.Fprintf(os.Stderr, "  please answer one of: %s\n", strings.Join(choices, ", "))
+	}
+}
+
+func (w *wizardPrompter) askInt(question string, defaultValue int) (int, error) {
+	for {
+		answer, err := w.ask(question, strconv.Itoa(defaultValue))
+		if err != nil {
+			return 0, err
+		}
+		value, err := strconv.Atoi(answer)
+		if err == nil && value >= 0 {
+			return value, nil
+		}
+		fmt.Fprintf(os.Stderr, "  please enter a number >= 0\n")
+	}
+}
+
+func (w *wizardPrompter) askList(question string) ([]string, error) {
+	fmt.Fprintf(os.Stderr, "%s (one per line, empty line to finish):\n", question)
+	var answers []string
+	for {
+		answer, err := w.ask("  value", "")
+		if err != nil {
+			if err == io.EOF {
+				return answers, nil
+			}
+			return nil, err
+		}
+		if answer == "" {
+			return answers, nil
+		}
+		answers = append(answers, answer)
+	}
+}
+
+// runWizard interactively builds a search condition, previews a sample of
+// matching keys and prints the command line that performs the search.
+func (r redisSearch) runWizard(in io.Reader) error {
+	w := &wizardPrompter{in: bufio.NewReader(in)}
+	env := []string{}
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		env = append(env, "REDIS_ADDR="+addr)
+	}
+	if tlsSetting := os.Getenv("TLS"); tlsSetting != "" {
+		env = append(env, "TLS="+tlsSetting)
+	}
+
+	search := &searchCondition{}
+
+	accessMode, err := w.choose("Read values as", []string{"hash", "string", "list", "set", "zset", "stream", "json"})
+	if err != nil {
+		return err
+	}
+	search.AccessMode = purge.ParseAccessMode(accessMode)
+	env = append(env, "ACCESS_MODE="+accessMode)
+
+	if search.AccessMode.IsCollection() {
+		perElement, err := w.choose("Match each element separately, instead of all elements together", []string{"n", "y"})
+		if err != nil {
+			return err
+		}
+		if perElement == "y" {
+			search.MatchElements = true
+			env = append(env, "MATCH_ELEMENTS=y")
+		}
+	}
+
+	if search.AccessMode == valueAccessHash {
+		if search.HashField, err = w.ask("Only match this hash field (empty for the whole hash)", ""); err != nil {
+			return err
+		}
+		if search.HashField != "" {
+			env = append(env, "HASH_FIELD="+search.HashField)
+		}
+	}
+
+	if search.AccessMode == valueAccessJSON {
+		if search.JSONPath, err = w.ask("Only match the parts of each document selected by this JSONPath (empty for the whole document)", ""); err != nil {
+			return err
+		}
+		if search.JSONPath != "" {
+			env = append(env, "JSON_PATH="+search.JSONPath)
+		}
+	}
+
+	if search.KeyPattern, err = w.ask("Only search keys matching glob pattern (empty for all keys)", ""); err != nil {
+		return err
+	}
+	if search.KeyPattern != "" {
+		env = append(env, "KEY_PATTERN="+search.KeyPattern)
+	}
+
+	if search.Search, err = w.askList("Values to search for (none to match any value)"); err != nil {
+		return err
+	}
+
+	if len(search.Search) > 0 {
+		matchType, err := w.choose("Match values exactly, or if they contain the search values", []string{"exact", "contains"})
+		if err != nil {
+			return err
+		}
+		if matchType == "contains" {
+			if search.Occurrences, err = w.askInt("Minimum occurrences of a search value", 1); err != nil {
+				return err
+			}
+			if search.Occurrences == 0 {
+				search.Occurrences = 1
+			}
+			env = append(env, "REQUIRED_MATCH_COUNT="+strconv.Itoa(search.Occurrences))
+		}
+		if len(search.Search) > 1 && search.Occurrences > 0 {
+			searchMode, err := w.choose("Match values containing any or all of the search values", []string{"any", "all"})
+			if err != nil {
+				return err
+			}
+			search.MatchAll = parseSearchMode(searchMode)
+			if search.MatchAll {
+				env = append(env, "SEARCH_MODE=all")
+			}
+		}
+	}
+
+	if search.SizeThreshold, err = w.askInt("Minimum value size in bytes", 0); err != nil {
+		return err
+	}
+	if search.SizeThreshold > 0 {
+		env = append(env, "SIZE_THRESHOLD="+strconv.Itoa(search.SizeThreshold))
+	}
+	if search.SizeMax, err = w.askInt("Maximum value size in bytes (0 for no maximum)", 0); err != nil {
+		return err
+	}
+	if search.SizeMax > 0 {
+		env = append(env, "SIZE_MAX="+strconv.Itoa(search.SizeMax))
+	}
+
+	action, err := w.choose("Action for matching keys", []string{"list", "delete", "expire"})
+	if err != nil {
+		return err
+	}
+	if action == "expire" {
+		ttl := 0
+		for ttl == 0 {
+			if ttl, err = w.askInt("TTL to set on matching keys, in seconds", 3600); err != nil {
+				return err
+			}
+		}
+		env = append(env, "EXPIRE_SECONDS="+strconv.Itoa(ttl))
+	}
+	if action == "delete" || action == "expire" {
+		if search.MatchesAll() {
+			matchAll, err := w.choose("With no search values, every key matching the key pattern and size limits is deleted; go ahead", []string{"n", "y"})
+			if err != nil {
+				return err
+			}
+			if matchAll != "y" {
+				return fmt.Errorf("not deleting every key")
+			}
+			env = append(env, "ALLOW_MATCH_ALL=y")
+		}
+		env = append(env, "DELETE_MATCHING_KEYS=yes")
+		redelete, err := w.choose("Wait and re-delete keys that are re-inserted by other clients", []string{"n", "y"})
+		if err != nil {
+			return err
+		}
+		if redelete == "y" {
+			env = append(env, "WAIT_AND_REDELETE=y")
+		}
+		maxDeletes, err := w.askInt("Maximum number of keys to delete, aborting if more match (0 for no limit)", 0)
+		if err != nil {
+			return err
+		}
+		if maxDeletes > 0 {
+			env = append(env, "MAX_DELETES="+strconv.Itoa(maxDeletes))
+		}
+		dryRun, err := w.choose("Dry run first, showing what would be deleted without deleting anything", []string{"y", "n"})
+		if err != nil {
+			return err
+		}
+		if dryRun == "y" {
+			env = append(env, "DRY_RUN=y")
+		}
+	}
+
+	if err = search.Validate(); err != nil {
+		return err
+	}
+
+	sampleSize, err := w.askInt("Number of matching keys to preview (0 to skip)", 10)
+	if err != nil {
+		return err
+	}
+	if sampleSize > 0 {
+		if err = r.previewMatchingKeys(search, sampleSize); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "\nTo run this search:\n\n")
+	fmt.Println(wizardCommandLine(env, search.Search))
+	return nil
+}
+
+// previewMatchingKeys lists up to sampleSize keys matching search.
+func (r redisSearch) previewMatchingKeys(search *searchCondition, sampleSize int) error {
+	fmt.Fprintf(os.Stderr, "\n> previewing up to %d keys on %s with value matching %s\n", sampleSize, r.String(), search)
+	r.Progress = false
+	found := 0
+	err := r.matchingKeysDo(search, func(key string, size int) error {
+		fmt.Fprintf(os.Stderr, "  %s (size = %d)\n", r.KeyDisplay.Format(key), size)
+		found++
+		if found >= sampleSize {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "> previewed %d matching keys\n", found)
+	return nil
+}
+
+func wizardCommandLine(env []string, search []string) string {
+	words := make([]string, 0, len(env)+len(search)+2)
+	for _, assignment := range env {
+		words = append(words, shellQuote(assignment))
+	}
+	words = append(words, "redis-purge")
+	if len(search) > 0 && (search[0] == "wizard" || search[0] == "--") {
+		words = append(words, "--")
+	}
+	for _, value := range search {
+		words = append(words, shellQuote(value))
+	}
+	if len(search) == 0 {
+		words = append(words, "''")
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote quotes s for a POSIX shell, if necessary.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=./:,@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}